@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"github.com/newm4n/dokku-aaa/configuration"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	AuditOutcomeGranted = "granted"
+	AuditOutcomeDenied  = "denied"
+)
+
+var (
+	auditLogger *log.Logger
+	auditMutex  sync.Mutex
+)
+
+// AuditEvent is a security sensitive action, written to the audit log whatever server.log.level is.
+type AuditEvent struct {
+	Event    string
+	Actor    string
+	Subject  string
+	ClientId string
+	Audience []string
+	TokenId  string
+	Outcome  string
+	Reason   string
+}
+
+// Audit writes the event to the audit log as one json line.
+func Audit(event *AuditEvent) {
+	fields := log.Fields{
+		"event":   event.Event,
+		"actor":   event.Actor,
+		"subject": event.Subject,
+		"outcome": event.Outcome,
+	}
+	if len(event.ClientId) > 0 {
+		fields["client_id"] = event.ClientId
+	}
+	if len(event.Audience) > 0 {
+		fields["aud"] = event.Audience
+	}
+	if len(event.TokenId) > 0 {
+		fields["jti"] = event.TokenId
+	}
+	if len(event.Reason) > 0 {
+		fields["reason"] = event.Reason
+	}
+	getAuditLogger().WithFields(fields).Info("audit")
+}
+
+// getAuditLogger returns the audit logger, writing to audit.log.path, or to stderr when it is not set.
+func getAuditLogger() *log.Logger {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	if auditLogger != nil {
+		return auditLogger
+	}
+	var out io.Writer = os.Stderr
+	if path := configuration.Get("audit.log.path"); len(path) > 0 {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			log.Errorf("can not open audit log %s, auditing to stderr. got %s", path, err.Error())
+		} else {
+			out = file
+		}
+	}
+	auditLogger = newAuditLogger(out)
+	return auditLogger
+}
+
+func newAuditLogger(out io.Writer) *log.Logger {
+	logger := log.New()
+	logger.SetOutput(out)
+	logger.SetLevel(log.InfoLevel)
+	logger.SetFormatter(&log.JSONFormatter{TimestampFormat: time.RFC3339})
+	return logger
+}
+
+// setAuditOutput redirects the audit log, tests read it back this way.
+func setAuditOutput(out io.Writer) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	auditLogger = newAuditLogger(out)
+}
@@ -0,0 +1,328 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/hyperjumptech/jiffy"
+	"github.com/newm4n/dokku-aaa/configuration"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	GrantTypeAuthorizationCode = "authorization_code"
+	// CodeChallengeS256 is the only PKCE method accepted, plain challenges are refused.
+	CodeChallengeS256 = "S256"
+)
+
+var (
+	ErrInvalidCode         = fmt.Errorf("authorization code is invalid, expired or already used")
+	ErrInvalidCodeVerifier = fmt.Errorf("code verifier does not match the code challenge")
+
+	// codeChallengePattern is the base64url encoded SHA-256 of the code verifier (RFC 7636 section 4.2).
+	codeChallengePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+	// codeVerifierPattern is the RFC 7636 section 4.1 code verifier.
+	codeVerifierPattern = regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`)
+)
+
+// AuthorizationCode is issued by /authorize once the user signed in, to be exchanged at the token endpoint
+// by the same client, using the same redirect URI and the verifier of the code challenge.
+type AuthorizationCode struct {
+	Code          string
+	ClientId      string
+	RedirectUri   string
+	Subject       string
+	CodeChallenge string
+	ExpireAt      time.Time
+	// Amr lists the methods the subject signed in with, carried over to the tokens.
+	Amr []string
+}
+
+// NewAuthorizationCode creates the code of the signed in subject, valid for authorization.code.age.
+func NewAuthorizationCode(clientId, redirectUri, subject, codeChallenge string, amr []string) (*AuthorizationCode, error) {
+	age, err := jiffy.DurationOf(configuration.Get("authorization.code.age"))
+	if err != nil {
+		return nil, err
+	}
+	return &AuthorizationCode{
+		Code:          randomHex(32),
+		ClientId:      clientId,
+		RedirectUri:   redirectUri,
+		Subject:       subject,
+		CodeChallenge: codeChallenge,
+		ExpireAt:      time.Now().Add(age),
+		Amr:           amr,
+	}, nil
+}
+
+// VerifyCodeVerifier checks the PKCE S256 code verifier against the code challenge.
+func VerifyCodeVerifier(codeChallenge, codeVerifier string) error {
+	if !codeVerifierPattern.MatchString(codeVerifier) {
+		return ErrInvalidCodeVerifier
+	}
+	sum := sha256.Sum256([]byte(codeVerifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(computed), []byte(codeChallenge)) != 1 {
+		return ErrInvalidCodeVerifier
+	}
+	return nil
+}
+
+// ExchangeAuthorizationCode takes the code, so it can only be used once, and checks it was issued to the client
+// for the redirect URI and that the verifier matches its challenge. It returns the subject the code was issued to.
+func ExchangeAuthorizationCode(ctx context.Context, codes AuthorizationCodeStore, client *OAuthClient, code, redirectUri, codeVerifier string) (*AuthorizationCode, error) {
+	if len(code) == 0 {
+		return nil, ErrInvalidCode
+	}
+	authCode, err := codes.TakeCode(ctx, code)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrInvalidCode
+	}
+	if err != nil {
+		return nil, err
+	}
+	if authCode.ClientId != client.ClientId || authCode.RedirectUri != redirectUri {
+		return nil, ErrInvalidCode
+	}
+	if err := VerifyCodeVerifier(authCode.CodeChallenge, codeVerifier); err != nil {
+		return nil, err
+	}
+	return authCode, nil
+}
+
+// AuthorizationCodeStore keeps the authorization codes until they are exchanged or expired.
+type AuthorizationCodeStore interface {
+	SaveCode(ctx context.Context, code *AuthorizationCode) error
+	// TakeCode returns and deletes the code, so only one caller may take it.
+	// It returns ErrNotFound for an unknown, taken or expired code.
+	TakeCode(ctx context.Context, code string) (*AuthorizationCode, error)
+}
+
+// MemoryAuthorizationCodeStore is the in memory AuthorizationCodeStore, pending codes are lost on restart.
+type MemoryAuthorizationCodeStore struct {
+	mutex sync.Mutex
+	codes map[string]*AuthorizationCode
+}
+
+func NewMemoryAuthorizationCodeStore() *MemoryAuthorizationCodeStore {
+	return &MemoryAuthorizationCodeStore{
+		codes: make(map[string]*AuthorizationCode),
+	}
+}
+
+func (store *MemoryAuthorizationCodeStore) SaveCode(ctx context.Context, code *AuthorizationCode) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if code == nil || len(code.Code) == 0 {
+		return ErrArgumentEmpty
+	}
+	now := time.Now()
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for key, data := range store.codes {
+		if now.After(data.ExpireAt) {
+			delete(store.codes, key)
+		}
+	}
+	saved := *code
+	store.codes[code.Code] = &saved
+	return nil
+}
+
+func (store *MemoryAuthorizationCodeStore) TakeCode(ctx context.Context, code string) (*AuthorizationCode, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(code) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	data, exist := store.codes[code]
+	if !exist {
+		return nil, ErrNotFound
+	}
+	delete(store.codes, code)
+	if time.Now().After(data.ExpireAt) {
+		return nil, ErrNotFound
+	}
+	return data, nil
+}
+
+// SqlAuthorizationCodeStore is the AuthorizationCodeStore kept in the authorization_code table, for SQLite and PostgreSQL.
+type SqlAuthorizationCodeStore struct {
+	DB *sql.DB
+}
+
+func NewSqlAuthorizationCodeStore(db *sql.DB) *SqlAuthorizationCodeStore {
+	return &SqlAuthorizationCodeStore{DB: db}
+}
+
+func (store *SqlAuthorizationCodeStore) SaveCode(ctx context.Context, code *AuthorizationCode) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if code == nil || len(code.Code) == 0 {
+		return ErrArgumentEmpty
+	}
+	if _, err := store.DB.ExecContext(ctx, `DELETE FROM authorization_code WHERE expire_at < $1`, sqlTime(time.Now())); err != nil {
+		return err
+	}
+	_, err := store.DB.ExecContext(ctx, `INSERT INTO authorization_code (code, client_id, redirect_uri, subject, code_challenge, expire_at, amr)
+VALUES ($1, $2, $3, $4, $5, $6, $7)`, code.Code, code.ClientId, code.RedirectUri, code.Subject, code.CodeChallenge, sqlTime(code.ExpireAt),
+		strings.Join(code.Amr, " "))
+	return err
+}
+
+func (store *SqlAuthorizationCodeStore) TakeCode(ctx context.Context, code string) (*AuthorizationCode, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(code) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	// the delete decides which caller takes the code.
+	data := &AuthorizationCode{}
+	var amr string
+	err := store.DB.QueryRowContext(ctx, `DELETE FROM authorization_code WHERE code = $1
+RETURNING code, client_id, redirect_uri, subject, code_challenge, expire_at, amr`, code).Scan(
+		&data.Code, &data.ClientId, &data.RedirectUri, &data.Subject, &data.CodeChallenge, &data.ExpireAt, &amr)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(data.ExpireAt) {
+		return nil, ErrNotFound
+	}
+	data.Amr = strings.Fields(amr)
+	return data, nil
+}
+
+// AuthorizeRequest holds the /authorize parameters, carried from the login page to its form post.
+type AuthorizeRequest struct {
+	ResponseType        string
+	ClientId            string
+	RedirectUri         string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// NewAuthorizeRequest reads the /authorize parameters of the query, or of the parsed form.
+func NewAuthorizeRequest(values url.Values) *AuthorizeRequest {
+	return &AuthorizeRequest{
+		ResponseType:        values.Get("response_type"),
+		ClientId:            values.Get("client_id"),
+		RedirectUri:         values.Get("redirect_uri"),
+		State:               values.Get("state"),
+		CodeChallenge:       values.Get("code_challenge"),
+		CodeChallengeMethod: values.Get("code_challenge_method"),
+	}
+}
+
+// ValidateClient returns the client of the request, when the redirect URI is registered to it.
+// Until the redirect URI is trusted, errors are shown to the user instead of being redirected.
+func (authReq *AuthorizeRequest) ValidateClient(ctx context.Context, clients ClientStore) (*OAuthClient, error) {
+	if len(authReq.ClientId) == 0 {
+		return nil, fmt.Errorf("%w, missing client_id parameter", ErrInvalidClient)
+	}
+	client, err := clients.GetClient(ctx, authReq.ClientId)
+	if errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("%w, unknown client %s", ErrInvalidClient, authReq.ClientId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !client.AllowRedirect(authReq.RedirectUri) {
+		return nil, fmt.Errorf("%w, redirect uri is not registered to the client", ErrInvalidRedirectUri)
+	}
+	return client, nil
+}
+
+// Validate checks the response type and the PKCE challenge, returning the error to be redirected to the client.
+func (authReq *AuthorizeRequest) Validate() *OAuthError {
+	if authReq.ResponseType != "code" {
+		return newOAuthError(http.StatusBadRequest, "unsupported_response_type", fmt.Errorf("response type must be code"))
+	}
+	if authReq.CodeChallengeMethod != CodeChallengeS256 || !codeChallengePattern.MatchString(authReq.CodeChallenge) {
+		return newOAuthError(http.StatusBadRequest, "invalid_request", fmt.Errorf("code_challenge using the S256 code_challenge_method is required"))
+	}
+	return nil
+}
+
+// RedirectUrl returns the redirect URI carrying the parameters and the state of the request.
+func (authReq *AuthorizeRequest) RedirectUrl(params url.Values) string {
+	if len(authReq.State) > 0 {
+		params.Set("state", authReq.State)
+	}
+	target, err := url.Parse(authReq.RedirectUri)
+	if err != nil {
+		return authReq.RedirectUri
+	}
+	query := target.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	target.RawQuery = query.Encode()
+	return target.String()
+}
+
+// loginPage is the sign in form of /authorize, it posts the authorize parameters back with the credentials.
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Sign in</title>
+</head>
+<body>
+<main>
+<h1>Sign in</h1>
+{{if .ClientName}}<p>to continue to {{.ClientName}}</p>{{end}}
+{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+<form method="post" action="authorize">
+<input type="hidden" name="response_type" value="{{.Request.ResponseType}}">
+<input type="hidden" name="client_id" value="{{.Request.ClientId}}">
+<input type="hidden" name="redirect_uri" value="{{.Request.RedirectUri}}">
+<input type="hidden" name="state" value="{{.Request.State}}">
+<input type="hidden" name="code_challenge" value="{{.Request.CodeChallenge}}">
+<input type="hidden" name="code_challenge_method" value="{{.Request.CodeChallengeMethod}}">
+<label>Email <input type="email" name="email" value="{{.Email}}" autocomplete="username" required autofocus></label>
+<label>Passphrase <input type="password" name="passphrase" autocomplete="current-password" required></label>
+<label>Authentication code, when enabled <input type="text" name="otp" autocomplete="one-time-code"></label>
+<button type="submit">Sign in</button>
+</form>
+</main>
+</body>
+</html>
+`))
+
+type loginPageData struct {
+	ClientName string
+	Email      string
+	Error      string
+	Request    *AuthorizeRequest
+}
+
+// writeLoginPage renders the sign in form. The page must not be framed nor cached.
+func writeLoginPage(response http.ResponseWriter, status int, data *loginPageData) {
+	response.Header().Set("Content-Type", "text/html; charset=utf-8")
+	response.Header().Set("Cache-Control", "no-store")
+	response.Header().Set("X-Frame-Options", "DENY")
+	response.Header().Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+	response.WriteHeader(status)
+	_ = loginPage.Execute(response, data)
+}
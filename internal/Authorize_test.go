@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCodeChallenge is the base64url encoded SHA-256 of testCodeVerifier.
+const (
+	testCodeVerifier  = "dBjftJeZ4CVP-mJ92K9qpgfHIbt-9u1TL6V8mKmXVLM"
+	testCodeChallenge = "WR0f_24WrxuHVVtw4XeetKOVbsvuQCCTsygAgdOreAs"
+)
+
+func testAuthorizationCodeStore(t *testing.T, newStore func(t *testing.T) AuthorizationCodeStore) {
+	ctx := context.Background()
+
+	t.Run("Single use", func(t *testing.T) {
+		store := newStore(t)
+		code := &AuthorizationCode{
+			Code:          "the-code",
+			ClientId:      "spa",
+			RedirectUri:   "https://app.domain.com/callback",
+			Subject:       "user@mail.com",
+			CodeChallenge: testCodeChallenge,
+			ExpireAt:      time.Now().Add(time.Minute),
+		}
+		assert.NoError(t, store.SaveCode(ctx, code))
+		got, err := store.TakeCode(ctx, "the-code")
+		assert.NoError(t, err)
+		assert.Equal(t, "spa", got.ClientId)
+		assert.Equal(t, "https://app.domain.com/callback", got.RedirectUri)
+		assert.Equal(t, "user@mail.com", got.Subject)
+		assert.Equal(t, testCodeChallenge, got.CodeChallenge)
+		_, err = store.TakeCode(ctx, "the-code")
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = store.TakeCode(ctx, "unknown")
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		store := newStore(t)
+		assert.NoError(t, store.SaveCode(ctx, &AuthorizationCode{Code: "old-code", ExpireAt: time.Now().Add(-time.Minute)}))
+		_, err := store.TakeCode(ctx, "old-code")
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+}
+
+func TestMemoryAuthorizationCodeStore(t *testing.T) {
+	testAuthorizationCodeStore(t, func(t *testing.T) AuthorizationCodeStore {
+		return NewMemoryAuthorizationCodeStore()
+	})
+}
+
+func TestSqlAuthorizationCodeStore_SQLite(t *testing.T) {
+	testAuthorizationCodeStore(t, func(t *testing.T) AuthorizationCodeStore {
+		return newSQLiteDAO(t).AuthorizationCodes()
+	})
+}
+
+func TestVerifyCodeVerifier(t *testing.T) {
+	assert.NoError(t, VerifyCodeVerifier(testCodeChallenge, testCodeVerifier))
+	assert.ErrorIs(t, VerifyCodeVerifier(testCodeChallenge, testCodeVerifier+"x"), ErrInvalidCodeVerifier)
+	assert.ErrorIs(t, VerifyCodeVerifier(testCodeChallenge, "short"), ErrInvalidCodeVerifier)
+	assert.ErrorIs(t, VerifyCodeVerifier(testCodeVerifier, testCodeVerifier), ErrInvalidCodeVerifier)
+}
+
+func authorizeQuery(challenge string) url.Values {
+	return url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"spa"},
+		"redirect_uri":          {"https://app.domain.com/callback"},
+		"state":                 {"xyz"},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+}
+
+// signIn posts the login form of /authorize and returns the redirect location.
+func signIn(t *testing.T, router http.Handler, passphrase string) (int, *url.URL) {
+	form := authorizeQuery(testCodeChallenge)
+	form.Set("email", "user@mail.com")
+	form.Set("passphrase", passphrase)
+	request := newRequest(http.MethodPost, "/authorize", form.Encode())
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp := serve(router, request)
+	location, err := url.Parse(resp.Header().Get("Location"))
+	assert.NoError(t, err)
+	return resp.Code, location
+}
+
+func TestTheHandler_AuthorizationCode(t *testing.T) {
+	router := newTestRouter()
+	resp := serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/create-user",
+		`{"Email":"user@mail.com","Passphrase":"a passphrase","TenantRole":["viewer@ACME"]}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/client",
+		`{"ClientId":"spa","Name":"Single page app","Public":true,"RedirectUri":["https://app.domain.com/callback"]}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	created := &ClientResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), created))
+	assert.Empty(t, created.Secret)
+
+	// an unregistered redirect uri is never redirected to.
+	query := authorizeQuery(testCodeChallenge)
+	query.Set("redirect_uri", "https://evil.domain.com/callback")
+	resp = serve(router, newRequest(http.MethodGet, "/authorize?"+query.Encode(), ""))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Empty(t, resp.Header().Get("Location"))
+
+	query = authorizeQuery("")
+	query.Del("code_challenge_method")
+	resp = serve(router, newRequest(http.MethodGet, "/authorize?"+query.Encode(), ""))
+	assert.Equal(t, http.StatusFound, resp.Code)
+	location, err := url.Parse(resp.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, "app.domain.com", location.Host)
+	assert.Equal(t, "invalid_request", location.Query().Get("error"))
+	assert.Equal(t, "xyz", location.Query().Get("state"))
+
+	resp = serve(router, newRequest(http.MethodGet, "/authorize?"+authorizeQuery(testCodeChallenge).Encode(), ""))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "DENY", resp.Header().Get("X-Frame-Options"))
+	assert.Contains(t, resp.Body.String(), "Single page app")
+	assert.Contains(t, resp.Body.String(), `name="code_challenge" value="`+testCodeChallenge+`"`)
+
+	status, _ := signIn(t, router, "wrong passphrase")
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	status, location = signIn(t, router, "a passphrase")
+	assert.Equal(t, http.StatusFound, status)
+	assert.True(t, strings.HasPrefix(location.String(), "https://app.domain.com/callback?"))
+	assert.Equal(t, "xyz", location.Query().Get("state"))
+	code := location.Query().Get("code")
+	assert.NotEmpty(t, code)
+
+	exchange := url.Values{"grant_type": {"authorization_code"}, "client_id": {"spa"}, "code": {code},
+		"redirect_uri": {"https://app.domain.com/callback"}, "code_verifier": {testCodeVerifier}}
+	resp = serve(router, newTokenRequest(exchange))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	token := &TokenResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), token))
+	assert.NotEmpty(t, token.RefreshToken)
+	claim, err := VerifyToken(token.AccessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "user@mail.com", claim.Subscriber)
+	assert.Equal(t, []string{"viewer@ACME"}, claim.Audience)
+	resp = serve(router, newRequest(http.MethodPost, "/refresh", `{"Refresh":"`+token.RefreshToken+`"}`))
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// codes are single use.
+	resp = serve(router, newTokenRequest(exchange))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	oerr := &OAuthError{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), oerr))
+	assert.Equal(t, "invalid_grant", oerr.Code)
+
+	_, location = signIn(t, router, "a passphrase")
+	exchange.Set("code", location.Query().Get("code"))
+	exchange.Set("code_verifier", strings.Repeat("a", 43))
+	resp = serve(router, newTokenRequest(exchange))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), oerr))
+	assert.Equal(t, "invalid_grant", oerr.Code)
+
+	// public clients can not get tokens of their own.
+	resp = serve(router, newTokenRequest(url.Values{"grant_type": {"client_credentials"}, "client_id": {"spa"}}))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), oerr))
+	assert.Equal(t, "unauthorized_client", oerr.Code)
+}
@@ -0,0 +1,1194 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	security "github.com/newm4n/dokku-common/security"
+	bolt "go.etcd.io/bbolt"
+	"strings"
+	"time"
+)
+
+const (
+	DriverBolt = "bolt"
+
+	// keySeparator joins the parts of a composite key, it sorts before any printable character
+	// so a prefix scan on "a\x00" never matches "ab\x00".
+	keySeparator = "\x00"
+)
+
+var (
+	// bucketUserAccount holds the accounts, keyed by lower-cased email. Its key is also the index for SearchUser.
+	bucketUserAccount = []byte("user_account")
+	// bucketTenant holds the tenant records, keyed by name.
+	bucketTenant = []byte("tenant")
+	// bucketUserTenant holds the memberships, keyed by lower(email)|tenant, valued by the email as registered.
+	bucketUserTenant = []byte("user_tenant")
+	// bucketTenantUser is the reverse of bucketUserTenant, keyed by tenant|lower(email), to list the members of a tenant.
+	bucketTenantUser = []byte("tenant_user")
+	// bucketUserTenantRole holds the roles, keyed by lower(email)|tenant|role.
+	bucketUserTenantRole = []byte("user_tenant_role")
+	// bucketTenantIndex indexes SearchTenant, keyed by lower(name)|name.
+	bucketTenantIndex = []byte("idx_tenant")
+	// bucketUserTenantIndex indexes SearchUserTenant, keyed by lower(email)|lower(tenant)|tenant.
+	bucketUserTenantIndex = []byte("idx_user_tenant")
+	// bucketUserRoleIndex indexes SearchUserRoleTenant, keyed by lower(email)|tenant|lower(role)|role.
+	bucketUserRoleIndex = []byte("idx_user_tenant_role")
+
+	boltBuckets = [][]byte{bucketUserAccount, bucketTenant, bucketUserTenant, bucketTenantUser,
+		bucketUserTenantRole, bucketTenantIndex, bucketUserTenantIndex, bucketUserRoleIndex, bucketOAuthClient,
+		bucketUserTotp, bucketWebAuthnCredential, bucketUserWebAuthnIndex}
+)
+
+// boltAccount is the stored form of UserAccount.
+type boltAccount struct {
+	Email      string
+	Passphrase string
+	FullName   string
+	Status     UserStatus
+	// PassphraseHistory holds the previous passphrase hashes, newest first.
+	PassphraseHistory    []string `json:",omitempty"`
+	MustChangePassphrase bool
+	PassphraseChangedAt  time.Time
+}
+
+// BoltDAO is the DataAccess implementation on top of a single bbolt file, for single node deployment.
+// Every write happens in one bolt transaction, so a failing multi-step operation leaves nothing behind.
+type BoltDAO struct {
+	DB *bolt.DB
+	// Revocation is kept in memory, revoked tokens become valid again after restart.
+	Revocation *MemoryRevocationStore
+	Client     *BoltClientStore
+	Factor     *BoltMFAStore
+	Passkey    *BoltWebAuthnCredentialStore
+	// Code and Device are kept in memory too, they only live for minutes.
+	Code   *MemoryAuthorizationCodeStore
+	Device *MemoryDeviceCodeStore
+	// Attempt is kept in memory too, a single node has no replica to share the counts with.
+	Attempt *MemoryLoginAttemptStore
+}
+
+// NewBoltDAO opens, or creates, the bolt file at the path and makes sure every bucket exist.
+func NewBoltDAO(path string) (*BoltDAO, error) {
+	if len(path) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range boltBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltDAO{DB: db, Revocation: NewMemoryRevocationStore(), Client: NewBoltClientStore(db), Factor: NewBoltMFAStore(db),
+		Passkey: NewBoltWebAuthnCredentialStore(db), Code: NewMemoryAuthorizationCodeStore(), Device: NewMemoryDeviceCodeStore(),
+		Attempt: NewMemoryLoginAttemptStore()}, nil
+}
+
+// Close the underlying bolt file.
+func (bdao *BoltDAO) Close() error {
+	return bdao.DB.Close()
+}
+
+func boltKey(parts ...string) []byte {
+	return []byte(strings.Join(parts, keySeparator))
+}
+
+// boltPrefix is the key prefix matching every key starting with the parts.
+func boltPrefix(parts ...string) []byte {
+	return []byte(strings.Join(parts, keySeparator) + keySeparator)
+}
+
+// lastPart returns the last part of a composite key.
+func lastPart(key []byte) string {
+	idx := bytes.LastIndex(key, []byte(keySeparator))
+	return string(key[idx+1:])
+}
+
+// scanPrefix calls fn for every key in the bucket starting with the prefix, in key order.
+// Keys must not be deleted from within fn, collect them first.
+func scanPrefix(bucket *bolt.Bucket, prefix []byte, fn func(k, v []byte) error) error {
+	c := bucket.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deletePrefix deletes every key in the bucket starting with the prefix.
+func deletePrefix(bucket *bolt.Bucket, prefix []byte) error {
+	keys := make([][]byte, 0)
+	err := scanPrefix(bucket, prefix, func(k, v []byte) error {
+		keys = append(keys, append([]byte(nil), k...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getBoltAccount(tx *bolt.Tx, email string) (*boltAccount, error) {
+	data := tx.Bucket(bucketUserAccount).Get([]byte(strings.ToLower(email)))
+	if data == nil {
+		return nil, ErrNotFound
+	}
+	acc := &boltAccount{}
+	if err := json.Unmarshal(data, acc); err != nil {
+		return nil, err
+	}
+	if len(acc.Status) == 0 {
+		// stored before accounts had a status.
+		acc.Status = UserStatusActive
+	}
+	return acc, nil
+}
+
+func putBoltAccount(tx *bolt.Tx, acc *boltAccount) error {
+	data, err := json.Marshal(acc)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketUserAccount).Put([]byte(strings.ToLower(acc.Email)), data)
+}
+
+func getBoltTenant(tx *bolt.Tx, tenant string) (*Tenant, error) {
+	data := tx.Bucket(bucketTenant).Get([]byte(tenant))
+	if data == nil {
+		return nil, ErrNotFound
+	}
+	ret := &Tenant{}
+	if err := json.Unmarshal(data, ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func putBoltTenant(tx *bolt.Tx, tenant *Tenant) error {
+	data, err := json.Marshal(tenant)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketTenant).Put([]byte(tenant.Name), data); err != nil {
+		return err
+	}
+	return tx.Bucket(bucketTenantIndex).Put(boltKey(strings.ToLower(tenant.Name), tenant.Name), nil)
+}
+
+func deleteBoltTenant(tx *bolt.Tx, tenant string) error {
+	if err := tx.Bucket(bucketTenant).Delete([]byte(tenant)); err != nil {
+		return err
+	}
+	return tx.Bucket(bucketTenantIndex).Delete(boltKey(strings.ToLower(tenant), tenant))
+}
+
+// ensureBoltTenant creates the tenant record for a tenant that is referred by a membership.
+func ensureBoltTenant(tx *bolt.Tx, tenant string) error {
+	if tx.Bucket(bucketTenant).Get([]byte(tenant)) != nil {
+		return nil
+	}
+	return putBoltTenant(tx, &Tenant{
+		Name:        tenant,
+		DisplayName: tenant,
+		CreatedAt:   time.Now().UTC(),
+		Status:      TenantStatusActive,
+	})
+}
+
+// boltMember returns the email, as registered, of the membership or an empty string if there is none.
+func boltMember(tx *bolt.Tx, email, tenant string) string {
+	return string(tx.Bucket(bucketUserTenant).Get(boltKey(strings.ToLower(email), tenant)))
+}
+
+func putBoltMember(tx *bolt.Tx, email, tenant string) error {
+	lower := strings.ToLower(email)
+	if err := tx.Bucket(bucketUserTenant).Put(boltKey(lower, tenant), []byte(email)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketTenantUser).Put(boltKey(tenant, lower), []byte(email)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketUserTenantIndex).Put(boltKey(lower, strings.ToLower(tenant), tenant), nil); err != nil {
+		return err
+	}
+	return ensureBoltTenant(tx, tenant)
+}
+
+// deleteBoltMember deletes the membership together with its roles.
+func deleteBoltMember(tx *bolt.Tx, email, tenant string) error {
+	lower := strings.ToLower(email)
+	if err := deletePrefix(tx.Bucket(bucketUserTenantRole), boltPrefix(lower, tenant)); err != nil {
+		return err
+	}
+	if err := deletePrefix(tx.Bucket(bucketUserRoleIndex), boltPrefix(lower, tenant)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketUserTenant).Delete(boltKey(lower, tenant)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketTenantUser).Delete(boltKey(tenant, lower)); err != nil {
+		return err
+	}
+	return tx.Bucket(bucketUserTenantIndex).Delete(boltKey(lower, strings.ToLower(tenant), tenant))
+}
+
+func boltRoleExist(tx *bolt.Tx, email, tenant, role string) bool {
+	return tx.Bucket(bucketUserTenantRole).Get(boltKey(strings.ToLower(email), tenant, role)) != nil
+}
+
+func putBoltRole(tx *bolt.Tx, email, tenant, role string) error {
+	lower := strings.ToLower(email)
+	if err := tx.Bucket(bucketUserTenantRole).Put(boltKey(lower, tenant, role), nil); err != nil {
+		return err
+	}
+	return tx.Bucket(bucketUserRoleIndex).Put(boltKey(lower, tenant, strings.ToLower(role), role), nil)
+}
+
+func deleteBoltRole(tx *bolt.Tx, email, tenant, role string) error {
+	lower := strings.ToLower(email)
+	if err := tx.Bucket(bucketUserTenantRole).Delete(boltKey(lower, tenant, role)); err != nil {
+		return err
+	}
+	return tx.Bucket(bucketUserRoleIndex).Delete(boltKey(lower, tenant, strings.ToLower(role), role))
+}
+
+// listBoltParts lists the last part of every key in the bucket starting with the prefix.
+func listBoltParts(tx *bolt.Tx, bucket, prefix []byte) ([]string, error) {
+	ret := make([]string, 0)
+	err := scanPrefix(tx.Bucket(bucket), prefix, func(k, v []byte) error {
+		ret = append(ret, lastPart(k))
+		return nil
+	})
+	return ret, err
+}
+
+// listBoltValues lists the value of every key in the bucket starting with the prefix.
+func listBoltValues(tx *bolt.Tx, bucket, prefix []byte) ([]string, error) {
+	ret := make([]string, 0)
+	err := scanPrefix(tx.Bucket(bucket), prefix, func(k, v []byte) error {
+		ret = append(ret, string(v))
+		return nil
+	})
+	return ret, err
+}
+
+// updateBoltMember moves the membership, and its roles, from the old tenant into the new one.
+// When the user is already a member of the new tenant, the roles are merged.
+func updateBoltMember(tx *bolt.Tx, email, oldTenant, newTenant string) error {
+	storedEmail := boltMember(tx, email, oldTenant)
+	if len(storedEmail) == 0 {
+		return ErrNotFound
+	}
+	if oldTenant == newTenant {
+		return nil
+	}
+	if len(boltMember(tx, email, newTenant)) == 0 {
+		if err := putBoltMember(tx, storedEmail, newTenant); err != nil {
+			return err
+		}
+	}
+	roles, err := listBoltParts(tx, bucketUserTenantRole, boltPrefix(strings.ToLower(email), oldTenant))
+	if err != nil {
+		return err
+	}
+	for _, role := range roles {
+		if err := putBoltRole(tx, storedEmail, newTenant, role); err != nil {
+			return err
+		}
+	}
+	return deleteBoltMember(tx, email, oldTenant)
+}
+
+func (bdao *BoltDAO) CreateUserAccount(ctx context.Context, email, passphrase string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 || len(passphrase) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	if ClientSubject(email) {
+		return false, ErrArgumentInvalid
+	}
+	if err := CheckPassphrase(email, passphrase); err != nil {
+		return false, err
+	}
+	passHash, err := security.CreateHash(passphrase, security.DefaultParams)
+	if err != nil {
+		return false, ErrInvalidPassword
+	}
+	err = bdao.DB.Update(func(tx *bolt.Tx) error {
+		if _, err := getBoltAccount(tx, email); err == nil {
+			return ErrFound
+		}
+		return putBoltAccount(tx, &boltAccount{Email: email, Passphrase: passHash, Status: UserStatusActive, PassphraseChangedAt: passphraseClock()})
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (bdao *BoltDAO) UpdateUserPassphrase(ctx context.Context, email, oldPassphrase, newPassphrase string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 || len(oldPassphrase) == 0 || len(newPassphrase) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	if err := CheckPassphrase(email, newPassphrase); err != nil {
+		return false, err
+	}
+	err = bdao.DB.Update(func(tx *bolt.Tx) error {
+		acc, err := getBoltAccount(tx, email)
+		if err != nil {
+			return err
+		}
+		compare, err := security.ComparePasswordAndHash(oldPassphrase, acc.Passphrase)
+		if err != nil {
+			return err
+		}
+		if !compare {
+			return ErrInvalidPassword
+		}
+		return replaceBoltPassphrase(tx, acc, newPassphrase)
+	})
+	if err == ErrNotFound || err == ErrInvalidPassword {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (bdao *BoltDAO) SetUserPassphrase(ctx context.Context, email, newPassphrase string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 || len(newPassphrase) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	if err := CheckPassphrase(email, newPassphrase); err != nil {
+		return false, err
+	}
+	err = bdao.DB.Update(func(tx *bolt.Tx) error {
+		acc, err := getBoltAccount(tx, email)
+		if err != nil {
+			return err
+		}
+		return replaceBoltPassphrase(tx, acc, newPassphrase)
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// replaceBoltPassphrase sets the new passphrase of the account, unless it is one of the last ones.
+func replaceBoltPassphrase(tx *bolt.Tx, acc *boltAccount, newPassphrase string) error {
+	if err := checkPassphraseHistory(newPassphrase, append([]string{acc.Passphrase}, acc.PassphraseHistory...)); err != nil {
+		return err
+	}
+	newHash, err := security.CreateHash(newPassphrase, security.DefaultParams)
+	if err != nil {
+		return err
+	}
+	acc.PassphraseHistory = nextPassphraseHistory(acc.Passphrase, acc.PassphraseHistory)
+	acc.Passphrase = newHash
+	acc.MustChangePassphrase = false
+	acc.PassphraseChangedAt = passphraseClock()
+	return putBoltAccount(tx, acc)
+}
+
+func (bdao *BoltDAO) ExpireUserPassphrase(ctx context.Context, email string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	err = bdao.DB.Update(func(tx *bolt.Tx) error {
+		acc, err := getBoltAccount(tx, email)
+		if err != nil {
+			return err
+		}
+		acc.MustChangePassphrase = true
+		return putBoltAccount(tx, acc)
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (bdao *BoltDAO) DeleteUserAccount(ctx context.Context, email string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	err = bdao.DB.Update(func(tx *bolt.Tx) error {
+		key := []byte(strings.ToLower(email))
+		if tx.Bucket(bucketUserAccount).Get(key) == nil {
+			return ErrNotFound
+		}
+		return tx.Bucket(bucketUserAccount).Delete(key)
+	})
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (bdao *BoltDAO) UserExist(ctx context.Context, email string) (exist bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	err = bdao.DB.View(func(tx *bolt.Tx) error {
+		exist = tx.Bucket(bucketUserAccount).Get([]byte(strings.ToLower(email))) != nil
+		return nil
+	})
+	return exist, err
+}
+
+func (bdao *BoltDAO) SearchUser(ctx context.Context, search string) (emails []string, err error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(search) == 0 {
+		return make([]string, 0), ErrArgumentEmpty
+	}
+	emails = make([]string, 0)
+	err = bdao.DB.View(func(tx *bolt.Tx) error {
+		return scanPrefix(tx.Bucket(bucketUserAccount), []byte(strings.ToLower(search)), func(k, v []byte) error {
+			acc := &boltAccount{}
+			if err := json.Unmarshal(v, acc); err != nil {
+				return err
+			}
+			emails = append(emails, acc.Email)
+			return nil
+		})
+	})
+	return emails, err
+}
+
+func (bdao *BoltDAO) GetUserProfile(ctx context.Context, email string) (profile *UserProfile, err error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(email) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	err = bdao.DB.View(func(tx *bolt.Tx) error {
+		acc, err := getBoltAccount(tx, email)
+		if err != nil {
+			return err
+		}
+		profile = &UserProfile{Email: acc.Email, FullName: acc.FullName, Status: acc.Status}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+func (bdao *BoltDAO) UpdateUserProfile(ctx context.Context, email, fullName string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	err = bdao.DB.Update(func(tx *bolt.Tx) error {
+		acc, err := getBoltAccount(tx, email)
+		if err != nil {
+			return err
+		}
+		acc.FullName = fullName
+		return putBoltAccount(tx, acc)
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (bdao *BoltDAO) UpdateUserStatus(ctx context.Context, email string, status UserStatus) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 || len(status) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	err = bdao.DB.Update(func(tx *bolt.Tx) error {
+		acc, err := getBoltAccount(tx, email)
+		if err != nil {
+			return err
+		}
+		acc.Status = status
+		return putBoltAccount(tx, acc)
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (bdao *BoltDAO) CreateTenant(ctx context.Context, tenant, displayName string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(tenant) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	if !ValidTenantName(tenant) {
+		return false, ErrInvalidTenantName
+	}
+	if len(displayName) == 0 {
+		displayName = tenant
+	}
+	err = bdao.DB.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketTenant).Get([]byte(tenant)) != nil {
+			return ErrFound
+		}
+		return putBoltTenant(tx, &Tenant{
+			Name:        tenant,
+			DisplayName: displayName,
+			CreatedAt:   time.Now().UTC(),
+			Status:      TenantStatusActive,
+		})
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (bdao *BoltDAO) UpdateTenant(ctx context.Context, oldTenant, newTenant, displayName string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(oldTenant) == 0 || len(newTenant) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	if newTenant != ReservedTenant && !ValidTenantName(newTenant) {
+		return false, ErrInvalidTenantName
+	}
+	err = bdao.DB.Update(func(tx *bolt.Tx) error {
+		data, err := getBoltTenant(tx, oldTenant)
+		if err != nil {
+			return err
+		}
+		if oldTenant != newTenant {
+			if oldTenant == ReservedTenant || newTenant == ReservedTenant {
+				return ErrTenantReserved
+			}
+			if tx.Bucket(bucketTenant).Get([]byte(newTenant)) != nil {
+				return ErrFound
+			}
+			// rename the record first, so moving the memberships will not create a new one.
+			if err := deleteBoltTenant(tx, oldTenant); err != nil {
+				return err
+			}
+			data.Name = newTenant
+			if err := putBoltTenant(tx, data); err != nil {
+				return err
+			}
+			members, err := listBoltValues(tx, bucketTenantUser, boltPrefix(oldTenant))
+			if err != nil {
+				return err
+			}
+			for _, email := range members {
+				if err := updateBoltMember(tx, email, oldTenant, newTenant); err != nil {
+					return err
+				}
+			}
+		}
+		if len(displayName) > 0 {
+			data.DisplayName = displayName
+			return putBoltTenant(tx, data)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// deleteBoltTenantAndMembers deletes the tenant record and every membership in it.
+func deleteBoltTenantAndMembers(tx *bolt.Tx, tenant string) error {
+	members, err := listBoltValues(tx, bucketTenantUser, boltPrefix(tenant))
+	if err != nil {
+		return err
+	}
+	if len(members) == 0 && tx.Bucket(bucketTenant).Get([]byte(tenant)) == nil {
+		return ErrNotFound
+	}
+	for _, email := range members {
+		if err := deleteBoltMember(tx, email, tenant); err != nil {
+			return err
+		}
+	}
+	return deleteBoltTenant(tx, tenant)
+}
+
+func (bdao *BoltDAO) DeleteTenant(ctx context.Context, tenant string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(tenant) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	if tenant == ReservedTenant {
+		return false, ErrTenantReserved
+	}
+	err = bdao.DB.Update(func(tx *bolt.Tx) error {
+		return deleteBoltTenantAndMembers(tx, tenant)
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (bdao *BoltDAO) DeleteAllTenant(ctx context.Context) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	err = bdao.DB.Update(func(tx *bolt.Tx) error {
+		tenants := make([]string, 0)
+		err := tx.Bucket(bucketTenant).ForEach(func(k, v []byte) error {
+			if string(k) != ReservedTenant {
+				tenants = append(tenants, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, tenant := range tenants {
+			if err := deleteBoltTenantAndMembers(tx, tenant); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (bdao *BoltDAO) GetTenant(ctx context.Context, tenant string) (data *Tenant, err error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(tenant) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	err = bdao.DB.View(func(tx *bolt.Tx) error {
+		data, err = getBoltTenant(tx, tenant)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (bdao *BoltDAO) ListTenant(ctx context.Context) (tenants []*Tenant, err error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	tenants = make([]*Tenant, 0)
+	err = bdao.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketTenant).ForEach(func(k, v []byte) error {
+			data := &Tenant{}
+			if err := json.Unmarshal(v, data); err != nil {
+				return err
+			}
+			tenants = append(tenants, data)
+			return nil
+		})
+	})
+	return tenants, err
+}
+
+func (bdao *BoltDAO) SearchTenant(ctx context.Context, search string) (tenants []*Tenant, err error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(search) == 0 {
+		return make([]*Tenant, 0), ErrArgumentEmpty
+	}
+	tenants = make([]*Tenant, 0)
+	err = bdao.DB.View(func(tx *bolt.Tx) error {
+		names, err := listBoltParts(tx, bucketTenantIndex, []byte(strings.ToLower(search)))
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			data, err := getBoltTenant(tx, name)
+			if err != nil {
+				return err
+			}
+			tenants = append(tenants, data)
+		}
+		return nil
+	})
+	return tenants, err
+}
+
+func (bdao *BoltDAO) ListTenantUser(ctx context.Context, tenant string) (emails []string, err error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(tenant) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	err = bdao.DB.View(func(tx *bolt.Tx) error {
+		emails, err = listBoltValues(tx, bucketTenantUser, boltPrefix(tenant))
+		return err
+	})
+	return emails, err
+}
+
+func (bdao *BoltDAO) CreateUserTenant(ctx context.Context, email, tenant string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 || len(tenant) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	if tenant != ReservedTenant && !ValidTenantName(tenant) {
+		return false, ErrInvalidTenantName
+	}
+	err = bdao.DB.Update(func(tx *bolt.Tx) error {
+		if len(boltMember(tx, email, tenant)) > 0 {
+			return ErrFound
+		}
+		return putBoltMember(tx, email, tenant)
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (bdao *BoltDAO) UpdateUserTenant(ctx context.Context, email, oldTenant, newTenant string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 || len(oldTenant) == 0 || len(newTenant) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	if !ValidTenantName(newTenant) {
+		return false, ErrInvalidTenantName
+	}
+	err = bdao.DB.Update(func(tx *bolt.Tx) error {
+		return updateBoltMember(tx, email, oldTenant, newTenant)
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (bdao *BoltDAO) DeleteUserTenant(ctx context.Context, email, tenant string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 || len(tenant) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	err = bdao.DB.Update(func(tx *bolt.Tx) error {
+		return deleteBoltMember(tx, email, tenant)
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (bdao *BoltDAO) DeleteUserAllTenant(ctx context.Context, email string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	err = bdao.DB.Update(func(tx *bolt.Tx) error {
+		tenants, err := listBoltParts(tx, bucketUserTenant, boltPrefix(strings.ToLower(email)))
+		if err != nil {
+			return err
+		}
+		for _, tenant := range tenants {
+			if err := deleteBoltMember(tx, email, tenant); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (bdao *BoltDAO) UserTenantExist(ctx context.Context, email, tenant string) (exist bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 || len(tenant) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	err = bdao.DB.View(func(tx *bolt.Tx) error {
+		exist = len(boltMember(tx, email, tenant)) > 0
+		return nil
+	})
+	return exist, err
+}
+
+func (bdao *BoltDAO) SearchUserTenant(ctx context.Context, email, search string) (tenants []string, err error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(search) == 0 {
+		return make([]string, 0), ErrArgumentEmpty
+	}
+	err = bdao.DB.View(func(tx *bolt.Tx) error {
+		prefix := boltKey(strings.ToLower(email), strings.ToLower(search))
+		tenants, err = listBoltParts(tx, bucketUserTenantIndex, prefix)
+		return err
+	})
+	return tenants, err
+}
+
+func (bdao *BoltDAO) CreateUserTenantRole(ctx context.Context, email, tenant, role string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 || len(tenant) == 0 || len(role) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	if tenant != ReservedTenant && !ValidTenantName(tenant) {
+		return false, ErrInvalidTenantName
+	}
+	if !ValidRoleName(role) {
+		return false, ErrInvalidRoleName
+	}
+	err = bdao.DB.Update(func(tx *bolt.Tx) error {
+		if len(boltMember(tx, email, tenant)) == 0 {
+			if err := putBoltMember(tx, email, tenant); err != nil {
+				return err
+			}
+		}
+		if boltRoleExist(tx, email, tenant, role) {
+			return ErrFound
+		}
+		return putBoltRole(tx, email, tenant, role)
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (bdao *BoltDAO) DeleteUserTenantRole(ctx context.Context, email, tenant, role string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 || len(tenant) == 0 || len(role) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	err = bdao.DB.Update(func(tx *bolt.Tx) error {
+		if !boltRoleExist(tx, email, tenant, role) {
+			return ErrNotFound
+		}
+		return deleteBoltRole(tx, email, tenant, role)
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (bdao *BoltDAO) DeleteUserTenantAllRoles(ctx context.Context, email, tenant string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 || len(tenant) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	err = bdao.DB.Update(func(tx *bolt.Tx) error {
+		if len(boltMember(tx, email, tenant)) == 0 {
+			return ErrNotFound
+		}
+		lower := strings.ToLower(email)
+		if err := deletePrefix(tx.Bucket(bucketUserTenantRole), boltPrefix(lower, tenant)); err != nil {
+			return err
+		}
+		return deletePrefix(tx.Bucket(bucketUserRoleIndex), boltPrefix(lower, tenant))
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (bdao *BoltDAO) UserTenantRoleExist(ctx context.Context, email, tenant, role string) (exist bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 || len(tenant) == 0 || len(role) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	err = bdao.DB.View(func(tx *bolt.Tx) error {
+		if len(boltMember(tx, email, tenant)) == 0 {
+			return ErrNotFound
+		}
+		exist = boltRoleExist(tx, email, tenant, role)
+		return nil
+	})
+	return exist, err
+}
+
+func (bdao *BoltDAO) SearchUserRoleTenant(ctx context.Context, email, tenant, search string) (roles []string, err error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(email) == 0 || len(tenant) == 0 || len(search) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	err = bdao.DB.View(func(tx *bolt.Tx) error {
+		if len(boltMember(tx, email, tenant)) == 0 {
+			return ErrNotFound
+		}
+		prefix := boltKey(strings.ToLower(email), tenant, strings.ToLower(search))
+		roles, err = listBoltParts(tx, bucketUserRoleIndex, prefix)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+func (bdao *BoltDAO) ListUserTenantRole(ctx context.Context, email, tenant string) (roles []string, err error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(email) == 0 || len(tenant) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	err = bdao.DB.View(func(tx *bolt.Tx) error {
+		if len(boltMember(tx, email, tenant)) == 0 {
+			return ErrNotFound
+		}
+		roles, err = listBoltParts(tx, bucketUserTenantRole, boltPrefix(strings.ToLower(email), tenant))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+func (bdao *BoltDAO) ListUserTenantRoles(ctx context.Context, email string) (tenantRoles []*TenantRoles, err error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(email) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	err = bdao.DB.View(func(tx *bolt.Tx) error {
+		tenantRoles, err = boltTenantRoles(tx, email)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tenantRoles, nil
+}
+
+// boltTenantRoles lists the roles of the user in every tenant, ordered by tenant.
+func boltTenantRoles(tx *bolt.Tx, email string) ([]*TenantRoles, error) {
+	lower := strings.ToLower(email)
+	tenants, err := listBoltParts(tx, bucketUserTenant, boltPrefix(lower))
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*TenantRoles, 0, len(tenants))
+	for _, tenant := range tenants {
+		roles, err := listBoltParts(tx, bucketUserTenantRole, boltPrefix(lower, tenant))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, &TenantRoles{
+			Tenant: tenant,
+			Roles:  roles,
+		})
+	}
+	return ret, nil
+}
+
+// boltAudience lists the tenant roles of the user in the 'role1,role2@tenant' pattern used as token audience.
+func boltAudience(tx *bolt.Tx, email string) ([]string, error) {
+	tenantRoles, err := boltTenantRoles(tx, email)
+	if err != nil {
+		return nil, err
+	}
+	return tenantRolesAudience(tenantRoles), nil
+}
+
+func (bdao *BoltDAO) Authenticate(ctx context.Context, email, passphrase string) (accessToken, refreshToken, mfaToken string, err error) {
+	if err := bdao.VerifyPassphrase(ctx, email, passphrase); err != nil {
+		return "", "", "", err
+	}
+	return signInTokens(ctx, bdao, email)
+}
+
+func (bdao *BoltDAO) VerifyPassphrase(ctx context.Context, email, passphrase string) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	var acc *boltAccount
+	err := bdao.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		acc, err = getBoltAccount(tx, email)
+		return err
+	})
+	if err == ErrNotFound {
+		return unknownAccount(passphrase)
+	}
+	if err != nil {
+		return err
+	}
+	match, err := security.ComparePasswordAndHash(passphrase, acc.Passphrase)
+	if err != nil || !match {
+		return ErrInvalidPassword
+	}
+	if acc.Status == UserStatusDisabled {
+		return ErrAccountDisabled
+	}
+	expired, err := passphraseExpired(acc.MustChangePassphrase, acc.PassphraseChangedAt)
+	if err != nil {
+		return err
+	}
+	if expired {
+		return ErrPassphraseExpired
+	}
+	return nil
+}
+
+func (bdao *BoltDAO) IssueTokens(ctx context.Context, email string, amr []string) (accessToken, refreshToken string, err error) {
+	if err := validContext(ctx); err != nil {
+		return "", "", err
+	}
+	auds, err := bdao.signInAudience(email)
+	if err != nil {
+		return "", "", err
+	}
+	return CreateTokenPair(email, auds, amr)
+}
+
+// signInAudience returns the token audience of the subject, as long as it can sign in.
+func (bdao *BoltDAO) signInAudience(email string) (auds []string, err error) {
+	err = bdao.DB.View(func(tx *bolt.Tx) error {
+		acc, err := getBoltAccount(tx, email)
+		if err == ErrNotFound {
+			return ErrAccountDeleted
+		}
+		if err != nil {
+			return err
+		}
+		if acc.Status == UserStatusDisabled {
+			return ErrAccountDisabled
+		}
+		expired, err := passphraseExpired(acc.MustChangePassphrase, acc.PassphraseChangedAt)
+		if err != nil {
+			return err
+		}
+		if expired {
+			return ErrPassphraseExpired
+		}
+		auds, err = boltAudience(tx, email)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return auds, nil
+}
+
+func (bdao *BoltDAO) Refresh(ctx context.Context, refreshToken string) (accessToken, nextRefreshToken string, err error) {
+	if err := validContext(ctx); err != nil {
+		return "", "", err
+	}
+	if len(refreshToken) == 0 {
+		return "", "", ErrArgumentEmpty
+	}
+	claim, err := VerifyRefreshToken(ctx, bdao.Revocation, refreshToken)
+	if err != nil {
+		return "", "", err
+	}
+	auds, err := bdao.signInAudience(claim.Subscriber)
+	if err != nil {
+		return "", "", err
+	}
+	return RefreshTokens(ctx, bdao.Revocation, claim, auds, TokenAmr(refreshToken))
+}
+
+func (bdao *BoltDAO) Revocations() RevocationStore {
+	return bdao.Revocation
+}
+
+func (bdao *BoltDAO) Clients() ClientStore {
+	return bdao.Client
+}
+
+func (bdao *BoltDAO) AuthorizationCodes() AuthorizationCodeStore {
+	return bdao.Code
+}
+
+func (bdao *BoltDAO) DeviceCodes() DeviceCodeStore {
+	return bdao.Device
+}
+
+func (bdao *BoltDAO) MFA() MFAStore {
+	return bdao.Factor
+}
+
+func (bdao *BoltDAO) WebAuthnCredentials() WebAuthnCredentialStore {
+	return bdao.Passkey
+}
+
+func (bdao *BoltDAO) LoginAttempts() LoginAttemptStore {
+	return bdao.Attempt
+}
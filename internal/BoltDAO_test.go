@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+	"path/filepath"
+	"testing"
+)
+
+func newBoltDAO(t *testing.T) DataAccess {
+	dao, err := NewBoltDAO(filepath.Join(t.TempDir(), "aaa.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = dao.Close()
+	})
+	return dao
+}
+
+func TestBoltDAO_Behaviour(t *testing.T) {
+	testDataAccessBehaviour(t, newBoltDAO)
+}
+
+func TestBoltDAO_Reopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "aaa.bolt")
+	dao, err := NewBoltDAO(path)
+	assert.NoError(t, err)
+	_, err = dao.CreateUserAccount(ctx, "User@mail.com", "a password")
+	assert.NoError(t, err)
+	_, err = dao.CreateUserTenantRole(ctx, "User@mail.com", "ACME", "R1")
+	assert.NoError(t, err)
+	assert.NoError(t, dao.Close())
+
+	dao, err = NewBoltDAO(path)
+	assert.NoError(t, err)
+	defer dao.Close()
+	emails, err := dao.SearchUser(ctx, "user")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"User@mail.com"}, emails)
+	tenants, err := dao.SearchUserTenant(ctx, "user@mail.com", "acm")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ACME"}, tenants)
+}
+
+func TestBoltDAO_Rollback(t *testing.T) {
+	ctx := context.Background()
+	dao := newBoltDAO(t).(*BoltDAO)
+	_, err := dao.CreateUserTenantRole(ctx, "user@mail.com", "A", "R1")
+	assert.NoError(t, err)
+
+	// a failure after the membership was moved must leave nothing half-applied
+	err = dao.DB.Update(func(tx *bolt.Tx) error {
+		if err := updateBoltMember(tx, "user@mail.com", "A", "B"); err != nil {
+			return err
+		}
+		return ErrFound
+	})
+	assert.ErrorIs(t, err, ErrFound)
+
+	roles, err := dao.ListUserTenantRole(ctx, "user@mail.com", "A")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"R1"}, roles)
+	exist, err := dao.UserTenantExist(ctx, "user@mail.com", "B")
+	assert.NoError(t, err)
+	assert.False(t, exist)
+	_, err = dao.GetTenant(ctx, "B")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/newm4n/dokku-aaa/configuration"
+	log "github.com/sirupsen/logrus"
+	"sync"
+)
+
+const (
+	// RootRole is the role, in the ReservedTenant, required to administer this server.
+	RootRole = "root"
+)
+
+var (
+	ErrBootstrapDone         = fmt.Errorf("root administrator already exist")
+	ErrBootstrapInvalidToken = fmt.Errorf("invalid setup token")
+	ErrBootstrapAccountExist = fmt.Errorf("bootstrap.root.email names an existing account whose passphrase is not bootstrap.root.passphrase")
+)
+
+// RootExist check whether there is an existing user account having the root role in the reserved tenant.
+func RootExist(ctx context.Context, dao DataAccess) (exist bool, err error) {
+	members, err := dao.ListTenantUser(ctx, ReservedTenant)
+	if err != nil {
+		return false, err
+	}
+	for _, email := range members {
+		isRoot, err := dao.UserTenantRoleExist(ctx, email, ReservedTenant, RootRole)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return false, err
+		}
+		if !isRoot {
+			continue
+		}
+		exist, err := dao.UserExist(ctx, email)
+		if err != nil {
+			return false, err
+		}
+		if exist {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Bootstrap creates the first root administrator of a fresh server.
+// The root is either taken from the bootstrap.root.email and bootstrap.root.passphrase configuration,
+// or created by whoever holds the one-time setup token printed at startup.
+// Once a root exists, the bootstrap switches itself off.
+type Bootstrap struct {
+	DAO DataAccess
+
+	mutex sync.Mutex
+	token string
+}
+
+// NewBootstrap prepares the bootstrap for the DataAccess. It creates the configured root right away,
+// or generates the setup token when no root exist yet.
+func NewBootstrap(ctx context.Context, dao DataAccess) (*Bootstrap, error) {
+	bs := &Bootstrap{
+		DAO: dao,
+	}
+	exist, err := RootExist(ctx, dao)
+	if err != nil {
+		return nil, err
+	}
+	if exist {
+		log.Infof("root administrator exist, bootstrap is disabled")
+		return bs, nil
+	}
+
+	email := configuration.Get("bootstrap.root.email")
+	passphrase := configuration.Get("bootstrap.root.passphrase")
+	if len(email) > 0 && len(passphrase) > 0 {
+		_, err := dao.CreateUserAccount(ctx, email, passphrase)
+		if errors.Is(err, ErrFound) {
+			// an existing account only becomes root when the configuration proves to own it.
+			err = dao.VerifyPassphrase(ctx, email, passphrase)
+			if errors.Is(err, ErrInvalidPassword) {
+				return nil, ErrBootstrapAccountExist
+			}
+			if errors.Is(err, ErrPassphraseExpired) {
+				err = nil
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := bs.grantRoot(ctx, email); err != nil {
+			return nil, err
+		}
+		log.Warnf("root administrator %s created from configuration. you may now remove the bootstrap.root.passphrase", email)
+		return bs, nil
+	}
+
+	tokenBytes := make([]byte, 24)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return nil, err
+	}
+	bs.token = hex.EncodeToString(tokenBytes)
+	log.Warnf("No root administrator found. Create one by posting to /bootstrap using this one-time setup token : %s", bs.token)
+	return bs, nil
+}
+
+// Active tells whether the setup token may still be used to create the root administrator.
+func (bs *Bootstrap) Active(ctx context.Context) (bool, error) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	return bs.active(ctx)
+}
+
+func (bs *Bootstrap) active(ctx context.Context) (bool, error) {
+	if len(bs.token) == 0 {
+		return false, nil
+	}
+	exist, err := RootExist(ctx, bs.DAO)
+	if err != nil {
+		return false, err
+	}
+	if exist {
+		bs.token = ""
+		return false, nil
+	}
+	return true, nil
+}
+
+// CreateRoot creates the root administrator using the setup token, and switches the bootstrap off.
+func (bs *Bootstrap) CreateRoot(ctx context.Context, token, email, passphrase, fullName string) error {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	active, err := bs.active(ctx)
+	if err != nil {
+		return err
+	}
+	if !active {
+		return ErrBootstrapDone
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(bs.token)) != 1 {
+		return ErrBootstrapInvalidToken
+	}
+	if _, err := bs.DAO.CreateUserAccount(ctx, email, passphrase); err != nil {
+		return err
+	}
+	if len(fullName) > 0 {
+		if _, err := bs.DAO.UpdateUserProfile(ctx, email, fullName); err != nil {
+			return err
+		}
+	}
+	if err := bs.grantRoot(ctx, email); err != nil {
+		return err
+	}
+	bs.token = ""
+	log.Warnf("root administrator %s created using setup token, bootstrap is disabled", email)
+	return nil
+}
+
+func (bs *Bootstrap) grantRoot(ctx context.Context, email string) error {
+	if _, err := bs.DAO.CreateUserTenantRole(ctx, email, ReservedTenant, RootRole); err != nil && !errors.Is(err, ErrFound) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/newm4n/dokku-aaa/configuration"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestBootstrap_SetupToken(t *testing.T) {
+	ctx := context.Background()
+	dao := NewMemoryDAO()
+	bs, err := NewBootstrap(ctx, dao)
+	assert.NoError(t, err)
+
+	active, err := bs.Active(ctx)
+	assert.NoError(t, err)
+	assert.True(t, active)
+
+	err = bs.CreateRoot(ctx, "wrong token", "root@mail.com", "admin passphrase", "")
+	assert.ErrorIs(t, err, ErrBootstrapInvalidToken)
+
+	err = bs.CreateRoot(ctx, bs.token, "root@mail.com", "admin passphrase", "The Root")
+	assert.NoError(t, err)
+
+	exist, err := RootExist(ctx, dao)
+	assert.NoError(t, err)
+	assert.True(t, exist)
+
+	active, err = bs.Active(ctx)
+	assert.NoError(t, err)
+	assert.False(t, active)
+
+	err = bs.CreateRoot(ctx, "", "other@mail.com", "other passphrase", "")
+	assert.ErrorIs(t, err, ErrBootstrapDone)
+}
+
+func TestBootstrap_Configuration(t *testing.T) {
+	configuration.SetConfig("bootstrap.root.email", "root@mail.com")
+	configuration.SetConfig("bootstrap.root.passphrase", "admin passphrase")
+	defer configuration.SetConfig("bootstrap.root.email", "")
+	defer configuration.SetConfig("bootstrap.root.passphrase", "")
+
+	ctx := context.Background()
+	dao := NewMemoryDAO()
+	bs, err := NewBootstrap(ctx, dao)
+	assert.NoError(t, err)
+
+	exist, err := dao.UserTenantRoleExist(ctx, "root@mail.com", ReservedTenant, RootRole)
+	assert.NoError(t, err)
+	assert.True(t, exist)
+
+	active, err := bs.Active(ctx)
+	assert.NoError(t, err)
+	assert.False(t, active)
+
+	// a second start must not fail on the already created root
+	_, err = NewBootstrap(ctx, dao)
+	assert.NoError(t, err)
+}
+
+func TestBootstrap_ConfigurationExistingAccount(t *testing.T) {
+	configuration.SetConfig("bootstrap.root.email", "user@mail.com")
+	configuration.SetConfig("bootstrap.root.passphrase", "admin passphrase")
+	defer configuration.SetConfig("bootstrap.root.email", "")
+	defer configuration.SetConfig("bootstrap.root.passphrase", "")
+
+	// the existing account is not made root without its own passphrase.
+	ctx := context.Background()
+	dao := NewMemoryDAO()
+	_, err := dao.CreateUserAccount(ctx, "user@mail.com", "a passphrase")
+	assert.NoError(t, err)
+	_, err = NewBootstrap(ctx, dao)
+	assert.ErrorIs(t, err, ErrBootstrapAccountExist)
+	exist, err := RootExist(ctx, dao)
+	assert.NoError(t, err)
+	assert.False(t, exist)
+
+	configuration.SetConfig("bootstrap.root.passphrase", "a passphrase")
+	_, err = NewBootstrap(ctx, dao)
+	assert.NoError(t, err)
+	exist, err = RootExist(ctx, dao)
+	assert.NoError(t, err)
+	assert.True(t, exist)
+}
+
+func TestTheHandler_BootstrapRoot(t *testing.T) {
+	dao := NewMemoryDAO()
+	bs, err := NewBootstrap(context.Background(), dao)
+	assert.NoError(t, err)
+	router := mux.NewRouter()
+	initRoutes(router, &TheHandler{DAO: dao, Bootstrap: bs})
+
+	resp := serve(router, newRequest(http.MethodPost, "/bootstrap", `{"Token":"wrong","Email":"root@mail.com","Passphrase":"admin passphrase"}`))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	resp = serve(router, newRequest(http.MethodPost, "/bootstrap", fmt.Sprintf(`{"Token":"%s","Email":"root@mail.com","Passphrase":"admin passphrase"}`, bs.token)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	resp = serve(router, newRequest(http.MethodPost, "/bootstrap", `{"Token":"","Email":"other@mail.com","Passphrase":"other passphrase"}`))
+	assert.Equal(t, http.StatusGone, resp.Code)
+
+	// the bootstrapped root can login and use the admin endpoints
+	resp = serve(router, newRequest(http.MethodPost, "/login", `{"Email":"root@mail.com","Passphrase":"admin passphrase"}`))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	authResp := &AuthenticateResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), authResp))
+
+	request := newRequest(http.MethodPost, "/tenant", `{"Name":"ACME"}`)
+	request.Header.Set("Authorization", "Bearer "+authResp.Access)
+	resp = serve(router, request)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	request = newRequest(http.MethodPost, "/tenant", `{"Name":"BETA"}`)
+	request.Header.Set("Authorization", "Bearer "+authResp.Refresh)
+	resp = serve(router, request)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+}
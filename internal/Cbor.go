@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+var ErrInvalidCbor = fmt.Errorf("invalid cbor data")
+
+// cborMaxDepth bounds the nesting of the decoded items, authenticator data never nests deeper than a few levels.
+const cborMaxDepth = 16
+
+// decodeCbor decodes the first CBOR (RFC 8949) item of the data, and returns the bytes following it.
+// It decodes the definite length subset WebAuthn authenticators emit: integers as int64, byte strings as []byte,
+// text strings as string, arrays as []interface{}, maps as map[interface{}]interface{} keyed by int64 or string,
+// booleans and nil. Anything else is refused.
+func decodeCbor(data []byte) (item interface{}, rest []byte, err error) {
+	return decodeCborItem(data, 0)
+}
+
+func decodeCborItem(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, fmt.Errorf("%w, nested too deep", ErrInvalidCbor)
+	}
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("%w, unexpected end of data", ErrInvalidCbor)
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data[1:], nil
+		case 21:
+			return true, data[1:], nil
+		case 22:
+			return nil, data[1:], nil
+		default:
+			return nil, nil, fmt.Errorf("%w, unsupported simple value %d", ErrInvalidCbor, info)
+		}
+	}
+	arg, data, err := cborArgument(info, data[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("%w, integer overflow", ErrInvalidCbor)
+		}
+		return int64(arg), data, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("%w, integer overflow", ErrInvalidCbor)
+		}
+		return -1 - int64(arg), data, nil
+	case 2, 3:
+		if arg > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("%w, unexpected end of data", ErrInvalidCbor)
+		}
+		if major == 2 {
+			return data[:arg], data[arg:], nil
+		}
+		return string(data[:arg]), data[arg:], nil
+	case 4:
+		// every item takes at least one byte, a longer array can not be there.
+		if arg > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("%w, unexpected end of data", ErrInvalidCbor)
+		}
+		array := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var element interface{}
+			element, data, err = decodeCborItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			array = append(array, element)
+		}
+		return array, data, nil
+	case 5:
+		if arg > uint64(len(data))/2 {
+			return nil, nil, fmt.Errorf("%w, unexpected end of data", ErrInvalidCbor)
+		}
+		dict := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value interface{}
+			key, data, err = decodeCborItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("%w, map key must be an integer or a text string", ErrInvalidCbor)
+			}
+			if _, exist := dict[key]; exist {
+				return nil, nil, fmt.Errorf("%w, duplicate map key %v", ErrInvalidCbor, key)
+			}
+			value, data, err = decodeCborItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			dict[key] = value
+		}
+		return dict, data, nil
+	default:
+		return nil, nil, fmt.Errorf("%w, unsupported major type %d", ErrInvalidCbor, major)
+	}
+}
+
+// cborArgument reads the argument of the item head, the value, length or count depending on its major type.
+func cborArgument(info byte, data []byte) (uint64, []byte, error) {
+	var size int
+	switch {
+	case info < 24:
+		return uint64(info), data, nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, nil, fmt.Errorf("%w, indefinite length is not supported", ErrInvalidCbor)
+	}
+	if len(data) < size {
+		return 0, nil, fmt.Errorf("%w, unexpected end of data", ErrInvalidCbor)
+	}
+	var arg uint64
+	switch size {
+	case 1:
+		arg = uint64(data[0])
+	case 2:
+		arg = uint64(binary.BigEndian.Uint16(data))
+	case 4:
+		arg = uint64(binary.BigEndian.Uint32(data))
+	default:
+		arg = binary.BigEndian.Uint64(data)
+	}
+	return arg, data[size:], nil
+}
@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"testing"
+)
+
+// encodeCbor encodes the items decodeCbor decodes, the way an authenticator would. Map keys are sorted
+// so the encoding is stable.
+func encodeCbor(item interface{}) []byte {
+	switch value := item.(type) {
+	case nil:
+		return []byte{0xf6}
+	case bool:
+		if value {
+			return []byte{0xf5}
+		}
+		return []byte{0xf4}
+	case int:
+		return encodeCbor(int64(value))
+	case int64:
+		if value < 0 {
+			return cborHead(1, uint64(-1-value))
+		}
+		return cborHead(0, uint64(value))
+	case []byte:
+		return append(cborHead(2, uint64(len(value))), value...)
+	case string:
+		return append(cborHead(3, uint64(len(value))), value...)
+	case []interface{}:
+		ret := cborHead(4, uint64(len(value)))
+		for _, element := range value {
+			ret = append(ret, encodeCbor(element)...)
+		}
+		return ret
+	case map[interface{}]interface{}:
+		entries := make([][]byte, 0, len(value))
+		for key, element := range value {
+			entries = append(entries, append(encodeCbor(key), encodeCbor(element)...))
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return string(entries[i]) < string(entries[j])
+		})
+		ret := cborHead(5, uint64(len(value)))
+		for _, entry := range entries {
+			ret = append(ret, entry...)
+		}
+		return ret
+	default:
+		panic("unsupported cbor item")
+	}
+}
+
+func cborHead(major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg <= 0xff:
+		return []byte{major<<5 | 24, byte(arg)}
+	case arg <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(arg))
+	case arg <= 0xffffffff:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(arg))
+	default:
+		return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, arg)
+	}
+}
+
+func TestDecodeCbor(t *testing.T) {
+	// RFC 8949 appendix A examples.
+	for encoded, want := range map[string]interface{}{
+		"00":                 int64(0),
+		"17":                 int64(23),
+		"1818":               int64(24),
+		"1903e8":             int64(1000),
+		"1b000000e8d4a51000": int64(1000000000000),
+		"20":                 int64(-1),
+		"3863":               int64(-100),
+		"f4":                 false,
+		"f5":                 true,
+		"f6":                 nil,
+		"4401020304":         []byte{1, 2, 3, 4},
+		"6449455446":         "IETF",
+		"83010203":           []interface{}{int64(1), int64(2), int64(3)},
+		"a201020304":         map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)},
+		"a26161016162820203": map[interface{}]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}},
+	} {
+		data, err := hex.DecodeString(encoded)
+		assert.NoError(t, err)
+		item, rest, err := decodeCbor(data)
+		assert.NoError(t, err, encoded)
+		assert.Equal(t, want, item, encoded)
+		assert.Empty(t, rest, encoded)
+		assert.Equal(t, data, encodeCbor(item), encoded)
+	}
+
+	// the bytes following the first item are returned.
+	item, rest, err := decodeCbor([]byte{0x01, 0x02})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), item)
+	assert.Equal(t, []byte{0x02}, rest)
+
+	for _, encoded := range []string{
+		"",                   // no data
+		"5f42010243030405ff", // indefinite length
+		"44010203",           // truncated byte string
+		"9bffffffffffffffff", // huge array
+		"a2010201",           // truncated map
+		"a1f50102",           // boolean key
+		"a201020103",         // duplicate key
+		"c11a514b67b0",       // tag
+		"fb3ff199999999999a", // float
+		"3bffffffffffffffff", // negative overflow
+	} {
+		data, err := hex.DecodeString(encoded)
+		assert.NoError(t, err)
+		_, _, err = decodeCbor(data)
+		assert.ErrorIs(t, err, ErrInvalidCbor, encoded)
+	}
+
+	nested := make([]byte, 0)
+	for i := 0; i < 100; i++ {
+		nested = append(nested, 0x81)
+	}
+	_, _, err = decodeCbor(append(nested, 0x00))
+	assert.ErrorIs(t, err, ErrInvalidCbor)
+}
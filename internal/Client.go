@@ -0,0 +1,531 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hyperjumptech/jiffy"
+	"github.com/newm4n/dokku-aaa/configuration"
+	"github.com/newm4n/dokku-common/security"
+	bolt "go.etcd.io/bbolt"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidClient       = fmt.Errorf("invalid client")
+	ErrInvalidClientId     = fmt.Errorf("client id may only contain letters, digits, dot, dash and underscore")
+	ErrInvalidClientSecret = fmt.Errorf("wrong client secret")
+	ErrInvalidRedirectUri  = fmt.Errorf("redirect uri must be an absolute uri without fragment")
+
+	// bucketOAuthClient holds the OAuth clients, keyed by client id.
+	bucketOAuthClient = []byte("oauth_client")
+
+	// clientIdPattern keeps client ids plain, they are sent in basic credentials and form parameters.
+	clientIdPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+)
+
+// ClientSubjectPrefix namespaces the client ids in the token subject, so a client is never taken for
+// the user account having the same email.
+const ClientSubjectPrefix = "client:"
+
+// OAuthClient is a machine identity, authenticating with its client id and secret to get access tokens
+// whose subject is the client. Clients having redirect URIs may also sign users in using the authorization code flow.
+type OAuthClient struct {
+	ClientId string
+	Name     string
+	// SecretHash is the argon2 hash of the client secret, the secret itself is only shown when it is created.
+	// It is empty for public clients.
+	SecretHash string
+	// Public clients, like browser and mobile apps, can not keep a secret. They only use the authorization code
+	// flow, identified by their client id and PKCE.
+	Public bool
+	// RedirectUri lists the exact URIs the authorization code may be sent to.
+	RedirectUri []string
+	// TenantRole lists the tenant roles granted to the client, in the 'role1,role2@tenant' pattern.
+	TenantRole []string
+	// TokenAge is the lifetime of the client access tokens, eg. "1 hour". token.age.access is used when empty.
+	TokenAge  string
+	CreatedAt time.Time
+}
+
+// Validate checks the client id, tenant roles and token age.
+func (client *OAuthClient) Validate() error {
+	if !clientIdPattern.MatchString(client.ClientId) {
+		return ErrInvalidClientId
+	}
+	for _, tr := range client.TenantRole {
+		parsed, err := ParseTenantRole(tr)
+		if err == nil {
+			err = ValidateTenantRoles(parsed)
+		}
+		if err != nil {
+			return fmt.Errorf("%w, %s", ErrInvalidClient, err.Error())
+		}
+	}
+	if len(client.TokenAge) > 0 {
+		if _, err := jiffy.DurationOf(client.TokenAge); err != nil {
+			return fmt.Errorf("%w, invalid token age \"%s\"", ErrInvalidClient, client.TokenAge)
+		}
+	}
+	for _, redirectUri := range client.RedirectUri {
+		parsed, err := url.Parse(redirectUri)
+		if err != nil || !parsed.IsAbs() || len(parsed.Host) == 0 || len(parsed.Fragment) > 0 {
+			return fmt.Errorf("%w, \"%s\"", ErrInvalidRedirectUri, redirectUri)
+		}
+	}
+	if client.Public && len(client.RedirectUri) == 0 {
+		return fmt.Errorf("%w, public client needs a redirect uri", ErrInvalidClient)
+	}
+	return nil
+}
+
+// AllowRedirect tells whether the redirect URI is registered to the client. URIs are compared as is.
+func (client *OAuthClient) AllowRedirect(redirectUri string) bool {
+	return len(redirectUri) > 0 && slices.Contains(client.RedirectUri, redirectUri)
+}
+
+// ClientSubject tells whether the token subject is a client, no user account may be named like one.
+func ClientSubject(subject string) bool {
+	return len(subject) >= len(ClientSubjectPrefix) && strings.EqualFold(subject[:len(ClientSubjectPrefix)], ClientSubjectPrefix)
+}
+
+// Subject returns the token subject of the client, its client id in the ClientSubjectPrefix namespace.
+func (client *OAuthClient) Subject() string {
+	return ClientSubjectPrefix + client.ClientId
+}
+
+// Audience returns the tenant roles of the client, one 'role1,role2@tenant' entry per tenant.
+func (client *OAuthClient) Audience() []string {
+	tenantRoles := make([]*TenantRoles, 0)
+	for _, tr := range client.TenantRole {
+		parsed, err := ParseTenantRole(tr)
+		if err != nil {
+			continue
+		}
+		tenantRoles = append(tenantRoles, parsed...)
+	}
+	return tenantRolesAudience(tenantRoles)
+}
+
+// AccessTokenAge returns the lifetime of the client access tokens, token.age.access unless the client has its own.
+func (client *OAuthClient) AccessTokenAge() (time.Duration, error) {
+	age := client.TokenAge
+	if len(age) == 0 {
+		age = configuration.Get("token.age.access")
+	}
+	return jiffy.DurationOf(age)
+}
+
+// RevokeClientTokens revokes every access token issued to the client so far, as the client is the token subject.
+func RevokeClientTokens(ctx context.Context, revocation RevocationStore, client *OAuthClient) error {
+	durAccess, err := client.AccessTokenAge()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return revocation.RevokeSubject(ctx, client.Subject(), now, now.Add(durAccess))
+}
+
+func (client *OAuthClient) copy() *OAuthClient {
+	ret := *client
+	ret.TenantRole = append([]string(nil), client.TenantRole...)
+	ret.RedirectUri = append([]string(nil), client.RedirectUri...)
+	return &ret
+}
+
+// NewClientSecret creates a random client secret, returned with its hash to be stored.
+func NewClientSecret() (secret, secretHash string, err error) {
+	secret = randomHex(32)
+	secretHash, err = security.CreateHash(secret, security.DefaultParams)
+	if err != nil {
+		return "", "", err
+	}
+	return secret, secretHash, nil
+}
+
+// AuthenticateClient returns the client, when the secret is the one of the client.
+// Unknown clients and wrong secrets both return ErrInvalidClientSecret.
+func AuthenticateClient(ctx context.Context, clients ClientStore, clientId, secret string) (*OAuthClient, error) {
+	if len(clientId) == 0 || len(secret) == 0 {
+		return nil, ErrInvalidClientSecret
+	}
+	client, err := clients.GetClient(ctx, clientId)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrInvalidClientSecret
+	}
+	if err != nil {
+		return nil, err
+	}
+	match, err := security.ComparePasswordAndHash(secret, client.SecretHash)
+	if err != nil || !match {
+		return nil, ErrInvalidClientSecret
+	}
+	return client, nil
+}
+
+// ClientStore keeps the registered OAuth clients.
+type ClientStore interface {
+	// CreateClient returns ErrFound when the client id is taken.
+	CreateClient(ctx context.Context, client *OAuthClient) error
+	// UpdateClient replaces the client having the same client id, it returns ErrNotFound when there is none.
+	UpdateClient(ctx context.Context, client *OAuthClient) error
+	DeleteClient(ctx context.Context, clientId string) error
+	GetClient(ctx context.Context, clientId string) (*OAuthClient, error)
+	// ListClient returns every client, ordered by client id.
+	ListClient(ctx context.Context) ([]*OAuthClient, error)
+}
+
+// MemoryClientStore is the in memory ClientStore, clients are lost on restart.
+type MemoryClientStore struct {
+	mutex   sync.RWMutex
+	clients map[string]*OAuthClient
+}
+
+func NewMemoryClientStore() *MemoryClientStore {
+	return &MemoryClientStore{
+		clients: make(map[string]*OAuthClient),
+	}
+}
+
+func (store *MemoryClientStore) CreateClient(ctx context.Context, client *OAuthClient) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if client == nil || len(client.ClientId) == 0 {
+		return ErrArgumentEmpty
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, exist := store.clients[client.ClientId]; exist {
+		return ErrFound
+	}
+	store.clients[client.ClientId] = client.copy()
+	return nil
+}
+
+func (store *MemoryClientStore) UpdateClient(ctx context.Context, client *OAuthClient) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if client == nil || len(client.ClientId) == 0 {
+		return ErrArgumentEmpty
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, exist := store.clients[client.ClientId]; !exist {
+		return ErrNotFound
+	}
+	store.clients[client.ClientId] = client.copy()
+	return nil
+}
+
+func (store *MemoryClientStore) DeleteClient(ctx context.Context, clientId string) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if len(clientId) == 0 {
+		return ErrArgumentEmpty
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, exist := store.clients[clientId]; !exist {
+		return ErrNotFound
+	}
+	delete(store.clients, clientId)
+	return nil
+}
+
+func (store *MemoryClientStore) GetClient(ctx context.Context, clientId string) (*OAuthClient, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(clientId) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	client, exist := store.clients[clientId]
+	if !exist {
+		return nil, ErrNotFound
+	}
+	return client.copy(), nil
+}
+
+func (store *MemoryClientStore) ListClient(ctx context.Context) ([]*OAuthClient, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	ret := make([]*OAuthClient, 0, len(store.clients))
+	for _, client := range store.clients {
+		ret = append(ret, client.copy())
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].ClientId < ret[j].ClientId
+	})
+	return ret, nil
+}
+
+// SqlClientStore is the ClientStore kept in the oauth_client table, for SQLite and PostgreSQL.
+type SqlClientStore struct {
+	DB *sql.DB
+}
+
+func NewSqlClientStore(db *sql.DB) *SqlClientStore {
+	return &SqlClientStore{DB: db}
+}
+
+func (store *SqlClientStore) CreateClient(ctx context.Context, client *OAuthClient) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if client == nil || len(client.ClientId) == 0 {
+		return ErrArgumentEmpty
+	}
+	tenantRoles, redirectUris, err := marshalClientLists(client)
+	if err != nil {
+		return err
+	}
+	result, err := store.DB.ExecContext(ctx, `INSERT INTO oauth_client (client_id, name, secret_hash, tenant_roles, token_age, created_at, redirect_uris, public)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT (client_id) DO NOTHING`,
+		client.ClientId, client.Name, client.SecretHash, tenantRoles, client.TokenAge, sqlTime(client.CreatedAt), redirectUris, client.Public)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrFound
+	}
+	return nil
+}
+
+func (store *SqlClientStore) UpdateClient(ctx context.Context, client *OAuthClient) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if client == nil || len(client.ClientId) == 0 {
+		return ErrArgumentEmpty
+	}
+	tenantRoles, redirectUris, err := marshalClientLists(client)
+	if err != nil {
+		return err
+	}
+	result, err := store.DB.ExecContext(ctx, `UPDATE oauth_client SET name = $1, secret_hash = $2, tenant_roles = $3, token_age = $4, redirect_uris = $5, public = $6
+WHERE client_id = $7`,
+		client.Name, client.SecretHash, tenantRoles, client.TokenAge, redirectUris, client.Public, client.ClientId)
+	if err != nil {
+		return err
+	}
+	return expectAffected(result)
+}
+
+func (store *SqlClientStore) DeleteClient(ctx context.Context, clientId string) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if len(clientId) == 0 {
+		return ErrArgumentEmpty
+	}
+	result, err := store.DB.ExecContext(ctx, `DELETE FROM oauth_client WHERE client_id = $1`, clientId)
+	if err != nil {
+		return err
+	}
+	return expectAffected(result)
+}
+
+func (store *SqlClientStore) GetClient(ctx context.Context, clientId string) (*OAuthClient, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(clientId) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	rows, err := store.DB.QueryContext(ctx, `SELECT client_id, name, secret_hash, tenant_roles, token_age, created_at, redirect_uris, public
+FROM oauth_client WHERE client_id = $1`, clientId)
+	if err != nil {
+		return nil, err
+	}
+	clients, err := scanClients(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(clients) == 0 {
+		return nil, ErrNotFound
+	}
+	return clients[0], nil
+}
+
+func (store *SqlClientStore) ListClient(ctx context.Context) ([]*OAuthClient, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	rows, err := store.DB.QueryContext(ctx, `SELECT client_id, name, secret_hash, tenant_roles, token_age, created_at, redirect_uris, public
+FROM oauth_client ORDER BY client_id`)
+	if err != nil {
+		return nil, err
+	}
+	return scanClients(rows)
+}
+
+func scanClients(rows *sql.Rows) ([]*OAuthClient, error) {
+	defer rows.Close()
+	ret := make([]*OAuthClient, 0)
+	for rows.Next() {
+		client := &OAuthClient{}
+		var tenantRoles, redirectUris string
+		if err := rows.Scan(&client.ClientId, &client.Name, &client.SecretHash, &tenantRoles, &client.TokenAge, &client.CreatedAt,
+			&redirectUris, &client.Public); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(tenantRoles), &client.TenantRole); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(redirectUris), &client.RedirectUri); err != nil {
+			return nil, err
+		}
+		ret = append(ret, client)
+	}
+	return ret, rows.Err()
+}
+
+// marshalClientLists returns the tenant roles and redirect URIs of the client as the json arrays kept in their column.
+func marshalClientLists(client *OAuthClient) (tenantRoles, redirectUris string, err error) {
+	trBytes, err := json.Marshal(client.TenantRole)
+	if err != nil {
+		return "", "", err
+	}
+	ruBytes, err := json.Marshal(client.RedirectUri)
+	if err != nil {
+		return "", "", err
+	}
+	return string(trBytes), string(ruBytes), nil
+}
+
+// expectAffected returns ErrNotFound when the statement changed no row.
+func expectAffected(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// BoltClientStore is the ClientStore kept in the oauth_client bucket of the bolt file.
+type BoltClientStore struct {
+	DB *bolt.DB
+}
+
+func NewBoltClientStore(db *bolt.DB) *BoltClientStore {
+	return &BoltClientStore{DB: db}
+}
+
+func putBoltClient(tx *bolt.Tx, client *OAuthClient) error {
+	data, err := json.Marshal(client)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketOAuthClient).Put([]byte(client.ClientId), data)
+}
+
+func (store *BoltClientStore) CreateClient(ctx context.Context, client *OAuthClient) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if client == nil || len(client.ClientId) == 0 {
+		return ErrArgumentEmpty
+	}
+	return store.DB.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketOAuthClient).Get([]byte(client.ClientId)) != nil {
+			return ErrFound
+		}
+		return putBoltClient(tx, client)
+	})
+}
+
+func (store *BoltClientStore) UpdateClient(ctx context.Context, client *OAuthClient) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if client == nil || len(client.ClientId) == 0 {
+		return ErrArgumentEmpty
+	}
+	return store.DB.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketOAuthClient).Get([]byte(client.ClientId)) == nil {
+			return ErrNotFound
+		}
+		return putBoltClient(tx, client)
+	})
+}
+
+func (store *BoltClientStore) DeleteClient(ctx context.Context, clientId string) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if len(clientId) == 0 {
+		return ErrArgumentEmpty
+	}
+	return store.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketOAuthClient)
+		if bucket.Get([]byte(clientId)) == nil {
+			return ErrNotFound
+		}
+		return bucket.Delete([]byte(clientId))
+	})
+}
+
+func (store *BoltClientStore) GetClient(ctx context.Context, clientId string) (*OAuthClient, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(clientId) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	client := &OAuthClient{}
+	err := store.DB.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketOAuthClient).Get([]byte(clientId))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, client)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func (store *BoltClientStore) ListClient(ctx context.Context) ([]*OAuthClient, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	ret := make([]*OAuthClient, 0)
+	err := store.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketOAuthClient).ForEach(func(k, v []byte) error {
+			client := &OAuthClient{}
+			if err := json.Unmarshal(v, client); err != nil {
+				return err
+			}
+			ret = append(ret, client)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
@@ -0,0 +1,239 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/newm4n/dokku-aaa/configuration"
+	"github.com/newm4n/dokku-common/security"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func testClientStore(t *testing.T, newStore func(t *testing.T) ClientStore) {
+	ctx := context.Background()
+
+	t.Run("CRUD", func(t *testing.T) {
+		store := newStore(t)
+		client := &OAuthClient{
+			ClientId:   "backend-job",
+			Name:       "Backend job",
+			SecretHash: "hash",
+			TenantRole: []string{"reader,writer@ACME"},
+			TokenAge:   "1 hour",
+			CreatedAt:  time.Now(),
+		}
+		assert.NoError(t, store.CreateClient(ctx, client))
+		assert.ErrorIs(t, store.CreateClient(ctx, client), ErrFound)
+		assert.NoError(t, store.CreateClient(ctx, &OAuthClient{ClientId: "another-job", SecretHash: "hash", CreatedAt: time.Now()}))
+
+		got, err := store.GetClient(ctx, "backend-job")
+		assert.NoError(t, err)
+		assert.Equal(t, "Backend job", got.Name)
+		assert.Equal(t, "hash", got.SecretHash)
+		assert.Equal(t, []string{"reader,writer@ACME"}, got.TenantRole)
+		assert.Equal(t, "1 hour", got.TokenAge)
+		assert.False(t, got.Public)
+		assert.Empty(t, got.RedirectUri)
+		_, err = store.GetClient(ctx, "unknown")
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		got.TenantRole = []string{"reader@ACME", "reader@BETA"}
+		got.SecretHash = "new hash"
+		got.Public = true
+		got.RedirectUri = []string{"https://app.domain.com/callback"}
+		assert.NoError(t, store.UpdateClient(ctx, got))
+		got, err = store.GetClient(ctx, "backend-job")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"reader@ACME", "reader@BETA"}, got.TenantRole)
+		assert.Equal(t, "new hash", got.SecretHash)
+		assert.True(t, got.Public)
+		assert.Equal(t, []string{"https://app.domain.com/callback"}, got.RedirectUri)
+		assert.ErrorIs(t, store.UpdateClient(ctx, &OAuthClient{ClientId: "unknown"}), ErrNotFound)
+
+		clients, err := store.ListClient(ctx)
+		assert.NoError(t, err)
+		if assert.Len(t, clients, 2) {
+			assert.Equal(t, "another-job", clients[0].ClientId)
+			assert.Equal(t, "backend-job", clients[1].ClientId)
+		}
+
+		assert.NoError(t, store.DeleteClient(ctx, "backend-job"))
+		assert.ErrorIs(t, store.DeleteClient(ctx, "backend-job"), ErrNotFound)
+		_, err = store.GetClient(ctx, "backend-job")
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = store.GetClient(ctx, "")
+		assert.ErrorIs(t, err, ErrArgumentEmpty)
+	})
+}
+
+func TestMemoryClientStore(t *testing.T) {
+	testClientStore(t, func(t *testing.T) ClientStore {
+		return NewMemoryClientStore()
+	})
+}
+
+func TestSqlClientStore_SQLite(t *testing.T) {
+	testClientStore(t, func(t *testing.T) ClientStore {
+		return newSQLiteDAO(t).Clients()
+	})
+}
+
+func TestBoltClientStore(t *testing.T) {
+	testClientStore(t, func(t *testing.T) ClientStore {
+		return newBoltDAO(t).Clients()
+	})
+}
+
+func TestOAuthClient_Validate(t *testing.T) {
+	assert.NoError(t, (&OAuthClient{ClientId: "backend-job.v2", TenantRole: []string{"reader@ACME"}, TokenAge: "10 minutes"}).Validate())
+	assert.ErrorIs(t, (&OAuthClient{ClientId: "user@mail.com"}).Validate(), ErrInvalidClientId)
+	assert.ErrorIs(t, (&OAuthClient{ClientId: ""}).Validate(), ErrInvalidClientId)
+	assert.ErrorIs(t, (&OAuthClient{ClientId: "job", TenantRole: []string{"reader"}}).Validate(), ErrInvalidClient)
+	assert.ErrorIs(t, (&OAuthClient{ClientId: "job", TenantRole: []string{"*@ACME"}}).Validate(), ErrInvalidClient)
+	assert.ErrorIs(t, (&OAuthClient{ClientId: "job", TenantRole: []string{"reader@ACME BETA"}}).Validate(), ErrInvalidClient)
+	assert.ErrorIs(t, (&OAuthClient{ClientId: "job", TokenAge: "soon"}).Validate(), ErrInvalidClient)
+	assert.NoError(t, (&OAuthClient{ClientId: "spa", Public: true, RedirectUri: []string{"https://app.domain.com/callback", "com.domain.app://callback"}}).Validate())
+	assert.ErrorIs(t, (&OAuthClient{ClientId: "spa", Public: true}).Validate(), ErrInvalidClient)
+	assert.ErrorIs(t, (&OAuthClient{ClientId: "spa", RedirectUri: []string{"/callback"}}).Validate(), ErrInvalidRedirectUri)
+	assert.ErrorIs(t, (&OAuthClient{ClientId: "spa", RedirectUri: []string{"https://app.domain.com/#callback"}}).Validate(), ErrInvalidRedirectUri)
+}
+
+func TestGrantedScope(t *testing.T) {
+	auds := []string{"reader,writer@ACME", "reader@BETA"}
+	granted, err := grantedScope(auds, "")
+	assert.NoError(t, err)
+	assert.Equal(t, auds, granted)
+	granted, err = grantedScope(auds, "writer@ACME  reader@ACME,BETA")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"writer@ACME", "reader@ACME", "reader@BETA"}, granted)
+	_, err = grantedScope(auds, "writer@BETA")
+	assert.ErrorIs(t, err, ErrInvalidScope)
+	_, err = grantedScope(auds, "reader")
+	assert.ErrorIs(t, err, ErrInvalidScope)
+}
+
+func newTokenRequest(form url.Values) *http.Request {
+	request := newRequest(http.MethodPost, "/oauth/token", form.Encode())
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return request
+}
+
+func TestTheHandler_ClientCredentials(t *testing.T) {
+	router := newTestRouter()
+
+	resp := serve(router, newRequest(http.MethodPost, "/client", `{"ClientId":"backend-job"}`))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/client", `{"ClientId":"user@mail.com"}`)))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/client",
+		`{"ClientId":"backend-job","Name":"Backend job","TenantRole":["reader,writer@ACME"],"TokenAge":"1 hour"}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	created := &ClientResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), created))
+	assert.Equal(t, "backend-job", created.ClientId)
+	assert.NotEmpty(t, created.Secret)
+	assert.NotContains(t, resp.Body.String(), "SecretHash")
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/client", `{"ClientId":"backend-job"}`)))
+	assert.Equal(t, http.StatusConflict, resp.Code)
+
+	resp = serve(router, asRoot(newRequest(http.MethodGet, "/client/backend-job", "")))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	got := &ClientResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), got))
+	assert.Empty(t, got.Secret)
+	assert.Equal(t, []string{"reader,writer@ACME"}, got.TenantRole)
+
+	// client_secret_basic
+	request := newTokenRequest(url.Values{"grant_type": {"client_credentials"}})
+	request.SetBasicAuth("backend-job", created.Secret)
+	resp = serve(router, request)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "no-store", resp.Header().Get("Cache-Control"))
+	token := &TokenResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), token))
+	assert.Equal(t, "Bearer", token.TokenType)
+	assert.Equal(t, int64(3600), token.ExpiresIn)
+	claim, err := ParseKeyringToken(token.AccessToken, GetKeyring())
+	assert.NoError(t, err)
+	assert.Equal(t, "client:backend-job", claim.Subscriber)
+	assert.Equal(t, security.AccessToken, claim.TokenType)
+	assert.Equal(t, configuration.Get("token.issuer"), claim.Issuer)
+	assert.Equal(t, []string{"reader,writer@ACME"}, claim.Audience)
+
+	// client_secret_post, narrowed down by scope. The token authorizes requests like a user token does.
+	resp = serve(router, newTokenRequest(url.Values{"grant_type": {"client_credentials"}, "client_id": {"backend-job"},
+		"client_secret": {created.Secret}, "scope": {"reader@ACME"}}))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), token))
+	assert.Equal(t, "reader@ACME", token.Scope)
+	request = newRequest(http.MethodGet, "/client", "")
+	request.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	resp = serve(router, request)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.NotContains(t, resp.Body.String(), "token contains problem")
+
+	resp = serve(router, newTokenRequest(url.Values{"grant_type": {"client_credentials"}, "client_id": {"backend-job"},
+		"client_secret": {created.Secret}, "scope": {"admin@ACME"}}))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	oerr := &OAuthError{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), oerr))
+	assert.Equal(t, "invalid_scope", oerr.Code)
+
+	resp = serve(router, newTokenRequest(url.Values{"grant_type": {"password"}, "client_id": {"backend-job"}, "client_secret": {created.Secret}}))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), oerr))
+	assert.Equal(t, "unsupported_grant_type", oerr.Code)
+
+	resp = serve(router, newTokenRequest(url.Values{"grant_type": {"client_credentials"}, "client_id": {"backend-job"}, "client_secret": {"wrong"}}))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), oerr))
+	assert.Equal(t, "invalid_client", oerr.Code)
+
+	// registered clients may introspect.
+	resp = serve(router, newIntrospectRequest(token.AccessToken, "backend-job", created.Secret))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	introspection := &IntrospectionResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), introspection))
+	assert.True(t, introspection.Active)
+	assert.Equal(t, "client:backend-job", introspection.Subject)
+
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/client/backend-job/secret", "")))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	reset := &ClientResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), reset))
+	assert.NotEqual(t, created.Secret, reset.Secret)
+	resp = serve(router, newTokenRequest(url.Values{"grant_type": {"client_credentials"}, "client_id": {"backend-job"}, "client_secret": {created.Secret}}))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	// the tokens issued with the old secret are revoked.
+	resp = serve(router, bearer(newRequest(http.MethodGet, "/client", ""), token.AccessToken))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Contains(t, resp.Body.String(), ErrTokenRevoked.Error())
+
+	resp = serve(router, asRoot(newRequest(http.MethodPut, "/client/backend-job", `{"Name":"Job","TenantRole":["reader@BETA"]}`)))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	resp = serve(router, newTokenRequest(url.Values{"grant_type": {"client_credentials"}, "client_id": {"backend-job"}, "client_secret": {reset.Secret}}))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), token))
+	assert.Equal(t, "reader@BETA", token.Scope)
+	assert.Equal(t, int64(300), token.ExpiresIn)
+	lastToken := token.AccessToken
+
+	resp = serve(router, asRoot(newRequest(http.MethodGet, "/client", "")))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	clients := make([]*ClientResponse, 0)
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &clients))
+	assert.Len(t, clients, 1)
+
+	resp = serve(router, asRoot(newRequest(http.MethodDelete, "/client/backend-job", "")))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	resp = serve(router, asRoot(newRequest(http.MethodDelete, "/client/backend-job", "")))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	resp = serve(router, bearer(newRequest(http.MethodGet, "/client", ""), lastToken))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Contains(t, resp.Body.String(), ErrTokenRevoked.Error())
+	resp = serve(router, newTokenRequest(url.Values{"grant_type": {"client_credentials"}, "client_id": {"backend-job"}, "client_secret": {reset.Secret}}))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+}
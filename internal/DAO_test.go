@@ -7,10 +7,7 @@ import (
 )
 
 func TestMemoryDAO_CreateUserAccount(t *testing.T) {
-	mdao := &MemoryDAO{
-		UserAccountList:    make([]*UserAccount, 0),
-		UserTenantRoleList: make([]*UserTenantRoles, 0),
-	}
+	mdao := NewMemoryDAO()
 
 	exist, err := mdao.UserExist(context.Background(), "user@email.com")
 	assert.NoError(t, err)
@@ -26,10 +23,7 @@ func TestMemoryDAO_CreateUserAccount(t *testing.T) {
 }
 
 func TestMemoryDAO_UpdateUserPassphrase(t *testing.T) {
-	mdao := &MemoryDAO{
-		UserAccountList:    make([]*UserAccount, 0),
-		UserTenantRoleList: make([]*UserTenantRoles, 0),
-	}
+	mdao := NewMemoryDAO()
 
 	exist, err := mdao.UserExist(context.Background(), "user@email.com")
 	assert.NoError(t, err)
@@ -50,10 +44,7 @@ func TestMemoryDAO_UpdateUserPassphrase(t *testing.T) {
 }
 
 func TestMemoryDAO_DeleteUserAccount(t *testing.T) {
-	mdao := &MemoryDAO{
-		UserAccountList:    make([]*UserAccount, 0),
-		UserTenantRoleList: make([]*UserTenantRoles, 0),
-	}
+	mdao := NewMemoryDAO()
 
 	exist, err := mdao.UserExist(context.Background(), "user1@email.com")
 	assert.NoError(t, err)
@@ -93,22 +84,12 @@ func TestMemoryDAO_DeleteUserAccount(t *testing.T) {
 }
 
 func TestMemoryDAO_SearchUser(t *testing.T) {
-	mdao := &MemoryDAO{
-		UserAccountList:    make([]*UserAccount, 0),
-		UserTenantRoleList: make([]*UserTenantRoles, 0),
+	mdao := NewMemoryDAO()
+	for _, email := range []string{"abc123@123.com", "abc234@123.com", "def123@123.com", "def234@123.com"} {
+		mdao.putAccount(&UserAccount{
+			email: email,
+		})
 	}
-	mdao.UserAccountList = append(mdao.UserAccountList, &UserAccount{
-		email: "abc123@123.com",
-	})
-	mdao.UserAccountList = append(mdao.UserAccountList, &UserAccount{
-		email: "abc234@123.com",
-	})
-	mdao.UserAccountList = append(mdao.UserAccountList, &UserAccount{
-		email: "def123@123.com",
-	})
-	mdao.UserAccountList = append(mdao.UserAccountList, &UserAccount{
-		email: "def234@123.com",
-	})
 
 	ret, err := mdao.SearchUser(context.Background(), "def")
 	assert.NoError(t, err)
@@ -120,16 +101,9 @@ func TestMemoryDAO_SearchUser(t *testing.T) {
 }
 
 func TestMemoryDAO_CreateUserTenant(t *testing.T) {
-	mdao := &MemoryDAO{
-		UserAccountList:    make([]*UserAccount, 0),
-		UserTenantRoleList: make([]*UserTenantRoles, 0),
-	}
+	mdao := NewMemoryDAO()
 
-	mdao.UserTenantRoleList = append(mdao.UserTenantRoleList, &UserTenantRoles{
-		email:  "abc123@123.com",
-		tenant: "ABC",
-		roles:  make([]string, 0),
-	})
+	mdao.addMembership("abc123@123.com", "ABC", make([]string, 0))
 
 	success, err := mdao.CreateUserTenant(context.Background(), "abc234@123.com", "ABC")
 	assert.NoError(t, err)
@@ -141,126 +115,79 @@ func TestMemoryDAO_CreateUserTenant(t *testing.T) {
 }
 
 func TestMemoryDAO_UpdateUserTenant(t *testing.T) {
-	mdao := &MemoryDAO{
-		UserAccountList:    make([]*UserAccount, 0),
-		UserTenantRoleList: make([]*UserTenantRoles, 0),
-	}
-
 	t.Run("Run copy new", func(t *testing.T) {
-		mdao.UserTenantRoleList = make([]*UserTenantRoles, 0)
-		mdao.UserTenantRoleList = append(mdao.UserTenantRoleList, &UserTenantRoles{
-			email:  "abc123@123.com",
-			tenant: "ABC",
-			roles:  make([]string, 0),
-		})
+		mdao := NewMemoryDAO()
+		mdao.addMembership("abc123@123.com", "ABC", make([]string, 0))
 
-		assert.Equal(t, 1, len(mdao.UserTenantRoleList))
+		assert.Equal(t, 1, len(mdao.memberships["abc123@123.com"]))
 
 		success, err := mdao.UpdateUserTenant(context.Background(), "abc123@123.com", "ABC", "AAA")
 		assert.NoError(t, err)
 		assert.True(t, success)
 
-		assert.Equal(t, 1, len(mdao.UserTenantRoleList))
+		assert.Equal(t, 1, len(mdao.memberships["abc123@123.com"]))
 
-		for _, el := range mdao.UserTenantRoleList {
+		for _, el := range mdao.memberships["abc123@123.com"] {
 			assert.Equal(t, "abc123@123.com", el.email)
 			assert.Equal(t, "AAA", el.tenant)
 		}
+		assert.Equal(t, []string{"abc123@123.com"}, mdao.tenantMembers("AAA"))
+		assert.Equal(t, 0, len(mdao.tenantMembers("ABC")))
 	})
 
 	t.Run("Run copy exist", func(t *testing.T) {
-		mdao.UserTenantRoleList = make([]*UserTenantRoles, 0)
-		mdao.UserTenantRoleList = append(mdao.UserTenantRoleList, &UserTenantRoles{
-			email:  "abc123@123.com",
-			tenant: "ABC",
-			roles:  []string{"R2"},
-		})
-		mdao.UserTenantRoleList = append(mdao.UserTenantRoleList, &UserTenantRoles{
-			email:  "abc123@123.com",
-			tenant: "AAA",
-			roles:  []string{"R1"},
-		})
+		mdao := NewMemoryDAO()
+		mdao.addMembership("abc123@123.com", "ABC", []string{"R2"})
+		mdao.addMembership("abc123@123.com", "AAA", []string{"R1"})
 
-		assert.Equal(t, 2, len(mdao.UserTenantRoleList))
+		assert.Equal(t, 2, len(mdao.memberships["abc123@123.com"]))
 
 		success, err := mdao.UpdateUserTenant(context.Background(), "abc123@123.com", "ABC", "AAA")
 		assert.NoError(t, err)
 		assert.True(t, success)
 
-		assert.Equal(t, 1, len(mdao.UserTenantRoleList))
+		assert.Equal(t, 1, len(mdao.memberships["abc123@123.com"]))
 
-		for _, el := range mdao.UserTenantRoleList {
+		for _, el := range mdao.memberships["abc123@123.com"] {
 			assert.Equal(t, "abc123@123.com", el.email)
 			assert.Equal(t, "AAA", el.tenant)
+			assert.ElementsMatch(t, []string{"R1", "R2"}, el.roles)
 		}
 	})
 }
 
 func TestMemoryDAO_DeleteUserTenant(t *testing.T) {
-	mdao := &MemoryDAO{
-		UserAccountList:    make([]*UserAccount, 0),
-		UserTenantRoleList: make([]*UserTenantRoles, 0),
-	}
-	mdao.UserTenantRoleList = append(mdao.UserTenantRoleList, &UserTenantRoles{
-		email:  "user@mail.com",
-		tenant: "A",
-		roles:  []string{"R1", "R2"},
-	})
-	mdao.UserTenantRoleList = append(mdao.UserTenantRoleList, &UserTenantRoles{
-		email:  "otheruser@mail.com",
-		tenant: "A",
-		roles:  []string{"R1", "R2"},
-	})
+	mdao := NewMemoryDAO()
+	mdao.addMembership("user@mail.com", "A", []string{"R1", "R2"})
+	mdao.addMembership("otheruser@mail.com", "A", []string{"R1", "R2"})
 
-	assert.Equal(t, 2, len(mdao.UserTenantRoleList))
+	assert.Equal(t, 2, len(mdao.members["A"]))
 	success, err := mdao.DeleteUserTenant(context.Background(), "user@mail.com", "A")
 	assert.NoError(t, err)
 	assert.True(t, success)
-	assert.Equal(t, 1, len(mdao.UserTenantRoleList))
+	assert.Equal(t, 1, len(mdao.members["A"]))
 }
 
 func TestMemoryDAO_DeleteUserAllTenant(t *testing.T) {
-	mdao := &MemoryDAO{
-		UserAccountList:    make([]*UserAccount, 0),
-		UserTenantRoleList: make([]*UserTenantRoles, 0),
-	}
-	mdao.UserAccountList = append(mdao.UserAccountList, &UserAccount{
+	mdao := NewMemoryDAO()
+	mdao.putAccount(&UserAccount{
 		email:      "user@mail.com",
 		passphrase: "somehashhere",
 	})
-	mdao.UserTenantRoleList = append(mdao.UserTenantRoleList, &UserTenantRoles{
-		email:  "user@mail.com",
-		tenant: "A",
-		roles:  []string{"R1", "R2"},
-	})
-	mdao.UserTenantRoleList = append(mdao.UserTenantRoleList, &UserTenantRoles{
-		email:  "user@mail.com",
-		tenant: "B",
-		roles:  []string{"R3", "R4"},
-	})
-	mdao.UserTenantRoleList = append(mdao.UserTenantRoleList, &UserTenantRoles{
-		email:  "user@mail.com",
-		tenant: "C",
-		roles:  []string{"R1", "R2"},
-	})
-	mdao.UserTenantRoleList = append(mdao.UserTenantRoleList, &UserTenantRoles{
-		email:  "user@mail.com",
-		tenant: "D",
-		roles:  []string{"R1", "R2"},
-	})
-	mdao.UserTenantRoleList = append(mdao.UserTenantRoleList, &UserTenantRoles{
-		email:  "otheruser@mail.com",
-		tenant: "A",
-		roles:  []string{"R1", "R2"},
-	})
+	mdao.addMembership("user@mail.com", "A", []string{"R1", "R2"})
+	mdao.addMembership("user@mail.com", "B", []string{"R3", "R4"})
+	mdao.addMembership("user@mail.com", "C", []string{"R1", "R2"})
+	mdao.addMembership("user@mail.com", "D", []string{"R1", "R2"})
+	mdao.addMembership("otheruser@mail.com", "A", []string{"R1", "R2"})
 
-	assert.Equal(t, 5, len(mdao.UserTenantRoleList))
+	assert.Equal(t, 4, len(mdao.memberships["user@mail.com"]))
 
 	success, err := mdao.DeleteUserAllTenant(context.Background(), "user@mail.com")
 	assert.NoError(t, err)
 	assert.True(t, success)
 
-	assert.Equal(t, 1, len(mdao.UserTenantRoleList))
+	assert.Equal(t, 0, len(mdao.memberships["user@mail.com"]))
+	assert.Equal(t, 1, len(mdao.memberships["otheruser@mail.com"]))
 }
 
 func TestMemoryDAO_UserTenantExist(t *testing.T) {
@@ -290,3 +217,147 @@ func TestMemoryDAO_Authenticate(t *testing.T) {
 func TestMemoryDAO_Refresh(t *testing.T) {
 	// TODO test this
 }
+
+func TestMemoryDAO_Tenant(t *testing.T) {
+	mdao := NewMemoryDAO()
+	ctx := context.Background()
+
+	success, err := mdao.CreateTenant(ctx, "ACME", "Acme Corporation")
+	assert.NoError(t, err)
+	assert.True(t, success)
+
+	success, err = mdao.CreateTenant(ctx, "ACME", "Acme Again")
+	assert.ErrorIs(t, err, ErrFound)
+	assert.False(t, success)
+
+	tenant, err := mdao.GetTenant(ctx, "ACME")
+	assert.NoError(t, err)
+	assert.Equal(t, "Acme Corporation", tenant.DisplayName)
+	assert.Equal(t, TenantStatusActive, tenant.Status)
+
+	// membership on an unknown tenant creates its record
+	success, err = mdao.CreateUserTenantRole(ctx, "user@mail.com", "OTHER", "R1")
+	assert.NoError(t, err)
+	assert.True(t, success)
+	tenant, err = mdao.GetTenant(ctx, "OTHER")
+	assert.NoError(t, err)
+	assert.Equal(t, "OTHER", tenant.DisplayName)
+
+	tenants, err := mdao.ListTenant(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(tenants))
+	assert.Equal(t, "ACME", tenants[0].Name)
+
+	tenants, err = mdao.SearchTenant(ctx, "ac")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(tenants))
+
+	_, err = mdao.GetTenant(ctx, "NONE")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMemoryDAO_UpdateTenant(t *testing.T) {
+	mdao := NewMemoryDAO()
+	ctx := context.Background()
+
+	_, err := mdao.CreateTenant(ctx, "ABC", "")
+	assert.NoError(t, err)
+	_, err = mdao.CreateUserTenantRole(ctx, "user1@mail.com", "ABC", "R1")
+	assert.NoError(t, err)
+	_, err = mdao.CreateUserTenantRole(ctx, "user2@mail.com", "ABC", "R2")
+	assert.NoError(t, err)
+
+	success, err := mdao.UpdateTenant(ctx, "ABC", "XYZ", "Xyz Inc")
+	assert.NoError(t, err)
+	assert.True(t, success)
+
+	_, err = mdao.GetTenant(ctx, "ABC")
+	assert.ErrorIs(t, err, ErrNotFound)
+	tenant, err := mdao.GetTenant(ctx, "XYZ")
+	assert.NoError(t, err)
+	assert.Equal(t, "Xyz Inc", tenant.DisplayName)
+
+	members, err := mdao.ListTenantUser(ctx, "XYZ")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(members))
+
+	exist, err := mdao.UserTenantRoleExist(ctx, "user2@mail.com", "XYZ", "R2")
+	assert.NoError(t, err)
+	assert.True(t, exist)
+
+	tenants, err := mdao.ListTenant(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(tenants))
+
+	_, err = mdao.UpdateTenant(ctx, "XYZ", ReservedTenant, "")
+	assert.ErrorIs(t, err, ErrTenantReserved)
+}
+
+func TestMemoryDAO_DeleteTenant(t *testing.T) {
+	mdao := NewMemoryDAO()
+	ctx := context.Background()
+
+	_, err := mdao.CreateUserTenantRole(ctx, "root@mail.com", ReservedTenant, "root")
+	assert.NoError(t, err)
+	_, err = mdao.CreateUserTenantRole(ctx, "user@mail.com", "A", "R1")
+	assert.NoError(t, err)
+	_, err = mdao.CreateUserTenantRole(ctx, "user@mail.com", "B", "R1")
+	assert.NoError(t, err)
+
+	success, err := mdao.DeleteTenant(ctx, "A")
+	assert.NoError(t, err)
+	assert.True(t, success)
+	assert.Equal(t, 0, len(mdao.members["A"]))
+	assert.Equal(t, 1, len(mdao.members["B"]))
+
+	_, err = mdao.DeleteTenant(ctx, "A")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = mdao.DeleteTenant(ctx, ReservedTenant)
+	assert.ErrorIs(t, err, ErrTenantReserved)
+
+	success, err = mdao.DeleteAllTenant(ctx)
+	assert.NoError(t, err)
+	assert.True(t, success)
+	assert.Equal(t, 1, len(mdao.members))
+	assert.Equal(t, 1, len(mdao.tenants))
+	assert.NotNil(t, mdao.tenants[ReservedTenant])
+}
+
+func TestMemoryDAO_UserProfile(t *testing.T) {
+	mdao := NewMemoryDAO()
+	ctx := context.Background()
+
+	_, err := mdao.GetUserProfile(ctx, "user@mail.com")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	mdao.putAccount(&UserAccount{
+		email:      "user@mail.com",
+		passphrase: "somehashhere",
+	})
+	success, err := mdao.UpdateUserProfile(ctx, "USER@mail.com", "Some User")
+	assert.NoError(t, err)
+	assert.True(t, success)
+
+	profile, err := mdao.GetUserProfile(ctx, "user@mail.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "Some User", profile.FullName)
+}
+
+func TestMemoryDAO_ListUserTenantRole(t *testing.T) {
+	mdao := NewMemoryDAO()
+	mdao.addMembership("user@mail.com", "A", []string{"R1", "R2"})
+
+	roles, err := mdao.ListUserTenantRole(context.Background(), "user@mail.com", "A")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"R1", "R2"}, roles)
+
+	_, err = mdao.ListUserTenantRole(context.Background(), "user@mail.com", "B")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMemoryDAO_Behaviour(t *testing.T) {
+	testDataAccessBehaviour(t, func(t *testing.T) DataAccess {
+		return NewMemoryDAO()
+	})
+}
@@ -0,0 +1,766 @@
+package internal
+
+import (
+	"context"
+	"github.com/SermoDigital/jose/crypto"
+	"github.com/newm4n/dokku-aaa/configuration"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dataAccessFactory creates an empty DataAccess for a behaviour test.
+type dataAccessFactory func(t *testing.T) DataAccess
+
+// testDataAccessBehaviour runs the same behaviour tests against any DataAccess implementation,
+// so every implementation behaves like MemoryDAO.
+func testDataAccessBehaviour(t *testing.T, newDAO dataAccessFactory) {
+	ctx := context.Background()
+
+	t.Run("CreateUserAccount", func(t *testing.T) {
+		dao := newDAO(t)
+		exist, err := dao.UserExist(ctx, "user@email.com")
+		assert.NoError(t, err)
+		assert.False(t, exist)
+
+		success, err := dao.CreateUserAccount(ctx, "user@email.com", "this is a password")
+		assert.NoError(t, err)
+		assert.True(t, success)
+
+		exist, err = dao.UserExist(ctx, "USER@email.com")
+		assert.NoError(t, err)
+		assert.True(t, exist)
+
+		success, err = dao.CreateUserAccount(ctx, "user@EMAIL.com", "this is a password")
+		assert.ErrorIs(t, err, ErrFound)
+		assert.False(t, success)
+
+		_, err = dao.CreateUserAccount(ctx, "", "this is a password")
+		assert.ErrorIs(t, err, ErrArgumentEmpty)
+		// the token subject of the clients is kept apart.
+		_, err = dao.CreateUserAccount(ctx, "Client:backend-job", "this is a password")
+		assert.ErrorIs(t, err, ErrArgumentInvalid)
+
+		success, err = dao.CreateUserAccount(ctx, "other@email.com", "password123")
+		assert.ErrorIs(t, err, ErrPassphrasePolicy)
+		assert.False(t, success)
+		exist, err = dao.UserExist(ctx, "other@email.com")
+		assert.NoError(t, err)
+		assert.False(t, exist)
+	})
+
+	t.Run("UpdateUserPassphrase", func(t *testing.T) {
+		dao := newDAO(t)
+		success, err := dao.CreateUserAccount(ctx, "user@email.com", "this is a password")
+		assert.NoError(t, err)
+		assert.True(t, success)
+
+		success, err = dao.UpdateUserPassphrase(ctx, "user@email.com", "not the password", "this is a new password")
+		assert.NoError(t, err)
+		assert.False(t, success)
+
+		success, err = dao.UpdateUserPassphrase(ctx, "user@email.com", "this is a password", "this is a new password")
+		assert.NoError(t, err)
+		assert.True(t, success)
+
+		_, _, _, err = dao.Authenticate(ctx, "user@email.com", "this is a password")
+		assert.ErrorIs(t, err, ErrInvalidPassword)
+		_, _, _, err = dao.Authenticate(ctx, "user@email.com", "this is a new password")
+		assert.NoError(t, err)
+
+		success, err = dao.UpdateUserPassphrase(ctx, "user@email.com", "this is a new password", "short")
+		assert.ErrorIs(t, err, ErrPassphrasePolicy)
+		assert.False(t, success)
+		_, _, _, err = dao.Authenticate(ctx, "user@email.com", "this is a new password")
+		assert.NoError(t, err)
+	})
+
+	t.Run("DeleteUserAccount", func(t *testing.T) {
+		dao := newDAO(t)
+		success, err := dao.CreateUserAccount(ctx, "user1@email.com", "this is a password")
+		assert.NoError(t, err)
+		assert.True(t, success)
+		success, err = dao.CreateUserAccount(ctx, "user2@email.com", "this is anpther password")
+		assert.NoError(t, err)
+		assert.True(t, success)
+
+		success, err = dao.DeleteUserAccount(ctx, "user2@email.com")
+		assert.NoError(t, err)
+		assert.True(t, success)
+
+		exist, err := dao.UserExist(ctx, "user2@email.com")
+		assert.NoError(t, err)
+		assert.False(t, exist)
+		exist, err = dao.UserExist(ctx, "user1@email.com")
+		assert.NoError(t, err)
+		assert.True(t, exist)
+
+		success, err = dao.DeleteUserAccount(ctx, "user2@email.com")
+		assert.NoError(t, err)
+		assert.False(t, success)
+	})
+
+	t.Run("SearchUser", func(t *testing.T) {
+		dao := newDAO(t)
+		for _, email := range []string{"abc123@123.com", "abc234@123.com", "def123@123.com", "def234@123.com"} {
+			_, err := dao.CreateUserAccount(ctx, email, "a password")
+			assert.NoError(t, err)
+		}
+		ret, err := dao.SearchUser(ctx, "DEF")
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"def123@123.com", "def234@123.com"}, ret)
+
+		ret, err = dao.SearchUser(ctx, "x")
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(ret))
+
+		_, err = dao.SearchUser(ctx, "")
+		assert.ErrorIs(t, err, ErrArgumentEmpty)
+	})
+
+	t.Run("UserProfile", func(t *testing.T) {
+		dao := newDAO(t)
+		_, err := dao.GetUserProfile(ctx, "user@mail.com")
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = dao.UpdateUserProfile(ctx, "user@mail.com", "Some User")
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		_, err = dao.CreateUserAccount(ctx, "user@mail.com", "a password")
+		assert.NoError(t, err)
+		success, err := dao.UpdateUserProfile(ctx, "USER@mail.com", "Some User")
+		assert.NoError(t, err)
+		assert.True(t, success)
+
+		profile, err := dao.GetUserProfile(ctx, "user@mail.com")
+		assert.NoError(t, err)
+		assert.Equal(t, "user@mail.com", profile.Email)
+		assert.Equal(t, "Some User", profile.FullName)
+	})
+
+	t.Run("Tenant", func(t *testing.T) {
+		dao := newDAO(t)
+		success, err := dao.CreateTenant(ctx, "ACME", "Acme Corporation")
+		assert.NoError(t, err)
+		assert.True(t, success)
+		_, err = dao.CreateTenant(ctx, "ACME", "Acme Again")
+		assert.ErrorIs(t, err, ErrFound)
+
+		tenant, err := dao.GetTenant(ctx, "ACME")
+		assert.NoError(t, err)
+		assert.Equal(t, "Acme Corporation", tenant.DisplayName)
+		assert.Equal(t, TenantStatusActive, tenant.Status)
+		assert.False(t, tenant.CreatedAt.IsZero())
+
+		// membership on an unknown tenant creates its record
+		_, err = dao.CreateUserTenantRole(ctx, "user@mail.com", "OTHER", "R1")
+		assert.NoError(t, err)
+		tenant, err = dao.GetTenant(ctx, "OTHER")
+		assert.NoError(t, err)
+		assert.Equal(t, "OTHER", tenant.DisplayName)
+
+		tenants, err := dao.ListTenant(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(tenants))
+		assert.Equal(t, "ACME", tenants[0].Name)
+
+		tenants, err = dao.SearchTenant(ctx, "ac")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(tenants))
+
+		_, err = dao.GetTenant(ctx, "NONE")
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		// tenant names are written into the token audience, where '*' is a wildcard and ',' and '@' separators.
+		for _, name := range []string{"*", "acme,*", "a@b", "ACME CORP"} {
+			_, err = dao.CreateTenant(ctx, name, "")
+			assert.ErrorIs(t, err, ErrArgumentInvalid, name)
+			_, err = dao.UpdateUserTenant(ctx, "user@mail.com", "OTHER", name)
+			assert.ErrorIs(t, err, ErrArgumentInvalid, name)
+			if name == ReservedTenant {
+				// the reserved tenant exists already, the root administrators are added to it.
+				continue
+			}
+			_, err = dao.UpdateTenant(ctx, "ACME", name, "")
+			assert.ErrorIs(t, err, ErrArgumentInvalid, name)
+			_, err = dao.CreateUserTenant(ctx, "user@mail.com", name)
+			assert.ErrorIs(t, err, ErrArgumentInvalid, name)
+			_, err = dao.CreateUserTenantRole(ctx, "user@mail.com", name, "R1")
+			assert.ErrorIs(t, err, ErrArgumentInvalid, name)
+		}
+		tenants, err = dao.ListTenant(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(tenants))
+	})
+
+	t.Run("UpdateTenant", func(t *testing.T) {
+		dao := newDAO(t)
+		_, err := dao.CreateTenant(ctx, "ABC", "")
+		assert.NoError(t, err)
+		_, err = dao.CreateUserTenantRole(ctx, "user1@mail.com", "ABC", "R1")
+		assert.NoError(t, err)
+		_, err = dao.CreateUserTenantRole(ctx, "user2@mail.com", "ABC", "R2")
+		assert.NoError(t, err)
+
+		success, err := dao.UpdateTenant(ctx, "ABC", "XYZ", "Xyz Inc")
+		assert.NoError(t, err)
+		assert.True(t, success)
+
+		_, err = dao.GetTenant(ctx, "ABC")
+		assert.ErrorIs(t, err, ErrNotFound)
+		tenant, err := dao.GetTenant(ctx, "XYZ")
+		assert.NoError(t, err)
+		assert.Equal(t, "Xyz Inc", tenant.DisplayName)
+
+		members, err := dao.ListTenantUser(ctx, "XYZ")
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"user1@mail.com", "user2@mail.com"}, members)
+		members, err = dao.ListTenantUser(ctx, "ABC")
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(members))
+
+		exist, err := dao.UserTenantRoleExist(ctx, "user2@mail.com", "XYZ", "R2")
+		assert.NoError(t, err)
+		assert.True(t, exist)
+
+		tenants, err := dao.ListTenant(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(tenants))
+
+		_, err = dao.UpdateTenant(ctx, "XYZ", ReservedTenant, "")
+		assert.ErrorIs(t, err, ErrTenantReserved)
+		_, err = dao.UpdateTenant(ctx, "NONE", "OTHER", "")
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("DeleteTenant", func(t *testing.T) {
+		dao := newDAO(t)
+		_, err := dao.CreateUserTenantRole(ctx, "root@mail.com", ReservedTenant, "root")
+		assert.NoError(t, err)
+		_, err = dao.CreateUserTenantRole(ctx, "user@mail.com", "A", "R1")
+		assert.NoError(t, err)
+		_, err = dao.CreateUserTenantRole(ctx, "user@mail.com", "B", "R1")
+		assert.NoError(t, err)
+
+		success, err := dao.DeleteTenant(ctx, "A")
+		assert.NoError(t, err)
+		assert.True(t, success)
+		exist, err := dao.UserTenantExist(ctx, "user@mail.com", "A")
+		assert.NoError(t, err)
+		assert.False(t, exist)
+
+		_, err = dao.DeleteTenant(ctx, "A")
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = dao.DeleteTenant(ctx, ReservedTenant)
+		assert.ErrorIs(t, err, ErrTenantReserved)
+
+		success, err = dao.DeleteAllTenant(ctx)
+		assert.NoError(t, err)
+		assert.True(t, success)
+		tenants, err := dao.ListTenant(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(tenants))
+		assert.Equal(t, ReservedTenant, tenants[0].Name)
+		exist, err = dao.UserTenantRoleExist(ctx, "root@mail.com", ReservedTenant, "root")
+		assert.NoError(t, err)
+		assert.True(t, exist)
+	})
+
+	t.Run("CreateUserTenant", func(t *testing.T) {
+		dao := newDAO(t)
+		success, err := dao.CreateUserTenant(ctx, "abc123@123.com", "ABC")
+		assert.NoError(t, err)
+		assert.True(t, success)
+
+		success, err = dao.CreateUserTenant(ctx, "abc234@123.com", "ABC")
+		assert.NoError(t, err)
+		assert.True(t, success)
+
+		success, err = dao.CreateUserTenant(ctx, "abc123@123.com", "ABC")
+		assert.ErrorIs(t, err, ErrFound)
+		assert.False(t, success)
+	})
+
+	t.Run("UpdateUserTenant copy new", func(t *testing.T) {
+		dao := newDAO(t)
+		_, err := dao.CreateUserTenant(ctx, "abc123@123.com", "ABC")
+		assert.NoError(t, err)
+
+		success, err := dao.UpdateUserTenant(ctx, "abc123@123.com", "ABC", "AAA")
+		assert.NoError(t, err)
+		assert.True(t, success)
+
+		exist, err := dao.UserTenantExist(ctx, "abc123@123.com", "ABC")
+		assert.NoError(t, err)
+		assert.False(t, exist)
+		exist, err = dao.UserTenantExist(ctx, "abc123@123.com", "AAA")
+		assert.NoError(t, err)
+		assert.True(t, exist)
+
+		_, err = dao.UpdateUserTenant(ctx, "abc123@123.com", "ABC", "AAA")
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		success, err = dao.UpdateUserTenant(ctx, "abc123@123.com", "AAA", "AAA")
+		assert.NoError(t, err)
+		assert.True(t, success)
+		exist, err = dao.UserTenantExist(ctx, "abc123@123.com", "AAA")
+		assert.NoError(t, err)
+		assert.True(t, exist)
+	})
+
+	t.Run("UpdateUserTenant copy exist", func(t *testing.T) {
+		dao := newDAO(t)
+		_, err := dao.CreateUserTenantRole(ctx, "abc123@123.com", "ABC", "R2")
+		assert.NoError(t, err)
+		_, err = dao.CreateUserTenantRole(ctx, "abc123@123.com", "AAA", "R1")
+		assert.NoError(t, err)
+
+		success, err := dao.UpdateUserTenant(ctx, "abc123@123.com", "ABC", "AAA")
+		assert.NoError(t, err)
+		assert.True(t, success)
+
+		exist, err := dao.UserTenantExist(ctx, "abc123@123.com", "ABC")
+		assert.NoError(t, err)
+		assert.False(t, exist)
+		roles, err := dao.ListUserTenantRole(ctx, "abc123@123.com", "AAA")
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"R1", "R2"}, roles)
+	})
+
+	t.Run("DeleteUserTenant", func(t *testing.T) {
+		dao := newDAO(t)
+		_, err := dao.CreateUserTenantRole(ctx, "user@mail.com", "A", "R1")
+		assert.NoError(t, err)
+		_, err = dao.CreateUserTenantRole(ctx, "otheruser@mail.com", "A", "R1")
+		assert.NoError(t, err)
+
+		success, err := dao.DeleteUserTenant(ctx, "user@mail.com", "A")
+		assert.NoError(t, err)
+		assert.True(t, success)
+
+		exist, err := dao.UserTenantExist(ctx, "user@mail.com", "A")
+		assert.NoError(t, err)
+		assert.False(t, exist)
+		exist, err = dao.UserTenantExist(ctx, "otheruser@mail.com", "A")
+		assert.NoError(t, err)
+		assert.True(t, exist)
+	})
+
+	t.Run("DeleteUserAllTenant", func(t *testing.T) {
+		dao := newDAO(t)
+		for _, tenant := range []string{"A", "B", "C", "D"} {
+			_, err := dao.CreateUserTenantRole(ctx, "user@mail.com", tenant, "R1")
+			assert.NoError(t, err)
+		}
+		_, err := dao.CreateUserTenantRole(ctx, "otheruser@mail.com", "A", "R1")
+		assert.NoError(t, err)
+
+		success, err := dao.DeleteUserAllTenant(ctx, "user@mail.com")
+		assert.NoError(t, err)
+		assert.True(t, success)
+
+		tenants, err := dao.SearchUserTenant(ctx, "user@mail.com", "A")
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(tenants))
+		members, err := dao.ListTenantUser(ctx, "A")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"otheruser@mail.com"}, members)
+	})
+
+	t.Run("UserTenantExist and SearchUserTenant", func(t *testing.T) {
+		dao := newDAO(t)
+		for _, tenant := range []string{"ACME", "ACE", "BETA"} {
+			_, err := dao.CreateUserTenant(ctx, "user@mail.com", tenant)
+			assert.NoError(t, err)
+		}
+		exist, err := dao.UserTenantExist(ctx, "USER@mail.com", "ACME")
+		assert.NoError(t, err)
+		assert.True(t, exist)
+		exist, err = dao.UserTenantExist(ctx, "user@mail.com", "GAMMA")
+		assert.NoError(t, err)
+		assert.False(t, exist)
+
+		tenants, err := dao.SearchUserTenant(ctx, "user@mail.com", "ac")
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"ACME", "ACE"}, tenants)
+	})
+
+	t.Run("UserTenantRole", func(t *testing.T) {
+		dao := newDAO(t)
+		_, err := dao.UserTenantRoleExist(ctx, "user@mail.com", "A", "R1")
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		for _, role := range []string{"R1", "R2", "ADMIN"} {
+			success, err := dao.CreateUserTenantRole(ctx, "user@mail.com", "A", role)
+			assert.NoError(t, err)
+			assert.True(t, success)
+		}
+		_, err = dao.CreateUserTenantRole(ctx, "user@mail.com", "A", "R1")
+		assert.ErrorIs(t, err, ErrFound)
+		// a role is written into the token audience, it can not be a wildcard nor add other tenant roles.
+		for _, role := range []string{"*", "R1,root@*", "R1@B", "R 1"} {
+			_, err = dao.CreateUserTenantRole(ctx, "user@mail.com", "A", role)
+			assert.ErrorIs(t, err, ErrArgumentInvalid, role)
+		}
+
+		exist, err := dao.UserTenantRoleExist(ctx, "user@mail.com", "A", "R1")
+		assert.NoError(t, err)
+		assert.True(t, exist)
+		exist, err = dao.UserTenantRoleExist(ctx, "user@mail.com", "A", "R3")
+		assert.NoError(t, err)
+		assert.False(t, exist)
+
+		roles, err := dao.SearchUserRoleTenant(ctx, "user@mail.com", "A", "r")
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"R1", "R2"}, roles)
+		_, err = dao.SearchUserRoleTenant(ctx, "user@mail.com", "B", "r")
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		success, err := dao.DeleteUserTenantRole(ctx, "user@mail.com", "A", "R1")
+		assert.NoError(t, err)
+		assert.True(t, success)
+		_, err = dao.DeleteUserTenantRole(ctx, "user@mail.com", "A", "R1")
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		roles, err = dao.ListUserTenantRole(ctx, "user@mail.com", "A")
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"R2", "ADMIN"}, roles)
+
+		success, err = dao.DeleteUserTenantAllRoles(ctx, "user@mail.com", "A")
+		assert.NoError(t, err)
+		assert.True(t, success)
+		roles, err = dao.ListUserTenantRole(ctx, "user@mail.com", "A")
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(roles))
+		_, err = dao.DeleteUserTenantAllRoles(ctx, "user@mail.com", "B")
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("User tenant roles", func(t *testing.T) {
+		dao := newDAO(t)
+		tenantRoles, err := dao.ListUserTenantRoles(ctx, "user@mail.com")
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(tenantRoles))
+
+		_, err = dao.CreateUserTenantRole(ctx, "user@mail.com", "B", "R1")
+		assert.NoError(t, err)
+		_, err = dao.CreateUserTenantRole(ctx, "user@mail.com", "A", "R2")
+		assert.NoError(t, err)
+		_, err = dao.CreateUserTenantRole(ctx, "user@mail.com", "A", "R1")
+		assert.NoError(t, err)
+		_, err = dao.CreateUserTenant(ctx, "user@mail.com", "C")
+		assert.NoError(t, err)
+		_, err = dao.CreateUserTenantRole(ctx, "other@mail.com", "D", "R1")
+		assert.NoError(t, err)
+
+		tenantRoles, err = dao.ListUserTenantRoles(ctx, "User@Mail.com")
+		assert.NoError(t, err)
+		if assert.Equal(t, 3, len(tenantRoles)) {
+			assert.Equal(t, "A", tenantRoles[0].Tenant)
+			assert.ElementsMatch(t, []string{"R1", "R2"}, tenantRoles[0].Roles)
+			assert.Equal(t, "B", tenantRoles[1].Tenant)
+			assert.Equal(t, []string{"R1"}, tenantRoles[1].Roles)
+			assert.Equal(t, "C", tenantRoles[2].Tenant)
+			assert.Equal(t, 0, len(tenantRoles[2].Roles))
+		}
+		_, err = dao.ListUserTenantRoles(ctx, "")
+		assert.ErrorIs(t, err, ErrArgumentEmpty)
+	})
+
+	t.Run("Authenticate and Refresh", func(t *testing.T) {
+		dao := newDAO(t)
+		_, err := dao.CreateUserAccount(ctx, "user@mail.com", "a password")
+		assert.NoError(t, err)
+		_, err = dao.CreateUserTenantRole(ctx, "user@mail.com", "A", "R1")
+		assert.NoError(t, err)
+
+		_, _, _, err = dao.Authenticate(ctx, "nobody@mail.com", "a password")
+		assert.Error(t, err)
+		_, _, _, err = dao.Authenticate(ctx, "user@mail.com", "wrong password")
+		assert.ErrorIs(t, err, ErrInvalidPassword)
+
+		access, refresh, _, err := dao.Authenticate(ctx, "user@mail.com", "a password")
+		assert.NoError(t, err)
+		claim, err := ParseToken(access, GetPublicKey(), crypto.SigningMethodRS512)
+		assert.NoError(t, err)
+		assert.Equal(t, "user@mail.com", claim.Subscriber)
+		assert.Equal(t, []string{"R1@A"}, claim.Audience)
+
+		newAccess, nextRefresh, err := dao.Refresh(ctx, refresh)
+		assert.NoError(t, err)
+		assert.Empty(t, nextRefresh)
+		claim, err = ParseToken(newAccess, GetPublicKey(), crypto.SigningMethodRS512)
+		assert.NoError(t, err)
+		assert.Equal(t, "user@mail.com", claim.Subscriber)
+
+		_, _, err = dao.Refresh(ctx, access)
+		assert.ErrorIs(t, err, ErrWrongToken)
+	})
+
+	t.Run("VerifyPassphrase and IssueTokens", func(t *testing.T) {
+		dao := newDAO(t)
+		_, err := dao.CreateUserAccount(ctx, "user@mail.com", "a password")
+		assert.NoError(t, err)
+		_, err = dao.CreateUserTenantRole(ctx, "user@mail.com", "A", "R1")
+		assert.NoError(t, err)
+
+		assert.ErrorIs(t, dao.VerifyPassphrase(ctx, "nobody@mail.com", "a password"), ErrInvalidPassword)
+		assert.ErrorIs(t, dao.VerifyPassphrase(ctx, "user@mail.com", "wrong password"), ErrInvalidPassword)
+		assert.NoError(t, dao.VerifyPassphrase(ctx, "USER@mail.com", "a password"))
+
+		access, refresh, err := dao.IssueTokens(ctx, "user@mail.com", nil)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, refresh)
+		claim, err := ParseToken(access, GetPublicKey(), crypto.SigningMethodRS512)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"R1@A"}, claim.Audience)
+		_, _, err = dao.IssueTokens(ctx, "nobody@mail.com", nil)
+		assert.ErrorIs(t, err, ErrAccountDeleted)
+
+		_, err = dao.UpdateUserStatus(ctx, "user@mail.com", UserStatusDisabled)
+		assert.NoError(t, err)
+		assert.ErrorIs(t, dao.VerifyPassphrase(ctx, "user@mail.com", "a password"), ErrAccountDisabled)
+		_, _, err = dao.IssueTokens(ctx, "user@mail.com", nil)
+		assert.ErrorIs(t, err, ErrAccountDisabled)
+	})
+
+	t.Run("Refresh uses current roles", func(t *testing.T) {
+		dao := newDAO(t)
+		_, err := dao.CreateUserAccount(ctx, "user@mail.com", "a password")
+		assert.NoError(t, err)
+		_, err = dao.CreateUserTenantRole(ctx, "user@mail.com", "A", "R1")
+		assert.NoError(t, err)
+		_, refresh, _, err := dao.Authenticate(ctx, "user@mail.com", "a password")
+		assert.NoError(t, err)
+
+		_, err = dao.DeleteUserTenant(ctx, "user@mail.com", "A")
+		assert.NoError(t, err)
+		_, err = dao.CreateUserTenantRole(ctx, "user@mail.com", "B", "R2")
+		assert.NoError(t, err)
+
+		access, _, err := dao.Refresh(ctx, refresh)
+		assert.NoError(t, err)
+		claim, err := ParseToken(access, GetPublicKey(), crypto.SigningMethodRS512)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"R2@B"}, claim.Audience)
+	})
+
+	t.Run("Passphrase history", func(t *testing.T) {
+		configuration.SetConfig("passphrase.history", "3")
+		defer configuration.SetConfig("passphrase.history", "")
+
+		dao := newDAO(t)
+		_, err := dao.CreateUserAccount(ctx, "user@mail.com", "first passphrase")
+		assert.NoError(t, err)
+		success, err := dao.UpdateUserPassphrase(ctx, "user@mail.com", "first passphrase", "first passphrase")
+		assert.ErrorIs(t, err, ErrPassphrasePolicy)
+		assert.False(t, success)
+		success, err = dao.UpdateUserPassphrase(ctx, "user@mail.com", "first passphrase", "second passphrase")
+		assert.NoError(t, err)
+		assert.True(t, success)
+		success, err = dao.SetUserPassphrase(ctx, "USER@mail.com", "third passphrase")
+		assert.NoError(t, err)
+		assert.True(t, success)
+
+		// the last 3 passphrases can not be reused, the older ones can.
+		for _, passphrase := range []string{"first passphrase", "second passphrase", "third passphrase"} {
+			_, err = dao.SetUserPassphrase(ctx, "user@mail.com", passphrase)
+			assert.ErrorIs(t, err, ErrPassphrasePolicy, passphrase)
+		}
+		success, err = dao.UpdateUserPassphrase(ctx, "user@mail.com", "third passphrase", "fourth passphrase")
+		assert.NoError(t, err)
+		assert.True(t, success)
+		success, err = dao.SetUserPassphrase(ctx, "user@mail.com", "first passphrase")
+		assert.NoError(t, err)
+		assert.True(t, success)
+		assert.NoError(t, dao.VerifyPassphrase(ctx, "user@mail.com", "first passphrase"))
+
+		_, err = dao.SetUserPassphrase(ctx, "nobody@mail.com", "a passphrase")
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = dao.SetUserPassphrase(ctx, "user@mail.com", "short")
+		assert.ErrorIs(t, err, ErrPassphrasePolicy)
+
+		// a deleted account does not leave its history behind.
+		_, err = dao.DeleteUserAccount(ctx, "user@mail.com")
+		assert.NoError(t, err)
+		_, err = dao.CreateUserAccount(ctx, "user@mail.com", "another passphrase")
+		assert.NoError(t, err)
+		success, err = dao.SetUserPassphrase(ctx, "user@mail.com", "fourth passphrase")
+		assert.NoError(t, err)
+		assert.True(t, success)
+	})
+
+	t.Run("ExpireUserPassphrase", func(t *testing.T) {
+		dao := newDAO(t)
+		_, err := dao.CreateUserAccount(ctx, "user@mail.com", "a passphrase")
+		assert.NoError(t, err)
+		_, refresh, _, err := dao.Authenticate(ctx, "user@mail.com", "a passphrase")
+		assert.NoError(t, err)
+		success, err := dao.ExpireUserPassphrase(ctx, "user@mail.com")
+		assert.NoError(t, err)
+		assert.True(t, success)
+		_, err = dao.ExpireUserPassphrase(ctx, "nobody@mail.com")
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		// the right passphrase only tells it expired, a wrong one is still wrong.
+		assert.ErrorIs(t, dao.VerifyPassphrase(ctx, "user@mail.com", "a passphrase"), ErrPassphraseExpired)
+		assert.ErrorIs(t, dao.VerifyPassphrase(ctx, "user@mail.com", "wrong passphrase"), ErrInvalidPassword)
+		_, _, _, err = dao.Authenticate(ctx, "user@mail.com", "a passphrase")
+		assert.ErrorIs(t, err, ErrPassphraseExpired)
+		// nor do a passkey sign in or a refresh get around it.
+		_, _, err = dao.IssueTokens(ctx, "user@mail.com", []string{AmrHardwareKey})
+		assert.ErrorIs(t, err, ErrPassphraseExpired)
+		_, _, err = dao.Refresh(ctx, refresh)
+		assert.ErrorIs(t, err, ErrPassphraseExpired)
+
+		success, err = dao.SetUserPassphrase(ctx, "user@mail.com", "new passphrase")
+		assert.NoError(t, err)
+		assert.True(t, success)
+		assert.NoError(t, dao.VerifyPassphrase(ctx, "user@mail.com", "new passphrase"))
+
+		// a passphrase older than passphrase.max.age expires too.
+		configuration.SetConfig("passphrase.max.age", "90 days")
+		defer configuration.SetConfig("passphrase.max.age", "")
+		assert.NoError(t, dao.VerifyPassphrase(ctx, "user@mail.com", "new passphrase"))
+		passphraseClock = func() time.Time { return time.Now().Add(91 * 24 * time.Hour) }
+		defer func() { passphraseClock = time.Now }()
+		assert.ErrorIs(t, dao.VerifyPassphrase(ctx, "user@mail.com", "new passphrase"), ErrPassphraseExpired)
+		_, err = dao.SetUserPassphrase(ctx, "user@mail.com", "newer passphrase")
+		assert.NoError(t, err)
+		assert.NoError(t, dao.VerifyPassphrase(ctx, "user@mail.com", "newer passphrase"))
+	})
+
+	t.Run("UpdateUserStatus", func(t *testing.T) {
+		dao := newDAO(t)
+		_, err := dao.UpdateUserStatus(ctx, "user@mail.com", UserStatusDisabled)
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		_, err = dao.CreateUserAccount(ctx, "user@mail.com", "a password")
+		assert.NoError(t, err)
+		profile, err := dao.GetUserProfile(ctx, "user@mail.com")
+		assert.NoError(t, err)
+		assert.Equal(t, UserStatusActive, profile.Status)
+		_, refresh, _, err := dao.Authenticate(ctx, "user@mail.com", "a password")
+		assert.NoError(t, err)
+
+		success, err := dao.UpdateUserStatus(ctx, "USER@mail.com", UserStatusDisabled)
+		assert.NoError(t, err)
+		assert.True(t, success)
+		profile, err = dao.GetUserProfile(ctx, "user@mail.com")
+		assert.NoError(t, err)
+		assert.Equal(t, UserStatusDisabled, profile.Status)
+
+		_, _, _, err = dao.Authenticate(ctx, "user@mail.com", "a password")
+		assert.ErrorIs(t, err, ErrAccountDisabled)
+		_, _, _, err = dao.Authenticate(ctx, "user@mail.com", "wrong password")
+		assert.ErrorIs(t, err, ErrInvalidPassword)
+		_, _, err = dao.Refresh(ctx, refresh)
+		assert.ErrorIs(t, err, ErrAccountDisabled)
+
+		_, err = dao.UpdateUserStatus(ctx, "user@mail.com", UserStatusActive)
+		assert.NoError(t, err)
+		_, _, err = dao.Refresh(ctx, refresh)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Refresh deleted account", func(t *testing.T) {
+		dao := newDAO(t)
+		_, err := dao.CreateUserAccount(ctx, "user@mail.com", "a password")
+		assert.NoError(t, err)
+		_, refresh, _, err := dao.Authenticate(ctx, "user@mail.com", "a password")
+		assert.NoError(t, err)
+
+		_, err = dao.DeleteUserAccount(ctx, "user@mail.com")
+		assert.NoError(t, err)
+		_, _, err = dao.Refresh(ctx, refresh)
+		assert.ErrorIs(t, err, ErrAccountDeleted)
+	})
+
+	t.Run("Refresh revoked token", func(t *testing.T) {
+		dao := newDAO(t)
+		_, err := dao.CreateUserAccount(ctx, "user@mail.com", "a password")
+		assert.NoError(t, err)
+		_, refresh, _, err := dao.Authenticate(ctx, "user@mail.com", "a password")
+		assert.NoError(t, err)
+		_, otherRefresh, _, err := dao.Authenticate(ctx, "user@mail.com", "a password")
+		assert.NoError(t, err)
+
+		assert.NoError(t, RevokeRefreshToken(ctx, dao.Revocations(), refresh))
+		_, _, err = dao.Refresh(ctx, refresh)
+		assert.ErrorIs(t, err, ErrTokenRevoked)
+		assert.ErrorIs(t, RevokeRefreshToken(ctx, dao.Revocations(), refresh), ErrTokenRevoked)
+
+		_, _, err = dao.Refresh(ctx, otherRefresh)
+		assert.NoError(t, err)
+		assert.NoError(t, RevokeUserTokens(ctx, dao.Revocations(), "USER@mail.com"))
+		_, _, err = dao.Refresh(ctx, otherRefresh)
+		assert.ErrorIs(t, err, ErrTokenRevoked)
+	})
+
+	t.Run("Refresh rotation", func(t *testing.T) {
+		configuration.SetConfig("token.refresh.rotation", "true")
+		defer configuration.SetConfig("token.refresh.rotation", "")
+
+		dao := newDAO(t)
+		_, err := dao.CreateUserAccount(ctx, "user@mail.com", "a password")
+		assert.NoError(t, err)
+		_, refresh1, _, err := dao.Authenticate(ctx, "user@mail.com", "a password")
+		assert.NoError(t, err)
+		_, otherRefresh, _, err := dao.Authenticate(ctx, "user@mail.com", "a password")
+		assert.NoError(t, err)
+
+		_, refresh2, err := dao.Refresh(ctx, refresh1)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, refresh2)
+		_, refresh3, err := dao.Refresh(ctx, refresh2)
+		assert.NoError(t, err)
+		claim1, err := ParseToken(refresh1, GetPublicKey(), crypto.SigningMethodRS512)
+		assert.NoError(t, err)
+		claim3, err := ParseToken(refresh3, GetPublicKey(), crypto.SigningMethodRS512)
+		assert.NoError(t, err)
+		assert.NotEqual(t, claim1.Tokenid, claim3.Tokenid)
+		assert.Equal(t, TokenFamily(claim1), TokenFamily(claim3))
+
+		// reusing a rotated out refresh token revokes the whole family.
+		_, _, err = dao.Refresh(ctx, refresh1)
+		assert.ErrorIs(t, err, ErrTokenRevoked)
+		_, _, err = dao.Refresh(ctx, refresh3)
+		assert.ErrorIs(t, err, ErrTokenRevoked)
+
+		_, _, err = dao.Refresh(ctx, otherRefresh)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Refresh rotation concurrent reuse", func(t *testing.T) {
+		configuration.SetConfig("token.refresh.rotation", "true")
+		defer configuration.SetConfig("token.refresh.rotation", "")
+
+		dao := newDAO(t)
+		_, err := dao.CreateUserAccount(ctx, "user@mail.com", "a password")
+		assert.NoError(t, err)
+		_, refresh, _, err := dao.Authenticate(ctx, "user@mail.com", "a password")
+		assert.NoError(t, err)
+
+		var wg sync.WaitGroup
+		var mutex sync.Mutex
+		rotated := make([]string, 0)
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, next, err := dao.Refresh(ctx, refresh)
+				if err == nil {
+					mutex.Lock()
+					rotated = append(rotated, next)
+					mutex.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Len(t, rotated, 1)
+		for _, next := range rotated {
+			_, _, err = dao.Refresh(ctx, next)
+			assert.ErrorIs(t, err, ErrTokenRevoked)
+		}
+	})
+}
@@ -0,0 +1,534 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/hyperjumptech/jiffy"
+	"github.com/newm4n/dokku-aaa/configuration"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	GrantTypeDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+
+	DeviceStatusPending  DeviceStatus = "pending"
+	DeviceStatusApproved DeviceStatus = "approved"
+	DeviceStatusDenied   DeviceStatus = "denied"
+
+	// userCodeAlphabet has no vowel nor look-alike characters (RFC 8628 section 6.1).
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+	// slowDownStep is added to the polling interval of a client polling too fast (RFC 8628 section 3.5).
+	slowDownStep = 5 * time.Second
+)
+
+var (
+	ErrAuthorizationPending = fmt.Errorf("the user has not yet approved the device")
+	ErrSlowDown             = fmt.Errorf("polling too fast, slow down")
+	ErrDeviceExpired        = fmt.Errorf("device code is expired")
+	ErrAccessDenied         = fmt.Errorf("the user denied the device")
+	ErrInvalidDeviceCode    = fmt.Errorf("device code is invalid or already used")
+	ErrInvalidUserCode      = fmt.Errorf("user code is invalid, expired or already used")
+)
+
+type DeviceStatus string
+
+// DeviceAuthorization is a pending device authorization request (RFC 8628). The device polls the token endpoint
+// using the device code, while the user approves it on the verification page using the user code.
+type DeviceAuthorization struct {
+	DeviceCode string
+	UserCode   string
+	ClientId   string
+	Status     DeviceStatus
+	// Subject is the user approving, or denying, the device. Amr lists the methods it signed in with.
+	Subject string
+	Amr     []string
+	// Interval is the minimum time between two polls of the device.
+	Interval time.Duration
+	LastPoll time.Time
+	ExpireAt time.Time
+}
+
+// DeviceAuthorizationResponse is the device authorization response (RFC 8628 section 3.2).
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationUri         string `json:"verification_uri"`
+	VerificationUriComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+// NewDeviceAuthorization creates the pending device authorization of the client,
+// valid for device.code.age and polled every device.code.interval.
+func NewDeviceAuthorization(clientId string) (*DeviceAuthorization, error) {
+	age, err := jiffy.DurationOf(configuration.Get("device.code.age"))
+	if err != nil {
+		return nil, err
+	}
+	interval, err := jiffy.DurationOf(configuration.Get("device.code.interval"))
+	if err != nil {
+		return nil, err
+	}
+	userCode, err := newUserCode()
+	if err != nil {
+		return nil, err
+	}
+	return &DeviceAuthorization{
+		DeviceCode: randomHex(32),
+		UserCode:   userCode,
+		ClientId:   clientId,
+		Status:     DeviceStatusPending,
+		Interval:   interval,
+		ExpireAt:   time.Now().Add(age),
+	}, nil
+}
+
+// NewDeviceAuthorizationResponse creates the response telling the device where the user should go.
+func NewDeviceAuthorizationResponse(baseUrl string, device *DeviceAuthorization) *DeviceAuthorizationResponse {
+	verificationUri := baseUrl + "/device"
+	return &DeviceAuthorizationResponse{
+		DeviceCode:              device.DeviceCode,
+		UserCode:                device.UserCode,
+		VerificationUri:         verificationUri,
+		VerificationUriComplete: verificationUri + "?" + url.Values{"user_code": {device.UserCode}}.Encode(),
+		ExpiresIn:               int64(time.Until(device.ExpireAt) / time.Second),
+		Interval:                int64(device.Interval / time.Second),
+	}
+}
+
+// newUserCode creates a random user code, like WDJB-MJHT.
+func newUserCode() (string, error) {
+	buff := make([]byte, userCodeLength)
+	max := big.NewInt(int64(len(userCodeAlphabet)))
+	for i := range buff {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		buff[i] = userCodeAlphabet[n.Int64()]
+	}
+	return string(buff[:userCodeLength/2]) + "-" + string(buff[userCodeLength/2:]), nil
+}
+
+// NormalizeUserCode formats the user code as typed by the user, ignoring case, spaces and dashes.
+func NormalizeUserCode(userCode string) string {
+	code := strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(userCode))
+	if len(code) != userCodeLength {
+		return code
+	}
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:]
+}
+
+// DecideDevice records the decision of the signed in user on the pending device authorization of the user code.
+// It returns ErrInvalidUserCode when there is no such pending authorization.
+func DecideDevice(ctx context.Context, devices DeviceCodeStore, userCode, subject string, amr []string, approved bool) (*DeviceAuthorization, error) {
+	device, err := devices.GetDeviceByUserCode(ctx, NormalizeUserCode(userCode))
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrArgumentEmpty) {
+		return nil, ErrInvalidUserCode
+	}
+	if err != nil {
+		return nil, err
+	}
+	if device.Status != DeviceStatusPending || time.Now().After(device.ExpireAt) {
+		return nil, ErrInvalidUserCode
+	}
+	device.Subject = subject
+	device.Amr = amr
+	device.Status = DeviceStatusDenied
+	if approved {
+		device.Status = DeviceStatusApproved
+	}
+	if err := devices.UpdateDevice(ctx, device); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// DeviceCodeToken answers a token request polling with the device code. It returns ErrAuthorizationPending
+// until the user decided, and ErrSlowDown when the device polls faster than its interval.
+// Once approved, the device gets the same access and refresh token the login endpoint issues, only once.
+func DeviceCodeToken(ctx context.Context, dao DataAccess, client *OAuthClient, deviceCode string) (*TokenResponse, error) {
+	devices := dao.DeviceCodes()
+	if len(deviceCode) == 0 {
+		return nil, ErrInvalidDeviceCode
+	}
+	device, err := devices.GetDevice(ctx, deviceCode)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrInvalidDeviceCode
+	}
+	if err != nil {
+		return nil, err
+	}
+	if device.ClientId != client.ClientId {
+		return nil, ErrInvalidDeviceCode
+	}
+	now := time.Now()
+	if now.After(device.ExpireAt) {
+		if _, err := devices.TakeDevice(ctx, deviceCode); err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		return nil, ErrDeviceExpired
+	}
+	// the poll is only recorded while pending, it must not undo a decision the user made meanwhile.
+	// Once decided, the next poll gets the answer.
+	if !device.LastPoll.IsZero() && now.Sub(device.LastPoll) < device.Interval {
+		if err := devices.PollDevice(ctx, deviceCode, now, device.Interval+slowDownStep); err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		return nil, ErrSlowDown
+	}
+	switch device.Status {
+	case DeviceStatusPending:
+		if err := devices.PollDevice(ctx, deviceCode, now, device.Interval); err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		return nil, ErrAuthorizationPending
+	case DeviceStatusDenied:
+		if _, err := devices.TakeDevice(ctx, deviceCode); err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		return nil, ErrAccessDenied
+	}
+	// taking the device decides which poll gets the tokens.
+	device, err = devices.TakeDevice(ctx, deviceCode)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrInvalidDeviceCode
+	}
+	if err != nil {
+		return nil, err
+	}
+	return issueUserTokens(ctx, dao, device.Subject, device.Amr)
+}
+
+// DeviceCodeStore keeps the device authorizations until they are exchanged or expired.
+type DeviceCodeStore interface {
+	SaveDevice(ctx context.Context, device *DeviceAuthorization) error
+	// GetDevice returns ErrNotFound when there is no such device code.
+	GetDevice(ctx context.Context, deviceCode string) (*DeviceAuthorization, error)
+	// GetDeviceByUserCode returns ErrNotFound when there is no such user code.
+	GetDeviceByUserCode(ctx context.Context, userCode string) (*DeviceAuthorization, error)
+	// UpdateDevice replaces the device authorization having the same device code, it returns ErrNotFound when there is none.
+	UpdateDevice(ctx context.Context, device *DeviceAuthorization) error
+	// PollDevice records the last poll and the polling interval of the device authorization, as long as it is pending.
+	// It returns ErrNotFound when there is no such pending device authorization.
+	PollDevice(ctx context.Context, deviceCode string, lastPoll time.Time, interval time.Duration) error
+	// TakeDevice returns and deletes the device authorization, so only one caller may take it.
+	TakeDevice(ctx context.Context, deviceCode string) (*DeviceAuthorization, error)
+}
+
+// MemoryDeviceCodeStore is the in memory DeviceCodeStore, pending device authorizations are lost on restart.
+type MemoryDeviceCodeStore struct {
+	mutex   sync.Mutex
+	devices map[string]*DeviceAuthorization
+	// userCodes maps the user codes to their device code.
+	userCodes map[string]string
+}
+
+func NewMemoryDeviceCodeStore() *MemoryDeviceCodeStore {
+	return &MemoryDeviceCodeStore{
+		devices:   make(map[string]*DeviceAuthorization),
+		userCodes: make(map[string]string),
+	}
+}
+
+func (store *MemoryDeviceCodeStore) SaveDevice(ctx context.Context, device *DeviceAuthorization) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if device == nil || len(device.DeviceCode) == 0 || len(device.UserCode) == 0 {
+		return ErrArgumentEmpty
+	}
+	now := time.Now()
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for deviceCode, data := range store.devices {
+		if now.After(data.ExpireAt) {
+			delete(store.devices, deviceCode)
+			delete(store.userCodes, data.UserCode)
+		}
+	}
+	if _, exist := store.userCodes[device.UserCode]; exist {
+		return ErrFound
+	}
+	if _, exist := store.devices[device.DeviceCode]; exist {
+		return ErrFound
+	}
+	saved := *device
+	store.devices[device.DeviceCode] = &saved
+	store.userCodes[device.UserCode] = device.DeviceCode
+	return nil
+}
+
+func (store *MemoryDeviceCodeStore) GetDevice(ctx context.Context, deviceCode string) (*DeviceAuthorization, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(deviceCode) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	data, exist := store.devices[deviceCode]
+	if !exist {
+		return nil, ErrNotFound
+	}
+	ret := *data
+	return &ret, nil
+}
+
+func (store *MemoryDeviceCodeStore) GetDeviceByUserCode(ctx context.Context, userCode string) (*DeviceAuthorization, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(userCode) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	data, exist := store.devices[store.userCodes[userCode]]
+	if !exist {
+		return nil, ErrNotFound
+	}
+	ret := *data
+	return &ret, nil
+}
+
+func (store *MemoryDeviceCodeStore) UpdateDevice(ctx context.Context, device *DeviceAuthorization) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if device == nil || len(device.DeviceCode) == 0 {
+		return ErrArgumentEmpty
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	data, exist := store.devices[device.DeviceCode]
+	if !exist {
+		return ErrNotFound
+	}
+	saved := *device
+	// the user code can not be changed.
+	saved.UserCode = data.UserCode
+	store.devices[device.DeviceCode] = &saved
+	return nil
+}
+
+func (store *MemoryDeviceCodeStore) PollDevice(ctx context.Context, deviceCode string, lastPoll time.Time, interval time.Duration) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if len(deviceCode) == 0 {
+		return ErrArgumentEmpty
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	data, exist := store.devices[deviceCode]
+	if !exist || data.Status != DeviceStatusPending {
+		return ErrNotFound
+	}
+	data.LastPoll = lastPoll
+	data.Interval = interval
+	return nil
+}
+
+func (store *MemoryDeviceCodeStore) TakeDevice(ctx context.Context, deviceCode string) (*DeviceAuthorization, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(deviceCode) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	data, exist := store.devices[deviceCode]
+	if !exist {
+		return nil, ErrNotFound
+	}
+	delete(store.devices, deviceCode)
+	delete(store.userCodes, data.UserCode)
+	return data, nil
+}
+
+// SqlDeviceCodeStore is the DeviceCodeStore kept in the device_authorization table, for SQLite and PostgreSQL.
+type SqlDeviceCodeStore struct {
+	DB *sql.DB
+}
+
+func NewSqlDeviceCodeStore(db *sql.DB) *SqlDeviceCodeStore {
+	return &SqlDeviceCodeStore{DB: db}
+}
+
+const deviceColumns = `device_code, user_code, client_id, status, subject, interval_seconds, last_poll_at, expire_at, amr`
+
+func (store *SqlDeviceCodeStore) SaveDevice(ctx context.Context, device *DeviceAuthorization) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if device == nil || len(device.DeviceCode) == 0 || len(device.UserCode) == 0 {
+		return ErrArgumentEmpty
+	}
+	if _, err := store.DB.ExecContext(ctx, `DELETE FROM device_authorization WHERE expire_at < $1`, sqlTime(time.Now())); err != nil {
+		return err
+	}
+	result, err := store.DB.ExecContext(ctx, `INSERT INTO device_authorization (`+deviceColumns+`)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT DO NOTHING`,
+		device.DeviceCode, device.UserCode, device.ClientId, string(device.Status), device.Subject,
+		int64(device.Interval/time.Second), sqlTime(device.LastPoll), sqlTime(device.ExpireAt), strings.Join(device.Amr, " "))
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrFound
+	}
+	return nil
+}
+
+func (store *SqlDeviceCodeStore) GetDevice(ctx context.Context, deviceCode string) (*DeviceAuthorization, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(deviceCode) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	return scanDevice(store.DB.QueryRowContext(ctx, `SELECT `+deviceColumns+` FROM device_authorization WHERE device_code = $1`, deviceCode))
+}
+
+func (store *SqlDeviceCodeStore) GetDeviceByUserCode(ctx context.Context, userCode string) (*DeviceAuthorization, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(userCode) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	return scanDevice(store.DB.QueryRowContext(ctx, `SELECT `+deviceColumns+` FROM device_authorization WHERE user_code = $1`, userCode))
+}
+
+func (store *SqlDeviceCodeStore) UpdateDevice(ctx context.Context, device *DeviceAuthorization) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if device == nil || len(device.DeviceCode) == 0 {
+		return ErrArgumentEmpty
+	}
+	result, err := store.DB.ExecContext(ctx, `UPDATE device_authorization SET client_id = $1, status = $2, subject = $3, interval_seconds = $4,
+last_poll_at = $5, expire_at = $6, amr = $7 WHERE device_code = $8`,
+		device.ClientId, string(device.Status), device.Subject, int64(device.Interval/time.Second),
+		sqlTime(device.LastPoll), sqlTime(device.ExpireAt), strings.Join(device.Amr, " "), device.DeviceCode)
+	if err != nil {
+		return err
+	}
+	return expectAffected(result)
+}
+
+func (store *SqlDeviceCodeStore) PollDevice(ctx context.Context, deviceCode string, lastPoll time.Time, interval time.Duration) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if len(deviceCode) == 0 {
+		return ErrArgumentEmpty
+	}
+	result, err := store.DB.ExecContext(ctx, `UPDATE device_authorization SET last_poll_at = $1, interval_seconds = $2
+WHERE device_code = $3 AND status = $4`, sqlTime(lastPoll), int64(interval/time.Second), deviceCode, string(DeviceStatusPending))
+	if err != nil {
+		return err
+	}
+	return expectAffected(result)
+}
+
+func (store *SqlDeviceCodeStore) TakeDevice(ctx context.Context, deviceCode string) (*DeviceAuthorization, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(deviceCode) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	// the delete decides which caller takes the device.
+	return scanDevice(store.DB.QueryRowContext(ctx, `DELETE FROM device_authorization WHERE device_code = $1 RETURNING `+deviceColumns, deviceCode))
+}
+
+func scanDevice(row *sql.Row) (*DeviceAuthorization, error) {
+	device := &DeviceAuthorization{}
+	var status string
+	var interval int64
+	var amr string
+	err := row.Scan(&device.DeviceCode, &device.UserCode, &device.ClientId, &status, &device.Subject, &interval, &device.LastPoll, &device.ExpireAt, &amr)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	device.Status = DeviceStatus(status)
+	device.Interval = time.Duration(interval) * time.Second
+	device.Amr = strings.Fields(amr)
+	if device.LastPoll.Year() <= 1 {
+		device.LastPoll = time.Time{}
+	}
+	return device, nil
+}
+
+// devicePage is the verification page of the device flow. The user signs in, then approves or denies the device.
+var devicePage = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Connect a device</title>
+</head>
+<body>
+<main>
+<h1>Connect a device</h1>
+{{if .Message}}<p role="status">{{.Message}}</p>{{else}}
+{{if .ClientName}}<p>{{.ClientName}} is asking to access your account.</p>{{end}}
+{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+<form method="post" action="device">
+<label>Code shown on your device <input type="text" name="user_code" value="{{.UserCode}}" autocomplete="off" required autofocus></label>
+<label>Email <input type="email" name="email" value="{{.Email}}" autocomplete="username" required></label>
+<label>Passphrase <input type="password" name="passphrase" autocomplete="current-password" required></label>
+<label>Authentication code, when enabled <input type="text" name="otp" autocomplete="one-time-code"></label>
+<button type="submit" name="action" value="approve">Approve</button>
+<button type="submit" name="action" value="deny">Deny</button>
+</form>
+{{end}}
+</main>
+</body>
+</html>
+`))
+
+type devicePageData struct {
+	ClientName string
+	UserCode   string
+	Email      string
+	Error      string
+	// Message replaces the form once the user decided.
+	Message string
+}
+
+// writeDevicePage renders the device verification page. The page must not be framed nor cached.
+func writeDevicePage(response http.ResponseWriter, status int, data *devicePageData) {
+	response.Header().Set("Content-Type", "text/html; charset=utf-8")
+	response.Header().Set("Cache-Control", "no-store")
+	response.Header().Set("X-Frame-Options", "DENY")
+	response.Header().Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+	response.WriteHeader(status)
+	_ = devicePage.Execute(response, data)
+}
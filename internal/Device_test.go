@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func testDeviceCodeStore(t *testing.T, newStore func(t *testing.T) DeviceCodeStore) {
+	ctx := context.Background()
+
+	t.Run("CRUD", func(t *testing.T) {
+		store := newStore(t)
+		device := &DeviceAuthorization{
+			DeviceCode: "device-code",
+			UserCode:   "WDJB-MJHT",
+			ClientId:   "cli",
+			Status:     DeviceStatusPending,
+			Interval:   5 * time.Second,
+			ExpireAt:   time.Now().Add(time.Minute),
+		}
+		assert.NoError(t, store.SaveDevice(ctx, device))
+		assert.ErrorIs(t, store.SaveDevice(ctx, &DeviceAuthorization{DeviceCode: "other-code", UserCode: "WDJB-MJHT", ExpireAt: device.ExpireAt}), ErrFound)
+
+		got, err := store.GetDevice(ctx, "device-code")
+		assert.NoError(t, err)
+		assert.Equal(t, "WDJB-MJHT", got.UserCode)
+		assert.Equal(t, "cli", got.ClientId)
+		assert.Equal(t, DeviceStatusPending, got.Status)
+		assert.Equal(t, 5*time.Second, got.Interval)
+		assert.True(t, got.LastPoll.IsZero())
+		_, err = store.GetDevice(ctx, "unknown")
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		lastPoll := time.Now().Truncate(time.Second)
+		assert.NoError(t, store.PollDevice(ctx, "device-code", lastPoll, 10*time.Second))
+		got, err = store.GetDevice(ctx, "device-code")
+		assert.NoError(t, err)
+		assert.Equal(t, 10*time.Second, got.Interval)
+		assert.True(t, lastPoll.Equal(got.LastPoll))
+		assert.ErrorIs(t, store.PollDevice(ctx, "unknown", lastPoll, 10*time.Second), ErrNotFound)
+
+		got.Status = DeviceStatusApproved
+		got.Subject = "user@mail.com"
+		assert.NoError(t, store.UpdateDevice(ctx, got))
+		// a late poll does not undo the decision.
+		assert.ErrorIs(t, store.PollDevice(ctx, "device-code", lastPoll.Add(time.Second), 15*time.Second), ErrNotFound)
+		got, err = store.GetDeviceByUserCode(ctx, "WDJB-MJHT")
+		assert.NoError(t, err)
+		assert.Equal(t, DeviceStatusApproved, got.Status)
+		assert.Equal(t, "user@mail.com", got.Subject)
+		assert.False(t, got.LastPoll.IsZero())
+		assert.ErrorIs(t, store.UpdateDevice(ctx, &DeviceAuthorization{DeviceCode: "unknown"}), ErrNotFound)
+
+		got, err = store.TakeDevice(ctx, "device-code")
+		assert.NoError(t, err)
+		assert.Equal(t, "user@mail.com", got.Subject)
+		_, err = store.TakeDevice(ctx, "device-code")
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = store.GetDeviceByUserCode(ctx, "WDJB-MJHT")
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+}
+
+func TestMemoryDeviceCodeStore(t *testing.T) {
+	testDeviceCodeStore(t, func(t *testing.T) DeviceCodeStore {
+		return NewMemoryDeviceCodeStore()
+	})
+}
+
+func TestSqlDeviceCodeStore_SQLite(t *testing.T) {
+	testDeviceCodeStore(t, func(t *testing.T) DeviceCodeStore {
+		return newSQLiteDAO(t).DeviceCodes()
+	})
+}
+
+func TestUserCode(t *testing.T) {
+	code, err := newUserCode()
+	assert.NoError(t, err)
+	assert.Regexp(t, regexp.MustCompile(`^[BCDFGHJKLMNPQRSTVWXZ]{4}-[BCDFGHJKLMNPQRSTVWXZ]{4}$`), code)
+	assert.Equal(t, "WDJB-MJHT", NormalizeUserCode("wdjb mjht"))
+	assert.Equal(t, "WDJB-MJHT", NormalizeUserCode("WDJBMJHT"))
+	assert.Equal(t, "ABC", NormalizeUserCode("abc"))
+}
+
+// approveDevice posts the verification page of the device flow.
+func approveDevice(router http.Handler, userCode, passphrase, action string) int {
+	form := url.Values{"user_code": {userCode}, "email": {"user@mail.com"}, "passphrase": {passphrase}, "action": {action}}
+	request := newRequest(http.MethodPost, "/device", form.Encode())
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return serve(router, request).Code
+}
+
+// pollDevice polls the token endpoint, it returns the token or the OAuth error code.
+func pollDevice(t *testing.T, router http.Handler, deviceCode string) (*TokenResponse, string) {
+	resp := serve(router, newTokenRequest(url.Values{"grant_type": {GrantTypeDeviceCode}, "client_id": {"cli"}, "device_code": {deviceCode}}))
+	if resp.Code == http.StatusOK {
+		token := &TokenResponse{}
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), token))
+		return token, ""
+	}
+	oerr := &OAuthError{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), oerr))
+	return nil, oerr.Code
+}
+
+// allowPoll moves the last poll of the device back, as if the device waited for its interval.
+func allowPoll(t *testing.T, dao DataAccess, deviceCode string) {
+	device, err := dao.DeviceCodes().GetDevice(context.Background(), deviceCode)
+	assert.NoError(t, err)
+	device.LastPoll = device.LastPoll.Add(-device.Interval)
+	assert.NoError(t, dao.DeviceCodes().UpdateDevice(context.Background(), device))
+}
+
+func TestTheHandler_DeviceCode(t *testing.T) {
+	dao := NewMemoryDAO()
+	router := mux.NewRouter()
+	initRoutes(router, &TheHandler{DAO: dao})
+	resp := serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/create-user",
+		`{"Email":"user@mail.com","Passphrase":"a passphrase","TenantRole":["viewer@ACME"]}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/client",
+		`{"ClientId":"cli","Name":"Deploy CLI","Public":true,"RedirectUri":["http://127.0.0.1/callback"]}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	request := newRequest(http.MethodPost, "/device/code", url.Values{"client_id": {"unknown"}}.Encode())
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp = serve(router, request)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	request = newRequest(http.MethodPost, "/device/code", url.Values{"client_id": {"cli"}}.Encode())
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Host = "aaa.domain.com"
+	resp = serve(router, request)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	device := &DeviceAuthorizationResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), device))
+	assert.NotEmpty(t, device.DeviceCode)
+	assert.Equal(t, "http://aaa.domain.com/device", device.VerificationUri)
+	assert.Equal(t, "http://aaa.domain.com/device?user_code="+device.UserCode, device.VerificationUriComplete)
+	assert.Equal(t, int64(5), device.Interval)
+	assert.InDelta(t, 600, device.ExpiresIn, 2)
+
+	_, code := pollDevice(t, router, device.DeviceCode)
+	assert.Equal(t, "authorization_pending", code)
+	_, code = pollDevice(t, router, device.DeviceCode)
+	assert.Equal(t, "slow_down", code)
+	stored, err := dao.DeviceCodes().GetDevice(context.Background(), device.DeviceCode)
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Second, stored.Interval)
+
+	resp = serve(router, newRequest(http.MethodGet, "/device?"+url.Values{"user_code": {device.UserCode}}.Encode(), ""))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), "Deploy CLI")
+	assert.Equal(t, "DENY", resp.Header().Get("X-Frame-Options"))
+
+	assert.Equal(t, http.StatusUnauthorized, approveDevice(router, device.UserCode, "wrong passphrase", "approve"))
+	assert.Equal(t, http.StatusBadRequest, approveDevice(router, "BCDF-GHJK", "a passphrase", "approve"))
+	allowPoll(t, dao, device.DeviceCode)
+	_, code = pollDevice(t, router, device.DeviceCode)
+	assert.Equal(t, "authorization_pending", code)
+
+	// the user code is accepted the way the user types it.
+	assert.Equal(t, http.StatusOK, approveDevice(router, " "+device.UserCode[:4]+device.UserCode[5:], "a passphrase", "approve"))
+	assert.Equal(t, http.StatusBadRequest, approveDevice(router, device.UserCode, "a passphrase", "deny"))
+	allowPoll(t, dao, device.DeviceCode)
+	token, code := pollDevice(t, router, device.DeviceCode)
+	assert.Empty(t, code)
+	if assert.NotNil(t, token) {
+		assert.NotEmpty(t, token.RefreshToken)
+		claim, err := VerifyToken(token.AccessToken)
+		assert.NoError(t, err)
+		assert.Equal(t, "user@mail.com", claim.Subscriber)
+		assert.Equal(t, []string{"viewer@ACME"}, claim.Audience)
+	}
+	_, code = pollDevice(t, router, device.DeviceCode)
+	assert.Equal(t, "invalid_grant", code)
+
+	// denied and expired devices.
+	denied, err := NewDeviceAuthorization("cli")
+	assert.NoError(t, err)
+	assert.NoError(t, dao.DeviceCodes().SaveDevice(context.Background(), denied))
+	assert.Equal(t, http.StatusOK, approveDevice(router, denied.UserCode, "a passphrase", "deny"))
+	_, code = pollDevice(t, router, denied.DeviceCode)
+	assert.Equal(t, "access_denied", code)
+
+	expired, err := NewDeviceAuthorization("cli")
+	assert.NoError(t, err)
+	assert.NoError(t, dao.DeviceCodes().SaveDevice(context.Background(), expired))
+	expired.ExpireAt = time.Now().Add(-time.Second)
+	assert.NoError(t, dao.DeviceCodes().UpdateDevice(context.Background(), expired))
+	_, code = pollDevice(t, router, expired.DeviceCode)
+	assert.Equal(t, "expired_token", code)
+}
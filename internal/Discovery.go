@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"github.com/newm4n/dokku-aaa/configuration"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// OpenIdConfiguration is the OpenID Connect discovery document served at /.well-known/openid-configuration.
+// The login, refresh and logout endpoints are this server's own JSON API, listed as extension members.
+type OpenIdConfiguration struct {
+	Issuer                                    string   `json:"issuer"`
+	JwksUri                                   string   `json:"jwks_uri"`
+	AuthorizationEndpoint                     string   `json:"authorization_endpoint"`
+	DeviceAuthorizationEndpoint               string   `json:"device_authorization_endpoint"`
+	UserinfoEndpoint                          string   `json:"userinfo_endpoint"`
+	TokenEndpoint                             string   `json:"token_endpoint"`
+	TokenEndpointAuthMethodsSupported         []string `json:"token_endpoint_auth_methods_supported"`
+	GrantTypesSupported                       []string `json:"grant_types_supported"`
+	IntrospectionEndpoint                     string   `json:"introspection_endpoint"`
+	IntrospectionEndpointAuthMethodsSupported []string `json:"introspection_endpoint_auth_methods_supported"`
+	LoginEndpoint                             string   `json:"login_endpoint"`
+	RefreshEndpoint                           string   `json:"refresh_endpoint"`
+	LogoutEndpoint                            string   `json:"logout_endpoint"`
+	ResponseTypesSupported                    []string `json:"response_types_supported"`
+	CodeChallengeMethodsSupported             []string `json:"code_challenge_methods_supported"`
+	SubjectTypesSupported                     []string `json:"subject_types_supported"`
+	IdTokenSigningAlgValuesSupported          []string `json:"id_token_signing_alg_values_supported"`
+	ClaimsSupported                           []string `json:"claims_supported"`
+}
+
+// UserInfo is the /userinfo response, the profile of the access token subject with its tenant roles.
+type UserInfo struct {
+	Subject     string         `json:"sub"`
+	Email       string         `json:"email"`
+	Name        string         `json:"name,omitempty"`
+	TenantRoles []*TenantRoles `json:"tenant_roles"`
+}
+
+// NewOpenIdConfiguration creates the discovery document of the server reachable at baseUrl.
+// The signing algorithms are the ones of the keys still verifying tokens, the active key first.
+func NewOpenIdConfiguration(baseUrl string, ring *Keyring) *OpenIdConfiguration {
+	algs := make([]string, 0)
+	for _, key := range ring.VerificationKeys() {
+		if !slices.Contains(algs, key.Alg) {
+			algs = append(algs, key.Alg)
+		}
+	}
+	return &OpenIdConfiguration{
+		Issuer:                            configuration.Get("token.issuer"),
+		JwksUri:                           baseUrl + "/.well-known/jwks.json",
+		AuthorizationEndpoint:             baseUrl + "/authorize",
+		DeviceAuthorizationEndpoint:       baseUrl + "/device/code",
+		UserinfoEndpoint:                  baseUrl + "/userinfo",
+		TokenEndpoint:                     baseUrl + "/oauth/token",
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		GrantTypesSupported:               []string{GrantTypeAuthorizationCode, GrantTypeClientCredentials, GrantTypeDeviceCode, GrantTypeTokenExchange},
+		IntrospectionEndpoint:             baseUrl + "/introspect",
+		IntrospectionEndpointAuthMethodsSupported: []string{"client_secret_basic"},
+		LoginEndpoint:                    baseUrl + "/login",
+		RefreshEndpoint:                  baseUrl + "/refresh",
+		LogoutEndpoint:                   baseUrl + "/logout",
+		ResponseTypesSupported:           []string{"code"},
+		CodeChallengeMethodsSupported:    []string{CodeChallengeS256},
+		SubjectTypesSupported:            []string{"public"},
+		IdTokenSigningAlgValuesSupported: algs,
+		ClaimsSupported:                  []string{"sub", "iss", "aud", "exp", "iat", "nbf", "jti", "email", "name", "tenant_roles"},
+	}
+}
+
+// ServerUrlConfigured tells whether server.url is set, otherwise the public URLs are built from the request headers.
+func ServerUrlConfigured() bool {
+	return len(configuration.Get("server.url")) > 0
+}
+
+// PublicBaseUrl returns server.url, or when it is not set, the scheme and host the request was sent to.
+func PublicBaseUrl(request *http.Request) string {
+	if baseUrl := configuration.Get("server.url"); len(baseUrl) > 0 {
+		return strings.TrimSuffix(baseUrl, "/")
+	}
+	scheme := "http"
+	if request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := request.Header.Get("X-Forwarded-Proto"); len(proto) > 0 {
+		scheme = proto
+	}
+	return scheme + "://" + request.Host
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"encoding/json"
+	"github.com/newm4n/dokku-aaa/configuration"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestTheHandler_OpenIdConfiguration(t *testing.T) {
+	router := newTestRouter()
+
+	request := newRequest(http.MethodGet, "/.well-known/openid-configuration", "")
+	request.Host = "aaa.domain.com"
+	request.Header.Set("X-Forwarded-Proto", "https")
+	resp := serve(router, request)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	discovery := &OpenIdConfiguration{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), discovery))
+	assert.Equal(t, configuration.Get("token.issuer"), discovery.Issuer)
+	assert.Equal(t, "https://aaa.domain.com/.well-known/jwks.json", discovery.JwksUri)
+	assert.Equal(t, "https://aaa.domain.com/userinfo", discovery.UserinfoEndpoint)
+	assert.Equal(t, "https://aaa.domain.com/authorize", discovery.AuthorizationEndpoint)
+	assert.Equal(t, []string{"S256"}, discovery.CodeChallengeMethodsSupported)
+	assert.Equal(t, "https://aaa.domain.com/device/code", discovery.DeviceAuthorizationEndpoint)
+	assert.Equal(t, []string{"RS512"}, discovery.IdTokenSigningAlgValuesSupported)
+	assert.Equal(t, "no-store", resp.Header().Get("Cache-Control"))
+
+	configuration.SetConfig("server.url", "https://login.domain.com/")
+	defer configuration.SetConfig("server.url", "")
+	resp = serve(router, newRequest(http.MethodGet, "/.well-known/openid-configuration", ""))
+	assert.Equal(t, "public, max-age=3600", resp.Header().Get("Cache-Control"))
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), discovery))
+	assert.Equal(t, "https://login.domain.com/introspect", discovery.IntrospectionEndpoint)
+}
+
+func TestTheHandler_UserInfo(t *testing.T) {
+	router := newTestRouter()
+	resp := serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/create-user",
+		`{"FullName":"Some User","Email":"user@mail.com","Passphrase":"a passphrase","TenantRole":["admin,viewer@ACME"]}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/role/BETA/user@mail.com", `{"Roles":["viewer"]}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	resp = serve(router, newRequest(http.MethodPost, "/login", `{"Email":"user@mail.com","Passphrase":"a passphrase"}`))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	login := &AuthenticateResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), login))
+
+	resp = serve(router, newRequest(http.MethodGet, "/userinfo", ""))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.Contains(t, resp.Header().Get("WWW-Authenticate"), "Bearer")
+
+	request := newRequest(http.MethodGet, "/userinfo", "")
+	request.Header.Set("Authorization", "Bearer "+login.Refresh)
+	resp = serve(router, request)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	request = newRequest(http.MethodGet, "/userinfo", "")
+	request.Header.Set("Authorization", "Bearer "+login.Access)
+	resp = serve(router, request)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	info := &UserInfo{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), info))
+	assert.Equal(t, "user@mail.com", info.Subject)
+	assert.Equal(t, "Some User", info.Name)
+	if assert.Equal(t, 2, len(info.TenantRoles)) {
+		assert.Equal(t, &TenantRoles{Tenant: "ACME", Roles: []string{"admin", "viewer"}}, info.TenantRoles[0])
+		assert.Equal(t, &TenantRoles{Tenant: "BETA", Roles: []string{"viewer"}}, info.TenantRoles[1])
+	}
+
+	resp = serve(router, asRoot(newRequest(http.MethodPut, "/user/ACME/user@mail.com/status", `{"Status":"disabled"}`)))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	request = newRequest(http.MethodPost, "/userinfo", "")
+	request.Header.Set("Authorization", "Bearer "+login.Access)
+	resp = serve(router, request)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	// deleting the account revokes its tokens.
+	resp = serve(router, asRoot(newRequest(http.MethodDelete, "/user/ACME/user@mail.com", "")))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	request = newRequest(http.MethodGet, "/userinfo", "")
+	request.Header.Set("Authorization", "Bearer "+login.Access)
+	resp = serve(router, request)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Contains(t, resp.Body.String(), ErrTokenRevoked.Error())
+}
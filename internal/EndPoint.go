@@ -1,90 +1,258 @@
 package internal
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	common "github.com/newm4n/dokku-common"
+	"github.com/newm4n/dokku-common/security"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func InitRouter(r *mux.Router) {
-
-	r.Use(common.UserTokenContextMiddleware)
-
+	// fail the startup, not the first token, when the signing key or its algorithm is wrong.
+	GetKeyring()
+	dao, err := NewDataAccess(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	bootstrap, err := NewBootstrap(context.Background(), dao)
+	if err != nil {
+		panic(err)
+	}
 	aaa := &TheHandler{
-		DAO: &MemoryDAO{
-			UserAccountList:    make([]*UserAccount, 0),
-			UserTenantRoleList: make([]*UserTenantRoles, 0),
-		},
+		DAO:       dao,
+		Bootstrap: bootstrap,
 	}
+	initRoutes(r, aaa)
+}
+
+func initRoutes(r *mux.Router, aaa *TheHandler) {
+	r.Use(aaa.UserTokenContextMiddleware)
 
+	r.HandleFunc("/.well-known/jwks.json", aaa.Jwks).Methods(http.MethodGet)
+	r.HandleFunc("/.well-known/openid-configuration", aaa.OpenIdConfiguration).Methods(http.MethodGet)
+	r.HandleFunc("/userinfo", aaa.UserInfo).Methods(http.MethodGet, http.MethodPost)
+	r.HandleFunc("/keys/rotate", aaa.RotateKey).Methods(http.MethodPost)
+	r.HandleFunc("/bootstrap", aaa.BootstrapRoot).Methods(http.MethodPost)
 	r.HandleFunc("/login", aaa.Authenticate).Methods(http.MethodPost)
+	r.HandleFunc("/login/mfa", aaa.AuthenticateMFA).Methods(http.MethodPost)
+	r.HandleFunc("/login/passphrase", aaa.ChangeExpiredPassphrase).Methods(http.MethodPost)
+	r.HandleFunc("/mfa/totp", aaa.EnrolTOTP).Methods(http.MethodPost)
+	r.HandleFunc("/mfa/totp/confirm", aaa.ConfirmTOTP).Methods(http.MethodPost)
+	r.HandleFunc("/mfa/totp", aaa.DisableTOTP).Methods(http.MethodDelete)
+	r.HandleFunc("/webauthn/register/begin", aaa.BeginWebAuthnRegistration).Methods(http.MethodPost)
+	r.HandleFunc("/webauthn/register/finish", aaa.FinishWebAuthnRegistration).Methods(http.MethodPost)
+	r.HandleFunc("/webauthn/login/begin", aaa.BeginWebAuthnLogin).Methods(http.MethodPost)
+	r.HandleFunc("/webauthn/login/finish", aaa.FinishWebAuthnLogin).Methods(http.MethodPost)
+	r.HandleFunc("/webauthn/credentials", aaa.ListWebAuthnCredentials).Methods(http.MethodGet)
+	r.HandleFunc("/webauthn/credentials/{id}", aaa.DeleteWebAuthnCredential).Methods(http.MethodDelete)
 	r.HandleFunc("/refresh", aaa.Refresh).Methods(http.MethodPost)
+	r.HandleFunc("/logout", aaa.Logout).Methods(http.MethodPost)
+	r.HandleFunc("/introspect", aaa.Introspect).Methods(http.MethodPost)
+	r.HandleFunc("/oauth/token", aaa.Token).Methods(http.MethodPost)
+	r.HandleFunc("/authorize", aaa.AuthorizeForm).Methods(http.MethodGet)
+	r.HandleFunc("/authorize", aaa.Authorize).Methods(http.MethodPost)
+	r.HandleFunc("/device/code", aaa.DeviceAuthorization).Methods(http.MethodPost)
+	r.HandleFunc("/device", aaa.DeviceForm).Methods(http.MethodGet)
+	r.HandleFunc("/device", aaa.DeviceVerify).Methods(http.MethodPost)
 
+	r.HandleFunc("/client", aaa.CreateClient).Methods(http.MethodPost)
+	r.HandleFunc("/client", aaa.ListClient).Methods(http.MethodGet)
+	r.HandleFunc("/client/{client}", aaa.GetClient).Methods(http.MethodGet)
+	r.HandleFunc("/client/{client}", aaa.UpdateClient).Methods(http.MethodPut)
+	r.HandleFunc("/client/{client}/secret", aaa.ResetClientSecret).Methods(http.MethodPost)
+	r.HandleFunc("/client/{client}", aaa.DeleteClient).Methods(http.MethodDelete)
+
+	// search route must be registered before /tenant/{tenant}, otherwise "s" is taken as tenant name.
+	r.HandleFunc("/tenant/s", aaa.SearchTenant).Methods(http.MethodGet)
 	r.HandleFunc("/tenant", aaa.CreateTenant).Methods(http.MethodPost)
 	r.HandleFunc("/tenant/{oldtenant}/{newtenant}", aaa.ChangeTenant).Methods(http.MethodPost)
 	r.HandleFunc("/tenant/{tenant}", aaa.DeleteTenant).Methods(http.MethodDelete)
 	r.HandleFunc("/tenant", aaa.DeleteAllTenant).Methods(http.MethodDelete)
 	r.HandleFunc("/tenant/{tenant}", aaa.GetTenant).Methods(http.MethodGet)
 	r.HandleFunc("/tenant", aaa.GetAllTenant).Methods(http.MethodGet)
-	r.HandleFunc("/tenant/s", aaa.SearchTenant).Methods(http.MethodGet)
 
+	r.HandleFunc("/user/{tenant}/s", aaa.SearchUser).Methods(http.MethodGet)
 	r.HandleFunc("/user/{tenant}/create-user", aaa.CreateUser).Methods(http.MethodPost)
 	r.HandleFunc("/user/{tenant}/{user}", aaa.ChangeUserPassword).Methods(http.MethodPut)
+	r.HandleFunc("/user/{tenant}/{user}/status", aaa.ChangeUserStatus).Methods(http.MethodPut)
+	r.HandleFunc("/user/{tenant}/{user}/revoke", aaa.RevokeUserTokens).Methods(http.MethodPost)
+	r.HandleFunc("/user/{tenant}/{user}/mfa", aaa.ResetUserMFA).Methods(http.MethodDelete)
+	r.HandleFunc("/user/{tenant}/{user}/unlock", aaa.UnlockUser).Methods(http.MethodPost)
+	r.HandleFunc("/user/{tenant}/{user}/expire-passphrase", aaa.ExpireUserPassphrase).Methods(http.MethodPost)
 	r.HandleFunc("/user/{tenant}/{user}", aaa.DeleteUser).Methods(http.MethodDelete)
 	r.HandleFunc("/user/{tenant}/{user}", aaa.GetUser).Methods(http.MethodGet)
-	r.HandleFunc("/user/{tenant}/s", aaa.SearchUser).Methods(http.MethodGet)
 
+	r.HandleFunc("/role/{tenant}/{user}/s", aaa.UserTenantSearchRole).Methods(http.MethodGet)
 	r.HandleFunc("/role/{tenant}/{user}", aaa.UserTenantCreateRole).Methods(http.MethodPost)
 	r.HandleFunc("/role/{tenant}/{user}/{role}", aaa.UserTenantDeleteRole).Methods(http.MethodDelete)
 	r.HandleFunc("/role/{tenant}/{user}", aaa.UserTenantDeleteAllRole).Methods(http.MethodDelete)
 	r.HandleFunc("/role/{tenant}/{user}/{role}", aaa.UserTenantGetRole).Methods(http.MethodGet)
-	r.HandleFunc("/role/{tenant}/{user}/s", aaa.UserTenantSearchRole).Methods(http.MethodGet)
 }
 
 type TheHandler struct {
-	DAO DataAccess
+	DAO       DataAccess
+	Bootstrap *Bootstrap
 }
 
-func (hdler *TheHandler) Authenticate(response http.ResponseWriter, request *http.Request) {
-	if request.Body == nil {
-		common.WriteHttpResponse(response, http.StatusBadRequest, nil, []byte("missing request body"))
+/*
+r.HandleFunc("/.well-known/jwks.json", aaa.Jwks).Methods(http.MethodGet)
+*/
+func (hdler *TheHandler) Jwks(response http.ResponseWriter, request *http.Request) {
+	jwks, err := PublicJsonWebKeySet(GetKeyring())
+	if err != nil {
+		writeTextResponse(response, http.StatusInternalServerError, err.Error())
 		return
 	}
-	bodyBytes, err := io.ReadAll(request.Body)
+	respBytes, err := json.Marshal(jwks)
 	if err != nil {
-		common.WriteHttpResponse(response, http.StatusBadRequest, nil, []byte(fmt.Sprintf("err got %s", err.Error())))
+		writeTextResponse(response, http.StatusInternalServerError, fmt.Sprintf("error while generating response. got %s", err.Error()))
 		return
 	}
-	loginRequest := &AuthenticateRequest{}
-	err = json.Unmarshal(bodyBytes, &loginRequest)
+	common.WriteHttpResponse(response, http.StatusOK, map[string][]string{
+		"Content-Type":  {"application/json"},
+		"Cache-Control": {"public, max-age=3600"},
+	}, respBytes)
+}
+
+/*
+r.HandleFunc("/.well-known/openid-configuration", aaa.OpenIdConfiguration).Methods(http.MethodGet)
+*/
+func (hdler *TheHandler) OpenIdConfiguration(response http.ResponseWriter, request *http.Request) {
+	respBytes, err := json.Marshal(NewOpenIdConfiguration(PublicBaseUrl(request), GetKeyring()))
 	if err != nil {
-		common.WriteHttpResponse(response, http.StatusBadRequest, nil, []byte(fmt.Sprintf("canot parse body. got %s", err.Error())))
+		writeTextResponse(response, http.StatusInternalServerError, fmt.Sprintf("error while generating response. got %s", err.Error()))
+		return
+	}
+	// URLs built from the request headers must not be served to anyone else by a shared cache.
+	cacheControl := "public, max-age=3600"
+	if !ServerUrlConfigured() {
+		cacheControl = "no-store"
+	}
+	common.WriteHttpResponse(response, http.StatusOK, map[string][]string{
+		"Content-Type":  {"application/json"},
+		"Cache-Control": {cacheControl},
+	}, respBytes)
+}
+
+/*
+r.HandleFunc("/userinfo", aaa.UserInfo).Methods(http.MethodGet, http.MethodPost)
+*/
+func (hdler *TheHandler) UserInfo(response http.ResponseWriter, request *http.Request) {
+	claim, ok := request.Context().Value(common.UserClaim).(*security.GoClaim)
+	if !ok {
+		writeBearerUnauthorized(response, "missing bearer access token")
+		return
+	}
+	ctx := request.Context()
+	profile, err := hdler.DAO.GetUserProfile(ctx, claim.Subscriber)
+	if errors.Is(err, ErrNotFound) {
+		writeBearerUnauthorized(response, ErrAccountDeleted.Error())
 		return
 	}
-	at, rt, err := hdler.DAO.Authenticate(request.Context(), loginRequest.Email, loginRequest.Passphrase)
 	if err != nil {
-		common.WriteHttpResponse(response, http.StatusUnauthorized, nil, []byte(fmt.Sprintf("unauthorized. got %s", err.Error())))
+		writeDataAccessError(response, err)
+		return
+	}
+	if profile.Status == UserStatusDisabled {
+		writeTextResponse(response, http.StatusForbidden, ErrAccountDisabled.Error())
+		return
+	}
+	tenantRoles, err := hdler.DAO.ListUserTenantRoles(ctx, profile.Email)
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	respBytes, err := json.Marshal(&UserInfo{
+		Subject:     claim.Subscriber,
+		Email:       profile.Email,
+		Name:        profile.FullName,
+		TenantRoles: tenantRoles,
+	})
+	if err != nil {
+		writeTextResponse(response, http.StatusInternalServerError, fmt.Sprintf("error while generating response. got %s", err.Error()))
 		return
 	}
+	common.WriteHttpResponse(response, http.StatusOK, map[string][]string{
+		"Content-Type":  {"application/json"},
+		"Cache-Control": {"no-store"},
+	}, respBytes)
+}
 
-	authResp := &AuthenticateResponse{
-		Access:  at,
-		Refresh: rt,
+/*
+r.HandleFunc("/keys/rotate", aaa.RotateKey).Methods(http.MethodPost)
+*/
+func (hdler *TheHandler) RotateKey(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	next, err := LoadSigningKey()
+	if err != nil {
+		writeTextResponse(response, http.StatusInternalServerError, fmt.Sprintf("can not load the signing key. got %s", err.Error()))
+		return
+	}
+	ring := GetKeyring()
+	if err := ring.Rotate(next); err != nil {
+		if errors.Is(err, ErrKeyUnchanged) {
+			writeTextResponse(response, http.StatusConflict, err.Error())
+			return
+		}
+		writeTextResponse(response, http.StatusInternalServerError, err.Error())
+		return
+	}
+	jwks, err := PublicJsonWebKeySet(ring)
+	if err != nil {
+		writeTextResponse(response, http.StatusInternalServerError, err.Error())
+		return
 	}
+	writeJsonResponse(response, http.StatusOK, jwks)
+}
 
-	respOk, err := json.Marshal(authResp)
+/*
+r.HandleFunc("/bootstrap", aaa.BootstrapRoot).Methods(http.MethodPost)
+*/
+func (hdler *TheHandler) BootstrapRoot(response http.ResponseWriter, request *http.Request) {
+	if hdler.Bootstrap == nil {
+		writeTextResponse(response, http.StatusGone, ErrBootstrapDone.Error())
+		return
+	}
+	bootstrapRequest := &BootstrapRequest{}
+	if !readJsonRequest(response, request, bootstrapRequest) {
+		return
+	}
+	ctx := request.Context()
+	err := hdler.Bootstrap.CreateRoot(ctx, bootstrapRequest.Token, bootstrapRequest.Email, bootstrapRequest.Passphrase, bootstrapRequest.FullName)
+	switch {
+	case errors.Is(err, ErrBootstrapDone):
+		writeTextResponse(response, http.StatusGone, err.Error())
+		return
+	case errors.Is(err, ErrBootstrapInvalidToken):
+		writeTextResponse(response, http.StatusForbidden, err.Error())
+		return
+	case err != nil:
+		writeDataAccessError(response, err)
+		return
+	}
+	user, err := hdler.getTenantUser(ctx, bootstrapRequest.Email, ReservedTenant)
 	if err != nil {
-		common.WriteHttpResponse(response, http.StatusInternalServerError, nil, []byte(fmt.Sprintf("error while generating response. got %s", err.Error())))
+		writeDataAccessError(response, err)
 		return
 	}
-	common.WriteHttpResponse(response, http.StatusOK, map[string][]string{"Content-Type": {"application/json"}}, respOk)
+	writeJsonResponse(response, http.StatusCreated, user)
 }
 
-func (hdler *TheHandler) Refresh(response http.ResponseWriter, request *http.Request) {
+func (hdler *TheHandler) Authenticate(response http.ResponseWriter, request *http.Request) {
 	if request.Body == nil {
 		common.WriteHttpResponse(response, http.StatusBadRequest, nil, []byte("missing request body"))
 		return
@@ -94,24 +262,47 @@ func (hdler *TheHandler) Refresh(response http.ResponseWriter, request *http.Req
 		common.WriteHttpResponse(response, http.StatusBadRequest, nil, []byte(fmt.Sprintf("err got %s", err.Error())))
 		return
 	}
-	refreshRequest := &RefreshRequest{}
-	err = json.Unmarshal(bodyBytes, &refreshRequest)
+	loginRequest := &AuthenticateRequest{}
+	err = json.Unmarshal(bodyBytes, &loginRequest)
 	if err != nil {
 		common.WriteHttpResponse(response, http.StatusBadRequest, nil, []byte(fmt.Sprintf("canot parse body. got %s", err.Error())))
 		return
 	}
-
-	at, err := hdler.DAO.Refresh(request.Context(), refreshRequest.Refresh)
+	if seconds := hdler.loginRetryAfter(response, request, loginRequest.Email); seconds > 0 {
+		common.WriteHttpResponse(response, http.StatusTooManyRequests, nil, []byte(tooManyAttemptsMessage(seconds)))
+		return
+	}
+	at, rt, mt, err := hdler.DAO.Authenticate(request.Context(), loginRequest.Email, loginRequest.Passphrase)
+	if errors.Is(err, ErrPassphraseExpired) {
+		// the passphrase is right, but only lets the user change it.
+		hdler.loginSucceeded(request, loginRequest.Email)
+		changeToken, err := CreatePassphraseChangeToken(loginRequest.Email)
+		if err != nil {
+			writeTextResponse(response, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJsonResponse(response, http.StatusOK, &AuthenticateResponse{PassphraseChangeToken: changeToken})
+		return
+	}
 	if err != nil {
+		if !errors.Is(err, ErrAccountDisabled) {
+			hdler.loginFailed(request, loginRequest.Email)
+		}
 		common.WriteHttpResponse(response, http.StatusUnauthorized, nil, []byte(fmt.Sprintf("unauthorized. got %s", err.Error())))
 		return
 	}
+	// with a second factor, the sign in only succeeds once the code is verified too.
+	if len(mt) == 0 {
+		hdler.loginSucceeded(request, loginRequest.Email)
+	}
 
-	refResp := &RefreshResponse{
-		Access: at,
+	authResp := &AuthenticateResponse{
+		Access:   at,
+		Refresh:  rt,
+		MFAToken: mt,
 	}
 
-	respOk, err := json.Marshal(refResp)
+	respOk, err := json.Marshal(authResp)
 	if err != nil {
 		common.WriteHttpResponse(response, http.StatusInternalServerError, nil, []byte(fmt.Sprintf("error while generating response. got %s", err.Error())))
 		return
@@ -119,170 +310,1739 @@ func (hdler *TheHandler) Refresh(response http.ResponseWriter, request *http.Req
 	common.WriteHttpResponse(response, http.StatusOK, map[string][]string{"Content-Type": {"application/json"}}, respOk)
 }
 
-type CreateTenantRequest struct {
-}
-type CreateTenantResponse struct {
-}
-
-func (hdler *TheHandler) CreateTenant(response http.ResponseWriter, request *http.Request) {
-	if common.RequestMayThrough(request, "*", "root") {
-		common.WriteHttpResponse(response, http.StatusNotImplemented, map[string][]string{"Content-Type": {"text/plain"}}, []byte("not yet implemented"))
-	} else {
-		common.WriteHttpResponse(response, http.StatusForbidden, map[string][]string{"Content-Type": {"text/plain"}}, []byte("you're provided token is insufficient"))
+/*
+r.HandleFunc("/login/mfa", aaa.AuthenticateMFA).Methods(http.MethodPost)
+*/
+func (hdler *TheHandler) AuthenticateMFA(response http.ResponseWriter, request *http.Request) {
+	mfaRequest := &MFALoginRequest{}
+	if !readJsonRequest(response, request, mfaRequest) {
+		return
+	}
+	email := MFATokenSubject(mfaRequest.MFAToken)
+	if seconds := hdler.loginRetryAfter(response, request, email); seconds > 0 {
+		writeTextResponse(response, http.StatusTooManyRequests, tooManyAttemptsMessage(seconds))
+		return
+	}
+	at, rt, err := VerifyMFA(request.Context(), hdler.DAO, mfaRequest.MFAToken, mfaRequest.Code)
+	if errors.Is(err, ErrInvalidMFACode) {
+		hdler.loginFailed(request, email)
+	}
+	if errors.Is(err, ErrInvalidMFAToken) || errors.Is(err, ErrMFARequired) || errors.Is(err, ErrInvalidMFACode) ||
+		errors.Is(err, ErrAccountDeleted) || errors.Is(err, ErrAccountDisabled) || errors.Is(err, ErrPassphraseExpired) {
+		writeTextResponse(response, http.StatusUnauthorized, fmt.Sprintf("unauthorized. got %s", err.Error()))
+		return
+	}
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
 	}
+	hdler.loginSucceeded(request, email)
+	writeJsonResponse(response, http.StatusOK, &AuthenticateResponse{Access: at, Refresh: rt})
 }
 
-func (hdler *TheHandler) ChangeTenant(response http.ResponseWriter, request *http.Request) {
-	if common.RequestMayThrough(request, "*", "root") {
-		common.WriteHttpResponse(response, http.StatusNotImplemented, map[string][]string{"Content-Type": {"text/plain"}}, []byte("not yet implemented"))
-	} else {
-		common.WriteHttpResponse(response, http.StatusForbidden, map[string][]string{"Content-Type": {"text/plain"}}, []byte("you're provided token is insufficient"))
+/*
+r.HandleFunc("/login/passphrase", aaa.ChangeExpiredPassphrase).Methods(http.MethodPost)
+*/
+func (hdler *TheHandler) ChangeExpiredPassphrase(response http.ResponseWriter, request *http.Request) {
+	changeRequest := &PassphraseChangeRequest{}
+	if !readJsonRequest(response, request, changeRequest) {
+		return
+	}
+	at, rt, mt, err := ChangeExpiredPassphrase(request.Context(), hdler.DAO, changeRequest.PassphraseChangeToken, changeRequest.NewPassphrase)
+	if errors.Is(err, ErrInvalidPassphraseChangeToken) || errors.Is(err, ErrAccountDeleted) || errors.Is(err, ErrAccountDisabled) {
+		writeTextResponse(response, http.StatusUnauthorized, fmt.Sprintf("unauthorized. got %s", err.Error()))
+		return
+	}
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
 	}
+	writeJsonResponse(response, http.StatusOK, &AuthenticateResponse{Access: at, Refresh: rt, MFAToken: mt})
 }
 
-func (hdler *TheHandler) DeleteTenant(response http.ResponseWriter, request *http.Request) {
-	if common.RequestMayThrough(request, "*", "root") {
-		common.WriteHttpResponse(response, http.StatusNotImplemented, map[string][]string{"Content-Type": {"text/plain"}}, []byte("not yet implemented"))
-	} else {
-		common.WriteHttpResponse(response, http.StatusForbidden, map[string][]string{"Content-Type": {"text/plain"}}, []byte("you're provided token is insufficient"))
+/*
+r.HandleFunc("/mfa/totp", aaa.EnrolTOTP).Methods(http.MethodPost)
+*/
+func (hdler *TheHandler) EnrolTOTP(response http.ResponseWriter, request *http.Request) {
+	email, ok := hdler.bearerUser(response, request)
+	if !ok {
+		return
+	}
+	reauthRequest := &ReauthenticateRequest{}
+	if !readJsonRequest(response, request, reauthRequest) {
+		return
+	}
+	if !hdler.reauthenticate(response, request, email, reauthRequest.Passphrase) {
+		return
+	}
+	enrolment, err := EnrolTOTP(request.Context(), hdler.DAO.MFA(), email)
+	if errors.Is(err, ErrMFAEnrolled) {
+		writeTextResponse(response, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
 	}
+	writeJsonResponse(response, http.StatusCreated, &TOTPEnrolmentResponse{Secret: enrolment.Secret, Uri: enrolment.Uri()})
 }
 
-func (hdler *TheHandler) DeleteAllTenant(response http.ResponseWriter, request *http.Request) {
-	if common.RequestMayThrough(request, "*", "root") {
-		common.WriteHttpResponse(response, http.StatusNotImplemented, map[string][]string{"Content-Type": {"text/plain"}}, []byte("not yet implemented"))
-	} else {
-		common.WriteHttpResponse(response, http.StatusForbidden, map[string][]string{"Content-Type": {"text/plain"}}, []byte("you're provided token is insufficient"))
+/*
+r.HandleFunc("/mfa/totp/confirm", aaa.ConfirmTOTP).Methods(http.MethodPost)
+*/
+func (hdler *TheHandler) ConfirmTOTP(response http.ResponseWriter, request *http.Request) {
+	email, ok := hdler.bearerUser(response, request)
+	if !ok {
+		return
+	}
+	codeRequest := &MFACodeRequest{}
+	if !readJsonRequest(response, request, codeRequest) {
+		return
+	}
+	recoveryCodes, err := ConfirmTOTP(request.Context(), hdler.DAO.MFA(), email, codeRequest.Code)
+	switch {
+	case errors.Is(err, ErrMFANotEnrolled):
+		writeTextResponse(response, http.StatusNotFound, err.Error())
+	case errors.Is(err, ErrMFAEnrolled):
+		writeTextResponse(response, http.StatusConflict, err.Error())
+	case errors.Is(err, ErrInvalidMFACode):
+		writeTextResponse(response, http.StatusBadRequest, err.Error())
+	case err != nil:
+		writeDataAccessError(response, err)
+	default:
+		writeJsonResponse(response, http.StatusOK, &RecoveryCodesResponse{RecoveryCodes: recoveryCodes})
 	}
 }
 
-func (hdler *TheHandler) GetTenant(response http.ResponseWriter, request *http.Request) {
-	if common.RequestMayThrough(request, "*", "root") {
-		common.WriteHttpResponse(response, http.StatusNotImplemented, map[string][]string{"Content-Type": {"text/plain"}}, []byte("not yet implemented"))
-	} else {
-		common.WriteHttpResponse(response, http.StatusForbidden, map[string][]string{"Content-Type": {"text/plain"}}, []byte("you're provided token is insufficient"))
+/*
+r.HandleFunc("/mfa/totp", aaa.DisableTOTP).Methods(http.MethodDelete)
+*/
+func (hdler *TheHandler) DisableTOTP(response http.ResponseWriter, request *http.Request) {
+	email, ok := hdler.bearerUser(response, request)
+	if !ok {
+		return
+	}
+	codeRequest := &MFACodeRequest{}
+	if !readJsonRequest(response, request, codeRequest) {
+		return
+	}
+	if !hdler.reauthenticate(response, request, email, codeRequest.Passphrase) {
+		return
+	}
+	err := DisableTOTP(request.Context(), hdler.DAO.MFA(), email, codeRequest.Code)
+	switch {
+	case errors.Is(err, ErrMFANotEnrolled):
+		writeTextResponse(response, http.StatusNotFound, err.Error())
+	case errors.Is(err, ErrInvalidMFACode):
+		writeTextResponse(response, http.StatusForbidden, err.Error())
+	case err != nil:
+		writeDataAccessError(response, err)
+	default:
+		writeTextResponse(response, http.StatusOK, "second factor removed")
 	}
 }
 
-func (hdler *TheHandler) GetAllTenant(response http.ResponseWriter, request *http.Request) {
-	if common.RequestMayThrough(request, "*", "root") {
-		common.WriteHttpResponse(response, http.StatusNotImplemented, map[string][]string{"Content-Type": {"text/plain"}}, []byte("not yet implemented"))
-	} else {
-		common.WriteHttpResponse(response, http.StatusForbidden, map[string][]string{"Content-Type": {"text/plain"}}, []byte("you're provided token is insufficient"))
+// reauthenticate checks the current passphrase of the bearer user before its sign in methods are changed,
+// so a stolen access token alone can not take the account over. Wrong passphrases count as failed sign ins.
+// It returns false once the response is written.
+func (hdler *TheHandler) reauthenticate(response http.ResponseWriter, request *http.Request, email, passphrase string) bool {
+	if len(passphrase) == 0 {
+		writeTextResponse(response, http.StatusForbidden, ErrReauthenticate.Error())
+		return false
+	}
+	if seconds := hdler.loginRetryAfter(response, request, email); seconds > 0 {
+		writeTextResponse(response, http.StatusTooManyRequests, tooManyAttemptsMessage(seconds))
+		return false
 	}
+	err := hdler.DAO.VerifyPassphrase(request.Context(), email, passphrase)
+	switch {
+	case err == nil:
+		hdler.loginSucceeded(request, email)
+		return true
+	case errors.Is(err, ErrAccountDisabled), errors.Is(err, ErrPassphraseExpired):
+		writeTextResponse(response, http.StatusForbidden, err.Error())
+	default:
+		hdler.loginFailed(request, email)
+		writeTextResponse(response, http.StatusForbidden, fmt.Sprintf("%s. got %s", ErrReauthenticate.Error(), ErrInvalidPassword.Error()))
+	}
+	return false
 }
 
-func (hdler *TheHandler) SearchTenant(response http.ResponseWriter, request *http.Request) {
-	if common.RequestMayThrough(request, "*", "root") {
-		common.WriteHttpResponse(response, http.StatusNotImplemented, map[string][]string{"Content-Type": {"text/plain"}}, []byte("not yet implemented"))
-	} else {
-		common.WriteHttpResponse(response, http.StatusForbidden, map[string][]string{"Content-Type": {"text/plain"}}, []byte("you're provided token is insufficient"))
+// bearerUser returns the user of the bearer access token, the self-service endpoints only act for the caller.
+// Exchanged tokens, acting on behalf of the user, are refused. It returns false once the response is written.
+func (hdler *TheHandler) bearerUser(response http.ResponseWriter, request *http.Request) (string, bool) {
+	claim, ok := request.Context().Value(common.UserClaim).(*security.GoClaim)
+	if !ok {
+		writeBearerUnauthorized(response, "missing bearer access token")
+		return "", false
+	}
+	if RequestActor(request) != nil {
+		writeTextResponse(response, http.StatusForbidden, ErrActorToken.Error())
+		return "", false
+	}
+	exist, err := hdler.DAO.UserExist(request.Context(), claim.Subscriber)
+	if err != nil {
+		writeDataAccessError(response, err)
+		return "", false
+	}
+	if !exist {
+		writeForbidden(response)
+		return "", false
 	}
+	return claim.Subscriber, true
 }
 
 /*
-r.HandleFunc("/user/{tenant}/create-user", aaa.CreateUser).Methods(http.MethodPost)
+r.HandleFunc("/webauthn/register/begin", aaa.BeginWebAuthnRegistration).Methods(http.MethodPost)
 */
-func (hdler *TheHandler) CreateUser(response http.ResponseWriter, request *http.Request) {
-	pathVars := mux.Vars(request)
-	if tenant, exist := pathVars["tenant"]; exist {
-		if common.RequestMayThrough(request, "*", "root") {
-			log.Debugf("Tenant=%s", tenant)
-			common.WriteHttpResponse(response, http.StatusNotImplemented, map[string][]string{"Content-Type": {"text/plain"}}, []byte("not yet implemented"))
-		} else {
-			common.WriteHttpResponse(response, http.StatusForbidden, map[string][]string{"Content-Type": {"text/plain"}}, []byte("you're provided token is insufficient"))
-		}
-	} else {
-		common.WriteHttpResponse(response, http.StatusNotFound, map[string][]string{"Content-Type": {"text/plain"}}, []byte("not found"))
+func (hdler *TheHandler) BeginWebAuthnRegistration(response http.ResponseWriter, request *http.Request) {
+	email, ok := hdler.bearerUser(response, request)
+	if !ok {
+		return
+	}
+	rp, err := RelyingPartyOf()
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	reauthRequest := &ReauthenticateRequest{}
+	if !readJsonRequest(response, request, reauthRequest) {
+		return
 	}
+	if !hdler.reauthenticate(response, request, email, reauthRequest.Passphrase) {
+		return
+	}
+	options, session, err := BeginWebAuthnRegistration(request.Context(), hdler.DAO, rp, email)
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	writeJsonResponse(response, http.StatusOK, &WebAuthnRegistrationOptionsResponse{Session: session, PublicKey: options})
 }
 
 /*
-r.HandleFunc("/user/{tenant}/{user}", aaa.ChangeUserPassword).Methods(http.MethodPut)
+r.HandleFunc("/webauthn/register/finish", aaa.FinishWebAuthnRegistration).Methods(http.MethodPost)
 */
-func (hdler *TheHandler) ChangeUserPassword(response http.ResponseWriter, request *http.Request) {
-	pathVars := mux.Vars(request)
-	if tenant, exist := pathVars["tenant"]; exist {
-		if user, exist := pathVars["user"]; exist {
-			if common.RequestMayThrough(request, "*", "root") {
-				log.Debugf("Tenant=%s & User=%s", tenant, user)
-				// create user here
-				common.WriteHttpResponse(response, http.StatusNotImplemented, map[string][]string{"Content-Type": {"text/plain"}}, []byte("not yet implemented"))
-			} else {
-				common.WriteHttpResponse(response, http.StatusForbidden, map[string][]string{"Content-Type": {"text/plain"}}, []byte("you're provided token is insufficient"))
-			}
-		}
+func (hdler *TheHandler) FinishWebAuthnRegistration(response http.ResponseWriter, request *http.Request) {
+	email, ok := hdler.bearerUser(response, request)
+	if !ok {
+		return
+	}
+	registration := &WebAuthnRegistrationRequest{}
+	if !readJsonRequest(response, request, registration) {
+		return
+	}
+	rp, err := RelyingPartyOf()
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
 	}
-	common.WriteHttpResponse(response, http.StatusNotFound, map[string][]string{"Content-Type": {"text/plain"}}, []byte("not found"))
+	credential, err := FinishWebAuthnRegistration(request.Context(), hdler.DAO, rp, email,
+		registration.Session, registration.Name, registration.Credential)
+	if errors.Is(err, ErrInvalidWebAuthn) || errors.Is(err, ErrInvalidWebAuthnSession) {
+		writeTextResponse(response, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	writeJsonResponse(response, http.StatusCreated, NewWebAuthnCredentialResponse(credential))
 }
 
 /*
-r.HandleFunc("/user/{tenant}/{user}", aaa.DeleteUser).Methods(http.MethodDelete)
+r.HandleFunc("/webauthn/login/begin", aaa.BeginWebAuthnLogin).Methods(http.MethodPost)
 */
-func (hdler *TheHandler) DeleteUser(response http.ResponseWriter, request *http.Request) {
-	pathVars := mux.Vars(request)
-	if tenant, exist := pathVars["tenant"]; exist {
-		if user, exist := pathVars["user"]; exist {
-			if common.RequestMayThrough(request, "*", "root") {
-				log.Debugf("Tenant=%s & User=%s", tenant, user)
-				// create user here
-				common.WriteHttpResponse(response, http.StatusNotImplemented, map[string][]string{"Content-Type": {"text/plain"}}, []byte("not yet implemented"))
-			} else {
-				common.WriteHttpResponse(response, http.StatusForbidden, map[string][]string{"Content-Type": {"text/plain"}}, []byte("you're provided token is insufficient"))
-			}
-		}
+func (hdler *TheHandler) BeginWebAuthnLogin(response http.ResponseWriter, request *http.Request) {
+	optionsRequest := &WebAuthnLoginOptionsRequest{}
+	if request.ContentLength != 0 && !readJsonRequest(response, request, optionsRequest) {
+		return
+	}
+	rp, err := RelyingPartyOf()
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	options, session, err := BeginWebAuthnLogin(request.Context(), hdler.DAO, rp, optionsRequest.Email)
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
 	}
-	common.WriteHttpResponse(response, http.StatusNotFound, map[string][]string{"Content-Type": {"text/plain"}}, []byte("not found"))
+	writeJsonResponse(response, http.StatusOK, &WebAuthnLoginOptionsResponse{Session: session, PublicKey: options})
 }
 
 /*
-r.HandleFunc("/user/{tenant}/{user}", aaa.GetUser).Methods(http.MethodGet)
+r.HandleFunc("/webauthn/login/finish", aaa.FinishWebAuthnLogin).Methods(http.MethodPost)
 */
-func (hdler *TheHandler) GetUser(response http.ResponseWriter, request *http.Request) {
-	pathVars := mux.Vars(request)
-	if tenant, exist := pathVars["tenant"]; exist {
-		if user, exist := pathVars["user"]; exist {
-			if common.RequestMayThrough(request, "*", "root") {
-				log.Debugf("Tenant=%s & User=%s", tenant, user)
-				// create user here
-				common.WriteHttpResponse(response, http.StatusNotImplemented, map[string][]string{"Content-Type": {"text/plain"}}, []byte("not yet implemented"))
-			} else {
-				common.WriteHttpResponse(response, http.StatusForbidden, map[string][]string{"Content-Type": {"text/plain"}}, []byte("you're provided token is insufficient"))
-			}
-		}
+func (hdler *TheHandler) FinishWebAuthnLogin(response http.ResponseWriter, request *http.Request) {
+	loginRequest := &WebAuthnLoginRequest{}
+	if !readJsonRequest(response, request, loginRequest) {
+		return
+	}
+	rp, err := RelyingPartyOf()
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	at, rt, err := FinishWebAuthnLogin(request.Context(), hdler.DAO, rp, loginRequest.Session, loginRequest.Credential)
+	if errors.Is(err, ErrInvalidWebAuthn) || errors.Is(err, ErrInvalidWebAuthnSession) || errors.Is(err, ErrWebAuthnCounter) ||
+		errors.Is(err, ErrAccountDeleted) || errors.Is(err, ErrAccountDisabled) || errors.Is(err, ErrPassphraseExpired) {
+		writeTextResponse(response, http.StatusUnauthorized, fmt.Sprintf("unauthorized. got %s", err.Error()))
+		return
 	}
-	common.WriteHttpResponse(response, http.StatusNotFound, map[string][]string{"Content-Type": {"text/plain"}}, []byte("not found"))
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	writeJsonResponse(response, http.StatusOK, &AuthenticateResponse{Access: at, Refresh: rt})
 }
 
 /*
-r.HandleFunc("/user/{tenant}/s", aaa.SearchUser).Methods(http.MethodGet)
+r.HandleFunc("/webauthn/credentials", aaa.ListWebAuthnCredentials).Methods(http.MethodGet)
 */
-func (hdler *TheHandler) SearchUser(response http.ResponseWriter, request *http.Request) {
-	pathVars := mux.Vars(request)
-	if tenant, exist := pathVars["tenant"]; exist {
-		log.Debugf("Tenant=%s", tenant)
-		common.WriteHttpResponse(response, http.StatusNotImplemented, map[string][]string{"Content-Type": {"text/plain"}}, []byte("not yet implemented"))
-	} else {
-		common.WriteHttpResponse(response, http.StatusNotFound, map[string][]string{"Content-Type": {"text/plain"}}, []byte("not found"))
+func (hdler *TheHandler) ListWebAuthnCredentials(response http.ResponseWriter, request *http.Request) {
+	email, ok := hdler.bearerUser(response, request)
+	if !ok {
+		return
+	}
+	credentials, err := hdler.DAO.WebAuthnCredentials().ListCredentials(request.Context(), email)
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
 	}
+	ret := make([]*WebAuthnCredentialResponse, 0, len(credentials))
+	for _, credential := range credentials {
+		ret = append(ret, NewWebAuthnCredentialResponse(credential))
+	}
+	writeJsonResponse(response, http.StatusOK, ret)
 }
 
-func (hdler *TheHandler) UserTenantCreateRole(response http.ResponseWriter, request *http.Request) {
-	common.WriteHttpResponse(response, http.StatusNotImplemented, map[string][]string{"Content-Type": {"text/plain"}}, []byte("not yet implemented"))
+/*
+r.HandleFunc("/webauthn/credentials/{id}", aaa.DeleteWebAuthnCredential).Methods(http.MethodDelete)
+*/
+func (hdler *TheHandler) DeleteWebAuthnCredential(response http.ResponseWriter, request *http.Request) {
+	email, ok := hdler.bearerUser(response, request)
+	if !ok {
+		return
+	}
+	id := mux.Vars(request)["id"]
+	if err := hdler.DAO.WebAuthnCredentials().DeleteCredential(request.Context(), email, id); err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	writeTextResponse(response, http.StatusOK, "passkey removed")
 }
 
-func (hdler *TheHandler) UserTenantDeleteRole(response http.ResponseWriter, request *http.Request) {
-	common.WriteHttpResponse(response, http.StatusNotImplemented, map[string][]string{"Content-Type": {"text/plain"}}, []byte("not yet implemented"))
-}
+func (hdler *TheHandler) Refresh(response http.ResponseWriter, request *http.Request) {
+	if request.Body == nil {
+		common.WriteHttpResponse(response, http.StatusBadRequest, nil, []byte("missing request body"))
+		return
+	}
+	bodyBytes, err := io.ReadAll(request.Body)
+	if err != nil {
+		common.WriteHttpResponse(response, http.StatusBadRequest, nil, []byte(fmt.Sprintf("err got %s", err.Error())))
+		return
+	}
+	refreshRequest := &RefreshRequest{}
+	err = json.Unmarshal(bodyBytes, &refreshRequest)
+	if err != nil {
+		common.WriteHttpResponse(response, http.StatusBadRequest, nil, []byte(fmt.Sprintf("canot parse body. got %s", err.Error())))
+		return
+	}
 
-func (hdler *TheHandler) UserTenantDeleteAllRole(response http.ResponseWriter, request *http.Request) {
-	common.WriteHttpResponse(response, http.StatusNotImplemented, map[string][]string{"Content-Type": {"text/plain"}}, []byte("not yet implemented"))
-}
+	at, rt, err := hdler.DAO.Refresh(request.Context(), refreshRequest.Refresh)
+	if err != nil {
+		common.WriteHttpResponse(response, http.StatusUnauthorized, nil, []byte(fmt.Sprintf("unauthorized. got %s", err.Error())))
+		return
+	}
 
-func (hdler *TheHandler) UserTenantGetRole(response http.ResponseWriter, request *http.Request) {
-	common.WriteHttpResponse(response, http.StatusNotImplemented, map[string][]string{"Content-Type": {"text/plain"}}, []byte("not yet implemented"))
-}
+	refResp := &RefreshResponse{
+		Access:  at,
+		Refresh: rt,
+	}
+
+	respOk, err := json.Marshal(refResp)
+	if err != nil {
+		common.WriteHttpResponse(response, http.StatusInternalServerError, nil, []byte(fmt.Sprintf("error while generating response. got %s", err.Error())))
+		return
+	}
+	common.WriteHttpResponse(response, http.StatusOK, map[string][]string{"Content-Type": {"application/json"}}, respOk)
+}
+
+/*
+r.HandleFunc("/logout", aaa.Logout).Methods(http.MethodPost)
+*/
+func (hdler *TheHandler) Logout(response http.ResponseWriter, request *http.Request) {
+	logoutRequest := &RefreshRequest{}
+	if !readJsonRequest(response, request, logoutRequest) {
+		return
+	}
+	if err := RevokeRefreshToken(request.Context(), hdler.DAO.Revocations(), logoutRequest.Refresh); err != nil {
+		common.WriteHttpResponse(response, http.StatusUnauthorized, nil, []byte(fmt.Sprintf("unauthorized. got %s", err.Error())))
+		return
+	}
+	writeTextResponse(response, http.StatusOK, "logged out")
+}
+
+/*
+r.HandleFunc("/introspect", aaa.Introspect).Methods(http.MethodPost)
+*/
+func (hdler *TheHandler) Introspect(response http.ResponseWriter, request *http.Request) {
+	if err := AuthenticateIntrospectionClient(request.Context(), hdler.DAO.Clients(), request); err != nil {
+		common.WriteHttpResponse(response, http.StatusUnauthorized, map[string][]string{
+			"Content-Type":     {"text/plain"},
+			"WWW-Authenticate": {`Basic realm="introspect"`},
+		}, []byte(err.Error()))
+		return
+	}
+	if err := request.ParseForm(); err != nil {
+		writeTextResponse(response, http.StatusBadRequest, fmt.Sprintf("canot parse body. got %s", err.Error()))
+		return
+	}
+	token := request.PostForm.Get("token")
+	if len(token) == 0 {
+		writeTextResponse(response, http.StatusBadRequest, "missing token parameter")
+		return
+	}
+	introspection, err := IntrospectToken(request.Context(), hdler.DAO.Revocations(), token)
+	if err != nil {
+		writeTextResponse(response, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respBytes, err := json.Marshal(introspection)
+	if err != nil {
+		writeTextResponse(response, http.StatusInternalServerError, fmt.Sprintf("error while generating response. got %s", err.Error()))
+		return
+	}
+	common.WriteHttpResponse(response, http.StatusOK, map[string][]string{
+		"Content-Type":  {"application/json"},
+		"Cache-Control": {"no-store"},
+	}, respBytes)
+}
+
+/*
+r.HandleFunc("/oauth/token", aaa.Token).Methods(http.MethodPost)
+*/
+func (hdler *TheHandler) Token(response http.ResponseWriter, request *http.Request) {
+	if err := request.ParseForm(); err != nil {
+		writeOAuthError(response, newOAuthError(http.StatusBadRequest, "invalid_request", err))
+		return
+	}
+	ctx := request.Context()
+	client, oerr := clientFromRequest(ctx, hdler.DAO.Clients(), request)
+	if oerr != nil {
+		writeOAuthError(response, oerr)
+		return
+	}
+	var tokenResp *TokenResponse
+	var err error
+	switch grantType := request.PostForm.Get("grant_type"); grantType {
+	case GrantTypeClientCredentials:
+		tokenResp, err = ClientCredentialsToken(client, request.PostForm.Get("scope"))
+	case GrantTypeAuthorizationCode:
+		tokenResp, err = AuthorizationCodeToken(ctx, hdler.DAO, client, request.PostForm.Get("code"),
+			request.PostForm.Get("redirect_uri"), request.PostForm.Get("code_verifier"))
+	case GrantTypeDeviceCode:
+		tokenResp, err = DeviceCodeToken(ctx, hdler.DAO, client, request.PostForm.Get("device_code"))
+	case GrantTypeTokenExchange:
+		tokenResp, err = TokenExchangeToken(ctx, hdler.DAO, client, &TokenExchangeRequest{
+			SubjectToken:     request.PostForm.Get("subject_token"),
+			SubjectTokenType: request.PostForm.Get("subject_token_type"),
+			ActorToken:       request.PostForm.Get("actor_token"),
+			ActorTokenType:   request.PostForm.Get("actor_token_type"),
+			RequestedSubject: request.PostForm.Get("requested_subject"),
+			Scope:            request.PostForm.Get("scope"),
+		})
+	case "":
+		writeOAuthError(response, newOAuthError(http.StatusBadRequest, "invalid_request", fmt.Errorf("missing grant_type parameter")))
+		return
+	default:
+		writeOAuthError(response, newOAuthError(http.StatusBadRequest, "unsupported_grant_type", fmt.Errorf("grant type %s is not supported", grantType)))
+		return
+	}
+	switch {
+	case errors.Is(err, ErrInvalidScope):
+		writeOAuthError(response, newOAuthError(http.StatusBadRequest, "invalid_scope", err))
+		return
+	case errors.Is(err, ErrUnauthorizedClient):
+		writeOAuthError(response, newOAuthError(http.StatusBadRequest, "unauthorized_client", err))
+		return
+	case errors.Is(err, ErrAuthorizationPending):
+		writeOAuthError(response, newOAuthError(http.StatusBadRequest, "authorization_pending", err))
+		return
+	case errors.Is(err, ErrSlowDown):
+		writeOAuthError(response, newOAuthError(http.StatusBadRequest, "slow_down", err))
+		return
+	case errors.Is(err, ErrDeviceExpired):
+		writeOAuthError(response, newOAuthError(http.StatusBadRequest, "expired_token", err))
+		return
+	case errors.Is(err, ErrAccessDenied):
+		writeOAuthError(response, newOAuthError(http.StatusBadRequest, "access_denied", err))
+		return
+	case errors.Is(err, ErrImpersonationDenied):
+		writeOAuthError(response, newOAuthError(http.StatusForbidden, "access_denied", err))
+		return
+	case errors.Is(err, ErrInvalidTokenExchange):
+		writeOAuthError(response, newOAuthError(http.StatusBadRequest, "invalid_request", err))
+		return
+	case errors.Is(err, ErrInvalidCode), errors.Is(err, ErrInvalidCodeVerifier), errors.Is(err, ErrInvalidDeviceCode),
+		errors.Is(err, ErrAccountDeleted), errors.Is(err, ErrAccountDisabled), errors.Is(err, ErrPassphraseExpired):
+		writeOAuthError(response, newOAuthError(http.StatusBadRequest, "invalid_grant", err))
+		return
+	case err != nil:
+		writeOAuthError(response, newOAuthError(http.StatusInternalServerError, "server_error", err))
+		return
+	}
+	respBytes, err := json.Marshal(tokenResp)
+	if err != nil {
+		writeTextResponse(response, http.StatusInternalServerError, fmt.Sprintf("error while generating response. got %s", err.Error()))
+		return
+	}
+	common.WriteHttpResponse(response, http.StatusOK, map[string][]string{
+		"Content-Type":  {"application/json"},
+		"Cache-Control": {"no-store"},
+	}, respBytes)
+}
+
+/*
+r.HandleFunc("/authorize", aaa.AuthorizeForm).Methods(http.MethodGet)
+*/
+func (hdler *TheHandler) AuthorizeForm(response http.ResponseWriter, request *http.Request) {
+	authReq := NewAuthorizeRequest(request.URL.Query())
+	client, ok := hdler.authorizeClient(response, request, authReq)
+	if !ok {
+		return
+	}
+	writeLoginPage(response, http.StatusOK, &loginPageData{ClientName: client.Name, Request: authReq})
+}
+
+/*
+r.HandleFunc("/authorize", aaa.Authorize).Methods(http.MethodPost)
+*/
+func (hdler *TheHandler) Authorize(response http.ResponseWriter, request *http.Request) {
+	if err := request.ParseForm(); err != nil {
+		writeTextResponse(response, http.StatusBadRequest, fmt.Sprintf("canot parse body. got %s", err.Error()))
+		return
+	}
+	authReq := NewAuthorizeRequest(request.PostForm)
+	client, ok := hdler.authorizeClient(response, request, authReq)
+	if !ok {
+		return
+	}
+	ctx := request.Context()
+	email := request.PostForm.Get("email")
+	if seconds := hdler.loginRetryAfter(response, request, email); seconds > 0 {
+		writeLoginPage(response, http.StatusTooManyRequests, &loginPageData{ClientName: client.Name, Email: email, Error: tooManyAttemptsMessage(seconds), Request: authReq})
+		return
+	}
+	err := hdler.DAO.VerifyPassphrase(ctx, email, request.PostForm.Get("passphrase"))
+	if errors.Is(err, ErrAccountDisabled) {
+		writeLoginPage(response, http.StatusForbidden, &loginPageData{ClientName: client.Name, Email: email, Error: "This account is disabled.", Request: authReq})
+		return
+	}
+	if errors.Is(err, ErrPassphraseExpired) {
+		hdler.loginSucceeded(request, email)
+		writeLoginPage(response, http.StatusForbidden, &loginPageData{ClientName: client.Name, Email: email, Error: passphraseExpiredMessage, Request: authReq})
+		return
+	}
+	if err != nil {
+		hdler.loginFailed(request, email)
+		writeLoginPage(response, http.StatusUnauthorized, &loginPageData{ClientName: client.Name, Email: email, Error: "Wrong email or passphrase.", Request: authReq})
+		return
+	}
+	amr, err := VerifySecondFactor(ctx, hdler.DAO.MFA(), email, request.PostForm.Get("otp"))
+	if errors.Is(err, ErrInvalidMFACode) {
+		hdler.loginFailed(request, email)
+	}
+	if errors.Is(err, ErrMFARequired) || errors.Is(err, ErrInvalidMFACode) {
+		writeLoginPage(response, http.StatusUnauthorized, &loginPageData{ClientName: client.Name, Email: email, Error: secondFactorMessage(err), Request: authReq})
+		return
+	}
+	if err != nil {
+		log.Errorf("can not verify second factor. got %s", err.Error())
+		http.Redirect(response, request, authReq.RedirectUrl(url.Values{"error": {"server_error"}}), http.StatusFound)
+		return
+	}
+	hdler.loginSucceeded(request, email)
+	code, err := NewAuthorizationCode(client.ClientId, authReq.RedirectUri, email, authReq.CodeChallenge, amr)
+	if err == nil {
+		err = hdler.DAO.AuthorizationCodes().SaveCode(ctx, code)
+	}
+	if err != nil {
+		log.Errorf("can not save authorization code. got %s", err.Error())
+		http.Redirect(response, request, authReq.RedirectUrl(url.Values{"error": {"server_error"}}), http.StatusFound)
+		return
+	}
+	http.Redirect(response, request, authReq.RedirectUrl(url.Values{"code": {code.Code}}), http.StatusFound)
+}
+
+// authorizeClient validates the /authorize request. An unknown client or redirect URI is shown as error page,
+// other errors are redirected to the client. It returns false once the response is written.
+func (hdler *TheHandler) authorizeClient(response http.ResponseWriter, request *http.Request, authReq *AuthorizeRequest) (*OAuthClient, bool) {
+	client, err := authReq.ValidateClient(request.Context(), hdler.DAO.Clients())
+	if errors.Is(err, ErrInvalidClient) || errors.Is(err, ErrInvalidRedirectUri) {
+		writeTextResponse(response, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	if err != nil {
+		writeTextResponse(response, http.StatusInternalServerError, err.Error())
+		return nil, false
+	}
+	if oerr := authReq.Validate(); oerr != nil {
+		http.Redirect(response, request, authReq.RedirectUrl(url.Values{"error": {oerr.Code}, "error_description": {oerr.ErrorDescription}}), http.StatusFound)
+		return nil, false
+	}
+	return client, true
+}
+
+/*
+r.HandleFunc("/device/code", aaa.DeviceAuthorization).Methods(http.MethodPost)
+*/
+func (hdler *TheHandler) DeviceAuthorization(response http.ResponseWriter, request *http.Request) {
+	if err := request.ParseForm(); err != nil {
+		writeOAuthError(response, newOAuthError(http.StatusBadRequest, "invalid_request", err))
+		return
+	}
+	ctx := request.Context()
+	client, oerr := clientFromRequest(ctx, hdler.DAO.Clients(), request)
+	if oerr != nil {
+		writeOAuthError(response, oerr)
+		return
+	}
+	device, err := NewDeviceAuthorization(client.ClientId)
+	if err == nil {
+		err = hdler.DAO.DeviceCodes().SaveDevice(ctx, device)
+	}
+	if err != nil {
+		writeOAuthError(response, newOAuthError(http.StatusInternalServerError, "server_error", err))
+		return
+	}
+	respBytes, err := json.Marshal(NewDeviceAuthorizationResponse(PublicBaseUrl(request), device))
+	if err != nil {
+		writeTextResponse(response, http.StatusInternalServerError, fmt.Sprintf("error while generating response. got %s", err.Error()))
+		return
+	}
+	common.WriteHttpResponse(response, http.StatusOK, map[string][]string{
+		"Content-Type":  {"application/json"},
+		"Cache-Control": {"no-store"},
+	}, respBytes)
+}
+
+/*
+r.HandleFunc("/device", aaa.DeviceForm).Methods(http.MethodGet)
+*/
+func (hdler *TheHandler) DeviceForm(response http.ResponseWriter, request *http.Request) {
+	data := &devicePageData{UserCode: NormalizeUserCode(request.URL.Query().Get("user_code"))}
+	if len(data.UserCode) > 0 {
+		data.ClientName = hdler.deviceClientName(request.Context(), data.UserCode)
+	}
+	writeDevicePage(response, http.StatusOK, data)
+}
+
+/*
+r.HandleFunc("/device", aaa.DeviceVerify).Methods(http.MethodPost)
+*/
+func (hdler *TheHandler) DeviceVerify(response http.ResponseWriter, request *http.Request) {
+	if err := request.ParseForm(); err != nil {
+		writeTextResponse(response, http.StatusBadRequest, fmt.Sprintf("canot parse body. got %s", err.Error()))
+		return
+	}
+	ctx := request.Context()
+	data := &devicePageData{
+		UserCode: NormalizeUserCode(request.PostForm.Get("user_code")),
+		Email:    request.PostForm.Get("email"),
+	}
+	data.ClientName = hdler.deviceClientName(ctx, data.UserCode)
+	if seconds := hdler.loginRetryAfter(response, request, data.Email); seconds > 0 {
+		data.Error = tooManyAttemptsMessage(seconds)
+		writeDevicePage(response, http.StatusTooManyRequests, data)
+		return
+	}
+	err := hdler.DAO.VerifyPassphrase(ctx, data.Email, request.PostForm.Get("passphrase"))
+	if errors.Is(err, ErrAccountDisabled) {
+		data.Error = "This account is disabled."
+		writeDevicePage(response, http.StatusForbidden, data)
+		return
+	}
+	if errors.Is(err, ErrPassphraseExpired) {
+		hdler.loginSucceeded(request, data.Email)
+		data.Error = passphraseExpiredMessage
+		writeDevicePage(response, http.StatusForbidden, data)
+		return
+	}
+	if err != nil {
+		hdler.loginFailed(request, data.Email)
+		data.Error = "Wrong email or passphrase."
+		writeDevicePage(response, http.StatusUnauthorized, data)
+		return
+	}
+	amr, err := VerifySecondFactor(ctx, hdler.DAO.MFA(), data.Email, request.PostForm.Get("otp"))
+	if errors.Is(err, ErrInvalidMFACode) {
+		hdler.loginFailed(request, data.Email)
+	}
+	if errors.Is(err, ErrMFARequired) || errors.Is(err, ErrInvalidMFACode) {
+		data.Error = secondFactorMessage(err)
+		writeDevicePage(response, http.StatusUnauthorized, data)
+		return
+	}
+	if err != nil {
+		writeTextResponse(response, http.StatusInternalServerError, err.Error())
+		return
+	}
+	hdler.loginSucceeded(request, data.Email)
+	approved := request.PostForm.Get("action") == "approve"
+	_, err = DecideDevice(ctx, hdler.DAO.DeviceCodes(), data.UserCode, data.Email, amr, approved)
+	if errors.Is(err, ErrInvalidUserCode) {
+		data.Error = "This code is invalid or expired, check the code shown on your device."
+		writeDevicePage(response, http.StatusBadRequest, data)
+		return
+	}
+	if err != nil {
+		writeTextResponse(response, http.StatusInternalServerError, err.Error())
+		return
+	}
+	data.Message = "The device is denied."
+	if approved {
+		data.Message = "The device is connected, you may return to it."
+	}
+	writeDevicePage(response, http.StatusOK, data)
+}
+
+// secondFactorMessage tells the user of a hosted page what is wrong with the authentication code.
+func secondFactorMessage(err error) string {
+	if errors.Is(err, ErrMFARequired) {
+		return "Enter the code of your authenticator app, or one of your recovery codes."
+	}
+	return "Wrong or already used authentication code."
+}
+
+// loginRetryAfter returns the seconds the sign in of the email from the client of the request is refused, and sets
+// the Retry-After header when it is. A failing store is only logged, it must not refuse every sign in.
+func (hdler *TheHandler) loginRetryAfter(response http.ResponseWriter, request *http.Request, email string) int {
+	retryAfter, err := LoginRetryAfter(request.Context(), hdler.DAO.LoginAttempts(), email, ClientAddress(request))
+	if err != nil {
+		log.Errorf("can not check the failed sign in attempts of %s. got %s", email, err.Error())
+		return 0
+	}
+	if retryAfter <= 0 {
+		return 0
+	}
+	seconds := retryAfterSeconds(retryAfter)
+	response.Header().Set("Retry-After", strconv.Itoa(seconds))
+	return seconds
+}
+
+// loginFailed counts the failed sign in of the email from the client of the request.
+func (hdler *TheHandler) loginFailed(request *http.Request, email string) {
+	if err := LoginFailed(request.Context(), hdler.DAO.LoginAttempts(), email, ClientAddress(request)); err != nil {
+		log.Errorf("can not count the failed sign in of %s. got %s", email, err.Error())
+	}
+}
+
+// loginSucceeded forgets the failed sign in attempts of the email.
+func (hdler *TheHandler) loginSucceeded(request *http.Request, email string) {
+	if len(email) == 0 {
+		return
+	}
+	if err := LoginSucceeded(request.Context(), hdler.DAO.LoginAttempts(), email); err != nil {
+		log.Errorf("can not reset the failed sign in attempts of %s. got %s", email, err.Error())
+	}
+}
+
+// passphraseExpiredMessage is shown by the hosted pages, the passphrase can only be changed through /login.
+const passphraseExpiredMessage = "Your passphrase has expired, change it by signing in at /login."
+
+// tooManyAttemptsMessage tells the user when to sign in again.
+func tooManyAttemptsMessage(seconds int) string {
+	return fmt.Sprintf("Too many failed sign in attempts, try again in %d seconds.", seconds)
+}
+
+// deviceClientName returns the name of the client asking for the pending user code, or empty when there is none.
+func (hdler *TheHandler) deviceClientName(ctx context.Context, userCode string) string {
+	device, err := hdler.DAO.DeviceCodes().GetDeviceByUserCode(ctx, userCode)
+	if err != nil || device.Status != DeviceStatusPending {
+		return ""
+	}
+	client, err := hdler.DAO.Clients().GetClient(ctx, device.ClientId)
+	if err != nil {
+		return ""
+	}
+	if len(client.Name) == 0 {
+		return client.ClientId
+	}
+	return client.Name
+}
+
+// NewClientResponse creates the client response, the secret is only given when it is just created.
+func NewClientResponse(client *OAuthClient, secret string) *ClientResponse {
+	return &ClientResponse{
+		ClientId:    client.ClientId,
+		Name:        client.Name,
+		TenantRole:  client.TenantRole,
+		TokenAge:    client.TokenAge,
+		Public:      client.Public,
+		RedirectUri: client.RedirectUri,
+		CreatedAt:   client.CreatedAt,
+		Secret:      secret,
+	}
+}
+
+/*
+r.HandleFunc("/client", aaa.CreateClient).Methods(http.MethodPost)
+*/
+func (hdler *TheHandler) CreateClient(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	clientRequest := &ClientRequest{}
+	if !readJsonRequest(response, request, clientRequest) {
+		return
+	}
+	client := &OAuthClient{
+		ClientId:    clientRequest.ClientId,
+		Name:        clientRequest.Name,
+		TenantRole:  clientRequest.TenantRole,
+		TokenAge:    clientRequest.TokenAge,
+		Public:      clientRequest.Public,
+		RedirectUri: clientRequest.RedirectUri,
+		CreatedAt:   time.Now(),
+	}
+	if len(client.ClientId) == 0 {
+		client.ClientId = NewTokenId()
+	}
+	if err := client.Validate(); err != nil {
+		writeTextResponse(response, http.StatusBadRequest, err.Error())
+		return
+	}
+	// public clients can not keep a secret, they do not get one.
+	var secret string
+	if !client.Public {
+		var secretHash string
+		var err error
+		secret, secretHash, err = NewClientSecret()
+		if err != nil {
+			writeTextResponse(response, http.StatusInternalServerError, err.Error())
+			return
+		}
+		client.SecretHash = secretHash
+	}
+	if err := hdler.DAO.Clients().CreateClient(request.Context(), client); err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	writeJsonResponse(response, http.StatusCreated, NewClientResponse(client, secret))
+}
+
+/*
+r.HandleFunc("/client", aaa.ListClient).Methods(http.MethodGet)
+*/
+func (hdler *TheHandler) ListClient(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	clients, err := hdler.DAO.Clients().ListClient(request.Context())
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	ret := make([]*ClientResponse, 0, len(clients))
+	for _, client := range clients {
+		ret = append(ret, NewClientResponse(client, ""))
+	}
+	writeJsonResponse(response, http.StatusOK, ret)
+}
+
+/*
+r.HandleFunc("/client/{client}", aaa.GetClient).Methods(http.MethodGet)
+*/
+func (hdler *TheHandler) GetClient(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	client, err := hdler.DAO.Clients().GetClient(request.Context(), mux.Vars(request)["client"])
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	writeJsonResponse(response, http.StatusOK, NewClientResponse(client, ""))
+}
+
+/*
+r.HandleFunc("/client/{client}", aaa.UpdateClient).Methods(http.MethodPut)
+*/
+func (hdler *TheHandler) UpdateClient(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	clientRequest := &ClientRequest{}
+	if !readJsonRequest(response, request, clientRequest) {
+		return
+	}
+	ctx := request.Context()
+	client, err := hdler.DAO.Clients().GetClient(ctx, mux.Vars(request)["client"])
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	client.Name = clientRequest.Name
+	client.TenantRole = clientRequest.TenantRole
+	client.TokenAge = clientRequest.TokenAge
+	client.RedirectUri = clientRequest.RedirectUri
+	if err := client.Validate(); err != nil {
+		writeTextResponse(response, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := hdler.DAO.Clients().UpdateClient(ctx, client); err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	writeJsonResponse(response, http.StatusOK, NewClientResponse(client, ""))
+}
+
+/*
+r.HandleFunc("/client/{client}/secret", aaa.ResetClientSecret).Methods(http.MethodPost)
+*/
+func (hdler *TheHandler) ResetClientSecret(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	ctx := request.Context()
+	client, err := hdler.DAO.Clients().GetClient(ctx, mux.Vars(request)["client"])
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	if client.Public {
+		writeTextResponse(response, http.StatusBadRequest, "public client has no secret")
+		return
+	}
+	secret, secretHash, err := NewClientSecret()
+	if err != nil {
+		writeTextResponse(response, http.StatusInternalServerError, err.Error())
+		return
+	}
+	client.SecretHash = secretHash
+	if err := hdler.DAO.Clients().UpdateClient(ctx, client); err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	// the tokens issued with the old secret end with it.
+	if err := RevokeClientTokens(ctx, hdler.DAO.Revocations(), client); err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	writeJsonResponse(response, http.StatusOK, NewClientResponse(client, secret))
+}
+
+/*
+r.HandleFunc("/client/{client}", aaa.DeleteClient).Methods(http.MethodDelete)
+*/
+func (hdler *TheHandler) DeleteClient(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	clientId := mux.Vars(request)["client"]
+	ctx := request.Context()
+	client, err := hdler.DAO.Clients().GetClient(ctx, clientId)
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	if err := hdler.DAO.Clients().DeleteClient(ctx, clientId); err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	if err := RevokeClientTokens(ctx, hdler.DAO.Revocations(), client); err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	writeTextResponse(response, http.StatusOK, fmt.Sprintf("client %s deleted", clientId))
+}
+
+type CreateTenantRequest struct {
+	Name        string
+	DisplayName string
+}
+
+type ChangeTenantRequest struct {
+	DisplayName string
+}
+
+type TenantResponse struct {
+	Name        string
+	DisplayName string
+	CreatedAt   time.Time
+	Status      TenantStatus
+	Members     []string `json:",omitempty"`
+}
+
+func NewTenantResponse(tenant *Tenant) *TenantResponse {
+	return &TenantResponse{
+		Name:        tenant.Name,
+		DisplayName: tenant.DisplayName,
+		CreatedAt:   tenant.CreatedAt,
+		Status:      tenant.Status,
+	}
+}
+
+/*
+r.HandleFunc("/tenant", aaa.CreateTenant).Methods(http.MethodPost)
+*/
+func (hdler *TheHandler) CreateTenant(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	createRequest := &CreateTenantRequest{}
+	if !readJsonRequest(response, request, createRequest) {
+		return
+	}
+	if _, err := hdler.DAO.CreateTenant(request.Context(), createRequest.Name, createRequest.DisplayName); err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	tenant, err := hdler.DAO.GetTenant(request.Context(), createRequest.Name)
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	writeJsonResponse(response, http.StatusCreated, NewTenantResponse(tenant))
+}
+
+/*
+r.HandleFunc("/tenant/{oldtenant}/{newtenant}", aaa.ChangeTenant).Methods(http.MethodPost)
+*/
+func (hdler *TheHandler) ChangeTenant(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	pathVars := mux.Vars(request)
+	oldTenant, newTenant := pathVars["oldtenant"], pathVars["newtenant"]
+	changeRequest := &ChangeTenantRequest{}
+	if request.ContentLength != 0 && !readJsonRequest(response, request, changeRequest) {
+		return
+	}
+	if _, err := hdler.DAO.UpdateTenant(request.Context(), oldTenant, newTenant, changeRequest.DisplayName); err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	tenant, err := hdler.DAO.GetTenant(request.Context(), newTenant)
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	writeJsonResponse(response, http.StatusOK, NewTenantResponse(tenant))
+}
+
+/*
+r.HandleFunc("/tenant/{tenant}", aaa.DeleteTenant).Methods(http.MethodDelete)
+*/
+func (hdler *TheHandler) DeleteTenant(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	tenant := mux.Vars(request)["tenant"]
+	if _, err := hdler.DAO.DeleteTenant(request.Context(), tenant); err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	writeTextResponse(response, http.StatusOK, fmt.Sprintf("tenant %s deleted", tenant))
+}
+
+/*
+r.HandleFunc("/tenant", aaa.DeleteAllTenant).Methods(http.MethodDelete)
+*/
+func (hdler *TheHandler) DeleteAllTenant(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	if _, err := hdler.DAO.DeleteAllTenant(request.Context()); err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	writeTextResponse(response, http.StatusOK, "all tenant deleted")
+}
+
+/*
+r.HandleFunc("/tenant/{tenant}", aaa.GetTenant).Methods(http.MethodGet)
+*/
+func (hdler *TheHandler) GetTenant(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	tenantName := mux.Vars(request)["tenant"]
+	tenant, err := hdler.DAO.GetTenant(request.Context(), tenantName)
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	members, err := hdler.DAO.ListTenantUser(request.Context(), tenantName)
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	tenantResponse := NewTenantResponse(tenant)
+	tenantResponse.Members = members
+	writeJsonResponse(response, http.StatusOK, tenantResponse)
+}
+
+/*
+r.HandleFunc("/tenant", aaa.GetAllTenant).Methods(http.MethodGet)
+*/
+func (hdler *TheHandler) GetAllTenant(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	tenants, err := hdler.DAO.ListTenant(request.Context())
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	ret := make([]*TenantResponse, 0)
+	for _, tenant := range tenants {
+		ret = append(ret, NewTenantResponse(tenant))
+	}
+	writeJsonResponse(response, http.StatusOK, ret)
+}
+
+/*
+r.HandleFunc("/tenant/s", aaa.SearchTenant).Methods(http.MethodGet)
+*/
+func (hdler *TheHandler) SearchTenant(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	tenants, err := hdler.DAO.SearchTenant(request.Context(), request.URL.Query().Get("search"))
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	ret := make([]*TenantResponse, 0)
+	for _, tenant := range tenants {
+		ret = append(ret, NewTenantResponse(tenant))
+	}
+	writeJsonResponse(response, http.StatusOK, ret)
+}
+
+/*
+r.HandleFunc("/user/{tenant}/create-user", aaa.CreateUser).Methods(http.MethodPost)
+*/
+func (hdler *TheHandler) CreateUser(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	tenant := mux.Vars(request)["tenant"]
+	registerRequest := &RegisterRequest{}
+	if !readJsonRequest(response, request, registerRequest) {
+		return
+	}
+	tenantRoles := make([]*TenantRoles, 0)
+	for _, tr := range registerRequest.TenantRole {
+		parsed, err := ParseTenantRole(tr)
+		if err != nil {
+			writeTextResponse(response, http.StatusBadRequest, err.Error())
+			return
+		}
+		tenantRoles = append(tenantRoles, parsed...)
+	}
+	if err := ValidateTenantRoles(tenantRoles); err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+
+	ctx := request.Context()
+	if _, err := hdler.DAO.CreateUserAccount(ctx, registerRequest.Email, registerRequest.Passphrase); err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	if len(registerRequest.FullName) > 0 {
+		if _, err := hdler.DAO.UpdateUserProfile(ctx, registerRequest.Email, registerRequest.FullName); err != nil {
+			writeDataAccessError(response, err)
+			return
+		}
+	}
+	if registerRequest.MustChangePassphrase {
+		if _, err := hdler.DAO.ExpireUserPassphrase(ctx, registerRequest.Email); err != nil {
+			writeDataAccessError(response, err)
+			return
+		}
+	}
+	if _, err := hdler.DAO.CreateUserTenant(ctx, registerRequest.Email, tenant); err != nil && !errors.Is(err, ErrFound) {
+		writeDataAccessError(response, err)
+		return
+	}
+	for _, tr := range tenantRoles {
+		for _, role := range tr.Roles {
+			if _, err := hdler.DAO.CreateUserTenantRole(ctx, registerRequest.Email, tr.Tenant, role); err != nil && !errors.Is(err, ErrFound) {
+				writeDataAccessError(response, err)
+				return
+			}
+		}
+	}
+	user, err := hdler.getTenantUser(ctx, registerRequest.Email, tenant)
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	writeJsonResponse(response, http.StatusCreated, user)
+}
 
+/*
+r.HandleFunc("/user/{tenant}/{user}", aaa.ChangeUserPassword).Methods(http.MethodPut)
+*/
+func (hdler *TheHandler) ChangeUserPassword(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	pathVars := mux.Vars(request)
+	tenant, user := pathVars["tenant"], pathVars["user"]
+	changeRequest := &ChangePassphraseRequest{}
+	if !readJsonRequest(response, request, changeRequest) {
+		return
+	}
+	ctx := request.Context()
+	if !hdler.tenantUserExist(response, request, user, tenant) {
+		return
+	}
+	success, err := hdler.DAO.UpdateUserPassphrase(ctx, user, changeRequest.OldPassphrase, changeRequest.NewPassphrase)
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	if !success {
+		writeTextResponse(response, http.StatusForbidden, ErrInvalidPassword.Error())
+		return
+	}
+	writeTextResponse(response, http.StatusOK, fmt.Sprintf("passphrase of user %s changed", user))
+}
+
+/*
+r.HandleFunc("/user/{tenant}/{user}/status", aaa.ChangeUserStatus).Methods(http.MethodPut)
+*/
+func (hdler *TheHandler) ChangeUserStatus(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	pathVars := mux.Vars(request)
+	tenant, user := pathVars["tenant"], pathVars["user"]
+	statusRequest := &ChangeUserStatusRequest{}
+	if !readJsonRequest(response, request, statusRequest) {
+		return
+	}
+	if statusRequest.Status != UserStatusActive && statusRequest.Status != UserStatusDisabled {
+		writeTextResponse(response, http.StatusBadRequest, fmt.Sprintf("invalid status \"%s\", expect %s or %s", statusRequest.Status, UserStatusActive, UserStatusDisabled))
+		return
+	}
+	ctx := request.Context()
+	if !hdler.tenantUserExist(response, request, user, tenant) {
+		return
+	}
+	if _, err := hdler.DAO.UpdateUserStatus(ctx, user, statusRequest.Status); err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	ret, err := hdler.getTenantUser(ctx, user, tenant)
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	writeJsonResponse(response, http.StatusOK, ret)
+}
+
+/*
+r.HandleFunc("/user/{tenant}/{user}/revoke", aaa.RevokeUserTokens).Methods(http.MethodPost)
+*/
+func (hdler *TheHandler) RevokeUserTokens(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	pathVars := mux.Vars(request)
+	tenant, user := pathVars["tenant"], pathVars["user"]
+	if !hdler.tenantUserExist(response, request, user, tenant) {
+		return
+	}
+	if err := RevokeUserTokens(request.Context(), hdler.DAO.Revocations(), user); err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	writeTextResponse(response, http.StatusOK, fmt.Sprintf("every token of %s is revoked", user))
+}
+
+/*
+r.HandleFunc("/user/{tenant}/{user}/mfa", aaa.ResetUserMFA).Methods(http.MethodDelete)
+*/
+func (hdler *TheHandler) ResetUserMFA(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	pathVars := mux.Vars(request)
+	tenant, user := pathVars["tenant"], pathVars["user"]
+	if !hdler.tenantUserExist(response, request, user, tenant) {
+		return
+	}
+	if err := hdler.DAO.MFA().DeleteTOTP(request.Context(), user); err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	writeTextResponse(response, http.StatusOK, fmt.Sprintf("second factor of %s removed", user))
+}
+
+/*
+r.HandleFunc("/user/{tenant}/{user}/expire-passphrase", aaa.ExpireUserPassphrase).Methods(http.MethodPost)
+*/
+func (hdler *TheHandler) ExpireUserPassphrase(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	pathVars := mux.Vars(request)
+	tenant, user := pathVars["tenant"], pathVars["user"]
+	if !hdler.tenantUserExist(response, request, user, tenant) {
+		return
+	}
+	if _, err := hdler.DAO.ExpireUserPassphrase(request.Context(), user); err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	// the tokens issued with the expired passphrase would otherwise keep the user signed in.
+	if err := RevokeUserTokens(request.Context(), hdler.DAO.Revocations(), user); err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	event := &AuditEvent{Event: "passphrase_expire", Subject: user, Outcome: AuditOutcomeGranted}
+	if claim, ok := request.Context().Value(common.UserClaim).(*security.GoClaim); ok {
+		event.Actor = claim.Subscriber
+	}
+	Audit(event)
+	writeTextResponse(response, http.StatusOK, fmt.Sprintf("passphrase of %s must be changed at the next sign in", user))
+}
+
+/*
+r.HandleFunc("/user/{tenant}/{user}/unlock", aaa.UnlockUser).Methods(http.MethodPost)
+*/
+func (hdler *TheHandler) UnlockUser(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	pathVars := mux.Vars(request)
+	tenant, user := pathVars["tenant"], pathVars["user"]
+	if !hdler.tenantUserExist(response, request, user, tenant) {
+		return
+	}
+	if err := UnlockAccount(request.Context(), hdler.DAO.LoginAttempts(), user); err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	event := &AuditEvent{Event: "account_unlock", Subject: user, Outcome: AuditOutcomeGranted}
+	if claim, ok := request.Context().Value(common.UserClaim).(*security.GoClaim); ok {
+		event.Actor = claim.Subscriber
+	}
+	Audit(event)
+	writeTextResponse(response, http.StatusOK, fmt.Sprintf("sign in of %s unlocked", user))
+}
+
+/*
+r.HandleFunc("/user/{tenant}/{user}", aaa.DeleteUser).Methods(http.MethodDelete)
+*/
+func (hdler *TheHandler) DeleteUser(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	pathVars := mux.Vars(request)
+	tenant, user := pathVars["tenant"], pathVars["user"]
+	ctx := request.Context()
+	if !hdler.tenantUserExist(response, request, user, tenant) {
+		return
+	}
+	if _, err := hdler.DAO.DeleteUserAccount(ctx, user); err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	if _, err := hdler.DAO.DeleteUserAllTenant(ctx, user); err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	if err := hdler.DAO.MFA().DeleteTOTP(ctx, user); err != nil && !errors.Is(err, ErrNotFound) {
+		writeDataAccessError(response, err)
+		return
+	}
+	passkeys, err := hdler.DAO.WebAuthnCredentials().ListCredentials(ctx, user)
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	for _, passkey := range passkeys {
+		if err := hdler.DAO.WebAuthnCredentials().DeleteCredential(ctx, user, passkey.Id); err != nil && !errors.Is(err, ErrNotFound) {
+			writeDataAccessError(response, err)
+			return
+		}
+	}
+	// the tokens and failed sign ins of the account must not carry over to an account created with the same email.
+	if err := RevokeUserTokens(ctx, hdler.DAO.Revocations(), user); err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	if err := UnlockAccount(ctx, hdler.DAO.LoginAttempts(), user); err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	writeTextResponse(response, http.StatusOK, fmt.Sprintf("user %s deleted", user))
+}
+
+/*
+r.HandleFunc("/user/{tenant}/{user}", aaa.GetUser).Methods(http.MethodGet)
+*/
+func (hdler *TheHandler) GetUser(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	pathVars := mux.Vars(request)
+	tenant, user := pathVars["tenant"], pathVars["user"]
+	if !hdler.tenantUserExist(response, request, user, tenant) {
+		return
+	}
+	ret, err := hdler.getTenantUser(request.Context(), user, tenant)
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	writeJsonResponse(response, http.StatusOK, ret)
+}
+
+/*
+r.HandleFunc("/user/{tenant}/s", aaa.SearchUser).Methods(http.MethodGet)
+*/
+func (hdler *TheHandler) SearchUser(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	tenant := mux.Vars(request)["tenant"]
+	ctx := request.Context()
+	emails, err := hdler.DAO.SearchUser(ctx, request.URL.Query().Get("search"))
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	sort.Strings(emails)
+	ret := make([]*User, 0)
+	for _, email := range emails {
+		exist, err := hdler.DAO.UserTenantExist(ctx, email, tenant)
+		if err != nil {
+			writeDataAccessError(response, err)
+			return
+		}
+		if !exist {
+			continue
+		}
+		user, err := hdler.getTenantUser(ctx, email, tenant)
+		if err != nil {
+			writeDataAccessError(response, err)
+			return
+		}
+		ret = append(ret, user)
+	}
+	writeJsonResponse(response, http.StatusOK, ret)
+}
+
+// tenantUserExist make sure the user exist and is a member of the tenant. It writes the not found response and returns false otherwise.
+func (hdler *TheHandler) tenantUserExist(response http.ResponseWriter, request *http.Request, email, tenant string) bool {
+	exist, err := hdler.DAO.UserExist(request.Context(), email)
+	if err != nil {
+		writeDataAccessError(response, err)
+		return false
+	}
+	if exist {
+		exist, err = hdler.DAO.UserTenantExist(request.Context(), email, tenant)
+		if err != nil {
+			writeDataAccessError(response, err)
+			return false
+		}
+	}
+	if !exist {
+		writeTextResponse(response, http.StatusNotFound, fmt.Sprintf("user %s not found in tenant %s", email, tenant))
+		return false
+	}
+	return true
+}
+
+// getTenantUser build the user response with the user's roles in the tenant.
+func (hdler *TheHandler) getTenantUser(ctx context.Context, email, tenant string) (*User, error) {
+	profile, err := hdler.DAO.GetUserProfile(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := hdler.DAO.ListUserTenantRole(ctx, email, tenant)
+	if err != nil {
+		return nil, err
+	}
+	tr := &TenantRoles{
+		Tenant: tenant,
+		Roles:  roles,
+	}
+	return &User{
+		Email:      profile.Email,
+		FullName:   profile.FullName,
+		Status:     profile.Status,
+		TenantRole: []string{tr.String()},
+	}, nil
+}
+
+type AssignRoleRequest struct {
+	Roles []string
+}
+
+/*
+r.HandleFunc("/role/{tenant}/{user}", aaa.UserTenantCreateRole).Methods(http.MethodPost)
+*/
+func (hdler *TheHandler) UserTenantCreateRole(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	pathVars := mux.Vars(request)
+	tenant, user := pathVars["tenant"], pathVars["user"]
+	assignRequest := &AssignRoleRequest{}
+	if !readJsonRequest(response, request, assignRequest) {
+		return
+	}
+	if len(assignRequest.Roles) == 0 {
+		writeTextResponse(response, http.StatusBadRequest, "no role to assign")
+		return
+	}
+	ctx := request.Context()
+	exist, err := hdler.DAO.UserExist(ctx, user)
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	if !exist {
+		writeTextResponse(response, http.StatusNotFound, fmt.Sprintf("user %s not found", user))
+		return
+	}
+
+	// check every role first, so a conflicting request assigns nothing. A role given twice is assigned once.
+	roles := make([]string, 0, len(assignRequest.Roles))
+	assigned := make([]string, 0)
+	for _, role := range assignRequest.Roles {
+		if len(role) == 0 {
+			writeTextResponse(response, http.StatusBadRequest, ErrArgumentEmpty.Error())
+			return
+		}
+		if !ValidRoleName(role) {
+			writeDataAccessError(response, ErrInvalidRoleName)
+			return
+		}
+		if Contains(roles, role) {
+			continue
+		}
+		roles = append(roles, role)
+		exist, err := hdler.DAO.UserTenantRoleExist(ctx, user, tenant, role)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			writeDataAccessError(response, err)
+			return
+		}
+		if exist {
+			assigned = append(assigned, role)
+		}
+	}
+	if len(assigned) > 0 {
+		writeTextResponse(response, http.StatusConflict, fmt.Sprintf("%s. role %s already assigned", ErrFound.Error(), strings.Join(assigned, ",")))
+		return
+	}
+	for _, role := range roles {
+		if _, err := hdler.DAO.CreateUserTenantRole(ctx, user, tenant, role); err != nil {
+			writeDataAccessError(response, err)
+			return
+		}
+	}
+	roles, err = hdler.DAO.ListUserTenantRole(ctx, user, tenant)
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	writeJsonResponse(response, http.StatusCreated, &TenantRoles{
+		Tenant: tenant,
+		Roles:  roles,
+	})
+}
+
+/*
+r.HandleFunc("/role/{tenant}/{user}/{role}", aaa.UserTenantDeleteRole).Methods(http.MethodDelete)
+*/
+func (hdler *TheHandler) UserTenantDeleteRole(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	pathVars := mux.Vars(request)
+	tenant, user, role := pathVars["tenant"], pathVars["user"], pathVars["role"]
+	if _, err := hdler.DAO.DeleteUserTenantRole(request.Context(), user, tenant, role); err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	writeTextResponse(response, http.StatusOK, fmt.Sprintf("role %s of user %s in tenant %s deleted", role, user, tenant))
+}
+
+/*
+r.HandleFunc("/role/{tenant}/{user}", aaa.UserTenantDeleteAllRole).Methods(http.MethodDelete)
+*/
+func (hdler *TheHandler) UserTenantDeleteAllRole(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	pathVars := mux.Vars(request)
+	tenant, user := pathVars["tenant"], pathVars["user"]
+	if _, err := hdler.DAO.DeleteUserTenantAllRoles(request.Context(), user, tenant); err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	writeTextResponse(response, http.StatusOK, fmt.Sprintf("all role of user %s in tenant %s deleted", user, tenant))
+}
+
+/*
+r.HandleFunc("/role/{tenant}/{user}/{role}", aaa.UserTenantGetRole).Methods(http.MethodGet)
+*/
+func (hdler *TheHandler) UserTenantGetRole(response http.ResponseWriter, request *http.Request) {
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	pathVars := mux.Vars(request)
+	tenant, user, role := pathVars["tenant"], pathVars["user"], pathVars["role"]
+	exist, err := hdler.DAO.UserTenantRoleExist(request.Context(), user, tenant, role)
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	if !exist {
+		writeTextResponse(response, http.StatusNotFound, fmt.Sprintf("%s. user %s has no role %s in tenant %s", ErrNotFound.Error(), user, role, tenant))
+		return
+	}
+	writeJsonResponse(response, http.StatusOK, &TenantRoles{
+		Tenant: tenant,
+		Roles:  []string{role},
+	})
+}
+
+/*
+r.HandleFunc("/role/{tenant}/{user}/s", aaa.UserTenantSearchRole).Methods(http.MethodGet)
+*/
 func (hdler *TheHandler) UserTenantSearchRole(response http.ResponseWriter, request *http.Request) {
-	common.WriteHttpResponse(response, http.StatusNotImplemented, map[string][]string{"Content-Type": {"text/plain"}}, []byte("not yet implemented"))
+	if !common.RequestMayThrough(request, "*", "root") {
+		writeForbidden(response)
+		return
+	}
+	pathVars := mux.Vars(request)
+	tenant, user := pathVars["tenant"], pathVars["user"]
+	roles, err := hdler.DAO.SearchUserRoleTenant(request.Context(), user, tenant, request.URL.Query().Get("search"))
+	if err != nil {
+		writeDataAccessError(response, err)
+		return
+	}
+	sort.Strings(roles)
+	writeJsonResponse(response, http.StatusOK, &TenantRoles{
+		Tenant: tenant,
+		Roles:  roles,
+	})
+}
+
+func writeForbidden(response http.ResponseWriter) {
+	common.WriteHttpResponse(response, http.StatusForbidden, map[string][]string{"Content-Type": {"text/plain"}}, []byte("you're provided token is insufficient"))
+}
+
+// writeOAuthError writes the RFC 6749 json error response. Client authentication failures challenge for basic credentials.
+func writeOAuthError(response http.ResponseWriter, oerr *OAuthError) {
+	respBytes, err := json.Marshal(oerr)
+	if err != nil {
+		writeTextResponse(response, http.StatusInternalServerError, fmt.Sprintf("error while generating response. got %s", err.Error()))
+		return
+	}
+	headers := map[string][]string{
+		"Content-Type":  {"application/json"},
+		"Cache-Control": {"no-store"},
+	}
+	if oerr.Status == http.StatusUnauthorized {
+		headers["WWW-Authenticate"] = []string{`Basic realm="oauth"`}
+	}
+	common.WriteHttpResponse(response, oerr.Status, headers, respBytes)
+}
+
+// writeBearerUnauthorized writes the 401 response challenging the caller for a bearer token (RFC 6750).
+func writeBearerUnauthorized(response http.ResponseWriter, text string) {
+	common.WriteHttpResponse(response, http.StatusUnauthorized, map[string][]string{
+		"Content-Type":     {"text/plain"},
+		"WWW-Authenticate": {`Bearer error="invalid_token"`},
+	}, []byte(text))
+}
+
+func writeTextResponse(response http.ResponseWriter, status int, text string) {
+	common.WriteHttpResponse(response, status, map[string][]string{"Content-Type": {"text/plain"}}, []byte(text))
+}
+
+func writeJsonResponse(response http.ResponseWriter, status int, body interface{}) {
+	respBytes, err := json.Marshal(body)
+	if err != nil {
+		writeTextResponse(response, http.StatusInternalServerError, fmt.Sprintf("error while generating response. got %s", err.Error()))
+		return
+	}
+	common.WriteHttpResponse(response, status, map[string][]string{"Content-Type": {"application/json"}}, respBytes)
+}
+
+// readJsonRequest parse the request body into target. It writes the bad request response and returns false if it fails.
+func readJsonRequest(response http.ResponseWriter, request *http.Request, target interface{}) bool {
+	if request.Body == nil {
+		writeTextResponse(response, http.StatusBadRequest, "missing request body")
+		return false
+	}
+	bodyBytes, err := io.ReadAll(request.Body)
+	if err != nil {
+		writeTextResponse(response, http.StatusBadRequest, fmt.Sprintf("err got %s", err.Error()))
+		return false
+	}
+	if err := json.Unmarshal(bodyBytes, target); err != nil {
+		writeTextResponse(response, http.StatusBadRequest, fmt.Sprintf("canot parse body. got %s", err.Error()))
+		return false
+	}
+	return true
+}
+
+// writeDataAccessError translate error returned by DataAccess into the matching http status.
+func writeDataAccessError(response http.ResponseWriter, err error) {
+	var policyErr *PassphrasePolicyError
+	switch {
+	case errors.As(err, &policyErr):
+		writeJsonResponse(response, http.StatusBadRequest, NewPassphrasePolicyResponse(policyErr))
+	case errors.Is(err, ErrNotFound):
+		writeTextResponse(response, http.StatusNotFound, err.Error())
+	case errors.Is(err, ErrFound):
+		writeTextResponse(response, http.StatusConflict, err.Error())
+	case errors.Is(err, ErrArgumentEmpty), errors.Is(err, ErrArgumentInvalid):
+		writeTextResponse(response, http.StatusBadRequest, err.Error())
+	case errors.Is(err, ErrTenantReserved):
+		writeTextResponse(response, http.StatusForbidden, err.Error())
+	default:
+		writeTextResponse(response, http.StatusInternalServerError, err.Error())
+	}
 }
@@ -0,0 +1,339 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/newm4n/dokku-aaa/configuration"
+	common "github.com/newm4n/dokku-common"
+	"github.com/newm4n/dokku-common/security"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestRouter() *mux.Router {
+	router := mux.NewRouter()
+	InitRouter(router)
+	return router
+}
+
+// asRoot put a root claim into the request context, the same way the token middleware would do.
+func asRoot(request *http.Request) *http.Request {
+	claim := &security.GoClaim{
+		Subscriber: "root@mail.com",
+		TokenType:  security.AccessToken,
+		Audience:   []string{"root@*"},
+	}
+	return request.WithContext(context.WithValue(request.Context(), common.UserClaim, claim))
+}
+
+// asUser put the claim of the user with the tenant roles into the request context.
+func asUser(request *http.Request, email string, tenantRoles ...string) *http.Request {
+	claim := &security.GoClaim{
+		Subscriber: email,
+		TokenType:  security.AccessToken,
+		Audience:   tenantRoles,
+	}
+	return request.WithContext(context.WithValue(request.Context(), common.UserClaim, claim))
+}
+
+func serve(router http.Handler, request *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func newRequest(method, target, body string) *http.Request {
+	var reader io.Reader
+	if len(body) > 0 {
+		reader = strings.NewReader(body)
+	}
+	return httptest.NewRequest(method, target, reader)
+}
+
+func TestTheHandler_Tenant(t *testing.T) {
+	router := newTestRouter()
+
+	resp := serve(router, newRequest(http.MethodPost, "/tenant", `{"Name":"ACME","DisplayName":"Acme Corp"}`))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/tenant", `{"Name":"ACME","DisplayName":"Acme Corp"}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	tenant := &TenantResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), tenant))
+	assert.Equal(t, "Acme Corp", tenant.DisplayName)
+	assert.Equal(t, TenantStatusActive, tenant.Status)
+
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/tenant", `{"Name":"ACME"}`)))
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/tenant", `{"Name":"acme,*"}`)))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/tenant/ACME/a@b", "")))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/tenant", `{"Name":"BETA"}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	resp = serve(router, asRoot(newRequest(http.MethodGet, "/tenant/s?search=ac", "")))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	tenants := make([]*TenantResponse, 0)
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &tenants))
+	assert.Equal(t, 1, len(tenants))
+
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/tenant/ACME/ACME2", `{"DisplayName":"Acme Two"}`)))
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	resp = serve(router, asRoot(newRequest(http.MethodGet, "/tenant/ACME2", "")))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), tenant))
+	assert.Equal(t, "Acme Two", tenant.DisplayName)
+
+	resp = serve(router, asRoot(newRequest(http.MethodGet, "/tenant/ACME", "")))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+
+	resp = serve(router, asRoot(newRequest(http.MethodDelete, "/tenant/BETA", "")))
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	resp = serve(router, asRoot(newRequest(http.MethodGet, "/tenant", "")))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &tenants))
+	assert.Equal(t, 1, len(tenants))
+
+	resp = serve(router, asRoot(newRequest(http.MethodDelete, "/tenant", "")))
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	resp = serve(router, asRoot(newRequest(http.MethodGet, "/tenant", "")))
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &tenants))
+	assert.Equal(t, 0, len(tenants))
+}
+
+func TestTheHandler_User(t *testing.T) {
+	router := newTestRouter()
+
+	resp := serve(router, newRequest(http.MethodPost, "/user/ACME/create-user", `{"Email":"user@mail.com","Passphrase":"a passphrase"}`))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/create-user",
+		`{"FullName":"Some User","Email":"user@mail.com","Passphrase":"a passphrase","TenantRole":["admin,viewer@ACME","viewer@BETA"]}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	user := &User{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), user))
+	assert.Equal(t, "user@mail.com", user.Email)
+	assert.Equal(t, "Some User", user.FullName)
+	assert.Equal(t, "", user.Passphrase)
+	assert.Equal(t, []string{"admin,viewer@ACME"}, user.TenantRole)
+
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/create-user", `{"Email":"user@mail.com","Passphrase":"a passphrase"}`)))
+	assert.Equal(t, http.StatusConflict, resp.Code)
+
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/create-user", `{"Email":"other@mail.com","Passphrase":"a passphrase"}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	resp = serve(router, asRoot(newRequest(http.MethodGet, "/user/BETA/user@mail.com", "")))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), user))
+	assert.Equal(t, []string{"viewer@BETA"}, user.TenantRole)
+
+	resp = serve(router, asRoot(newRequest(http.MethodGet, "/user/BETA/other@mail.com", "")))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+
+	resp = serve(router, asRoot(newRequest(http.MethodGet, "/user/ACME/s?search=us", "")))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	users := make([]*User, 0)
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &users))
+	assert.Equal(t, 1, len(users))
+
+	resp = serve(router, asRoot(newRequest(http.MethodPut, "/user/ACME/user@mail.com", `{"OldPassphrase":"wrong","NewPassphrase":"new passphrase"}`)))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	resp = serve(router, asRoot(newRequest(http.MethodPut, "/user/ACME/user@mail.com", `{"OldPassphrase":"a passphrase","NewPassphrase":"new passphrase"}`)))
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	resp = serve(router, newRequest(http.MethodPost, "/login", `{"Email":"user@mail.com","Passphrase":"new passphrase"}`))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	login := &AuthenticateResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), login))
+
+	resp = serve(router, asRoot(newRequest(http.MethodPut, "/user/ACME/user@mail.com/status", `{"Status":"gone"}`)))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	resp = serve(router, asRoot(newRequest(http.MethodPut, "/user/ACME/user@mail.com/status", `{"Status":"disabled"}`)))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), user))
+	assert.Equal(t, UserStatusDisabled, user.Status)
+
+	resp = serve(router, newRequest(http.MethodPost, "/refresh", `{"Refresh":"`+login.Refresh+`"}`))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.Contains(t, resp.Body.String(), ErrAccountDisabled.Error())
+
+	resp = serve(router, asRoot(newRequest(http.MethodPut, "/user/ACME/user@mail.com/status", `{"Status":"active"}`)))
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	resp = serve(router, newRequest(http.MethodPost, "/refresh", `{"Refresh":"`+login.Refresh+`"}`))
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	resp = serve(router, asRoot(newRequest(http.MethodDelete, "/user/ACME/user@mail.com", "")))
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	resp = serve(router, asRoot(newRequest(http.MethodGet, "/user/BETA/user@mail.com", "")))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+
+	resp = serve(router, asRoot(newRequest(http.MethodDelete, "/user/ACME/user@mail.com", "")))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+func TestTheHandler_DeleteUserRevokes(t *testing.T) {
+	dao := NewMemoryDAO()
+	router := mux.NewRouter()
+	initRoutes(router, &TheHandler{DAO: dao})
+	resp := serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/create-user",
+		`{"Email":"user@mail.com","Passphrase":"a passphrase","TenantRole":["viewer@ACME,BETA"]}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	resp = serve(router, newRequest(http.MethodPost, "/login", `{"Email":"user@mail.com","Passphrase":"a passphrase"}`))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	login := &AuthenticateResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), login))
+	resp = serve(router, newRequest(http.MethodPost, "/login", `{"Email":"user@mail.com","Passphrase":"wrong passphrase"}`))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// only root deletes an account.
+	resp = serve(router, asUser(newRequest(http.MethodDelete, "/user/ACME/user@mail.com", ""), "admin@mail.com", "admin@ACME"))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = serve(router, asRoot(newRequest(http.MethodDelete, "/user/ACME/user@mail.com", "")))
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// the tokens and failed sign ins of the account are gone with it.
+	resp = serve(router, bearer(newRequest(http.MethodGet, "/userinfo", ""), login.Access))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = serve(router, newRequest(http.MethodPost, "/refresh", `{"Refresh":"`+login.Refresh+`"}`))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	attempts, err := dao.LoginAttempts().GetAttempts(context.Background(), accountAttemptKey("user@mail.com"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, attempts.Failures)
+}
+
+func TestTheHandler_Logout(t *testing.T) {
+	router := newTestRouter()
+
+	resp := serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/create-user", `{"Email":"user@mail.com","Passphrase":"a passphrase"}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	resp = serve(router, newRequest(http.MethodPost, "/login", `{"Email":"user@mail.com","Passphrase":"a passphrase"}`))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	login := &AuthenticateResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), login))
+
+	resp = serve(router, newRequest(http.MethodPost, "/logout", `{"Refresh":"not a token"}`))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	resp = serve(router, newRequest(http.MethodPost, "/logout", `{"Refresh":"`+login.Access+`"}`))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	resp = serve(router, newRequest(http.MethodPost, "/logout", `{"Refresh":"`+login.Refresh+`"}`))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	resp = serve(router, newRequest(http.MethodPost, "/refresh", `{"Refresh":"`+login.Refresh+`"}`))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.Contains(t, resp.Body.String(), ErrTokenRevoked.Error())
+	resp = serve(router, newRequest(http.MethodPost, "/logout", `{"Refresh":"`+login.Refresh+`"}`))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// logout only revokes the refresh token, the access token lives until it expires.
+	request := newRequest(http.MethodGet, "/tenant", "")
+	request.Header.Set("Authorization", "Bearer "+login.Access)
+	resp = serve(router, request)
+	assert.NotContains(t, resp.Body.String(), ErrTokenRevoked.Error())
+
+	resp = serve(router, newRequest(http.MethodPost, "/user/ACME/user@mail.com/revoke", ""))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/other@mail.com/revoke", "")))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/user@mail.com/revoke", "")))
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	request = newRequest(http.MethodGet, "/tenant", "")
+	request.Header.Set("Authorization", "Bearer "+login.Access)
+	resp = serve(router, request)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Contains(t, resp.Body.String(), ErrTokenRevoked.Error())
+}
+
+func TestTheHandler_RefreshRotation(t *testing.T) {
+	configuration.SetConfig("token.refresh.rotation", "true")
+	defer configuration.SetConfig("token.refresh.rotation", "")
+	router := newTestRouter()
+
+	resp := serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/create-user", `{"Email":"user@mail.com","Passphrase":"a passphrase"}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	resp = serve(router, newRequest(http.MethodPost, "/login", `{"Email":"user@mail.com","Passphrase":"a passphrase"}`))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	login := &AuthenticateResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), login))
+
+	resp = serve(router, newRequest(http.MethodPost, "/refresh", `{"Refresh":"`+login.Refresh+`"}`))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	refreshed := &RefreshResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), refreshed))
+	assert.NotEmpty(t, refreshed.Access)
+	assert.NotEmpty(t, refreshed.Refresh)
+
+	resp = serve(router, newRequest(http.MethodPost, "/refresh", `{"Refresh":"`+login.Refresh+`"}`))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	resp = serve(router, newRequest(http.MethodPost, "/refresh", `{"Refresh":"`+refreshed.Refresh+`"}`))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.Contains(t, resp.Body.String(), ErrTokenRevoked.Error())
+}
+
+func TestTheHandler_Role(t *testing.T) {
+	router := newTestRouter()
+
+	resp := serve(router, newRequest(http.MethodPost, "/role/ACME/user@mail.com", `{"Roles":["admin"]}`))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/role/ACME/user@mail.com", `{"Roles":["admin"]}`)))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/create-user", `{"Email":"user@mail.com","Passphrase":"a passphrase"}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/role/ACME/user@mail.com", `{"Roles":["admin","auditor","viewer"]}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	tenantRoles := &TenantRoles{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), tenantRoles))
+	assert.Equal(t, []string{"admin", "auditor", "viewer"}, tenantRoles.Roles)
+
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/role/ACME/user@mail.com", `{"Roles":["editor","admin"]}`)))
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	resp = serve(router, asRoot(newRequest(http.MethodGet, "/role/ACME/user@mail.com/editor", "")))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+
+	resp = serve(router, asRoot(newRequest(http.MethodGet, "/role/ACME/user@mail.com/admin", "")))
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// a role that is not a plain name assigns nothing, a role given twice is assigned once.
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/role/BETA/user@mail.com", `{"Roles":["editor","*"]}`)))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/role/BETA/user@mail.com", `{"Roles":["editor","editor"]}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), tenantRoles))
+	assert.Equal(t, []string{"editor"}, tenantRoles.Roles)
+
+	resp = serve(router, asRoot(newRequest(http.MethodGet, "/role/ACME/user@mail.com/s?search=a", "")))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), tenantRoles))
+	assert.Equal(t, []string{"admin", "auditor"}, tenantRoles.Roles)
+
+	resp = serve(router, asRoot(newRequest(http.MethodDelete, "/role/ACME/user@mail.com/admin", "")))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	resp = serve(router, asRoot(newRequest(http.MethodDelete, "/role/ACME/user@mail.com/admin", "")))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+
+	resp = serve(router, asRoot(newRequest(http.MethodDelete, "/role/ACME/user@mail.com", "")))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	resp = serve(router, asRoot(newRequest(http.MethodDelete, "/role/OTHER/user@mail.com", "")))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+
+	resp = serve(router, asRoot(newRequest(http.MethodGet, "/role/ACME/user@mail.com/viewer", "")))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hyperjumptech/jiffy"
+	"github.com/newm4n/dokku-aaa/configuration"
+	"github.com/newm4n/dokku-common/security"
+	"strings"
+	"time"
+)
+
+const (
+	GrantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	// TokenTypeAccessToken is the only token type exchanged, and issued, by the token exchange.
+	TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+	// ImpersonationRole lets its holder exchange tokens acting as the members of the tenant.
+	ImpersonationRole = "impersonate"
+)
+
+var (
+	ErrInvalidTokenExchange = fmt.Errorf("invalid token exchange request")
+	ErrImpersonationDenied  = fmt.Errorf("actor may not act on behalf of the subject")
+	ErrActorToken           = fmt.Errorf("token acting on behalf of the subject can not manage its account")
+)
+
+// TokenExchangeRequest holds the RFC 8693 token exchange parameters. The subject is either the subject token,
+// when a service narrows a user token down for a downstream call, or the requested subject, when an administrator
+// impersonates a user. The actor is the actor token subject, or the client itself when there is no actor token.
+type TokenExchangeRequest struct {
+	SubjectToken     string
+	SubjectTokenType string
+	ActorToken       string
+	ActorTokenType   string
+	RequestedSubject string
+	Scope            string
+}
+
+// exchangeParty is the verified subject, or actor, of a token exchange.
+type exchangeParty struct {
+	subject  string
+	audience []string
+	actor    *Actor
+	expireAt time.Time
+}
+
+// TokenExchangeToken issues a short-lived access token of the subject, carrying the act claim of the actor
+// and the requested scope, which must be part of the subject tenant roles. The actor must be root,
+// or hold the impersonate role in every tenant of the scope. The reserved tenant is never granted.
+// Every exchange, granted or denied, is audited.
+func TokenExchangeToken(ctx context.Context, dao DataAccess, client *OAuthClient, exchange *TokenExchangeRequest) (*TokenResponse, error) {
+	event := &AuditEvent{Event: "token_exchange", ClientId: client.ClientId, Outcome: AuditOutcomeDenied}
+	tokenResp, err := tokenExchange(ctx, dao, client, exchange, event)
+	if err != nil {
+		event.Reason = err.Error()
+	}
+	Audit(event)
+	return tokenResp, err
+}
+
+func tokenExchange(ctx context.Context, dao DataAccess, client *OAuthClient, exchange *TokenExchangeRequest, event *AuditEvent) (*TokenResponse, error) {
+	actor, err := exchangeActor(ctx, dao, client, exchange)
+	if err != nil {
+		return nil, err
+	}
+	event.Actor = actor.subject
+	subject, err := exchangeSubject(ctx, dao, exchange)
+	if err != nil {
+		return nil, err
+	}
+	event.Subject = subject.subject
+	if len(strings.TrimSpace(exchange.Scope)) == 0 {
+		return nil, fmt.Errorf("%w, scope is required", ErrInvalidScope)
+	}
+	auds, err := grantedScope(subject.audience, exchange.Scope)
+	if err != nil {
+		return nil, err
+	}
+	event.Audience = auds
+	for _, aud := range auds {
+		trs, err := ParseTenantRole(aud)
+		if err != nil {
+			return nil, fmt.Errorf("%w, %s", ErrInvalidScope, err.Error())
+		}
+		for _, tr := range trs {
+			if tr.Tenant == ReservedTenant {
+				return nil, fmt.Errorf("%w, the %s tenant can not be exchanged", ErrInvalidScope, ReservedTenant)
+			}
+			if !mayImpersonate(actor.audience, tr.Tenant) {
+				return nil, fmt.Errorf("%w in tenant %s", ErrImpersonationDenied, tr.Tenant)
+			}
+		}
+	}
+
+	age, err := jiffy.DurationOf(configuration.Get("token.age.exchange"))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	expireAt := now.Add(age)
+	if !subject.expireAt.IsZero() && subject.expireAt.Before(expireAt) {
+		expireAt = subject.expireAt
+	}
+	claim := &security.GoClaim{
+		Issuer:     configuration.Get("token.issuer"),
+		Subscriber: subject.subject,
+		TokenType:  security.AccessToken,
+		Audience:   auds,
+		NotBefore:  now,
+		IssuedAt:   now,
+		ExpireAt:   expireAt,
+		Tokenid:    NewTokenId(),
+	}
+	accessToken, err := SignActorToken(claim, &Actor{Subject: actor.subject, Actor: subject.actor}, GetKeyring().Active())
+	if err != nil {
+		return nil, err
+	}
+	event.TokenId = claim.Tokenid
+	event.Outcome = AuditOutcomeGranted
+	return &TokenResponse{
+		AccessToken:     accessToken,
+		IssuedTokenType: TokenTypeAccessToken,
+		TokenType:       "Bearer",
+		ExpiresIn:       int64(expireAt.Sub(now) / time.Second),
+		Scope:           strings.Join(auds, " "),
+	}, nil
+}
+
+// exchangeActor returns the actor of the exchange, the actor token subject or the confidential client itself.
+func exchangeActor(ctx context.Context, dao DataAccess, client *OAuthClient, exchange *TokenExchangeRequest) (*exchangeParty, error) {
+	if len(exchange.ActorToken) == 0 {
+		if client.Public {
+			return nil, fmt.Errorf("%w, public client needs an actor token", ErrUnauthorizedClient)
+		}
+		return &exchangeParty{subject: client.Subject(), audience: client.Audience()}, nil
+	}
+	if exchange.ActorTokenType != TokenTypeAccessToken {
+		return nil, fmt.Errorf("%w, actor_token_type must be %s", ErrInvalidTokenExchange, TokenTypeAccessToken)
+	}
+	return verifyExchangeToken(ctx, dao, exchange.ActorToken)
+}
+
+// exchangeSubject returns the subject of the exchange, with the tenant roles it may be narrowed down to.
+func exchangeSubject(ctx context.Context, dao DataAccess, exchange *TokenExchangeRequest) (*exchangeParty, error) {
+	switch {
+	case len(exchange.SubjectToken) > 0 && len(exchange.RequestedSubject) > 0:
+		return nil, fmt.Errorf("%w, subject_token and requested_subject are exclusive", ErrInvalidTokenExchange)
+	case len(exchange.SubjectToken) > 0:
+		if exchange.SubjectTokenType != TokenTypeAccessToken {
+			return nil, fmt.Errorf("%w, subject_token_type must be %s", ErrInvalidTokenExchange, TokenTypeAccessToken)
+		}
+		return verifyExchangeToken(ctx, dao, exchange.SubjectToken)
+	case len(exchange.RequestedSubject) > 0:
+		profile, err := dao.GetUserProfile(ctx, exchange.RequestedSubject)
+		if errors.Is(err, ErrNotFound) {
+			return nil, ErrAccountDeleted
+		}
+		if err != nil {
+			return nil, err
+		}
+		if profile.Status == UserStatusDisabled {
+			return nil, ErrAccountDisabled
+		}
+		tenantRoles, err := dao.ListUserTenantRoles(ctx, profile.Email)
+		if err != nil {
+			return nil, err
+		}
+		return &exchangeParty{subject: profile.Email, audience: tenantRolesAudience(tenantRoles)}, nil
+	default:
+		return nil, fmt.Errorf("%w, subject_token or requested_subject is required", ErrInvalidTokenExchange)
+	}
+}
+
+// verifyExchangeToken verifies the access token presented in an exchange, and that it is not revoked.
+func verifyExchangeToken(ctx context.Context, dao DataAccess, token string) (*exchangeParty, error) {
+	claim, err := VerifyToken(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w, %s", ErrInvalidTokenExchange, err.Error())
+	}
+	if claim.TokenType != security.AccessToken {
+		return nil, fmt.Errorf("%w, %s", ErrInvalidTokenExchange, ErrWrongToken.Error())
+	}
+	revoked, err := dao.Revocations().IsRevoked(ctx, claim)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, fmt.Errorf("%w, %s", ErrInvalidTokenExchange, ErrTokenRevoked.Error())
+	}
+	return &exchangeParty{
+		subject:  claim.Subscriber,
+		audience: claim.Audience,
+		actor:    TokenActor(token),
+		expireAt: claim.ExpireAt,
+	}, nil
+}
+
+// mayImpersonate tells whether the audience is root, or holds the impersonate role in the tenant.
+func mayImpersonate(auds []string, tenant string) bool {
+	for _, aud := range auds {
+		tr, err := security.NewTenantRole(aud)
+		if err != nil {
+			continue
+		}
+		if tr.Validates(ReservedTenant, RootRole) || tr.Validates(tenant, ImpersonationRole) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,198 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/newm4n/dokku-aaa/configuration"
+	"github.com/newm4n/dokku-common/security"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exchangeToken posts a token exchange of the gateway client, it returns the token or the OAuth error code.
+func exchangeToken(t *testing.T, router http.Handler, secret string, form url.Values) (*TokenResponse, int, string) {
+	form.Set("grant_type", GrantTypeTokenExchange)
+	request := newTokenRequest(form)
+	request.SetBasicAuth("gateway", secret)
+	resp := serve(router, request)
+	if resp.Code == http.StatusOK {
+		token := &TokenResponse{}
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), token))
+		return token, resp.Code, ""
+	}
+	oerr := &OAuthError{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), oerr))
+	return nil, resp.Code, oerr.Code
+}
+
+// auditLines returns the audit log lines written since the last call, decoded.
+func auditLines(t *testing.T, out *bytes.Buffer) []map[string]interface{} {
+	lines := make([]map[string]interface{}, 0)
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if len(line) == 0 {
+			continue
+		}
+		fields := make(map[string]interface{})
+		assert.NoError(t, json.Unmarshal([]byte(line), &fields))
+		lines = append(lines, fields)
+	}
+	out.Reset()
+	return lines
+}
+
+func TestTheHandler_TokenExchange(t *testing.T) {
+	auditOut := &bytes.Buffer{}
+	setAuditOutput(auditOut)
+	defer setAuditOutput(os.Stderr)
+
+	router := newTestRouter()
+	resp := serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/create-user",
+		`{"Email":"user@mail.com","Passphrase":"a passphrase","TenantRole":["admin,viewer@ACME","viewer@BETA"]}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/create-user",
+		`{"Email":"support@mail.com","Passphrase":"a passphrase","TenantRole":["impersonate@ACME"]}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/client",
+		`{"ClientId":"gateway","Name":"Gateway","TenantRole":["impersonate@ACME"]}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	gateway := &ClientResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), gateway))
+	auditOut.Reset()
+
+	// the client impersonates a user of the tenant it holds the impersonate role in.
+	token, status, _ := exchangeToken(t, router, gateway.Secret, url.Values{"requested_subject": {"user@mail.com"}, "scope": {"viewer@ACME"}})
+	assert.Equal(t, http.StatusOK, status)
+	if assert.NotNil(t, token) {
+		assert.Equal(t, TokenTypeAccessToken, token.IssuedTokenType)
+		assert.Empty(t, token.RefreshToken)
+		assert.InDelta(t, 300, token.ExpiresIn, 2)
+		claim, err := VerifyToken(token.AccessToken)
+		assert.NoError(t, err)
+		assert.Equal(t, "user@mail.com", claim.Subscriber)
+		assert.Equal(t, []string{"viewer@ACME"}, claim.Audience)
+		assert.Equal(t, &Actor{Subject: "client:gateway"}, TokenActor(token.AccessToken))
+		lines := auditLines(t, auditOut)
+		if assert.Len(t, lines, 1) {
+			assert.Equal(t, "token_exchange", lines[0]["event"])
+			assert.Equal(t, AuditOutcomeGranted, lines[0]["outcome"])
+			assert.Equal(t, "client:gateway", lines[0]["actor"])
+			assert.Equal(t, "user@mail.com", lines[0]["subject"])
+			assert.Equal(t, claim.Tokenid, lines[0]["jti"])
+		}
+
+		// the exchanged token uses the tenant roles of the user, it does not manage the user account.
+		resp = serve(router, bearer(newRequest(http.MethodGet, "/userinfo", ""), token.AccessToken))
+		assert.Equal(t, http.StatusOK, resp.Code)
+		for _, request := range []*http.Request{
+			newRequest(http.MethodPost, "/mfa/totp", ""),
+			newRequest(http.MethodPost, "/webauthn/register/begin", ""),
+			newRequest(http.MethodGet, "/webauthn/credentials", ""),
+		} {
+			resp = serve(router, bearer(request, token.AccessToken))
+			assert.Equal(t, http.StatusForbidden, resp.Code, request.URL.Path)
+			assert.Contains(t, resp.Body.String(), ErrActorToken.Error(), request.URL.Path)
+		}
+	}
+
+	// but not in another tenant, and the refusal is audited too.
+	_, status, code := exchangeToken(t, router, gateway.Secret, url.Values{"requested_subject": {"user@mail.com"}, "scope": {"viewer@BETA"}})
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, "access_denied", code)
+	lines := auditLines(t, auditOut)
+	if assert.Len(t, lines, 1) {
+		assert.Equal(t, AuditOutcomeDenied, lines[0]["outcome"])
+		assert.Contains(t, lines[0]["reason"], "BETA")
+	}
+
+	// root may impersonate in any tenant.
+	rootToken, err := createAccessToken("root@mail.com", []string{"root@*"}, time.Minute)
+	assert.NoError(t, err)
+	token, status, _ = exchangeToken(t, router, gateway.Secret, url.Values{"requested_subject": {"user@mail.com"}, "scope": {"viewer@BETA"},
+		"actor_token": {rootToken}, "actor_token_type": {TokenTypeAccessToken}})
+	assert.Equal(t, http.StatusOK, status)
+	if assert.NotNil(t, token) {
+		assert.Equal(t, &Actor{Subject: "root@mail.com"}, TokenActor(token.AccessToken))
+	}
+
+	// the reserved tenant is never exchanged.
+	adminToken, err := createAccessToken("admin@mail.com", []string{"root@*"}, time.Minute)
+	assert.NoError(t, err)
+	_, status, code = exchangeToken(t, router, gateway.Secret, url.Values{"subject_token": {adminToken}, "subject_token_type": {TokenTypeAccessToken},
+		"scope": {"root@*"}, "actor_token": {rootToken}, "actor_token_type": {TokenTypeAccessToken}})
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "invalid_scope", code)
+
+	// a user without the impersonate role can not act for another one.
+	resp = serve(router, newRequest(http.MethodPost, "/login", `{"Email":"user@mail.com","Passphrase":"a passphrase"}`))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	userLogin := &AuthenticateResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), userLogin))
+	_, status, code = exchangeToken(t, router, gateway.Secret, url.Values{"requested_subject": {"support@mail.com"}, "scope": {"impersonate@ACME"},
+		"actor_token": {userLogin.Access}, "actor_token_type": {TokenTypeAccessToken}})
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, "access_denied", code)
+
+	// a subject token is narrowed down, the actors of an exchanged token are nested.
+	resp = serve(router, newRequest(http.MethodPost, "/login", `{"Email":"support@mail.com","Passphrase":"a passphrase"}`))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	supportLogin := &AuthenticateResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), supportLogin))
+	token, status, _ = exchangeToken(t, router, gateway.Secret, url.Values{"subject_token": {userLogin.Access}, "subject_token_type": {TokenTypeAccessToken},
+		"scope": {"admin@ACME"}, "actor_token": {supportLogin.Access}, "actor_token_type": {TokenTypeAccessToken}})
+	assert.Equal(t, http.StatusOK, status)
+	if assert.NotNil(t, token) {
+		nested, status, _ := exchangeToken(t, router, gateway.Secret, url.Values{"subject_token": {token.AccessToken},
+			"subject_token_type": {TokenTypeAccessToken}, "scope": {"admin@ACME"}})
+		assert.Equal(t, http.StatusOK, status)
+		if assert.NotNil(t, nested) {
+			claim, err := VerifyToken(nested.AccessToken)
+			assert.NoError(t, err)
+			assert.Equal(t, "user@mail.com", claim.Subscriber)
+			assert.Equal(t, []string{"admin@ACME"}, claim.Audience)
+			assert.Equal(t, &Actor{Subject: "client:gateway", Actor: &Actor{Subject: "support@mail.com"}}, TokenActor(nested.AccessToken))
+		}
+		_, status, code = exchangeToken(t, router, gateway.Secret, url.Values{"subject_token": {token.AccessToken},
+			"subject_token_type": {TokenTypeAccessToken}, "scope": {"viewer@BETA"}})
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Equal(t, "invalid_scope", code)
+	}
+
+	// malformed requests.
+	_, status, code = exchangeToken(t, router, gateway.Secret, url.Values{"requested_subject": {"user@mail.com"}})
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "invalid_scope", code)
+	_, _, code = exchangeToken(t, router, gateway.Secret, url.Values{"scope": {"viewer@ACME"}})
+	assert.Equal(t, "invalid_request", code)
+	_, _, code = exchangeToken(t, router, gateway.Secret, url.Values{"subject_token": {userLogin.Access}, "subject_token_type": {"urn:ietf:params:oauth:token-type:jwt"}, "scope": {"viewer@ACME"}})
+	assert.Equal(t, "invalid_request", code)
+	_, _, code = exchangeToken(t, router, gateway.Secret, url.Values{"subject_token": {userLogin.Refresh}, "subject_token_type": {TokenTypeAccessToken}, "scope": {"viewer@ACME"}})
+	assert.Equal(t, "invalid_request", code)
+	_, _, code = exchangeToken(t, router, gateway.Secret, url.Values{"requested_subject": {"nobody@mail.com"}, "scope": {"viewer@ACME"}})
+	assert.Equal(t, "invalid_grant", code)
+}
+
+func TestIntrospectToken_Actor(t *testing.T) {
+	now := time.Now()
+	claim := &security.GoClaim{
+		Issuer:     configuration.Get("token.issuer"),
+		Subscriber: "user@mail.com",
+		TokenType:  security.AccessToken,
+		Audience:   []string{"viewer@ACME"},
+		NotBefore:  now,
+		IssuedAt:   now,
+		ExpireAt:   now.Add(time.Minute),
+		Tokenid:    NewTokenId(),
+	}
+	token, err := SignActorToken(claim, &Actor{Subject: "gateway", Actor: &Actor{Subject: "support@mail.com"}}, GetKeyring().Active())
+	assert.NoError(t, err)
+	introspection, err := IntrospectToken(context.Background(), NewMemoryDAO().Revocations(), token)
+	assert.NoError(t, err)
+	assert.True(t, introspection.Active)
+	assert.Equal(t, &Actor{Subject: "gateway", Actor: &Actor{Subject: "support@mail.com"}}, introspection.Actor)
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/newm4n/dokku-aaa/configuration"
+	"github.com/newm4n/dokku-common/security"
+	"net/http"
+	"time"
+)
+
+var (
+	ErrTokenExpired       = fmt.Errorf("token is expired")
+	ErrClientUnauthorized = fmt.Errorf("client authentication failed")
+)
+
+// IntrospectionResponse is the RFC 7662 introspection response. Inactive tokens only carry active false,
+// so the caller learns nothing about why the token is not accepted.
+type IntrospectionResponse struct {
+	Active    bool     `json:"active"`
+	Subject   string   `json:"sub,omitempty"`
+	TokenType string   `json:"token_type,omitempty"`
+	Expire    int64    `json:"exp,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	Issuer    string   `json:"iss,omitempty"`
+	TokenId   string   `json:"jti,omitempty"`
+	Audience  []string `json:"aud,omitempty"`
+	// TenantRoles are the tenant roles of the subject carried by the token audience.
+	TenantRoles []*TenantRoles `json:"tenant_roles,omitempty"`
+	// Actor is the party acting on behalf of the subject, for tokens issued by the token exchange.
+	Actor *Actor `json:"act,omitempty"`
+	// Amr lists the methods the subject authenticated with (RFC 8176).
+	Amr []string `json:"amr,omitempty"`
+}
+
+// tokenTypeHints names the token types using the RFC 7009 token type hint values.
+var tokenTypeHints = map[security.TokenType]string{
+	security.AccessToken:  "access_token",
+	security.RefreshToken: "refresh_token",
+}
+
+// IntrospectToken verifies the token using the keyring, its issuer, expiry and revocation state.
+// It returns an inactive response when any of them fails, an error is only returned when the revocation
+// state can not be read.
+func IntrospectToken(ctx context.Context, revocation RevocationStore, token string) (*IntrospectionResponse, error) {
+	inactive := &IntrospectionResponse{}
+	claim, err := VerifyToken(token)
+	if err != nil {
+		return inactive, nil
+	}
+	if _, known := tokenTypeHints[claim.TokenType]; !known {
+		// MFA challenge tokens only prove the passphrase, they must never pass for an active token.
+		return inactive, nil
+	}
+	revoked, err := revocation.IsRevoked(ctx, claim)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return inactive, nil
+	}
+	resp := &IntrospectionResponse{
+		Active:    true,
+		Subject:   claim.Subscriber,
+		TokenType: tokenTypeHints[claim.TokenType],
+		Expire:    claim.ExpireAt.Unix(),
+		Issuer:    claim.Issuer,
+		TokenId:   claim.Tokenid,
+		Audience:  claim.Audience,
+		Actor:     TokenActor(token),
+		Amr:       TokenAmr(token),
+	}
+	if !claim.IssuedAt.IsZero() {
+		resp.IssuedAt = claim.IssuedAt.Unix()
+	}
+	if !claim.NotBefore.IsZero() {
+		resp.NotBefore = claim.NotBefore.Unix()
+	}
+	for _, aud := range claim.Audience {
+		trs, err := ParseTenantRole(aud)
+		if err != nil {
+			continue
+		}
+		resp.TenantRoles = append(resp.TenantRoles, trs...)
+	}
+	return resp, nil
+}
+
+// VerifyToken verifies the token signature using the keyring, and that it is issued by this server and not expired.
+// Tokens without expiry are refused.
+func VerifyToken(token string) (*security.GoClaim, error) {
+	claim, err := ParseKeyringToken(token, GetKeyring())
+	if err != nil {
+		return nil, err
+	}
+	if claim.Issuer != configuration.Get("token.issuer") {
+		return nil, ErrWrongIssuer
+	}
+	if claim.ExpireAt.IsZero() || !time.Now().Before(claim.ExpireAt) {
+		return nil, ErrTokenExpired
+	}
+	return claim, nil
+}
+
+// AuthenticateIntrospectionClient checks the HTTP basic credentials of the request against the configured
+// introspection client, then against the registered OAuth clients.
+func AuthenticateIntrospectionClient(ctx context.Context, clients ClientStore, request *http.Request) error {
+	id, secret, ok := request.BasicAuth()
+	if !ok {
+		return ErrClientUnauthorized
+	}
+	clientId, clientSecret := configuration.Get("introspection.client.id"), configuration.Get("introspection.client.secret")
+	if len(clientId) > 0 && len(clientSecret) > 0 {
+		idMatch := subtle.ConstantTimeCompare([]byte(id), []byte(clientId))
+		secretMatch := subtle.ConstantTimeCompare([]byte(secret), []byte(clientSecret))
+		if idMatch&secretMatch == 1 {
+			return nil
+		}
+	}
+	_, err := AuthenticateClient(ctx, clients, id, secret)
+	if errors.Is(err, ErrInvalidClientSecret) {
+		return ErrClientUnauthorized
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"encoding/json"
+	"github.com/newm4n/dokku-aaa/configuration"
+	"github.com/newm4n/dokku-common/security"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newIntrospectRequest(token, clientId, clientSecret string) *http.Request {
+	request := newRequest(http.MethodPost, "/introspect", url.Values{"token": {token}}.Encode())
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(clientId) > 0 {
+		request.SetBasicAuth(clientId, clientSecret)
+	}
+	return request
+}
+
+func introspect(t *testing.T, router http.Handler, token string) *IntrospectionResponse {
+	resp := serve(router, newIntrospectRequest(token, "resource-server", "resource secret"))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "no-store", resp.Header().Get("Cache-Control"))
+	introspection := &IntrospectionResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), introspection))
+	return introspection
+}
+
+func TestTheHandler_Introspect(t *testing.T) {
+	router := newTestRouter()
+	resp := serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/create-user",
+		`{"Email":"user@mail.com","Passphrase":"a passphrase","TenantRole":["admin,viewer@ACME"]}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	resp = serve(router, newRequest(http.MethodPost, "/login", `{"Email":"user@mail.com","Passphrase":"a passphrase"}`))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	login := &AuthenticateResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), login))
+
+	// refused until the introspection client is configured.
+	resp = serve(router, newIntrospectRequest(login.Access, "resource-server", "resource secret"))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	configuration.SetConfig("introspection.client.id", "resource-server")
+	configuration.SetConfig("introspection.client.secret", "resource secret")
+	defer func() {
+		configuration.SetConfig("introspection.client.id", "")
+		configuration.SetConfig("introspection.client.secret", "")
+	}()
+	resp = serve(router, newIntrospectRequest(login.Access, "", ""))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.Contains(t, resp.Header().Get("WWW-Authenticate"), "Basic")
+	resp = serve(router, newIntrospectRequest(login.Access, "resource-server", "wrong secret"))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	resp = serve(router, newIntrospectRequest("", "resource-server", "resource secret"))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	access := introspect(t, router, login.Access)
+	assert.True(t, access.Active)
+	assert.Equal(t, "user@mail.com", access.Subject)
+	assert.Equal(t, "access_token", access.TokenType)
+	assert.Equal(t, configuration.Get("token.issuer"), access.Issuer)
+	assert.NotZero(t, access.IssuedAt)
+	assert.Greater(t, access.Expire, time.Now().Unix())
+	assert.Equal(t, []*TenantRoles{{Tenant: "ACME", Roles: []string{"admin", "viewer"}}}, access.TenantRoles)
+
+	refresh := introspect(t, router, login.Refresh)
+	assert.True(t, refresh.Active)
+	assert.Equal(t, "refresh_token", refresh.TokenType)
+
+	assert.Equal(t, &IntrospectionResponse{}, introspect(t, router, "not a token"))
+
+	resp = serve(router, newRequest(http.MethodPost, "/logout", `{"Refresh":"`+login.Refresh+`"}`))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.False(t, introspect(t, router, login.Refresh).Active)
+	assert.True(t, introspect(t, router, login.Access).Active)
+}
+
+func TestVerifyToken(t *testing.T) {
+	claim := &security.GoClaim{
+		Issuer:     configuration.Get("token.issuer"),
+		Subscriber: "user@mail.com",
+		TokenType:  security.AccessToken,
+		IssuedAt:   time.Now(),
+		ExpireAt:   time.Now().Add(time.Hour),
+		Tokenid:    NewTokenId(),
+	}
+	token, err := SignToken(claim, GetKeyring().Active())
+	assert.NoError(t, err)
+	_, err = VerifyToken(token)
+	assert.NoError(t, err)
+
+	claim.Issuer = "somebody else"
+	token, err = SignToken(claim, GetKeyring().Active())
+	assert.NoError(t, err)
+	_, err = VerifyToken(token)
+	assert.ErrorIs(t, err, ErrWrongIssuer)
+
+	claim.Issuer = configuration.Get("token.issuer")
+	claim.ExpireAt = time.Time{}
+	token, err = SignToken(claim, GetKeyring().Active())
+	assert.NoError(t, err)
+	_, err = VerifyToken(token)
+	assert.ErrorIs(t, err, ErrTokenExpired)
+
+	_, err = VerifyToken(signTestToken(t, newTestSigningKey(t)))
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestUserTokenContextMiddleware_Issuer(t *testing.T) {
+	router := newTestRouter()
+	claim := &security.GoClaim{
+		Issuer:     "somebody else",
+		Subscriber: "root@mail.com",
+		Audience:   []string{"root@*"},
+		TokenType:  security.AccessToken,
+		IssuedAt:   time.Now(),
+		ExpireAt:   time.Now().Add(time.Hour),
+		Tokenid:    NewTokenId(),
+	}
+	// a token signed with the same key by another issuer is not accepted.
+	token, err := SignToken(claim, GetKeyring().Active())
+	assert.NoError(t, err)
+	resp := serve(router, bearer(newRequest(http.MethodGet, "/tenant", ""), token))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Contains(t, resp.Body.String(), ErrWrongIssuer.Error())
+
+	claim.Issuer = configuration.Get("token.issuer")
+	token, err = SignToken(claim, GetKeyring().Active())
+	assert.NoError(t, err)
+	resp = serve(router, bearer(newRequest(http.MethodGet, "/tenant", ""), token))
+	assert.Equal(t, http.StatusOK, resp.Code)
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+	stdcrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+)
+
+// JsonWebKey is the public part of a signing key, as published in the JWKS document (RFC 7517).
+type JsonWebKey struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid"`
+	// RSA members
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC and OKP members
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JsonWebKeySet is the JWKS document served at /.well-known/jwks.json.
+type JsonWebKeySet struct {
+	Keys []*JsonWebKey `json:"keys"`
+}
+
+// NewJsonWebKey creates the json web key of the public key, identified by its thumbprint.
+// The alg is left out when empty.
+func NewJsonWebKey(key stdcrypto.PublicKey, alg string) (*JsonWebKey, error) {
+	jwk, err := publicJsonWebKey(key)
+	if err != nil {
+		return nil, err
+	}
+	jwk.Use = "sig"
+	jwk.Alg = alg
+	jwk.Kid, err = jwk.thumbprint()
+	if err != nil {
+		return nil, err
+	}
+	return jwk, nil
+}
+
+// publicJsonWebKey creates the json web key having only the members defining the key.
+func publicJsonWebKey(key stdcrypto.PublicKey) (*JsonWebKey, error) {
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		return &JsonWebKey{
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		x, y := make([]byte, size), make([]byte, size)
+		pub.X.FillBytes(x)
+		pub.Y.FillBytes(y)
+		return &JsonWebKey{
+			Kty: "EC",
+			Crv: pub.Curve.Params().Name,
+			X:   base64.RawURLEncoding.EncodeToString(x),
+			Y:   base64.RawURLEncoding.EncodeToString(y),
+		}, nil
+	case ed25519.PublicKey:
+		return &JsonWebKey{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(pub),
+		}, nil
+	}
+	return nil, ErrUnsupportedKey
+}
+
+// thumbprint hashes the required members of the key in lexicographic order, without white space, as RFC 7638 requires.
+func (jwk *JsonWebKey) thumbprint() (string, error) {
+	var members interface{}
+	switch jwk.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{E: jwk.E, Kty: jwk.Kty, N: jwk.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{Crv: jwk.Crv, Kty: jwk.Kty, X: jwk.X, Y: jwk.Y}
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{Crv: jwk.Crv, Kty: jwk.Kty, X: jwk.X}
+	default:
+		return "", ErrUnsupportedKey
+	}
+	canonical, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// KeyThumbprint returns the RFC 7638 thumbprint of the public key, used as the kid of the key.
+// It only depends on the key, so the kid stays the same across restarts and servers sharing the key.
+func KeyThumbprint(key stdcrypto.PublicKey) (string, error) {
+	jwk, err := publicJsonWebKey(key)
+	if err != nil {
+		return "", err
+	}
+	return jwk.thumbprint()
+}
+
+// PublicJsonWebKeySet returns the JWKS document of every key in the keyring still verifying tokens.
+func PublicJsonWebKeySet(ring *Keyring) (*JsonWebKeySet, error) {
+	keys := ring.VerificationKeys()
+	jwks := &JsonWebKeySet{
+		Keys: make([]*JsonWebKey, 0, len(keys)),
+	}
+	for _, key := range keys {
+		jwk, err := NewJsonWebKey(key.Public, key.Alg)
+		if err != nil {
+			return nil, err
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks, nil
+}
@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/SermoDigital/jose/crypto"
+	"github.com/SermoDigital/jose/jws"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"net/http"
+	"testing"
+)
+
+// TestKeyThumbprint uses the example of RFC 7638 section 3.1.
+func TestKeyThumbprint(t *testing.T) {
+	n, err := base64.RawURLEncoding.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+	assert.NoError(t, err)
+	key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537}
+	kid, err := KeyThumbprint(key)
+	assert.NoError(t, err)
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", kid)
+}
+
+func TestTheHandler_Jwks(t *testing.T) {
+	router := newTestRouter()
+
+	resp := serve(router, newRequest(http.MethodGet, "/.well-known/jwks.json", ""))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "application/json", resp.Header().Get("Content-Type"))
+	jwks := &JsonWebKeySet{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), jwks))
+	assert.Len(t, jwks.Keys, 1)
+	jwk := jwks.Keys[0]
+	assert.Equal(t, "RSA", jwk.Kty)
+	assert.Equal(t, "RS512", jwk.Alg)
+
+	// a downstream service verifies the token using only the published key.
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	assert.NoError(t, err)
+	e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	assert.NoError(t, err)
+	key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+	access, err := CreateAccessToken("user@mail.com", []string{"viewer@ACME"}, nil)
+	assert.NoError(t, err)
+	token, err := jws.ParseJWT([]byte(access))
+	assert.NoError(t, err)
+	assert.Equal(t, jwk.Kid, token.(jws.JWS).Protected().Get("kid"))
+	claim, err := ParseToken(access, key, crypto.SigningMethodRS512)
+	assert.NoError(t, err)
+	assert.Equal(t, "user@mail.com", claim.Subscriber)
+}
@@ -0,0 +1,368 @@
+package internal
+
+import (
+	stdcrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"github.com/SermoDigital/jose/crypto"
+	"github.com/SermoDigital/jose/jws"
+	"github.com/hyperjumptech/jiffy"
+	"github.com/newm4n/dokku-aaa/configuration"
+	"github.com/newm4n/dokku-common/security"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownKey   = fmt.Errorf("token is signed by unknown key")
+	ErrKeyUnchanged = fmt.Errorf("signing key is unchanged")
+	ErrMalformedKey = fmt.Errorf("malformed pem key")
+	ErrNoSigningKey = fmt.Errorf("key can only verify tokens")
+	ErrDemoKey      = fmt.Errorf("refusing the demo key in strict key mode, generate a new key pair")
+	ErrKeyMode      = fmt.Errorf("unknown key mode")
+	keyringMutex    sync.Mutex
+	keyring         *Keyring
+)
+
+// SigningKey is a key of the Keyring. Retired keys only verify tokens, they have no private key.
+// Keys retired before the last restart have no Alg, they verify tokens of any algorithm matching their key type.
+type SigningKey struct {
+	Kid       string
+	Alg       string
+	Method    crypto.SigningMethod
+	Private   stdcrypto.Signer
+	Public    stdcrypto.PublicKey
+	RetiredAt time.Time
+}
+
+// NewSigningKey creates the key identified by the thumbprint of its public key.
+// It fails when the algorithm does not match the key type, or the public key does not belong to the private key.
+func NewSigningKey(private stdcrypto.Signer, public stdcrypto.PublicKey, alg string) (*SigningKey, error) {
+	key := &SigningKey{
+		Alg:     alg,
+		Private: private,
+		Public:  public,
+	}
+	if len(alg) > 0 {
+		if err := CheckKeyAlgorithm(alg, public); err != nil {
+			return nil, err
+		}
+		key.Method, _ = SigningMethodFor(alg)
+	}
+	if private != nil {
+		if pub, ok := private.Public().(interface {
+			Equal(stdcrypto.PublicKey) bool
+		}); !ok || !pub.Equal(public) {
+			return nil, ErrKeyPairMismatch
+		}
+	}
+	kid, err := KeyThumbprint(public)
+	if err != nil {
+		return nil, err
+	}
+	key.Kid = kid
+	return key, nil
+}
+
+// canVerify tells whether the key may verify a token signed using the algorithm.
+func (key *SigningKey) canVerify(alg string) bool {
+	if len(key.Alg) > 0 {
+		return key.Alg == alg
+	}
+	return CheckKeyAlgorithm(alg, key.Public) == nil
+}
+
+// Keyring holds the active signing key, and the retired keys still verifying the tokens they signed
+// until their overlap window ends.
+type Keyring struct {
+	mutex   sync.RWMutex
+	active  *SigningKey
+	retired []*SigningKey
+	overlap time.Duration
+}
+
+func NewKeyring(active *SigningKey, overlap time.Duration) *Keyring {
+	return &Keyring{
+		active:  active,
+		retired: make([]*SigningKey, 0),
+		overlap: overlap,
+	}
+}
+
+// Active returns the key signing every new token.
+func (ring *Keyring) Active() *SigningKey {
+	ring.mutex.RLock()
+	defer ring.mutex.RUnlock()
+	return ring.active
+}
+
+// Rotate makes the key the active signing key. The previous one is retired, it keeps verifying
+// the tokens it signed for the overlap window.
+func (ring *Keyring) Rotate(next *SigningKey) error {
+	if next == nil || next.Private == nil || next.Method == nil {
+		return ErrNoSigningKey
+	}
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+	if ring.active.Kid == next.Kid {
+		return ErrKeyUnchanged
+	}
+	now := time.Now()
+	valid := make([]*SigningKey, 0, len(ring.retired)+1)
+	for _, key := range ring.retired {
+		if now.Before(key.RetiredAt.Add(ring.overlap)) {
+			valid = append(valid, key)
+		}
+	}
+	retired := *ring.active
+	retired.Private = nil
+	retired.RetiredAt = now
+	ring.retired = append(valid, &retired)
+	ring.active = next
+	return nil
+}
+
+// Retire adds a key that only verifies tokens, for the overlap window starting at retiredAt.
+func (ring *Keyring) Retire(public stdcrypto.PublicKey, retiredAt time.Time) error {
+	key, err := NewSigningKey(nil, public, "")
+	if err != nil {
+		return err
+	}
+	key.RetiredAt = retiredAt
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+	ring.retired = append(ring.retired, key)
+	return nil
+}
+
+// VerificationKeys returns the active key followed by every retired key still in its overlap window.
+func (ring *Keyring) VerificationKeys() []*SigningKey {
+	now := time.Now()
+	ring.mutex.RLock()
+	defer ring.mutex.RUnlock()
+	ret := []*SigningKey{ring.active}
+	for _, key := range ring.retired {
+		if now.Before(key.RetiredAt.Add(ring.overlap)) {
+			ret = append(ret, key)
+		}
+	}
+	return ret
+}
+
+// VerificationKey returns the key with the kid, as long as it may still verify tokens.
+func (ring *Keyring) VerificationKey(kid string) (*SigningKey, error) {
+	for _, key := range ring.VerificationKeys() {
+		if key.Kid == kid {
+			return key, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// ParseKeyringToken verifies the token using the keyring key named by its kid header, and returns its claim.
+// The token algorithm must be the one of the key. Tokens signed before they carried a kid are tried
+// against every key of the keyring.
+func ParseKeyringToken(tokenString string, ring *Keyring) (*security.GoClaim, error) {
+	token, err := jws.ParseJWT([]byte(tokenString))
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	header := token.(jws.JWS).Protected()
+	alg, _ := header.Get("alg").(string)
+	method, err := SigningMethodFor(alg)
+	if err != nil {
+		return nil, err
+	}
+	kid, _ := header.Get("kid").(string)
+	if len(kid) > 0 {
+		key, err := ring.VerificationKey(kid)
+		if err != nil {
+			return nil, err
+		}
+		if !key.canVerify(alg) {
+			return nil, ErrAlgorithmMismatch
+		}
+		return ParseToken(tokenString, key.Public, method)
+	}
+	err = ErrUnknownKey
+	for _, key := range ring.VerificationKeys() {
+		if !key.canVerify(alg) {
+			continue
+		}
+		var claim *security.GoClaim
+		if claim, err = ParseToken(tokenString, key.Public, method); err == nil {
+			return claim, nil
+		}
+	}
+	return nil, err
+}
+
+// GetKeyring returns the server keyring, loaded by LoadKeyring on first use. It panics when the keyring can not be
+// loaded, the server should not start without its signing key.
+func GetKeyring() *Keyring {
+	keyringMutex.Lock()
+	defer keyringMutex.Unlock()
+	if keyring != nil {
+		return keyring
+	}
+	ring, err := LoadKeyring()
+	if err != nil {
+		panic(err)
+	}
+	keyring = ring
+	return keyring
+}
+
+// LoadKeyring creates the keyring whose active key is loaded from the configured PEM files using token.signing.algorithm,
+// see loadActiveKey.
+// Every public PEM listed in token.key.retired.public.pem.paths is retired, starting its overlap window now.
+func LoadKeyring() (*Keyring, error) {
+	overlap, err := jiffy.DurationOf(configuration.Get("token.key.overlap"))
+	if err != nil {
+		return nil, err
+	}
+	active, err := loadActiveKey()
+	if err != nil {
+		return nil, err
+	}
+	ring := NewKeyring(active, overlap)
+	for _, path := range strings.Split(configuration.Get("token.key.retired.public.pem.paths"), ",") {
+		if path = strings.TrimSpace(path); len(path) == 0 {
+			continue
+		}
+		pemBytes, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		retired, err := ParsePublicKeyPEM(pemBytes)
+		if err != nil {
+			return nil, fmt.Errorf("can not load retired public key from %s. got %w", path, err)
+		}
+		if err := ring.Retire(retired, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	return ring, nil
+}
+
+const (
+	// KeyModeStrict refuses to start without a valid key pair in the configured PEM files, or with the demo key.
+	KeyModeStrict = "strict"
+	// KeyModeDev signs using an ephemeral key when the configured PEM files can not be loaded.
+	KeyModeDev = "dev"
+)
+
+// loadActiveKey loads the signing key from the configured PEM files. When they can not be loaded,
+// the startup fails in strict key mode, while dev key mode generates an ephemeral key.
+func loadActiveKey() (*SigningKey, error) {
+	mode := configuration.Get("token.key.mode")
+	if mode != KeyModeStrict && mode != KeyModeDev {
+		return nil, fmt.Errorf("%w \"%s\", expect %s or %s", ErrKeyMode, mode, KeyModeStrict, KeyModeDev)
+	}
+	key, err := LoadSigningKey()
+	if err == nil || mode == KeyModeStrict {
+		return key, err
+	}
+	log.Warnf("Can not load the signing key from file, using an ephemeral key. Tokens become invalid on restart. Got %s", err.Error())
+	return GenerateSigningKey(configuration.Get("token.signing.algorithm"))
+}
+
+// LoadSigningKey reads the key pair from the configured PEM files using token.signing.algorithm,
+// and makes sure they sign tokens the public key verifies. The demo key is refused in strict key mode.
+func LoadSigningKey() (*SigningKey, error) {
+	priPath, pubPath := configuration.Get("token.key.private.pem.path"), configuration.Get("token.key.public.pem.path")
+	priBytes, err := os.ReadFile(priPath)
+	if err != nil {
+		return nil, err
+	}
+	priKey, err := ParsePrivateKeyPEM(priBytes)
+	if err != nil {
+		return nil, fmt.Errorf("can not load private key from %s. got %w", priPath, err)
+	}
+	pubBytes, err := os.ReadFile(pubPath)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, err := ParsePublicKeyPEM(pubBytes)
+	if err != nil {
+		return nil, fmt.Errorf("can not load public key from %s. got %w", pubPath, err)
+	}
+	key, err := NewSigningKey(priKey, pubKey, configuration.Get("token.signing.algorithm"))
+	if err != nil {
+		return nil, err
+	}
+	if configuration.Get("token.key.mode") == KeyModeStrict && isDemoKey(key) {
+		return nil, ErrDemoKey
+	}
+	if err := ValidateSigningKey(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ValidateSigningKey signs a probe token and verifies it using the public key.
+func ValidateSigningKey(key *SigningKey) error {
+	probe := &security.GoClaim{
+		Subscriber: "key-validation",
+		ExpireAt:   time.Now().Add(time.Minute),
+		Tokenid:    NewTokenId(),
+	}
+	token, err := SignToken(probe, key)
+	if err != nil {
+		return fmt.Errorf("%w, can not sign. got %s", ErrKeyPairMismatch, err.Error())
+	}
+	if _, err := ParseToken(token, key.Public, key.Method); err != nil {
+		return fmt.Errorf("%w, can not verify. got %s", ErrKeyPairMismatch, err.Error())
+	}
+	return nil
+}
+
+// isDemoKey tells whether the key is DefaultPrivatePEM, published in README.
+func isDemoKey(key *SigningKey) bool {
+	demoKey, err := ParsePublicKeyPEM([]byte(DefaultPublicPEM))
+	if err != nil {
+		panic(err)
+	}
+	demoKid, err := KeyThumbprint(demoKey)
+	if err != nil {
+		panic(err)
+	}
+	return key.Kid == demoKid
+}
+
+// GenerateSigningKey creates a new key of the type the algorithm needs, RSA keys are 2048 bits.
+func GenerateSigningKey(alg string) (*SigningKey, error) {
+	method, err := SigningMethodFor(alg)
+	if err != nil {
+		return nil, err
+	}
+	var priKey stdcrypto.Signer
+	switch method := method.(type) {
+	case *SigningMethodECDSA:
+		priKey, err = ecdsa.GenerateKey(method.Curve, rand.Reader)
+	case *SigningMethodEdDSA:
+		_, priKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		priKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewSigningKey(priKey, priKey.Public(), alg)
+}
+
+// GetPrivateKey returns the private key of the active signing key.
+func GetPrivateKey() stdcrypto.Signer {
+	return GetKeyring().Active().Private
+}
+
+// GetPublicKey returns the public key of the active signing key.
+func GetPublicKey() stdcrypto.PublicKey {
+	return GetKeyring().Active().Public
+}
@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/SermoDigital/jose/crypto"
+	"github.com/newm4n/dokku-aaa/configuration"
+	"github.com/newm4n/dokku-common/security"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestSigningKey(t *testing.T) *SigningKey {
+	privKey, pubKey, err := security.GenerateKeyPair(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := NewSigningKey(privKey, pubKey, "RS512")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func signTestToken(t *testing.T, key *SigningKey) string {
+	claim := &security.GoClaim{
+		Subscriber: "user@mail.com",
+		TokenType:  security.AccessToken,
+		IssuedAt:   time.Now(),
+		ExpireAt:   time.Now().Add(time.Hour),
+		Tokenid:    NewTokenId(),
+	}
+	token, err := SignToken(claim, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestKeyring_Rotate(t *testing.T) {
+	first, second := newTestSigningKey(t), newTestSigningKey(t)
+	ring := NewKeyring(first, time.Hour)
+	firstToken := signTestToken(t, ring.Active())
+
+	assert.NoError(t, ring.Rotate(second))
+	assert.Equal(t, second.Kid, ring.Active().Kid)
+	assert.Len(t, ring.VerificationKeys(), 2)
+	assert.ErrorIs(t, ring.Rotate(second), ErrKeyUnchanged)
+	verifyOnly, err := NewSigningKey(nil, first.Public, "RS512")
+	assert.NoError(t, err)
+	assert.ErrorIs(t, ring.Rotate(verifyOnly), ErrNoSigningKey)
+
+	claim, err := ParseKeyringToken(firstToken, ring)
+	assert.NoError(t, err)
+	assert.Equal(t, "user@mail.com", claim.Subscriber)
+	_, err = ParseKeyringToken(signTestToken(t, ring.Active()), ring)
+	assert.NoError(t, err)
+
+	// tokens signed before they carried a kid are tried against every key.
+	noKid, err := (&security.GoClaim{Subscriber: "user@mail.com", ExpireAt: time.Now().Add(time.Hour)}).ToToken(first.Private.(*rsa.PrivateKey), crypto.SigningMethodRS512)
+	assert.NoError(t, err)
+	_, err = ParseKeyringToken(noKid, ring)
+	assert.NoError(t, err)
+
+	_, err = ParseKeyringToken(signTestToken(t, newTestSigningKey(t)), ring)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestKeyring_OverlapEnds(t *testing.T) {
+	first, second := newTestSigningKey(t), newTestSigningKey(t)
+	ring := NewKeyring(first, 0)
+	firstToken := signTestToken(t, first)
+
+	assert.NoError(t, ring.Rotate(second))
+	assert.Len(t, ring.VerificationKeys(), 1)
+	_, err := ParseKeyringToken(firstToken, ring)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	assert.NoError(t, ring.Retire(first.Public, time.Now().Add(-time.Minute)))
+	assert.Len(t, ring.VerificationKeys(), 1)
+}
+
+// writeTestKeyFiles writes the key pair as PKCS#8 and PKIX PEM files, and configures the server to use them.
+func writeTestKeyFiles(t *testing.T, key *SigningKey) {
+	dir := t.TempDir()
+	priBytes, err := x509.MarshalPKCS8PrivateKey(key.Private)
+	assert.NoError(t, err)
+	pubBytes, err := x509.MarshalPKIXPublicKey(key.Public)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "private.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: priBytes}), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "public.pem"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes}), 0644))
+	configuration.SetConfig("token.key.private.pem.path", filepath.Join(dir, "private.pem"))
+	configuration.SetConfig("token.key.public.pem.path", filepath.Join(dir, "public.pem"))
+}
+
+func TestTheHandler_RotateKey(t *testing.T) {
+	saved := keyring
+	defer func() {
+		keyring = saved
+		configuration.SetConfig("token.key.private.pem.path", "")
+		configuration.SetConfig("token.key.public.pem.path", "")
+	}()
+	keyring = NewKeyring(newTestSigningKey(t), time.Hour)
+	router := newTestRouter()
+
+	resp := serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/create-user", `{"Email":"user@mail.com","Passphrase":"a passphrase"}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	resp = serve(router, newRequest(http.MethodPost, "/login", `{"Email":"user@mail.com","Passphrase":"a passphrase"}`))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	login := &AuthenticateResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), login))
+
+	next := newTestSigningKey(t)
+	writeTestKeyFiles(t, next)
+	resp = serve(router, newRequest(http.MethodPost, "/keys/rotate", ""))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/keys/rotate", "")))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/keys/rotate", "")))
+	assert.Equal(t, http.StatusConflict, resp.Code)
+
+	resp = serve(router, newRequest(http.MethodGet, "/.well-known/jwks.json", ""))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	jwks := &JsonWebKeySet{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), jwks))
+	assert.Len(t, jwks.Keys, 2)
+	assert.Equal(t, next.Kid, jwks.Keys[0].Kid)
+
+	// the refresh token signed before the rotation still works, the new access token is signed by the new key.
+	resp = serve(router, newRequest(http.MethodPost, "/refresh", `{"Refresh":"`+login.Refresh+`"}`))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	refreshed := &RefreshResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), refreshed))
+	_, err := ParseToken(refreshed.Access, next.Public, crypto.SigningMethodRS512)
+	assert.NoError(t, err)
+
+	request := newRequest(http.MethodGet, "/tenant", "")
+	request.Header.Set("Authorization", "Bearer "+login.Access)
+	resp = serve(router, request)
+	assert.NotContains(t, resp.Body.String(), "token contains problem")
+}
+
+func TestLoadKeyring_KeyMode(t *testing.T) {
+	dir := t.TempDir()
+	defer func() {
+		configuration.SetConfig("token.key.private.pem.path", "")
+		configuration.SetConfig("token.key.public.pem.path", "")
+		configuration.SetConfig("token.key.mode", "")
+	}()
+
+	configuration.SetConfig("token.key.private.pem.path", filepath.Join(dir, "missing-private.pem"))
+	configuration.SetConfig("token.key.public.pem.path", filepath.Join(dir, "missing-public.pem"))
+	_, err := LoadKeyring()
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	configuration.SetConfig("token.key.mode", KeyModeDev)
+	ring, err := LoadKeyring()
+	assert.NoError(t, err)
+	assert.NoError(t, ValidateSigningKey(ring.Active()))
+	other, err := LoadKeyring()
+	assert.NoError(t, err)
+	assert.NotEqual(t, ring.Active().Kid, other.Active().Kid)
+
+	configuration.SetConfig("token.key.mode", "production")
+	_, err = LoadKeyring()
+	assert.ErrorIs(t, err, ErrKeyMode)
+}
+
+func TestLoadKeyring_DemoKey(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "private.pem"), []byte(DefaultPrivatePEM), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "public.pem"), []byte(DefaultPublicPEM), 0644))
+	configuration.SetConfig("token.key.private.pem.path", filepath.Join(dir, "private.pem"))
+	configuration.SetConfig("token.key.public.pem.path", filepath.Join(dir, "public.pem"))
+	defer func() {
+		configuration.SetConfig("token.key.private.pem.path", "")
+		configuration.SetConfig("token.key.public.pem.path", "")
+		configuration.SetConfig("token.key.mode", "")
+	}()
+
+	_, err := LoadKeyring()
+	assert.ErrorIs(t, err, ErrDemoKey)
+
+	// the demo key is a matching pair, usable for local development.
+	configuration.SetConfig("token.key.mode", KeyModeDev)
+	ring, err := LoadKeyring()
+	assert.NoError(t, err)
+	assert.True(t, isDemoKey(ring.Active()))
+}
+
+func TestLoadSigningKey_PairMismatch(t *testing.T) {
+	key := newTestSigningKey(t)
+	writeTestKeyFiles(t, key)
+	other := newTestSigningKey(t)
+	pubBytes, err := x509.MarshalPKIXPublicKey(other.Public)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(configuration.Get("token.key.public.pem.path"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes}), 0644))
+	defer func() {
+		configuration.SetConfig("token.key.private.pem.path", "")
+		configuration.SetConfig("token.key.public.pem.path", "")
+	}()
+
+	_, err = LoadSigningKey()
+	assert.ErrorIs(t, err, ErrKeyPairMismatch)
+}
+
+func TestGenerateSigningKey(t *testing.T) {
+	for _, alg := range []string{"RS256", "PS384", "ES256", "ES384", "ES512", "EdDSA"} {
+		key, err := GenerateSigningKey(alg)
+		assert.NoError(t, err, alg)
+		assert.NoError(t, ValidateSigningKey(key), alg)
+	}
+	_, err := GenerateSigningKey("HS256")
+	assert.ErrorIs(t, err, ErrUnknownAlgorithm)
+}
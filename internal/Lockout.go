@@ -0,0 +1,338 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/hyperjumptech/jiffy"
+	"github.com/newm4n/dokku-aaa/configuration"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LoginAttempts is the count of the failed sign in attempts of an account or a client address.
+type LoginAttempts struct {
+	Failures    int
+	LastFailure time.Time
+}
+
+// LoginAttemptStore counts the failed sign in attempts. Replicas sharing the store share the counts,
+// so an attacker can not spread the attempts over them.
+type LoginAttemptStore interface {
+	// GetAttempts returns the failed attempts of the key, with no failure when there is none.
+	GetAttempts(ctx context.Context, key string) (*LoginAttempts, error)
+	// RecordFailure counts a failed attempt of the key at now, and returns the updated count.
+	// The failures older than the window are forgotten first.
+	RecordFailure(ctx context.Context, key string, now time.Time, window time.Duration) (*LoginAttempts, error)
+	// ResetAttempts forgets the failed attempts of the key.
+	ResetAttempts(ctx context.Context, key string) error
+}
+
+// loginRule is how the failed attempts of one key delay the next sign in.
+type loginRule struct {
+	key     string
+	address string
+	email   string
+	// free is the number of failures allowed before backing off, lockout the number locking the sign in.
+	free    int
+	lockout int
+}
+
+// loginRules returns the rules guarding the sign in of the email from the client address, a lockout of 0 turns
+// the rule off.
+func loginRules(email, address string) []*loginRule {
+	rules := make([]*loginRule, 0, 2)
+	if lockout := configuration.GetInt("login.account.lockout"); lockout > 0 && len(email) > 0 {
+		rules = append(rules, &loginRule{
+			key:     accountAttemptKey(email),
+			email:   email,
+			address: address,
+			free:    configuration.GetInt("login.account.free"),
+			lockout: lockout,
+		})
+	}
+	if lockout := configuration.GetInt("login.address.lockout"); lockout > 0 && len(address) > 0 {
+		rules = append(rules, &loginRule{
+			key:     "address:" + address,
+			address: address,
+			free:    configuration.GetInt("login.address.free"),
+			lockout: lockout,
+		})
+	}
+	return rules
+}
+
+func accountAttemptKey(email string) string {
+	return "account:" + normalizeEmail(email)
+}
+
+// loginPolicy is the timing of the rules.
+type loginPolicy struct {
+	backoff    time.Duration
+	lockoutAge time.Duration
+	window     time.Duration
+}
+
+func getLoginPolicy() (*loginPolicy, error) {
+	backoff, err := jiffy.DurationOf(configuration.Get("login.backoff"))
+	if err != nil {
+		return nil, err
+	}
+	lockoutAge, err := jiffy.DurationOf(configuration.Get("login.lockout.age"))
+	if err != nil {
+		return nil, err
+	}
+	window, err := jiffy.DurationOf(configuration.Get("login.attempt.window"))
+	if err != nil {
+		return nil, err
+	}
+	return &loginPolicy{backoff: backoff, lockoutAge: lockoutAge, window: window}, nil
+}
+
+// delay returns how long after the last failure the sign in stays refused. Past the free failures it is
+// the backoff, doubled at every further failure, until the lockout threshold refuses it for the lockout age.
+func (policy *loginPolicy) delay(rule *loginRule, failures int) time.Duration {
+	if failures >= rule.lockout {
+		return policy.lockoutAge
+	}
+	if failures <= rule.free {
+		return 0
+	}
+	exponent := failures - rule.free - 1
+	if exponent >= 32 || policy.backoff<<exponent > policy.lockoutAge {
+		return policy.lockoutAge
+	}
+	return policy.backoff << exponent
+}
+
+// LoginRetryAfter tells how long the sign in of the email from the client address is refused, zero when it is not.
+// It is checked before the passphrase, so a refused attempt costs no hashing.
+func LoginRetryAfter(ctx context.Context, store LoginAttemptStore, email, address string) (time.Duration, error) {
+	policy, err := getLoginPolicy()
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	var retryAfter time.Duration
+	for _, rule := range loginRules(email, address) {
+		attempts, err := store.GetAttempts(ctx, rule.key)
+		if err != nil {
+			return 0, err
+		}
+		if attempts.Failures == 0 || now.Sub(attempts.LastFailure) > policy.window {
+			continue
+		}
+		if wait := attempts.LastFailure.Add(policy.delay(rule, attempts.Failures)).Sub(now); wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	return retryAfter, nil
+}
+
+// LoginFailed counts a failed sign in of the email from the client address. Reaching the lockout threshold is audited.
+func LoginFailed(ctx context.Context, store LoginAttemptStore, email, address string) error {
+	policy, err := getLoginPolicy()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, rule := range loginRules(email, address) {
+		attempts, err := store.RecordFailure(ctx, rule.key, now, policy.window)
+		if err != nil {
+			return err
+		}
+		if attempts.Failures == rule.lockout {
+			Audit(&AuditEvent{
+				Event:   "login_lockout",
+				Actor:   rule.address,
+				Subject: rule.email,
+				Outcome: AuditOutcomeDenied,
+				Reason:  fmt.Sprintf("%d failed sign in attempts", attempts.Failures),
+			})
+		}
+	}
+	return nil
+}
+
+// LoginSucceeded forgets the failed attempts of the account. Those of the client address are kept, signing in
+// to an account of its own must not let an attacker try again on the others.
+func LoginSucceeded(ctx context.Context, store LoginAttemptStore, email string) error {
+	return store.ResetAttempts(ctx, accountAttemptKey(email))
+}
+
+// UnlockAccount forgets the failed attempts of the account, the next sign in is no longer refused.
+func UnlockAccount(ctx context.Context, store LoginAttemptStore, email string) error {
+	return store.ResetAttempts(ctx, accountAttemptKey(email))
+}
+
+// ClientAddress returns the ip address of the client sending the request. When server.proxy.trusted is on,
+// it is the last X-Forwarded-For entry, the one appended by the proxy, the others are set by the client.
+func ClientAddress(request *http.Request) string {
+	if configuration.GetBoolean("server.proxy.trusted") {
+		if forwarded := request.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			entries := strings.Split(forwarded[len(forwarded)-1], ",")
+			if address := strings.TrimSpace(entries[len(entries)-1]); len(address) > 0 {
+				return address
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// retryAfterSeconds is the Retry-After header value of the duration, rounded up to a whole second.
+func retryAfterSeconds(retryAfter time.Duration) int {
+	return int(math.Ceil(retryAfter.Seconds()))
+}
+
+// MemoryLoginAttemptStore is the in memory LoginAttemptStore, each replica counts on its own and counts are lost on restart.
+type MemoryLoginAttemptStore struct {
+	mutex     sync.Mutex
+	attempts  map[string]*LoginAttempts
+	lastPurge time.Time
+	// window is the longest window seen, the purge keeps every count younger than that.
+	window time.Duration
+}
+
+func NewMemoryLoginAttemptStore() *MemoryLoginAttemptStore {
+	return &MemoryLoginAttemptStore{
+		attempts:  make(map[string]*LoginAttempts),
+		lastPurge: time.Now(),
+	}
+}
+
+// purge removes the forgotten counts, at most once a minute. The caller must hold the mutex.
+func (store *MemoryLoginAttemptStore) purge(now time.Time) {
+	if now.Sub(store.lastPurge) < time.Minute {
+		return
+	}
+	for key, attempts := range store.attempts {
+		if now.Sub(attempts.LastFailure) > store.window {
+			delete(store.attempts, key)
+		}
+	}
+	store.lastPurge = now
+}
+
+func (store *MemoryLoginAttemptStore) GetAttempts(ctx context.Context, key string) (*LoginAttempts, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if attempts, exist := store.attempts[key]; exist {
+		ret := *attempts
+		return &ret, nil
+	}
+	return &LoginAttempts{}, nil
+}
+
+func (store *MemoryLoginAttemptStore) RecordFailure(ctx context.Context, key string, now time.Time, window time.Duration) (*LoginAttempts, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if window > store.window {
+		store.window = window
+	}
+	store.purge(now)
+	attempts, exist := store.attempts[key]
+	if !exist || now.Sub(attempts.LastFailure) > window {
+		attempts = &LoginAttempts{}
+		store.attempts[key] = attempts
+	}
+	attempts.Failures++
+	attempts.LastFailure = now
+	ret := *attempts
+	return &ret, nil
+}
+
+func (store *MemoryLoginAttemptStore) ResetAttempts(ctx context.Context, key string) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if len(key) == 0 {
+		return ErrArgumentEmpty
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.attempts, key)
+	return nil
+}
+
+// SqlLoginAttemptStore is the LoginAttemptStore kept in the login_attempt table of a SqlDAO database,
+// replicas sharing the database share the counts.
+type SqlLoginAttemptStore struct {
+	DB *sql.DB
+}
+
+func NewSqlLoginAttemptStore(db *sql.DB) *SqlLoginAttemptStore {
+	return &SqlLoginAttemptStore{DB: db}
+}
+
+func (store *SqlLoginAttemptStore) GetAttempts(ctx context.Context, key string) (*LoginAttempts, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	attempts := &LoginAttempts{}
+	err := store.DB.QueryRowContext(ctx, `SELECT failures, last_failure_at FROM login_attempt WHERE attempt_key = $1`, key).
+		Scan(&attempts.Failures, &attempts.LastFailure)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &LoginAttempts{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
+func (store *SqlLoginAttemptStore) RecordFailure(ctx context.Context, key string, now time.Time, window time.Duration) (*LoginAttempts, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	forgetBefore := sqlTime(now.Add(-window))
+	if _, err := store.DB.ExecContext(ctx, `DELETE FROM login_attempt WHERE last_failure_at < $1`, forgetBefore); err != nil {
+		return nil, err
+	}
+	// a single statement, so failures counted at the same time by several replicas are all kept.
+	attempts := &LoginAttempts{}
+	err := store.DB.QueryRowContext(ctx, `INSERT INTO login_attempt (attempt_key, failures, last_failure_at) VALUES ($1, 1, $2)
+ON CONFLICT (attempt_key) DO UPDATE SET failures = login_attempt.failures + 1, last_failure_at = excluded.last_failure_at
+RETURNING failures, last_failure_at`, key, sqlTime(now)).Scan(&attempts.Failures, &attempts.LastFailure)
+	if err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
+func (store *SqlLoginAttemptStore) ResetAttempts(ctx context.Context, key string) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if len(key) == 0 {
+		return ErrArgumentEmpty
+	}
+	_, err := store.DB.ExecContext(ctx, `DELETE FROM login_attempt WHERE attempt_key = $1`, key)
+	return err
+}
@@ -0,0 +1,233 @@
+package internal
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"github.com/newm4n/dokku-aaa/configuration"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLoginPolicy_Delay(t *testing.T) {
+	policy := &loginPolicy{backoff: time.Second, lockoutAge: 15 * time.Minute, window: time.Hour}
+	rule := &loginRule{free: 3, lockout: 10}
+	for failures, want := range map[int]time.Duration{
+		1:  0,
+		3:  0,
+		4:  time.Second,
+		5:  2 * time.Second,
+		9:  32 * time.Second,
+		10: 15 * time.Minute,
+		50: 15 * time.Minute,
+	} {
+		assert.Equal(t, want, policy.delay(rule, failures), failures)
+	}
+
+	// the backoff never exceeds the lockout age, nor overflows.
+	rule = &loginRule{free: 0, lockout: 1000}
+	assert.Equal(t, 8*time.Minute+32*time.Second, policy.delay(rule, 10))
+	assert.Equal(t, 15*time.Minute, policy.delay(rule, 11))
+	assert.Equal(t, 15*time.Minute, policy.delay(rule, 100))
+}
+
+func testLoginAttemptStore(t *testing.T, newStore func(t *testing.T) LoginAttemptStore) {
+	store := newStore(t)
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+
+	attempts, err := store.GetAttempts(ctx, "account:user@mail.com")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, attempts.Failures)
+
+	for i := 1; i <= 3; i++ {
+		attempts, err = store.RecordFailure(ctx, "account:user@mail.com", now.Add(time.Duration(i)*time.Second), time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, i, attempts.Failures)
+	}
+	attempts, err = store.GetAttempts(ctx, "account:user@mail.com")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts.Failures)
+	assert.True(t, now.Add(3*time.Second).Equal(attempts.LastFailure))
+
+	// other keys are counted on their own.
+	attempts, err = store.RecordFailure(ctx, "address:192.0.2.1", now, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, attempts.Failures)
+
+	// failures older than the window are forgotten.
+	attempts, err = store.RecordFailure(ctx, "account:user@mail.com", now.Add(2*time.Hour), time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, attempts.Failures)
+
+	assert.NoError(t, store.ResetAttempts(ctx, "account:user@mail.com"))
+	attempts, err = store.GetAttempts(ctx, "account:user@mail.com")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, attempts.Failures)
+	assert.NoError(t, store.ResetAttempts(ctx, "account:nobody@mail.com"))
+
+	_, err = store.RecordFailure(ctx, "", now, time.Hour)
+	assert.ErrorIs(t, err, ErrArgumentEmpty)
+}
+
+func TestMemoryLoginAttemptStore(t *testing.T) {
+	testLoginAttemptStore(t, func(t *testing.T) LoginAttemptStore {
+		return NewMemoryLoginAttemptStore()
+	})
+}
+
+func TestSqlLoginAttemptStore_SQLite(t *testing.T) {
+	testLoginAttemptStore(t, func(t *testing.T) LoginAttemptStore {
+		return newSQLiteDAO(t).LoginAttempts()
+	})
+}
+
+func TestLoginRetryAfter(t *testing.T) {
+	configuration.SetConfig("login.account.free", "1")
+	configuration.SetConfig("login.account.lockout", "3")
+	configuration.SetConfig("login.address.free", "2")
+	configuration.SetConfig("login.address.lockout", "5")
+	configuration.SetConfig("login.backoff", "1 minute")
+	defer func() {
+		for _, key := range []string{"login.account.free", "login.account.lockout", "login.address.free", "login.address.lockout", "login.backoff"} {
+			configuration.SetConfig(key, "")
+		}
+	}()
+	store := NewMemoryLoginAttemptStore()
+	ctx := context.Background()
+	retryAfter := func(email, address string) time.Duration {
+		wait, err := LoginRetryAfter(ctx, store, email, address)
+		assert.NoError(t, err)
+		return wait
+	}
+
+	// the free failure is not delayed, the next one backs off.
+	assert.NoError(t, LoginFailed(ctx, store, "user@mail.com", "192.0.2.1"))
+	assert.Equal(t, time.Duration(0), retryAfter("user@mail.com", "192.0.2.1"))
+	assert.NoError(t, LoginFailed(ctx, store, "USER@mail.com", "192.0.2.1"))
+	assert.InDelta(t, time.Minute, retryAfter("user@mail.com", "192.0.2.2"), float64(time.Second))
+
+	// a third failure locks the account, from any address.
+	assert.NoError(t, LoginFailed(ctx, store, "user@mail.com", "192.0.2.1"))
+	assert.InDelta(t, 15*time.Minute, retryAfter("user@mail.com", "192.0.2.2"), float64(time.Second))
+
+	// the address tried three times too, it backs off on every account.
+	assert.InDelta(t, time.Minute, retryAfter("other@mail.com", "192.0.2.1"), float64(time.Second))
+	assert.Equal(t, time.Duration(0), retryAfter("other@mail.com", "192.0.2.2"))
+
+	// a successful sign in forgets the account failures, not those of the address.
+	assert.NoError(t, LoginSucceeded(ctx, store, "user@mail.com"))
+	assert.Equal(t, time.Duration(0), retryAfter("user@mail.com", "192.0.2.2"))
+	assert.InDelta(t, time.Minute, retryAfter("user@mail.com", "192.0.2.1"), float64(time.Second))
+
+	assert.NoError(t, LoginFailed(ctx, store, "user@mail.com", "192.0.2.2"))
+	assert.NoError(t, LoginFailed(ctx, store, "user@mail.com", "192.0.2.2"))
+	assert.NoError(t, LoginFailed(ctx, store, "user@mail.com", "192.0.2.2"))
+	assert.InDelta(t, 15*time.Minute, retryAfter("user@mail.com", "192.0.2.3"), float64(time.Second))
+	assert.NoError(t, UnlockAccount(ctx, store, "user@mail.com"))
+	assert.Equal(t, time.Duration(0), retryAfter("user@mail.com", "192.0.2.3"))
+
+	// a lockout of 0 turns the counting off.
+	configuration.SetConfig("login.account.lockout", "0")
+	configuration.SetConfig("login.address.lockout", "0")
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, LoginFailed(ctx, store, "third@mail.com", "192.0.2.4"))
+	}
+	assert.Equal(t, time.Duration(0), retryAfter("third@mail.com", "192.0.2.4"))
+}
+
+func TestClientAddress(t *testing.T) {
+	request := newRequest(http.MethodPost, "/login", "")
+	request.RemoteAddr = "192.0.2.1:5432"
+	request.Header.Add("X-Forwarded-For", "203.0.113.9, 198.51.100.7")
+	assert.Equal(t, "192.0.2.1", ClientAddress(request))
+
+	configuration.SetConfig("server.proxy.trusted", "true")
+	defer configuration.SetConfig("server.proxy.trusted", "")
+	assert.Equal(t, "198.51.100.7", ClientAddress(request))
+	request.Header.Add("X-Forwarded-For", "198.51.100.8")
+	assert.Equal(t, "198.51.100.8", ClientAddress(request))
+	request.Header.Del("X-Forwarded-For")
+	assert.Equal(t, "192.0.2.1", ClientAddress(request))
+}
+
+func TestTheHandler_LoginLockout(t *testing.T) {
+	configuration.SetConfig("login.account.free", "1")
+	configuration.SetConfig("login.account.lockout", "3")
+	configuration.SetConfig("login.backoff", "1 minute")
+	defer func() {
+		configuration.SetConfig("login.account.free", "")
+		configuration.SetConfig("login.account.lockout", "")
+		configuration.SetConfig("login.backoff", "")
+	}()
+	dao := NewMemoryDAO()
+	router := mux.NewRouter()
+	initRoutes(router, &TheHandler{DAO: dao})
+	resp := serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/create-user",
+		`{"Email":"user@mail.com","Passphrase":"a passphrase","TenantRole":["viewer@ACME"]}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	login := func(passphrase string) *http.Response {
+		return serve(router, newRequest(http.MethodPost, "/login", `{"Email":"user@mail.com","Passphrase":"`+passphrase+`"}`)).Result()
+	}
+	retryAfter := func(resp *http.Response) int {
+		seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		assert.NoError(t, err)
+		return seconds
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, login("wrong").StatusCode)
+	assert.Equal(t, http.StatusOK, login("a passphrase").StatusCode)
+
+	// a success forgets the failures, the second one in a row backs off.
+	assert.Equal(t, http.StatusUnauthorized, login("wrong").StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, login("wrong").StatusCode)
+	result := login("a passphrase")
+	assert.Equal(t, http.StatusTooManyRequests, result.StatusCode)
+	assert.InDelta(t, 60, retryAfter(result), 1)
+
+	// the passphrase is not even checked while backing off, even a wrong one is not counted.
+	assert.Equal(t, http.StatusTooManyRequests, login("wrong").StatusCode)
+	attempts, err := dao.LoginAttempts().GetAttempts(context.Background(), accountAttemptKey("user@mail.com"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts.Failures)
+
+	// only root unlocks.
+	resp = serve(router, newRequest(http.MethodPost, "/user/ACME/user@mail.com/unlock", ""))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/nobody@mail.com/unlock", "")))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/user@mail.com/unlock", "")))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, http.StatusOK, login("a passphrase").StatusCode)
+
+	// the hosted pages are refused the same way.
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, LoginFailed(context.Background(), dao.LoginAttempts(), "user@mail.com", "192.0.2.9"))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, approveDevice(router, "BCDF-GHJK", "a passphrase", "approve"))
+	result = login("a passphrase")
+	assert.Equal(t, http.StatusTooManyRequests, result.StatusCode)
+	assert.InDelta(t, 900, retryAfter(result), 1)
+}
+
+func TestTheHandler_LoginUnknownAccount(t *testing.T) {
+	configuration.SetConfig("login.account.free", "1")
+	defer configuration.SetConfig("login.account.free", "")
+	dao := NewMemoryDAO()
+	router := mux.NewRouter()
+	initRoutes(router, &TheHandler{DAO: dao})
+	resp := serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/create-user",
+		`{"Email":"user@mail.com","Passphrase":"a passphrase","TenantRole":["viewer@ACME"]}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	// an account that does not exist is answered like a wrong passphrase, and probing it counts too.
+	wrong := serve(router, newRequest(http.MethodPost, "/login", `{"Email":"user@mail.com","Passphrase":"wrong"}`))
+	unknown := serve(router, newRequest(http.MethodPost, "/login", `{"Email":"nobody@mail.com","Passphrase":"wrong"}`))
+	assert.Equal(t, http.StatusUnauthorized, unknown.Code)
+	assert.Equal(t, wrong.Body.String(), unknown.Body.String())
+	attempts, err := dao.LoginAttempts().GetAttempts(context.Background(), accountAttemptKey("nobody@mail.com"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, attempts.Failures)
+}
@@ -0,0 +1,1088 @@
+package internal
+
+import (
+	"context"
+	security "github.com/newm4n/dokku-common/security"
+	log "github.com/sirupsen/logrus"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryDAO is the in memory DataAccess implementation. It is safe for concurrent use,
+// readers share the lock while any write holds it exclusively.
+type MemoryDAO struct {
+	mutex sync.RWMutex
+
+	// accounts is keyed by normalized email.
+	accounts map[string]*UserAccount
+	// sortedEmails holds the normalized emails in order, for the SearchUser prefix search.
+	// It is only re-sorted on the next search after emailsDirty is set.
+	sortedEmails []string
+	emailsDirty  bool
+
+	// memberships is keyed by normalized email, then by tenant.
+	memberships map[string]map[string]*UserTenantRoles
+	// members is keyed by tenant, then by normalized email. It holds the same records as memberships.
+	members map[string]map[string]*UserTenantRoles
+
+	tenants map[string]*Tenant
+
+	revocation RevocationStore
+	clients    ClientStore
+	codes      AuthorizationCodeStore
+	devices    DeviceCodeStore
+	mfa        MFAStore
+	passkeys   WebAuthnCredentialStore
+	attempts   LoginAttemptStore
+}
+
+func NewMemoryDAO() *MemoryDAO {
+	return &MemoryDAO{
+		accounts:     make(map[string]*UserAccount),
+		sortedEmails: make([]string, 0),
+		memberships:  make(map[string]map[string]*UserTenantRoles),
+		members:      make(map[string]map[string]*UserTenantRoles),
+		tenants:      make(map[string]*Tenant),
+		revocation:   NewMemoryRevocationStore(),
+		clients:      NewMemoryClientStore(),
+		codes:        NewMemoryAuthorizationCodeStore(),
+		devices:      NewMemoryDeviceCodeStore(),
+		mfa:          NewMemoryMFAStore(),
+		passkeys:     NewMemoryWebAuthnCredentialStore(),
+		attempts:     NewMemoryLoginAttemptStore(),
+	}
+}
+
+// normalizeEmail is the key of an email in every index, emails are compared case-insensitively.
+func normalizeEmail(email string) string {
+	return strings.ToLower(email)
+}
+
+// The following helpers expect the caller to hold the mutex.
+
+func (mdao *MemoryDAO) putAccount(acc *UserAccount) {
+	key := normalizeEmail(acc.email)
+	mdao.accounts[key] = acc
+	if !mdao.emailsDirty && len(mdao.sortedEmails) > 0 && mdao.sortedEmails[len(mdao.sortedEmails)-1] >= key {
+		mdao.emailsDirty = true
+	}
+	mdao.sortedEmails = append(mdao.sortedEmails, key)
+}
+
+func (mdao *MemoryDAO) removeAccount(email string) {
+	key := normalizeEmail(email)
+	delete(mdao.accounts, key)
+	mdao.sortEmails()
+	idx := sort.SearchStrings(mdao.sortedEmails, key)
+	if idx < len(mdao.sortedEmails) && mdao.sortedEmails[idx] == key {
+		mdao.sortedEmails = append(mdao.sortedEmails[:idx], mdao.sortedEmails[idx+1:]...)
+	}
+}
+
+func (mdao *MemoryDAO) sortEmails() {
+	if mdao.emailsDirty {
+		sort.Strings(mdao.sortedEmails)
+		mdao.emailsDirty = false
+	}
+}
+
+func (mdao *MemoryDAO) membership(email, tenant string) *UserTenantRoles {
+	return mdao.memberships[normalizeEmail(email)][tenant]
+}
+
+func (mdao *MemoryDAO) addMembership(email, tenant string, roles []string) *UserTenantRoles {
+	key := normalizeEmail(email)
+	data := &UserTenantRoles{
+		email:  email,
+		tenant: tenant,
+		roles:  roles,
+	}
+	if mdao.memberships[key] == nil {
+		mdao.memberships[key] = make(map[string]*UserTenantRoles)
+	}
+	mdao.memberships[key][tenant] = data
+	if mdao.members[tenant] == nil {
+		mdao.members[tenant] = make(map[string]*UserTenantRoles)
+	}
+	mdao.members[tenant][key] = data
+	mdao.ensureTenant(tenant)
+	return data
+}
+
+func (mdao *MemoryDAO) removeMembership(email, tenant string) {
+	key := normalizeEmail(email)
+	delete(mdao.memberships[key], tenant)
+	if len(mdao.memberships[key]) == 0 {
+		delete(mdao.memberships, key)
+	}
+	delete(mdao.members[tenant], key)
+	if len(mdao.members[tenant]) == 0 {
+		delete(mdao.members, tenant)
+	}
+}
+
+// ensureTenant creates the tenant record for a tenant that is referred by a membership.
+func (mdao *MemoryDAO) ensureTenant(tenant string) {
+	if _, exist := mdao.tenants[tenant]; !exist {
+		mdao.tenants[tenant] = &Tenant{
+			Name:        tenant,
+			DisplayName: tenant,
+			CreatedAt:   time.Now(),
+			Status:      TenantStatusActive,
+		}
+	}
+}
+
+// tenantMembers lists the emails, as registered, of the tenant members in order.
+func (mdao *MemoryDAO) tenantMembers(tenant string) []string {
+	ret := make([]string, 0, len(mdao.members[tenant]))
+	for _, data := range mdao.members[tenant] {
+		ret = append(ret, data.email)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// moveMembership moves the membership, and its roles, from the old tenant into the new one.
+// When the user is already a member of the new tenant, the roles are merged.
+func (mdao *MemoryDAO) moveMembership(email, oldTenant, newTenant string) error {
+	source := mdao.membership(email, oldTenant)
+	if source == nil {
+		return ErrNotFound
+	}
+	if oldTenant == newTenant {
+		return nil
+	}
+	target := mdao.membership(email, newTenant)
+	if target == nil {
+		roles := make([]string, len(source.roles))
+		copy(roles, source.roles)
+		mdao.addMembership(source.email, newTenant, roles)
+	} else {
+		target.roles = Merge(target.roles, source.roles)
+	}
+	mdao.removeMembership(email, oldTenant)
+	return nil
+}
+
+func (mdao *MemoryDAO) deleteTenant(tenant string) error {
+	_, found := mdao.tenants[tenant]
+	members := mdao.tenantMembers(tenant)
+	if !found && len(members) == 0 {
+		return ErrNotFound
+	}
+	delete(mdao.tenants, tenant)
+	for _, email := range members {
+		mdao.removeMembership(email, tenant)
+	}
+	return nil
+}
+
+func (mdao *MemoryDAO) CreateUserAccount(ctx context.Context, email, passphrase string) (success bool, err error) {
+	if ctx == nil {
+		return false, ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if len(email) == 0 || len(passphrase) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	if ClientSubject(email) {
+		return false, ErrArgumentInvalid
+	}
+	if err := CheckPassphrase(email, passphrase); err != nil {
+		return false, err
+	}
+
+	// hashing is slow, do it before taking the lock.
+	passHash, err := security.CreateHash(passphrase, security.DefaultParams)
+	if err != nil {
+		return false, ErrInvalidPassword
+	}
+
+	mdao.mutex.Lock()
+	defer mdao.mutex.Unlock()
+	if _, exist := mdao.accounts[normalizeEmail(email)]; exist {
+		log.Errorf("can not create user. user with %s email aready exist in accounts", email)
+		return false, ErrFound
+	}
+	mdao.putAccount(&UserAccount{
+		email:               email,
+		passphrase:          passHash,
+		status:              UserStatusActive,
+		passphraseChangedAt: passphraseClock(),
+	})
+	return true, nil
+}
+
+func (mdao *MemoryDAO) UpdateUserPassphrase(ctx context.Context, email, oldPassphrase, newPassphrase string) (success bool, err error) {
+	if ctx == nil {
+		return false, ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if len(email) == 0 || len(oldPassphrase) == 0 || len(newPassphrase) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	if err := CheckPassphrase(email, newPassphrase); err != nil {
+		return false, err
+	}
+
+	mdao.mutex.RLock()
+	acc, exist := mdao.accounts[normalizeEmail(email)]
+	var oldHash string
+	var history []string
+	if exist {
+		oldHash = acc.passphrase
+		history = slices.Clone(acc.passphraseHistory)
+	}
+	mdao.mutex.RUnlock()
+	if !exist {
+		return false, nil
+	}
+
+	compare, err := security.ComparePasswordAndHash(oldPassphrase, oldHash)
+	if err != nil {
+		return false, err
+	}
+	if !compare {
+		return false, nil
+	}
+	return mdao.replacePassphrase(acc, oldHash, history, newPassphrase)
+}
+
+func (mdao *MemoryDAO) SetUserPassphrase(ctx context.Context, email, newPassphrase string) (success bool, err error) {
+	if ctx == nil {
+		return false, ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if len(email) == 0 || len(newPassphrase) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	if err := CheckPassphrase(email, newPassphrase); err != nil {
+		return false, err
+	}
+	mdao.mutex.RLock()
+	acc, exist := mdao.accounts[normalizeEmail(email)]
+	var oldHash string
+	var history []string
+	if exist {
+		oldHash = acc.passphrase
+		history = slices.Clone(acc.passphraseHistory)
+	}
+	mdao.mutex.RUnlock()
+	if !exist {
+		return false, ErrNotFound
+	}
+	return mdao.replacePassphrase(acc, oldHash, history, newPassphrase)
+}
+
+// replacePassphrase sets the new passphrase of the account, unless it is one of the last ones.
+// It returns false when the passphrase was changed, or the account deleted, in the meantime.
+func (mdao *MemoryDAO) replacePassphrase(acc *UserAccount, oldHash string, history []string, newPassphrase string) (success bool, err error) {
+	if err := checkPassphraseHistory(newPassphrase, append([]string{oldHash}, history...)); err != nil {
+		return false, err
+	}
+	newHash, err := security.CreateHash(newPassphrase, security.DefaultParams)
+	if err != nil {
+		return false, err
+	}
+
+	mdao.mutex.Lock()
+	defer mdao.mutex.Unlock()
+	// the passphrase may have been changed, or the account deleted, while hashing.
+	if mdao.accounts[normalizeEmail(acc.email)] != acc || acc.passphrase != oldHash {
+		return false, nil
+	}
+	acc.passphraseHistory = nextPassphraseHistory(oldHash, acc.passphraseHistory)
+	acc.passphrase = newHash
+	acc.mustChangePassphrase = false
+	acc.passphraseChangedAt = passphraseClock()
+	return true, nil
+}
+
+func (mdao *MemoryDAO) ExpireUserPassphrase(ctx context.Context, email string) (success bool, err error) {
+	if ctx == nil {
+		return false, ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if len(email) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	mdao.mutex.Lock()
+	defer mdao.mutex.Unlock()
+	acc, exist := mdao.accounts[normalizeEmail(email)]
+	if !exist {
+		return false, ErrNotFound
+	}
+	acc.mustChangePassphrase = true
+	return true, nil
+}
+
+func (mdao *MemoryDAO) DeleteUserAccount(ctx context.Context, email string) (success bool, err error) {
+	if ctx == nil {
+		return false, ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if len(email) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	mdao.mutex.Lock()
+	defer mdao.mutex.Unlock()
+	if _, exist := mdao.accounts[normalizeEmail(email)]; !exist {
+		return false, nil
+	}
+	mdao.removeAccount(email)
+	return true, nil
+}
+
+func (mdao *MemoryDAO) UserExist(ctx context.Context, email string) (exist bool, err error) {
+	if ctx == nil {
+		return false, ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if len(email) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	mdao.mutex.RLock()
+	defer mdao.mutex.RUnlock()
+	_, exist = mdao.accounts[normalizeEmail(email)]
+	return exist, nil
+}
+
+func (mdao *MemoryDAO) SearchUser(ctx context.Context, search string) (emails []string, err error) {
+	if ctx == nil {
+		return nil, ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if len(search) == 0 {
+		return make([]string, 0), ErrArgumentEmpty
+	}
+	mdao.mutex.RLock()
+	for mdao.emailsDirty {
+		// sorting needs the write lock, take it just long enough.
+		mdao.mutex.RUnlock()
+		mdao.mutex.Lock()
+		mdao.sortEmails()
+		mdao.mutex.Unlock()
+		mdao.mutex.RLock()
+	}
+	defer mdao.mutex.RUnlock()
+
+	prefix := normalizeEmail(search)
+	ret := make([]string, 0)
+	for idx := sort.SearchStrings(mdao.sortedEmails, prefix); idx < len(mdao.sortedEmails); idx++ {
+		key := mdao.sortedEmails[idx]
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+		ret = append(ret, mdao.accounts[key].email)
+	}
+	return ret, nil
+}
+
+func (mdao *MemoryDAO) GetUserProfile(ctx context.Context, email string) (profile *UserProfile, err error) {
+	if ctx == nil {
+		return nil, ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if len(email) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	mdao.mutex.RLock()
+	defer mdao.mutex.RUnlock()
+	acc, exist := mdao.accounts[normalizeEmail(email)]
+	if !exist {
+		return nil, ErrNotFound
+	}
+	return &UserProfile{
+		Email:    acc.email,
+		FullName: acc.fullName,
+		Status:   acc.status,
+	}, nil
+}
+
+func (mdao *MemoryDAO) UpdateUserProfile(ctx context.Context, email, fullName string) (success bool, err error) {
+	if ctx == nil {
+		return false, ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if len(email) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	mdao.mutex.Lock()
+	defer mdao.mutex.Unlock()
+	acc, exist := mdao.accounts[normalizeEmail(email)]
+	if !exist {
+		return false, ErrNotFound
+	}
+	acc.fullName = fullName
+	return true, nil
+}
+
+func (mdao *MemoryDAO) UpdateUserStatus(ctx context.Context, email string, status UserStatus) (success bool, err error) {
+	if ctx == nil {
+		return false, ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if len(email) == 0 || len(status) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	mdao.mutex.Lock()
+	defer mdao.mutex.Unlock()
+	acc, exist := mdao.accounts[normalizeEmail(email)]
+	if !exist {
+		return false, ErrNotFound
+	}
+	acc.status = status
+	return true, nil
+}
+
+func (mdao *MemoryDAO) CreateTenant(ctx context.Context, tenant, displayName string) (success bool, err error) {
+	if ctx == nil {
+		return false, ErrArgumentEmpty
+	}
+	if !ValidTenantName(tenant) {
+		return false, ErrInvalidTenantName
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if len(tenant) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	mdao.mutex.Lock()
+	defer mdao.mutex.Unlock()
+	if _, exist := mdao.tenants[tenant]; exist {
+		return false, ErrFound
+	}
+	if len(displayName) == 0 {
+		displayName = tenant
+	}
+	mdao.tenants[tenant] = &Tenant{
+		Name:        tenant,
+		DisplayName: displayName,
+		CreatedAt:   time.Now(),
+		Status:      TenantStatusActive,
+	}
+	return true, nil
+}
+
+func (mdao *MemoryDAO) UpdateTenant(ctx context.Context, oldTenant, newTenant, displayName string) (success bool, err error) {
+	if ctx == nil {
+		return false, ErrArgumentEmpty
+	}
+	if newTenant != ReservedTenant && !ValidTenantName(newTenant) {
+		return false, ErrInvalidTenantName
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if len(oldTenant) == 0 || len(newTenant) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	mdao.mutex.Lock()
+	defer mdao.mutex.Unlock()
+	source, exist := mdao.tenants[oldTenant]
+	if !exist {
+		return false, ErrNotFound
+	}
+	if oldTenant != newTenant {
+		if oldTenant == ReservedTenant || newTenant == ReservedTenant {
+			return false, ErrTenantReserved
+		}
+		if _, exist := mdao.tenants[newTenant]; exist {
+			return false, ErrFound
+		}
+		// rename the record first, so moving the memberships will not create a new one.
+		delete(mdao.tenants, oldTenant)
+		source.Name = newTenant
+		mdao.tenants[newTenant] = source
+		for _, email := range mdao.tenantMembers(oldTenant) {
+			if err := mdao.moveMembership(email, oldTenant, newTenant); err != nil {
+				return false, err
+			}
+		}
+	}
+	if len(displayName) > 0 {
+		source.DisplayName = displayName
+	}
+	return true, nil
+}
+
+func (mdao *MemoryDAO) DeleteTenant(ctx context.Context, tenant string) (success bool, err error) {
+	if ctx == nil {
+		return false, ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if len(tenant) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	if tenant == ReservedTenant {
+		return false, ErrTenantReserved
+	}
+	mdao.mutex.Lock()
+	defer mdao.mutex.Unlock()
+	if err := mdao.deleteTenant(tenant); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (mdao *MemoryDAO) DeleteAllTenant(ctx context.Context) (success bool, err error) {
+	if ctx == nil {
+		return false, ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	mdao.mutex.Lock()
+	defer mdao.mutex.Unlock()
+	tenantsToDel := make(map[string]bool)
+	for tenant := range mdao.tenants {
+		tenantsToDel[tenant] = true
+	}
+	for tenant := range mdao.members {
+		tenantsToDel[tenant] = true
+	}
+	delete(tenantsToDel, ReservedTenant)
+	for tenant := range tenantsToDel {
+		if err := mdao.deleteTenant(tenant); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (mdao *MemoryDAO) GetTenant(ctx context.Context, tenant string) (data *Tenant, err error) {
+	if ctx == nil {
+		return nil, ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if len(tenant) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	mdao.mutex.RLock()
+	defer mdao.mutex.RUnlock()
+	data, exist := mdao.tenants[tenant]
+	if !exist {
+		return nil, ErrNotFound
+	}
+	ret := *data
+	return &ret, nil
+}
+
+func (mdao *MemoryDAO) ListTenant(ctx context.Context) (tenants []*Tenant, err error) {
+	if ctx == nil {
+		return nil, ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	mdao.mutex.RLock()
+	defer mdao.mutex.RUnlock()
+	ret := make([]*Tenant, 0, len(mdao.tenants))
+	for _, data := range mdao.tenants {
+		t := *data
+		ret = append(ret, &t)
+	}
+	SortTenant(ret)
+	return ret, nil
+}
+
+func (mdao *MemoryDAO) SearchTenant(ctx context.Context, search string) (tenants []*Tenant, err error) {
+	if ctx == nil {
+		return nil, ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if len(search) == 0 {
+		return make([]*Tenant, 0), ErrArgumentEmpty
+	}
+	mdao.mutex.RLock()
+	defer mdao.mutex.RUnlock()
+	ret := make([]*Tenant, 0)
+	for _, data := range mdao.tenants {
+		if hasPrefixFold(data.Name, search) {
+			t := *data
+			ret = append(ret, &t)
+		}
+	}
+	SortTenant(ret)
+	return ret, nil
+}
+
+func (mdao *MemoryDAO) ListTenantUser(ctx context.Context, tenant string) (emails []string, err error) {
+	if ctx == nil {
+		return nil, ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if len(tenant) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	mdao.mutex.RLock()
+	defer mdao.mutex.RUnlock()
+	return mdao.tenantMembers(tenant), nil
+}
+
+func (mdao *MemoryDAO) CreateUserTenant(ctx context.Context, email, tenant string) (success bool, err error) {
+	if ctx == nil {
+		return false, ErrArgumentEmpty
+	}
+	if tenant != ReservedTenant && !ValidTenantName(tenant) {
+		return false, ErrInvalidTenantName
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if len(email) == 0 || len(tenant) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	mdao.mutex.Lock()
+	defer mdao.mutex.Unlock()
+	if mdao.membership(email, tenant) != nil {
+		return false, ErrFound
+	}
+	mdao.addMembership(email, tenant, make([]string, 0))
+	return true, nil
+}
+
+func (mdao *MemoryDAO) UpdateUserTenant(ctx context.Context, email, oldTenant, newTenant string) (success bool, err error) {
+	if ctx == nil {
+		return false, ErrArgumentEmpty
+	}
+	if !ValidTenantName(newTenant) {
+		return false, ErrInvalidTenantName
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if len(email) == 0 || len(oldTenant) == 0 || len(newTenant) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	mdao.mutex.Lock()
+	defer mdao.mutex.Unlock()
+	if err := mdao.moveMembership(email, oldTenant, newTenant); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (mdao *MemoryDAO) DeleteUserTenant(ctx context.Context, email, tenant string) (success bool, err error) {
+	if ctx == nil {
+		return false, ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if len(email) == 0 || len(tenant) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	mdao.mutex.Lock()
+	defer mdao.mutex.Unlock()
+	mdao.removeMembership(email, tenant)
+	return true, nil
+}
+
+func (mdao *MemoryDAO) DeleteUserAllTenant(ctx context.Context, email string) (success bool, err error) {
+	if ctx == nil {
+		return false, ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if len(email) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	mdao.mutex.Lock()
+	defer mdao.mutex.Unlock()
+	for tenant := range mdao.memberships[normalizeEmail(email)] {
+		mdao.removeMembership(email, tenant)
+	}
+	return true, nil
+}
+
+func (mdao *MemoryDAO) UserTenantExist(ctx context.Context, email, tenant string) (exist bool, err error) {
+	if ctx == nil {
+		return false, ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if len(email) == 0 || len(tenant) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	mdao.mutex.RLock()
+	defer mdao.mutex.RUnlock()
+	return mdao.membership(email, tenant) != nil, nil
+}
+
+func (mdao *MemoryDAO) SearchUserTenant(ctx context.Context, email, search string) (tenants []string, err error) {
+	if ctx == nil {
+		return nil, ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if len(search) == 0 {
+		return make([]string, 0), ErrArgumentEmpty
+	}
+	mdao.mutex.RLock()
+	defer mdao.mutex.RUnlock()
+	ret := make([]string, 0)
+	for tenant := range mdao.memberships[normalizeEmail(email)] {
+		if hasPrefixFold(tenant, search) {
+			ret = append(ret, tenant)
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (mdao *MemoryDAO) CreateUserTenantRole(ctx context.Context, email, tenant, role string) (success bool, err error) {
+	if ctx == nil {
+		return false, ErrArgumentEmpty
+	}
+	if tenant != ReservedTenant && !ValidTenantName(tenant) {
+		return false, ErrInvalidTenantName
+	}
+	if !ValidRoleName(role) {
+		return false, ErrInvalidRoleName
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if len(email) == 0 || len(tenant) == 0 || len(role) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	mdao.mutex.Lock()
+	defer mdao.mutex.Unlock()
+	data := mdao.membership(email, tenant)
+	if data == nil {
+		mdao.addMembership(email, tenant, []string{role})
+		return true, nil
+	}
+	if Contains(data.roles, role) {
+		return false, ErrFound
+	}
+	data.roles = append(data.roles, role)
+	return true, nil
+}
+
+func (mdao *MemoryDAO) DeleteUserTenantRole(ctx context.Context, email, tenant, role string) (success bool, err error) {
+	if ctx == nil {
+		return false, ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if len(email) == 0 || len(tenant) == 0 || len(role) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	mdao.mutex.Lock()
+	defer mdao.mutex.Unlock()
+	data := mdao.membership(email, tenant)
+	if data == nil {
+		return false, ErrNotFound
+	}
+	for idx, r := range data.roles {
+		if r == role {
+			data.roles = append(data.roles[:idx], data.roles[idx+1:]...)
+			return true, nil
+		}
+	}
+	return false, ErrNotFound
+}
+
+func (mdao *MemoryDAO) DeleteUserTenantAllRoles(ctx context.Context, email, tenant string) (success bool, err error) {
+	if ctx == nil {
+		return false, ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if len(email) == 0 || len(tenant) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	mdao.mutex.Lock()
+	defer mdao.mutex.Unlock()
+	data := mdao.membership(email, tenant)
+	if data == nil {
+		return false, ErrNotFound
+	}
+	data.roles = make([]string, 0)
+	return true, nil
+}
+
+func (mdao *MemoryDAO) UserTenantRoleExist(ctx context.Context, email, tenant, role string) (exist bool, err error) {
+	if ctx == nil {
+		return false, ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if len(email) == 0 || len(tenant) == 0 || len(role) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	mdao.mutex.RLock()
+	defer mdao.mutex.RUnlock()
+	data := mdao.membership(email, tenant)
+	if data == nil {
+		return false, ErrNotFound
+	}
+	return Contains(data.roles, role), nil
+}
+
+func (mdao *MemoryDAO) SearchUserRoleTenant(ctx context.Context, email, tenant, search string) (roles []string, err error) {
+	if ctx == nil {
+		return nil, ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if len(email) == 0 || len(tenant) == 0 || len(search) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	mdao.mutex.RLock()
+	defer mdao.mutex.RUnlock()
+	data := mdao.membership(email, tenant)
+	if data == nil {
+		return nil, ErrNotFound
+	}
+	ret := make([]string, 0)
+	for _, role := range data.roles {
+		if hasPrefixFold(role, search) {
+			ret = append(ret, role)
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (mdao *MemoryDAO) ListUserTenantRole(ctx context.Context, email, tenant string) (roles []string, err error) {
+	if ctx == nil {
+		return nil, ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if len(email) == 0 || len(tenant) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	mdao.mutex.RLock()
+	defer mdao.mutex.RUnlock()
+	data := mdao.membership(email, tenant)
+	if data == nil {
+		return nil, ErrNotFound
+	}
+	ret := make([]string, len(data.roles))
+	copy(ret, data.roles)
+	return ret, nil
+}
+
+func (mdao *MemoryDAO) ListUserTenantRoles(ctx context.Context, email string) (tenantRoles []*TenantRoles, err error) {
+	if ctx == nil {
+		return nil, ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if len(email) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	mdao.mutex.RLock()
+	defer mdao.mutex.RUnlock()
+	return mdao.userTenantRoles(email), nil
+}
+
+// userTenantRoles lists the roles of the user in every tenant, ordered by tenant. The caller must hold the mutex.
+func (mdao *MemoryDAO) userTenantRoles(email string) []*TenantRoles {
+	memberships := mdao.memberships[normalizeEmail(email)]
+	tenants := make([]string, 0, len(memberships))
+	for tenant := range memberships {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	ret := make([]*TenantRoles, 0, len(tenants))
+	for _, tenant := range tenants {
+		roles := make([]string, len(memberships[tenant].roles))
+		copy(roles, memberships[tenant].roles)
+		ret = append(ret, &TenantRoles{
+			Tenant: tenant,
+			Roles:  roles,
+		})
+	}
+	return ret
+}
+
+// userAudience lists the tenant roles of the user in the 'role1,role2@tenant' pattern used as token audience.
+// The caller must hold the mutex.
+func (mdao *MemoryDAO) userAudience(email string) []string {
+	return tenantRolesAudience(mdao.userTenantRoles(email))
+}
+
+func (mdao *MemoryDAO) Authenticate(ctx context.Context, email, passphrase string) (accessToken, refreshToken, mfaToken string, err error) {
+	if err := mdao.VerifyPassphrase(ctx, email, passphrase); err != nil {
+		return "", "", "", err
+	}
+	return signInTokens(ctx, mdao, email)
+}
+
+func (mdao *MemoryDAO) VerifyPassphrase(ctx context.Context, email, passphrase string) error {
+	if ctx == nil {
+		return ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	mdao.mutex.RLock()
+	acc, exist := mdao.accounts[normalizeEmail(email)]
+	var passHash string
+	var status UserStatus
+	var mustChange bool
+	var changedAt time.Time
+	if exist {
+		passHash = acc.passphrase
+		status = acc.status
+		mustChange = acc.mustChangePassphrase
+		changedAt = acc.passphraseChangedAt
+	}
+	mdao.mutex.RUnlock()
+	if !exist {
+		return unknownAccount(passphrase)
+	}
+
+	// comparing the hash is slow, it must not hold the lock.
+	match, err := security.ComparePasswordAndHash(passphrase, passHash)
+	if err != nil || match == false {
+		return ErrInvalidPassword
+	}
+	if status == UserStatusDisabled {
+		return ErrAccountDisabled
+	}
+	expired, err := passphraseExpired(mustChange, changedAt)
+	if err != nil {
+		return err
+	}
+	if expired {
+		return ErrPassphraseExpired
+	}
+	return nil
+}
+
+func (mdao *MemoryDAO) IssueTokens(ctx context.Context, email string, amr []string) (accessToken, refreshToken string, err error) {
+	if ctx == nil {
+		return "", "", ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return "", "", ctx.Err()
+	}
+	auds, err := mdao.signInAudience(email)
+	if err != nil {
+		return "", "", err
+	}
+	return CreateTokenPair(email, auds, amr)
+}
+
+// signInAudience returns the token audience of the subject, as long as it can sign in.
+func (mdao *MemoryDAO) signInAudience(email string) ([]string, error) {
+	mdao.mutex.RLock()
+	defer mdao.mutex.RUnlock()
+	acc, exist := mdao.accounts[normalizeEmail(email)]
+	if !exist {
+		return nil, ErrAccountDeleted
+	}
+	if acc.status == UserStatusDisabled {
+		return nil, ErrAccountDisabled
+	}
+	expired, err := passphraseExpired(acc.mustChangePassphrase, acc.passphraseChangedAt)
+	if err != nil {
+		return nil, err
+	}
+	if expired {
+		return nil, ErrPassphraseExpired
+	}
+	return mdao.userAudience(email), nil
+}
+
+func (mdao *MemoryDAO) Refresh(ctx context.Context, refreshToken string) (accessToken, nextRefreshToken string, err error) {
+	if ctx == nil {
+		return "", "", ErrArgumentEmpty
+	}
+	if ctx.Err() != nil {
+		return "", "", ctx.Err()
+	}
+	if len(refreshToken) == 0 {
+		return "", "", ErrArgumentEmpty
+	}
+	claim, err := VerifyRefreshToken(ctx, mdao.revocation, refreshToken)
+	if err != nil {
+		return "", "", err
+	}
+	auds, err := mdao.signInAudience(claim.Subscriber)
+	if err != nil {
+		return "", "", err
+	}
+	return RefreshTokens(ctx, mdao.revocation, claim, auds, TokenAmr(refreshToken))
+}
+
+func (mdao *MemoryDAO) Revocations() RevocationStore {
+	return mdao.revocation
+}
+
+func (mdao *MemoryDAO) Clients() ClientStore {
+	return mdao.clients
+}
+
+func (mdao *MemoryDAO) AuthorizationCodes() AuthorizationCodeStore {
+	return mdao.codes
+}
+
+func (mdao *MemoryDAO) DeviceCodes() DeviceCodeStore {
+	return mdao.devices
+}
+
+func (mdao *MemoryDAO) MFA() MFAStore {
+	return mdao.mfa
+}
+
+func (mdao *MemoryDAO) WebAuthnCredentials() WebAuthnCredentialStore {
+	return mdao.passkeys
+}
+
+func (mdao *MemoryDAO) LoginAttempts() LoginAttemptStore {
+	return mdao.attempts
+}
+
+// hasPrefixFold tells whether the str starts with the prefix, ignoring case.
+func hasPrefixFold(str, prefix string) bool {
+	return len(prefix) <= len(str) && strings.EqualFold(prefix, str[:len(prefix)])
+}
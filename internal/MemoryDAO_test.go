@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	security "github.com/newm4n/dokku-common/security"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+// TestMemoryDAO_Concurrent hammers the same MemoryDAO from many goroutines, run it with -race.
+func TestMemoryDAO_Concurrent(t *testing.T) {
+	ctx := context.Background()
+	mdao := NewMemoryDAO()
+	_, err := mdao.CreateUserAccount(ctx, "shared@mail.com", "a password")
+	assert.NoError(t, err)
+
+	wg := &sync.WaitGroup{}
+	for worker := 0; worker < 16; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			tenant := fmt.Sprintf("T%d", worker%4)
+			for i := 0; i < 50; i++ {
+				email := fmt.Sprintf("user%d-%d@mail.com", worker, i)
+				mdao.putAccountLocked(email, "hash")
+				_, _ = mdao.CreateUserTenantRole(ctx, email, tenant, "R1")
+				_, _ = mdao.CreateUserTenantRole(ctx, "shared@mail.com", tenant, fmt.Sprintf("R%d", i))
+				_, _ = mdao.SearchUser(ctx, "user")
+				_, _ = mdao.SearchUserTenant(ctx, "shared@mail.com", "t")
+				_, _ = mdao.ListTenantUser(ctx, tenant)
+				_, _ = mdao.UserTenantRoleExist(ctx, email, tenant, "R1")
+				_, _ = mdao.UpdateUserTenant(ctx, email, tenant, "MOVED")
+				_, _ = mdao.ListTenant(ctx)
+				if i%10 == 0 {
+					_, _ = mdao.DeleteUserAccount(ctx, email)
+					_, _ = mdao.DeleteUserAllTenant(ctx, email)
+				}
+			}
+		}(worker)
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, _, err := mdao.Authenticate(ctx, "shared@mail.com", "a password")
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	emails, err := mdao.SearchUser(ctx, "user")
+	assert.NoError(t, err)
+	assert.Equal(t, 16*45, len(emails))
+	members, err := mdao.ListTenantUser(ctx, "MOVED")
+	assert.NoError(t, err)
+	assert.Equal(t, 16*45, len(members))
+	roles, err := mdao.ListUserTenantRole(ctx, "shared@mail.com", "T0")
+	assert.NoError(t, err)
+	assert.Equal(t, 50, len(roles))
+}
+
+// putAccountLocked registers an account with a ready made hash, skipping the slow hashing of CreateUserAccount.
+func (mdao *MemoryDAO) putAccountLocked(email, passHash string) {
+	mdao.mutex.Lock()
+	defer mdao.mutex.Unlock()
+	mdao.putAccount(&UserAccount{
+		email:      email,
+		passphrase: passHash,
+	})
+}
+
+// newPopulatedMemoryDAO creates a MemoryDAO holding the number of users, each a member of one of 100 tenants.
+// Every user shares the same passphrase hash, as hashing 100k passphrases would take minutes.
+func newPopulatedMemoryDAO(b *testing.B, users int) *MemoryDAO {
+	passHash, err := security.CreateHash("a password", security.DefaultParams)
+	if err != nil {
+		b.Fatal(err)
+	}
+	mdao := NewMemoryDAO()
+	for i := 0; i < users; i++ {
+		email := fmt.Sprintf("user%06d@mail.com", i)
+		mdao.putAccountLocked(email, passHash)
+		mdao.addMembership(email, fmt.Sprintf("T%02d", i%100), []string{"R1", "R2"})
+	}
+	return mdao
+}
+
+var benchmarkSizes = []int{100, 100000}
+
+// BenchmarkMemoryDAO_Authenticate is dominated by the argon2 passphrase comparison, the user lookup is a map access.
+func BenchmarkMemoryDAO_Authenticate(b *testing.B) {
+	ctx := context.Background()
+	for _, size := range benchmarkSizes {
+		mdao := newPopulatedMemoryDAO(b, size)
+		email := fmt.Sprintf("user%06d@mail.com", size/2)
+		b.Run(fmt.Sprintf("users-%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, _, _, err := mdao.Authenticate(ctx, email, "a password"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMemoryDAO_UserExist(b *testing.B) {
+	ctx := context.Background()
+	for _, size := range benchmarkSizes {
+		mdao := newPopulatedMemoryDAO(b, size)
+		email := fmt.Sprintf("USER%06d@mail.com", size/2)
+		b.Run(fmt.Sprintf("users-%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if exist, _ := mdao.UserExist(ctx, email); !exist {
+					b.Fatal("user not found")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMemoryDAO_SearchUser(b *testing.B) {
+	ctx := context.Background()
+	for _, size := range benchmarkSizes {
+		mdao := newPopulatedMemoryDAO(b, size)
+		// matches 10 users
+		search := fmt.Sprintf("user%05d", size/20)
+		b.Run(fmt.Sprintf("users-%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if emails, _ := mdao.SearchUser(ctx, search); len(emails) != 10 {
+					b.Fatalf("expect 10 users, got %d", len(emails))
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMemoryDAO_SearchUserTenant(b *testing.B) {
+	ctx := context.Background()
+	for _, size := range benchmarkSizes {
+		mdao := newPopulatedMemoryDAO(b, size)
+		email := fmt.Sprintf("user%06d@mail.com", size/2)
+		b.Run(fmt.Sprintf("users-%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if tenants, _ := mdao.SearchUserTenant(ctx, email, "t"); len(tenants) != 1 {
+					b.Fatal("tenant not found")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,710 @@
+package internal
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hyperjumptech/jiffy"
+	"github.com/newm4n/dokku-aaa/configuration"
+	"github.com/newm4n/dokku-common/security"
+	bolt "go.etcd.io/bbolt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// AmrPassword, AmrOTP and AmrMFA are the RFC 8176 amr values carried by the tokens of a signed in user.
+	AmrPassword = "pwd"
+	AmrOTP      = "otp"
+	AmrMFA      = "mfa"
+
+	// MFAToken is the token type of the MFA challenge token, only accepted by /login/mfa.
+	MFAToken security.TokenType = "application/mfa+jwt"
+
+	// totpPeriod, totpDigits and the HMAC-SHA1 are the RFC 6238 defaults every authenticator app supports.
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is the number of time steps a code is still, or already, accepted around the current one.
+	totpSkew          = 1
+	totpSecretSize    = 20
+	recoveryCodeCount = 10
+	// recoveryCodeSize random bytes make a 16 characters recovery code, too strong to be guessed from its SHA-256.
+	recoveryCodeSize = 10
+)
+
+var (
+	ErrMFARequired     = fmt.Errorf("second factor code is required")
+	ErrInvalidMFACode  = fmt.Errorf("invalid second factor code")
+	ErrInvalidMFAToken = fmt.Errorf("mfa token is invalid, expired or already used")
+	ErrMFAEnrolled     = fmt.Errorf("second factor is already enrolled")
+	ErrMFANotEnrolled  = fmt.Errorf("no second factor is enrolled")
+	// ErrReauthenticate is returned when the credentials of an account are changed without its current passphrase.
+	ErrReauthenticate = fmt.Errorf("the current passphrase is required to change the sign in methods")
+
+	// bucketUserTotp holds the TOTP enrolments, keyed by lower-cased email.
+	bucketUserTotp = []byte("user_totp")
+
+	totpEncoding         = base32.StdEncoding.WithPadding(base32.NoPadding)
+	recoveryCodeEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+)
+
+// TOTPEnrolment is the RFC 6238 time-based one-time password second factor of a user.
+// It only guards the sign in once confirmed, by a first code from the authenticator app.
+type TOTPEnrolment struct {
+	Email     string
+	Secret    string // base32 encoded, as shown to the authenticator app
+	Confirmed bool
+	// RecoveryCodes are the SHA-256 of the unused recovery codes, the codes themselves are only shown once.
+	RecoveryCodes []string
+	// LastStep is the time step of the last accepted code, a code is never accepted twice.
+	LastStep  int64
+	CreatedAt time.Time
+}
+
+func (enrolment *TOTPEnrolment) copy() *TOTPEnrolment {
+	ret := *enrolment
+	ret.RecoveryCodes = slices.Clone(enrolment.RecoveryCodes)
+	return &ret
+}
+
+// Uri returns the otpauth URI of the enrolment, shown as QR code to the authenticator app.
+func (enrolment *TOTPEnrolment) Uri() string {
+	issuer := configuration.Get("token.issuer")
+	query := url.Values{
+		"secret":    {enrolment.Secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	return (&url.URL{Scheme: "otpauth", Host: "totp", Path: "/" + issuer + ":" + enrolment.Email, RawQuery: query.Encode()}).String()
+}
+
+// NewTOTPEnrolment creates the unconfirmed enrolment of the user, with a random secret.
+func NewTOTPEnrolment(email string) (*TOTPEnrolment, error) {
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &TOTPEnrolment{Email: email, Secret: totpEncoding.EncodeToString(secret), CreatedAt: time.Now()}, nil
+}
+
+// TOTPCode computes the code of the base32 secret at the time step (RFC 6238, HMAC-SHA1).
+func TOTPCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, bin%1000000), nil
+}
+
+// TOTPStep returns the time step of the time.
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// matchTOTP returns the time step the code is valid for, around the current time.
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	current := TOTPStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := TOTPCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// newRecoveryCodes creates the one-time recovery codes, like abcd-efgh-ijkl-mnop, and their hashes to be stored.
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		buff := make([]byte, recoveryCodeSize)
+		if _, err := rand.Read(buff); err != nil {
+			return nil, nil, err
+		}
+		code := recoveryCodeEncoding.EncodeToString(buff)
+		codes = append(codes, code[0:4]+"-"+code[4:8]+"-"+code[8:12]+"-"+code[12:16])
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes the recovery code as typed by the user, ignoring case, spaces and dashes.
+func hashRecoveryCode(code string) string {
+	code = strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// isTOTPCode tells whether the code looks like a TOTP code rather than a recovery code.
+func isTOTPCode(code string) bool {
+	if len(code) != totpDigits {
+		return false
+	}
+	for _, r := range code {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// EnrolTOTP starts the TOTP enrolment of the user, replacing an unconfirmed one.
+// It returns ErrMFAEnrolled when the user already confirmed one.
+func EnrolTOTP(ctx context.Context, store MFAStore, email string) (*TOTPEnrolment, error) {
+	existing, err := store.GetTOTP(ctx, email)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if err == nil && existing.Confirmed {
+		return nil, ErrMFAEnrolled
+	}
+	enrolment, err := NewTOTPEnrolment(email)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.SaveTOTP(ctx, enrolment); err != nil {
+		return nil, err
+	}
+	return enrolment, nil
+}
+
+// ConfirmTOTP confirms the pending enrolment of the user using a code of the authenticator app.
+// It returns the recovery codes, they are not kept and can not be shown again.
+func ConfirmTOTP(ctx context.Context, store MFAStore, email, code string) (recoveryCodes []string, err error) {
+	enrolment, err := store.GetTOTP(ctx, email)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrMFANotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if enrolment.Confirmed {
+		return nil, ErrMFAEnrolled
+	}
+	step, ok := matchTOTP(enrolment.Secret, strings.TrimSpace(code), time.Now())
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+	recoveryCodes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	enrolment.Confirmed = true
+	enrolment.LastStep = step
+	enrolment.RecoveryCodes = hashes
+	if err := store.SaveTOTP(ctx, enrolment); err != nil {
+		return nil, err
+	}
+	return recoveryCodes, nil
+}
+
+// DisableTOTP removes the second factor of the user, once a last code or recovery code is verified.
+func DisableTOTP(ctx context.Context, store MFAStore, email, code string) error {
+	enrolment, err := store.GetTOTP(ctx, email)
+	if errors.Is(err, ErrNotFound) {
+		return ErrMFANotEnrolled
+	}
+	if err != nil {
+		return err
+	}
+	if enrolment.Confirmed {
+		if err := verifyFactorCode(ctx, store, enrolment, code); err != nil {
+			return err
+		}
+	}
+	return store.DeleteTOTP(ctx, email)
+}
+
+// VerifySecondFactor returns the amr of the user whose passphrase is verified. Users having confirmed a
+// second factor must also give a code of their authenticator app, or one of their recovery codes.
+// It returns ErrMFARequired when the code is missing, and ErrInvalidMFACode when it is wrong or already used.
+func VerifySecondFactor(ctx context.Context, store MFAStore, email, code string) (amr []string, err error) {
+	enrolment, err := store.GetTOTP(ctx, email)
+	if errors.Is(err, ErrNotFound) {
+		return []string{AmrPassword}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !enrolment.Confirmed {
+		return []string{AmrPassword}, nil
+	}
+	if len(strings.TrimSpace(code)) == 0 {
+		return nil, ErrMFARequired
+	}
+	if err := verifyFactorCode(ctx, store, enrolment, code); err != nil {
+		return nil, err
+	}
+	return []string{AmrPassword, AmrOTP, AmrMFA}, nil
+}
+
+// verifyFactorCode accepts a TOTP code once per time step, or an unused recovery code, which is then used up.
+func verifyFactorCode(ctx context.Context, store MFAStore, enrolment *TOTPEnrolment, code string) error {
+	code = strings.TrimSpace(code)
+	if isTOTPCode(code) {
+		step, ok := matchTOTP(enrolment.Secret, code, time.Now())
+		if !ok {
+			return ErrInvalidMFACode
+		}
+		fresh, err := store.UseTOTPStep(ctx, enrolment.Email, step)
+		if err != nil {
+			return err
+		}
+		if !fresh {
+			return ErrInvalidMFACode
+		}
+		return nil
+	}
+	used, err := store.UseRecoveryCode(ctx, enrolment.Email, hashRecoveryCode(code))
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// signInTokens issues the tokens of the user whose passphrase is verified. When the user confirmed a second factor,
+// only the MFA challenge token is issued, exchanged for the tokens by VerifyMFA. Every DataAccess Authenticate uses it.
+func signInTokens(ctx context.Context, dao DataAccess, email string) (accessToken, refreshToken, mfaToken string, err error) {
+	enrolment, err := dao.MFA().GetTOTP(ctx, email)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return "", "", "", err
+	}
+	if err == nil && enrolment.Confirmed {
+		mfaToken, err = createMFAToken(email)
+		if err != nil {
+			return "", "", "", err
+		}
+		return "", "", mfaToken, nil
+	}
+	accessToken, refreshToken, err = dao.IssueTokens(ctx, email, []string{AmrPassword})
+	if err != nil {
+		return "", "", "", err
+	}
+	return accessToken, refreshToken, "", nil
+}
+
+// createMFAToken issues the MFA challenge token of the user, valid for mfa.challenge.age.
+func createMFAToken(email string) (string, error) {
+	age, err := jiffy.DurationOf(configuration.Get("mfa.challenge.age"))
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return SignToken(&security.GoClaim{
+		Issuer:     configuration.Get("token.issuer"),
+		Subscriber: email,
+		TokenType:  MFAToken,
+		Audience:   []string{},
+		NotBefore:  now,
+		IssuedAt:   now,
+		ExpireAt:   now.Add(age),
+		Tokenid:    NewTokenId(),
+	}, GetKeyring().Active())
+}
+
+// MFATokenSubject returns the subject of the MFA challenge token, or empty when it is not a valid one.
+func MFATokenSubject(mfaToken string) string {
+	claim, err := VerifyToken(mfaToken)
+	if err != nil || claim.TokenType != MFAToken {
+		return ""
+	}
+	return claim.Subscriber
+}
+
+// VerifyMFA completes the sign in started by Authenticate, issuing the tokens once the code is verified.
+// The challenge token is single-use whatever the outcome, a wrong code means signing in again.
+func VerifyMFA(ctx context.Context, dao DataAccess, mfaToken, code string) (accessToken, refreshToken string, err error) {
+	claim, err := VerifyToken(mfaToken)
+	if err != nil || claim.TokenType != MFAToken {
+		return "", "", ErrInvalidMFAToken
+	}
+	firstUse, err := dao.Revocations().UseToken(ctx, claim.Tokenid, claim.ExpireAt)
+	if err != nil {
+		return "", "", err
+	}
+	if !firstUse {
+		return "", "", ErrInvalidMFAToken
+	}
+	amr, err := VerifySecondFactor(ctx, dao.MFA(), claim.Subscriber, code)
+	if err != nil {
+		return "", "", err
+	}
+	return dao.IssueTokens(ctx, claim.Subscriber, amr)
+}
+
+// MFAStore keeps the second factor enrolments of the users.
+type MFAStore interface {
+	// SaveTOTP creates, or replaces, the TOTP enrolment of the user.
+	SaveTOTP(ctx context.Context, enrolment *TOTPEnrolment) error
+	// GetTOTP returns ErrNotFound when the user has no enrolment.
+	GetTOTP(ctx context.Context, email string) (*TOTPEnrolment, error)
+	// DeleteTOTP returns ErrNotFound when the user has no enrolment.
+	DeleteTOTP(ctx context.Context, email string) error
+	// UseTOTPStep records the time step of an accepted code. It returns false when this step,
+	// or a later one, was already used.
+	UseTOTPStep(ctx context.Context, email string, step int64) (fresh bool, err error)
+	// UseRecoveryCode removes the recovery code hash. It returns false when the user has no such unused code.
+	UseRecoveryCode(ctx context.Context, email, codeHash string) (used bool, err error)
+}
+
+// MemoryMFAStore is the in memory MFAStore, enrolments are lost on restart.
+type MemoryMFAStore struct {
+	mutex      sync.Mutex
+	enrolments map[string]*TOTPEnrolment
+}
+
+func NewMemoryMFAStore() *MemoryMFAStore {
+	return &MemoryMFAStore{
+		enrolments: make(map[string]*TOTPEnrolment),
+	}
+}
+
+func (store *MemoryMFAStore) SaveTOTP(ctx context.Context, enrolment *TOTPEnrolment) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if enrolment == nil || len(enrolment.Email) == 0 || len(enrolment.Secret) == 0 {
+		return ErrArgumentEmpty
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.enrolments[strings.ToLower(enrolment.Email)] = enrolment.copy()
+	return nil
+}
+
+func (store *MemoryMFAStore) GetTOTP(ctx context.Context, email string) (*TOTPEnrolment, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(email) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	enrolment, exist := store.enrolments[strings.ToLower(email)]
+	if !exist {
+		return nil, ErrNotFound
+	}
+	return enrolment.copy(), nil
+}
+
+func (store *MemoryMFAStore) DeleteTOTP(ctx context.Context, email string) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if len(email) == 0 {
+		return ErrArgumentEmpty
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, exist := store.enrolments[strings.ToLower(email)]; !exist {
+		return ErrNotFound
+	}
+	delete(store.enrolments, strings.ToLower(email))
+	return nil
+}
+
+func (store *MemoryMFAStore) UseTOTPStep(ctx context.Context, email string, step int64) (fresh bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	enrolment, exist := store.enrolments[strings.ToLower(email)]
+	if !exist || enrolment.LastStep >= step {
+		return false, nil
+	}
+	enrolment.LastStep = step
+	return true, nil
+}
+
+func (store *MemoryMFAStore) UseRecoveryCode(ctx context.Context, email, codeHash string) (used bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	enrolment, exist := store.enrolments[strings.ToLower(email)]
+	if !exist {
+		return false, nil
+	}
+	idx := slices.Index(enrolment.RecoveryCodes, codeHash)
+	if idx < 0 {
+		return false, nil
+	}
+	enrolment.RecoveryCodes = slices.Delete(enrolment.RecoveryCodes, idx, idx+1)
+	return true, nil
+}
+
+// SqlMFAStore is the MFAStore kept in the user_totp and user_recovery_code tables, for SQLite and PostgreSQL.
+type SqlMFAStore struct {
+	DB *sql.DB
+}
+
+func NewSqlMFAStore(db *sql.DB) *SqlMFAStore {
+	return &SqlMFAStore{DB: db}
+}
+
+func (store *SqlMFAStore) SaveTOTP(ctx context.Context, enrolment *TOTPEnrolment) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if enrolment == nil || len(enrolment.Email) == 0 || len(enrolment.Secret) == 0 {
+		return ErrArgumentEmpty
+	}
+	tx, err := store.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	email := strings.ToLower(enrolment.Email)
+	if _, err := tx.ExecContext(ctx, `INSERT INTO user_totp (email, secret, confirmed, last_step, created_at) VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (email) DO UPDATE SET secret = excluded.secret, confirmed = excluded.confirmed, last_step = excluded.last_step, created_at = excluded.created_at`,
+		email, enrolment.Secret, enrolment.Confirmed, enrolment.LastStep, sqlTime(enrolment.CreatedAt)); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_recovery_code WHERE email = $1`, email); err != nil {
+		return err
+	}
+	for _, codeHash := range enrolment.RecoveryCodes {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO user_recovery_code (email, code_hash) VALUES ($1, $2)`, email, codeHash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (store *SqlMFAStore) GetTOTP(ctx context.Context, email string) (*TOTPEnrolment, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(email) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	enrolment := &TOTPEnrolment{}
+	err := store.DB.QueryRowContext(ctx, `SELECT email, secret, confirmed, last_step, created_at FROM user_totp WHERE email = $1`, strings.ToLower(email)).
+		Scan(&enrolment.Email, &enrolment.Secret, &enrolment.Confirmed, &enrolment.LastStep, &enrolment.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	rows, err := store.DB.QueryContext(ctx, `SELECT code_hash FROM user_recovery_code WHERE email = $1`, enrolment.Email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var codeHash string
+		if err := rows.Scan(&codeHash); err != nil {
+			return nil, err
+		}
+		enrolment.RecoveryCodes = append(enrolment.RecoveryCodes, codeHash)
+	}
+	return enrolment, rows.Err()
+}
+
+func (store *SqlMFAStore) DeleteTOTP(ctx context.Context, email string) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if len(email) == 0 {
+		return ErrArgumentEmpty
+	}
+	if _, err := store.DB.ExecContext(ctx, `DELETE FROM user_recovery_code WHERE email = $1`, strings.ToLower(email)); err != nil {
+		return err
+	}
+	result, err := store.DB.ExecContext(ctx, `DELETE FROM user_totp WHERE email = $1`, strings.ToLower(email))
+	if err != nil {
+		return err
+	}
+	return expectAffected(result)
+}
+
+func (store *SqlMFAStore) UseTOTPStep(ctx context.Context, email string, step int64) (fresh bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	// the update decides which caller uses the step.
+	result, err := store.DB.ExecContext(ctx, `UPDATE user_totp SET last_step = $1 WHERE email = $2 AND last_step < $3`,
+		step, strings.ToLower(email), step)
+	if err != nil {
+		return false, err
+	}
+	return usedUp(result)
+}
+
+func (store *SqlMFAStore) UseRecoveryCode(ctx context.Context, email, codeHash string) (used bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	result, err := store.DB.ExecContext(ctx, `DELETE FROM user_recovery_code WHERE email = $1 AND code_hash = $2`,
+		strings.ToLower(email), codeHash)
+	if err != nil {
+		return false, err
+	}
+	return usedUp(result)
+}
+
+// usedUp tells whether the statement changed a row.
+func usedUp(result sql.Result) (bool, error) {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// BoltMFAStore is the MFAStore kept in the user_totp bucket of the bolt file.
+type BoltMFAStore struct {
+	DB *bolt.DB
+}
+
+func NewBoltMFAStore(db *bolt.DB) *BoltMFAStore {
+	return &BoltMFAStore{DB: db}
+}
+
+func getBoltTotp(tx *bolt.Tx, email string) (*TOTPEnrolment, error) {
+	data := tx.Bucket(bucketUserTotp).Get([]byte(strings.ToLower(email)))
+	if data == nil {
+		return nil, ErrNotFound
+	}
+	enrolment := &TOTPEnrolment{}
+	if err := json.Unmarshal(data, enrolment); err != nil {
+		return nil, err
+	}
+	return enrolment, nil
+}
+
+func putBoltTotp(tx *bolt.Tx, enrolment *TOTPEnrolment) error {
+	data, err := json.Marshal(enrolment)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketUserTotp).Put([]byte(strings.ToLower(enrolment.Email)), data)
+}
+
+func (store *BoltMFAStore) SaveTOTP(ctx context.Context, enrolment *TOTPEnrolment) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if enrolment == nil || len(enrolment.Email) == 0 || len(enrolment.Secret) == 0 {
+		return ErrArgumentEmpty
+	}
+	return store.DB.Update(func(tx *bolt.Tx) error {
+		return putBoltTotp(tx, enrolment)
+	})
+}
+
+func (store *BoltMFAStore) GetTOTP(ctx context.Context, email string) (*TOTPEnrolment, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(email) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	var enrolment *TOTPEnrolment
+	err := store.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		enrolment, err = getBoltTotp(tx, email)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return enrolment, nil
+}
+
+func (store *BoltMFAStore) DeleteTOTP(ctx context.Context, email string) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if len(email) == 0 {
+		return ErrArgumentEmpty
+	}
+	return store.DB.Update(func(tx *bolt.Tx) error {
+		key := []byte(strings.ToLower(email))
+		if tx.Bucket(bucketUserTotp).Get(key) == nil {
+			return ErrNotFound
+		}
+		return tx.Bucket(bucketUserTotp).Delete(key)
+	})
+}
+
+func (store *BoltMFAStore) UseTOTPStep(ctx context.Context, email string, step int64) (fresh bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	err = store.DB.Update(func(tx *bolt.Tx) error {
+		enrolment, err := getBoltTotp(tx, email)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if enrolment.LastStep >= step {
+			return nil
+		}
+		enrolment.LastStep = step
+		fresh = true
+		return putBoltTotp(tx, enrolment)
+	})
+	return fresh, err
+}
+
+func (store *BoltMFAStore) UseRecoveryCode(ctx context.Context, email, codeHash string) (used bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	err = store.DB.Update(func(tx *bolt.Tx) error {
+		enrolment, err := getBoltTotp(tx, email)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		idx := slices.Index(enrolment.RecoveryCodes, codeHash)
+		if idx < 0 {
+			return nil
+		}
+		enrolment.RecoveryCodes = slices.Delete(enrolment.RecoveryCodes, idx, idx+1)
+		used = true
+		return putBoltTotp(tx, enrolment)
+	})
+	return used, err
+}
@@ -0,0 +1,304 @@
+package internal
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/json"
+	"github.com/newm4n/dokku-aaa/configuration"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1 test vectors truncated to 6 digits.
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	for seconds, want := range map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 2000000000: "279037"} {
+		code, err := TOTPCode(secret, TOTPStep(time.Unix(seconds, 0)))
+		assert.NoError(t, err)
+		assert.Equal(t, want, code)
+	}
+	_, err := TOTPCode("not base32!", 1)
+	assert.Error(t, err)
+
+	enrolment, err := NewTOTPEnrolment("User@Mail.com")
+	assert.NoError(t, err)
+	uri, err := url.Parse(enrolment.Uri())
+	assert.NoError(t, err)
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, enrolment.Secret, uri.Query().Get("secret"))
+	assert.Contains(t, uri.Path, "User@Mail.com")
+}
+
+func testMFAStore(t *testing.T, newStore func(t *testing.T) MFAStore) {
+	ctx := context.Background()
+
+	t.Run("CRUD", func(t *testing.T) {
+		store := newStore(t)
+		_, err := store.GetTOTP(ctx, "user@mail.com")
+		assert.ErrorIs(t, err, ErrNotFound)
+		assert.ErrorIs(t, store.DeleteTOTP(ctx, "user@mail.com"), ErrNotFound)
+
+		enrolment, err := NewTOTPEnrolment("user@mail.com")
+		assert.NoError(t, err)
+		assert.NoError(t, store.SaveTOTP(ctx, enrolment))
+		got, err := store.GetTOTP(ctx, "USER@mail.com")
+		assert.NoError(t, err)
+		assert.Equal(t, enrolment.Secret, got.Secret)
+		assert.False(t, got.Confirmed)
+		assert.Empty(t, got.RecoveryCodes)
+
+		got.Confirmed = true
+		got.LastStep = 100
+		got.RecoveryCodes = []string{hashRecoveryCode("aaaa-bbbb-cccc-dddd"), hashRecoveryCode("eeee-ffff-gggg-hhhh")}
+		assert.NoError(t, store.SaveTOTP(ctx, got))
+		got, err = store.GetTOTP(ctx, "user@mail.com")
+		assert.NoError(t, err)
+		assert.True(t, got.Confirmed)
+		assert.Equal(t, int64(100), got.LastStep)
+		assert.ElementsMatch(t, []string{hashRecoveryCode("aaaa-bbbb-cccc-dddd"), hashRecoveryCode("eeee-ffff-gggg-hhhh")}, got.RecoveryCodes)
+
+		// steps only move forward.
+		fresh, err := store.UseTOTPStep(ctx, "user@mail.com", 100)
+		assert.NoError(t, err)
+		assert.False(t, fresh)
+		fresh, err = store.UseTOTPStep(ctx, "user@mail.com", 101)
+		assert.NoError(t, err)
+		assert.True(t, fresh)
+		fresh, err = store.UseTOTPStep(ctx, "user@mail.com", 100)
+		assert.NoError(t, err)
+		assert.False(t, fresh)
+
+		// recovery codes are single use.
+		used, err := store.UseRecoveryCode(ctx, "user@mail.com", hashRecoveryCode("aaaa-bbbb-cccc-dddd"))
+		assert.NoError(t, err)
+		assert.True(t, used)
+		used, err = store.UseRecoveryCode(ctx, "user@mail.com", hashRecoveryCode("aaaa-bbbb-cccc-dddd"))
+		assert.NoError(t, err)
+		assert.False(t, used)
+		got, err = store.GetTOTP(ctx, "user@mail.com")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{hashRecoveryCode("eeee-ffff-gggg-hhhh")}, got.RecoveryCodes)
+
+		assert.NoError(t, store.DeleteTOTP(ctx, "user@mail.com"))
+		_, err = store.GetTOTP(ctx, "user@mail.com")
+		assert.ErrorIs(t, err, ErrNotFound)
+		used, err = store.UseRecoveryCode(ctx, "user@mail.com", hashRecoveryCode("eeee-ffff-gggg-hhhh"))
+		assert.NoError(t, err)
+		assert.False(t, used)
+	})
+}
+
+func TestMemoryMFAStore(t *testing.T) {
+	testMFAStore(t, func(t *testing.T) MFAStore {
+		return NewMemoryMFAStore()
+	})
+}
+
+func TestSqlMFAStore_SQLite(t *testing.T) {
+	testMFAStore(t, func(t *testing.T) MFAStore {
+		return newSQLiteDAO(t).MFA()
+	})
+}
+
+func TestBoltMFAStore(t *testing.T) {
+	testMFAStore(t, func(t *testing.T) MFAStore {
+		return newBoltDAO(t).MFA()
+	})
+}
+
+// currentTOTP returns the code of the current time step, moved later by the given steps.
+func currentTOTP(t *testing.T, secret string, later int64) string {
+	code, err := TOTPCode(secret, TOTPStep(time.Now())+later)
+	assert.NoError(t, err)
+	return code
+}
+
+// wrongTOTP returns a code no time step around the current one accepts.
+func wrongTOTP(t *testing.T, secret string) string {
+	for _, wrong := range []string{"000000", "111111", "222222", "333333", "444444"} {
+		accepted := false
+		for later := int64(-2); later <= 2; later++ {
+			accepted = accepted || wrong == currentTOTP(t, secret, later)
+		}
+		if !accepted {
+			return wrong
+		}
+	}
+	t.Fatal("no wrong code left")
+	return ""
+}
+
+// bearer sets the access token of the request.
+func bearer(request *http.Request, accessToken string) *http.Request {
+	request.Header.Set("Authorization", "Bearer "+accessToken)
+	return request
+}
+
+func TestTheHandler_MFA(t *testing.T) {
+	configuration.SetConfig("introspection.client.id", "resource-server")
+	configuration.SetConfig("introspection.client.secret", "resource secret")
+	defer func() {
+		configuration.SetConfig("introspection.client.id", "")
+		configuration.SetConfig("introspection.client.secret", "")
+	}()
+	router := newTestRouter()
+	resp := serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/create-user",
+		`{"Email":"user@mail.com","Passphrase":"a passphrase","TenantRole":["viewer@ACME"]}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	login := func() *AuthenticateResponse {
+		resp := serve(router, newRequest(http.MethodPost, "/login", `{"Email":"user@mail.com","Passphrase":"a passphrase"}`))
+		assert.Equal(t, http.StatusOK, resp.Code)
+		authResp := &AuthenticateResponse{}
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), authResp))
+		return authResp
+	}
+	loginMFA := func(mfaToken, code string) (int, *AuthenticateResponse) {
+		resp := serve(router, newRequest(http.MethodPost, "/login/mfa", `{"MFAToken":"`+mfaToken+`","Code":"`+code+`"}`))
+		authResp := &AuthenticateResponse{}
+		if resp.Code == http.StatusOK {
+			assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), authResp))
+		}
+		return resp.Code, authResp
+	}
+
+	// without a second factor the password is the only authentication method.
+	first := login()
+	assert.NotEmpty(t, first.Access)
+	assert.Empty(t, first.MFAToken)
+	assert.Equal(t, []string{AmrPassword}, TokenAmr(first.Access))
+
+	resp = serve(router, bearer(newRequest(http.MethodPost, "/mfa/totp/confirm", `{"Code":"000000"}`), first.Access))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	// enrolling needs the passphrase too, an access token alone does not add a sign in method.
+	resp = serve(router, bearer(newRequest(http.MethodPost, "/mfa/totp", `{}`), first.Access))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = serve(router, bearer(newRequest(http.MethodPost, "/mfa/totp", `{"Passphrase":"wrong passphrase"}`), first.Access))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = serve(router, bearer(newRequest(http.MethodPost, "/mfa/totp", `{"Passphrase":"a passphrase"}`), first.Access))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	enrolment := &TOTPEnrolmentResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), enrolment))
+	assert.NotEmpty(t, enrolment.Secret)
+	assert.True(t, strings.HasPrefix(enrolment.Uri, "otpauth://totp/"))
+
+	// an unconfirmed enrolment does not change the login yet.
+	assert.Empty(t, login().MFAToken)
+	wrong := wrongTOTP(t, enrolment.Secret)
+	resp = serve(router, bearer(newRequest(http.MethodPost, "/mfa/totp/confirm", `{"Code":"`+wrong+`"}`), first.Access))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	confirmCode := currentTOTP(t, enrolment.Secret, 0)
+	resp = serve(router, bearer(newRequest(http.MethodPost, "/mfa/totp/confirm", `{"Code":"`+confirmCode+`"}`), first.Access))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	recovery := &RecoveryCodesResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), recovery))
+	assert.Len(t, recovery.RecoveryCodes, 10)
+	resp = serve(router, bearer(newRequest(http.MethodPost, "/mfa/totp", `{"Passphrase":"a passphrase"}`), first.Access))
+	assert.Equal(t, http.StatusConflict, resp.Code)
+
+	// the login now returns a challenge token instead of the tokens.
+	challenge := login()
+	assert.Empty(t, challenge.Access)
+	assert.Empty(t, challenge.Refresh)
+	assert.NotEmpty(t, challenge.MFAToken)
+	introspection := introspect(t, router, challenge.MFAToken)
+	assert.False(t, introspection.Active)
+	resp = serve(router, bearer(newRequest(http.MethodGet, "/userinfo", ""), challenge.MFAToken))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	// the code used to confirm can not be replayed, and the challenge is single use.
+	status, _ := loginMFA(challenge.MFAToken, confirmCode)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	code := currentTOTP(t, enrolment.Secret, 1)
+	status, _ = loginMFA(challenge.MFAToken, code)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	status, tokens := loginMFA(login().MFAToken, code)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{AmrPassword, AmrOTP, AmrMFA}, TokenAmr(tokens.Access))
+	assert.Equal(t, []string{AmrPassword, AmrOTP, AmrMFA}, introspect(t, router, tokens.Access).Amr)
+	status, _ = loginMFA(login().MFAToken, code)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// refreshed tokens keep the authentication methods.
+	resp = serve(router, newRequest(http.MethodPost, "/refresh", `{"Refresh":"`+tokens.Refresh+`"}`))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	refreshed := &AuthenticateResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), refreshed))
+	assert.Equal(t, []string{AmrPassword, AmrOTP, AmrMFA}, TokenAmr(refreshed.Access))
+
+	// a recovery code works once.
+	status, _ = loginMFA(login().MFAToken, recovery.RecoveryCodes[0])
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = loginMFA(login().MFAToken, recovery.RecoveryCodes[0])
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, _ = loginMFA("not a token", recovery.RecoveryCodes[1])
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// removing the second factor needs a code and the passphrase, root may reset it.
+	resp = serve(router, bearer(newRequest(http.MethodDelete, "/mfa/totp", `{"Code":"`+wrong+`","Passphrase":"a passphrase"}`), tokens.Access))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = serve(router, bearer(newRequest(http.MethodDelete, "/mfa/totp", `{"Code":"`+recovery.RecoveryCodes[1]+`"}`), tokens.Access))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Contains(t, resp.Body.String(), ErrReauthenticate.Error())
+	resp = serve(router, bearer(newRequest(http.MethodDelete, "/mfa/totp", `{"Code":"`+recovery.RecoveryCodes[1]+`","Passphrase":"wrong passphrase"}`), tokens.Access))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = serve(router, bearer(newRequest(http.MethodDelete, "/mfa/totp", `{"Code":"`+recovery.RecoveryCodes[1]+`","Passphrase":"a passphrase"}`), tokens.Access))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NotEmpty(t, login().Access)
+	resp = serve(router, asRoot(newRequest(http.MethodDelete, "/user/ACME/user@mail.com/mfa", "")))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+
+	resp = serve(router, bearer(newRequest(http.MethodPost, "/mfa/totp", `{"Passphrase":"a passphrase"}`), tokens.Access))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	resp = serve(router, newRequest(http.MethodDelete, "/user/ACME/user@mail.com/mfa", ""))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = serve(router, asRoot(newRequest(http.MethodDelete, "/user/ACME/user@mail.com/mfa", "")))
+	assert.Equal(t, http.StatusOK, resp.Code)
+}
+
+func TestTheHandler_AuthorizationCodeMFA(t *testing.T) {
+	router := newTestRouter()
+	resp := serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/create-user",
+		`{"Email":"user@mail.com","Passphrase":"a passphrase","TenantRole":["viewer@ACME"]}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/client",
+		`{"ClientId":"spa","Name":"Single page app","Public":true,"RedirectUri":["https://app.domain.com/callback"]}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	access, _, err := CreateTokenPair("user@mail.com", []string{"viewer@ACME"}, []string{AmrPassword})
+	assert.NoError(t, err)
+	resp = serve(router, bearer(newRequest(http.MethodPost, "/mfa/totp", `{"Passphrase":"a passphrase"}`), access))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	enrolment := &TOTPEnrolmentResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), enrolment))
+	resp = serve(router, bearer(newRequest(http.MethodPost, "/mfa/totp/confirm", `{"Code":"`+currentTOTP(t, enrolment.Secret, 0)+`"}`), access))
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// the hosted login page asks for the code.
+	status, _ := signIn(t, router, "a passphrase")
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	form := authorizeQuery(testCodeChallenge)
+	form.Set("email", "user@mail.com")
+	form.Set("passphrase", "a passphrase")
+	form.Set("otp", currentTOTP(t, enrolment.Secret, 1))
+	request := newRequest(http.MethodPost, "/authorize", form.Encode())
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp = serve(router, request)
+	assert.Equal(t, http.StatusFound, resp.Code)
+	location, err := url.Parse(resp.Header().Get("Location"))
+	assert.NoError(t, err)
+
+	resp = serve(router, newTokenRequest(url.Values{"grant_type": {"authorization_code"}, "client_id": {"spa"},
+		"code": {location.Query().Get("code")}, "redirect_uri": {"https://app.domain.com/callback"}, "code_verifier": {testCodeVerifier}}))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	token := &TokenResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), token))
+	assert.Equal(t, []string{AmrPassword, AmrOTP, AmrMFA}, TokenAmr(token.AccessToken))
+}
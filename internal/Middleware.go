@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	common "github.com/newm4n/dokku-common"
+	"github.com/newm4n/dokku-common/security"
+	"net/http"
+	"strings"
+)
+
+// UserTokenContextMiddleware verifies the bearer access token using this server's keyring and put its claim
+// into the request context, so handlers can authorize the request using common.RequestMayThrough.
+// Requests without Authorization header, or using basic client credentials, are passed through without claim.
+// Tokens of another issuer, expired and revoked tokens are rejected.
+func (hdler *TheHandler) UserTokenContextMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader := r.Header.Get("Authorization")
+		if len(authHeader) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(authHeader) >= 6 && strings.EqualFold(authHeader[:6], "Basic ") {
+			// client credentials, authenticated by the handler accepting them.
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(authHeader) < 7 || !strings.EqualFold(authHeader[:7], "Bearer ") {
+			writeTextResponse(w, http.StatusUnauthorized, "Authorization header found, but it seems that it uses wrong bearer string")
+			return
+		}
+		goClaim, err := VerifyToken(authHeader[7:])
+		if err != nil {
+			writeTextResponse(w, http.StatusForbidden, fmt.Sprintf("Authorization header found, but token contains problem. %s", err.Error()))
+			return
+		}
+		if goClaim.TokenType != security.AccessToken {
+			writeTextResponse(w, http.StatusForbidden, fmt.Sprintf("Authorization header found, but token contains problem. %s", ErrWrongToken.Error()))
+			return
+		}
+		revoked, err := hdler.DAO.Revocations().IsRevoked(r.Context(), goClaim)
+		if err != nil {
+			writeTextResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if revoked {
+			writeTextResponse(w, http.StatusForbidden, fmt.Sprintf("Authorization header found, but token contains problem. %s", ErrTokenRevoked.Error()))
+			return
+		}
+		nCtx := context.WithValue(r.Context(), common.UserAuthorization, authHeader)
+		nCtx = context.WithValue(nCtx, common.UserClaim, goClaim)
+		next.ServeHTTP(w, r.WithContext(nCtx))
+	})
+}
+
+// RequestActor returns the act claim of the bearer access token of the request, or nil when the token was not
+// exchanged, or when there is no token. Tokens acting on behalf of their subject may use its tenant roles,
+// they may not manage its account.
+func RequestActor(request *http.Request) *Actor {
+	authHeader, ok := request.Context().Value(common.UserAuthorization).(string)
+	if !ok || len(authHeader) < 7 {
+		return nil
+	}
+	return TokenActor(authHeader[7:])
+}
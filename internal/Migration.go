@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFS embed.FS
+
+// Migration is a versioned schema script, embedded from the migrations directory.
+// The script file is named after its version, eg. 0001_initial.sql
+type Migration struct {
+	Version int
+	Name    string
+	Script  string
+}
+
+// LoadMigrations reads the embedded schema migrations, ordered by their version.
+func LoadMigrations() ([]*Migration, error) {
+	entries, err := migrationFS.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*Migration, 0)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+		splt := strings.SplitN(name, "_", 2)
+		version, err := strconv.Atoi(splt[0])
+		if err != nil {
+			return nil, fmt.Errorf("migration %s is not prefixed with its version. got %w", entry.Name(), err)
+		}
+		script, err := migrationFS.ReadFile(path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, &Migration{
+			Version: version,
+			Name:    name,
+			Script:  string(script),
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Version < ret[j].Version
+	})
+	for i := 1; i < len(ret); i++ {
+		if ret[i].Version == ret[i-1].Version {
+			return nil, fmt.Errorf("migration %s and %s have the same version", ret[i-1].Name, ret[i].Name)
+		}
+	}
+	return ret, nil
+}
+
+// Migrate applies every embedded migration newer than the schema version of the database.
+// Each migration is applied in its own transaction, together with its record in the schema_migration table.
+func Migrate(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migration (
+    version    INTEGER      NOT NULL PRIMARY KEY,
+    name       VARCHAR(255) NOT NULL,
+    applied_at TIMESTAMP    NOT NULL
+)`)
+	if err != nil {
+		return err
+	}
+	var current int
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migration`).Scan(&current); err != nil {
+		return err
+	}
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return err
+	}
+	for _, migration := range migrations {
+		if migration.Version <= current {
+			continue
+		}
+		log.Infof("applying schema migration %s", migration.Name)
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, migration.Script); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to apply migration %s. got %w", migration.Name, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migration (version, name, applied_at) VALUES ($1, $2, $3)`, migration.Version, migration.Name, time.Now().UTC()); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,8 +1,17 @@
 package internal
 
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
 type User struct {
 	Email      string
-	Passphrase string
+	Passphrase string `json:",omitempty"`
+	FullName   string
+	Status     UserStatus `json:",omitempty"`
+	TenantRole []string   // role1,role2@tenant
 }
 
 type TenantRoles struct {
@@ -16,8 +25,83 @@ type AuthenticateRequest struct {
 }
 
 type AuthenticateResponse struct {
-	Access  string
-	Refresh string
+	Access  string `json:",omitempty"`
+	Refresh string `json:",omitempty"`
+	// MFAToken is returned instead of the tokens when the user enrolled a second factor, see /login/mfa.
+	MFAToken string `json:",omitempty"`
+	// PassphraseChangeToken is returned instead of the tokens when the passphrase expired, see /login/passphrase.
+	PassphraseChangeToken string `json:",omitempty"`
+}
+
+type PassphraseChangeRequest struct {
+	PassphraseChangeToken string
+	NewPassphrase         string
+}
+
+type MFALoginRequest struct {
+	MFAToken string
+	Code     string // TOTP code, or recovery code
+}
+
+type MFACodeRequest struct {
+	Code string
+	// Passphrase is the current passphrase, required to remove the second factor.
+	Passphrase string `json:",omitempty"`
+}
+
+// ReauthenticateRequest carries the current passphrase of the user, required to add a sign in method.
+type ReauthenticateRequest struct {
+	Passphrase string
+}
+
+type TOTPEnrolmentResponse struct {
+	Secret string
+	Uri    string // otpauth URI, to be shown as QR code
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string
+}
+
+type WebAuthnRegistrationOptionsResponse struct {
+	Session   string // posted back to /webauthn/register/finish
+	PublicKey *WebAuthnCreationOptions
+}
+
+type WebAuthnRegistrationRequest struct {
+	Session    string
+	Name       string // shown in the passkey list, eg. "Work laptop"
+	Credential *WebAuthnCredentialJSON
+}
+
+type WebAuthnLoginOptionsRequest struct {
+	Email string // optional, without it the authenticator offers the passkeys it holds
+}
+
+type WebAuthnLoginOptionsResponse struct {
+	Session   string // posted back to /webauthn/login/finish
+	PublicKey *WebAuthnRequestOptions
+}
+
+type WebAuthnLoginRequest struct {
+	Session    string
+	Credential *WebAuthnCredentialJSON
+}
+
+type WebAuthnCredentialResponse struct {
+	Id         string
+	Name       string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+}
+
+func NewWebAuthnCredentialResponse(credential *WebAuthnCredential) *WebAuthnCredentialResponse {
+	return &WebAuthnCredentialResponse{
+		Id:         credential.Id,
+		Name:       credential.Name,
+		CreatedAt:  credential.CreatedAt,
+		LastUsedAt: credential.LastUsedAt,
+	}
 }
 
 type RefreshRequest struct {
@@ -26,6 +110,32 @@ type RefreshRequest struct {
 
 type RefreshResponse struct {
 	Access string
+	// Refresh is the next refresh token, only issued when refresh token rotation is on.
+	Refresh string `json:",omitempty"`
+}
+
+type ClientRequest struct {
+	// ClientId is generated when empty. It can not be changed once the client is created.
+	ClientId   string
+	Name       string
+	TenantRole []string // role1,role2@tenant1,tenant2
+	TokenAge   string   // eg. 1 hour, token.age.access when empty
+	// Public clients get no secret, they sign users in using the authorization code flow with PKCE.
+	// It can not be changed once the client is created.
+	Public      bool
+	RedirectUri []string // exact redirect URIs of the authorization code flow
+}
+
+type ClientResponse struct {
+	ClientId    string
+	Name        string
+	TenantRole  []string
+	TokenAge    string
+	Public      bool
+	RedirectUri []string
+	CreatedAt   time.Time
+	// Secret is only given when the client is created or its secret is reset, it can not be read afterward.
+	Secret string `json:",omitempty"`
 }
 
 type RegisterRequest struct {
@@ -33,8 +143,80 @@ type RegisterRequest struct {
 	Email      string
 	Passphrase string
 	TenantRole []string // role1,role2@tenant1,tenant2
+	// MustChangePassphrase makes the user change the passphrase at the first sign in.
+	MustChangePassphrase bool
+}
+
+type BootstrapRequest struct {
+	Token      string
+	FullName   string
+	Email      string
+	Passphrase string
+}
+
+type ChangePassphraseRequest struct {
+	OldPassphrase string
+	NewPassphrase string
+}
+
+// PassphrasePolicyResponse lists every rule of the passphrase policy the new passphrase fails.
+type PassphrasePolicyResponse struct {
+	Error      string
+	Violations []*PassphraseViolation
+}
+
+func NewPassphrasePolicyResponse(perr *PassphrasePolicyError) *PassphrasePolicyResponse {
+	return &PassphrasePolicyResponse{
+		Error:      ErrPassphrasePolicy.Error(),
+		Violations: perr.Violations,
+	}
+}
+
+type ChangeUserStatusRequest struct {
+	Status UserStatus // active or disabled
 }
 
 type UnRegisterRequest struct {
 	Email string
 }
+
+// ParseTenantRole parse tenant-role string with pattern of 'role1,role2@tenant1,tenant2' into TenantRoles for each of the tenant.
+func ParseTenantRole(tenantRole string) ([]*TenantRoles, error) {
+	splt := strings.Split(tenantRole, "@")
+	if len(splt) != 2 {
+		return nil, fmt.Errorf("invalid tenant-role string \"%s\" need single @ separator", tenantRole)
+	}
+	roles := make([]string, 0)
+	for _, role := range strings.Split(splt[0], ",") {
+		if role = strings.TrimSpace(role); len(role) > 0 {
+			roles = append(roles, role)
+		}
+	}
+	ret := make([]*TenantRoles, 0)
+	for _, tenant := range strings.Split(splt[1], ",") {
+		if tenant = strings.TrimSpace(tenant); len(tenant) > 0 {
+			ret = append(ret, &TenantRoles{
+				Tenant: tenant,
+				Roles:  roles,
+			})
+		}
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("invalid tenant-role string \"%s\" missing tenant", tenantRole)
+	}
+	return ret, nil
+}
+
+// tenantRolesAudience formats the tenant roles in the 'role1,role2@tenant' pattern used as token audience.
+func tenantRolesAudience(tenantRoles []*TenantRoles) []string {
+	auds := make([]string, 0, len(tenantRoles))
+	for _, tr := range tenantRoles {
+		auds = append(auds, tr.String())
+	}
+	return auds
+}
+
+// String returns the tenant roles in the 'role1,role2@tenant' pattern.
+func (tr *TenantRoles) String() string {
+	return fmt.Sprintf("%s@%s", strings.Join(tr.Roles, ","), tr.Tenant)
+}
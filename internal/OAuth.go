@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hyperjumptech/jiffy"
+	"github.com/newm4n/dokku-aaa/configuration"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	GrantTypeClientCredentials = "client_credentials"
+)
+
+var (
+	ErrInvalidScope       = fmt.Errorf("scope is not granted to the client")
+	ErrUnauthorizedClient = fmt.Errorf("grant type is not allowed to the client")
+)
+
+// TokenResponse is the successful response of the token endpoint (RFC 6749 section 5.1).
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	// IssuedTokenType is only set by the token exchange (RFC 8693).
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int64  `json:"expires_in"`
+	RefreshToken    string `json:"refresh_token,omitempty"`
+	Scope           string `json:"scope,omitempty"`
+}
+
+// OAuthError is the error response of the token endpoint (RFC 6749 section 5.2).
+type OAuthError struct {
+	Status           int    `json:"-"`
+	Code             string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+func (oerr *OAuthError) Error() string {
+	return fmt.Sprintf("%s: %s", oerr.Code, oerr.ErrorDescription)
+}
+
+func newOAuthError(status int, code string, err error) *OAuthError {
+	return &OAuthError{
+		Status:           status,
+		Code:             code,
+		ErrorDescription: err.Error(),
+	}
+}
+
+// clientFromRequest authenticates the client of a token request, using HTTP basic (client_secret_basic)
+// or the client_id and client_secret form parameters (client_secret_post). Public clients only send their
+// client_id (none), the grant they use must prove the client some other way. The form must be parsed.
+func clientFromRequest(ctx context.Context, clients ClientStore, request *http.Request) (*OAuthClient, *OAuthError) {
+	clientId, secret, ok := request.BasicAuth()
+	if !ok {
+		clientId, secret = request.PostForm.Get("client_id"), request.PostForm.Get("client_secret")
+	}
+	if len(clientId) > 0 && len(secret) == 0 {
+		client, err := clients.GetClient(ctx, clientId)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, newOAuthError(http.StatusInternalServerError, "server_error", err)
+		}
+		if err == nil && client.Public {
+			return client, nil
+		}
+	}
+	client, err := AuthenticateClient(ctx, clients, clientId, secret)
+	if errors.Is(err, ErrInvalidClientSecret) {
+		return nil, newOAuthError(http.StatusUnauthorized, "invalid_client", err)
+	}
+	if err != nil {
+		return nil, newOAuthError(http.StatusInternalServerError, "server_error", err)
+	}
+	return client, nil
+}
+
+// ClientCredentialsToken issues the access token of the client, carrying the requested scope as audience.
+// The scope lists 'role1,role2@tenant' entries separated by spaces, each of them must be granted to the client.
+// Without scope, every tenant role of the client is carried.
+func ClientCredentialsToken(client *OAuthClient, scope string) (*TokenResponse, error) {
+	if client.Public {
+		return nil, ErrUnauthorizedClient
+	}
+	auds, err := grantedScope(client.Audience(), scope)
+	if err != nil {
+		return nil, err
+	}
+	durAccess, err := client.AccessTokenAge()
+	if err != nil {
+		return nil, err
+	}
+	accessToken, err := createAccessToken(client.Subject(), auds, durAccess)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(durAccess / time.Second),
+		Scope:       strings.Join(auds, " "),
+	}, nil
+}
+
+// AuthorizationCodeToken exchanges the authorization code for the access and refresh token of the signed in user,
+// the same pair the login endpoint issues.
+func AuthorizationCodeToken(ctx context.Context, dao DataAccess, client *OAuthClient, code, redirectUri, codeVerifier string) (*TokenResponse, error) {
+	authCode, err := ExchangeAuthorizationCode(ctx, dao.AuthorizationCodes(), client, code, redirectUri, codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+	return issueUserTokens(ctx, dao, authCode.Subject, authCode.Amr)
+}
+
+// issueUserTokens issues the access and refresh token of the signed in user, see DataAccess.IssueTokens.
+func issueUserTokens(ctx context.Context, dao DataAccess, subject string, amr []string) (*TokenResponse, error) {
+	accessToken, refreshToken, err := dao.IssueTokens(ctx, subject, amr)
+	if err != nil {
+		return nil, err
+	}
+	durAccess, err := jiffy.DurationOf(configuration.Get("token.age.access"))
+	if err != nil {
+		return nil, err
+	}
+	return &TokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(durAccess / time.Second),
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// grantedScope returns the audience narrowed down to the requested scope.
+// It returns ErrInvalidScope when a requested tenant role is not in the audience.
+func grantedScope(auds []string, scope string) ([]string, error) {
+	if len(strings.TrimSpace(scope)) == 0 {
+		return auds, nil
+	}
+	granted := make(map[string][]string)
+	for _, aud := range auds {
+		trs, err := ParseTenantRole(aud)
+		if err != nil {
+			continue
+		}
+		for _, tr := range trs {
+			granted[tr.Tenant] = append(granted[tr.Tenant], tr.Roles...)
+		}
+	}
+	requested := make([]*TenantRoles, 0)
+	for _, entry := range strings.Fields(scope) {
+		trs, err := ParseTenantRole(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%w, %s", ErrInvalidScope, err.Error())
+		}
+		for _, tr := range trs {
+			for _, role := range tr.Roles {
+				if !slices.Contains(granted[tr.Tenant], role) {
+					return nil, fmt.Errorf("%w, %s@%s", ErrInvalidScope, role, tr.Tenant)
+				}
+			}
+		}
+		requested = append(requested, trs...)
+	}
+	return tenantRolesAudience(requested), nil
+}
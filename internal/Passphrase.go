@@ -0,0 +1,319 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	_ "embed"
+	"fmt"
+	"github.com/hyperjumptech/jiffy"
+	"github.com/newm4n/dokku-aaa/configuration"
+	"github.com/newm4n/dokku-common/security"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	ErrPassphrasePolicy             = fmt.Errorf("passphrase does not meet the policy")
+	ErrPassphraseExpired            = fmt.Errorf("passphrase has expired and must be changed")
+	ErrInvalidPassphraseChangeToken = fmt.Errorf("passphrase change token is invalid, expired or already used")
+)
+
+// PassphraseChangeToken is the token type of the restricted token /login returns instead of the tokens
+// when the passphrase must be changed, only accepted by /login/passphrase.
+const PassphraseChangeToken security.TokenType = "application/passphrase-change+jwt"
+
+// The rules of the passphrase policy, as reported in PassphraseViolation.
+const (
+	PassphraseRuleMinLength = "min_length"
+	PassphraseRuleLower     = "lower"
+	PassphraseRuleUpper     = "upper"
+	PassphraseRuleDigit     = "digit"
+	PassphraseRuleSymbol    = "symbol"
+	PassphraseRuleEmail     = "email"
+	PassphraseRuleBlocklist = "blocklist"
+	PassphraseRuleHistory   = "history"
+)
+
+//go:embed blocklist/passphrases.txt
+var embeddedBlocklist string
+
+var (
+	blocklistMutex sync.Mutex
+	// blocklists holds the loaded blocklists, keyed by path. The embedded one is keyed by the empty path.
+	blocklists = make(map[string]map[string]bool)
+)
+
+// PassphraseViolation is a rule of the passphrase policy a passphrase fails.
+type PassphraseViolation struct {
+	Rule    string
+	Message string
+}
+
+// PassphrasePolicyError lists every rule of the passphrase policy a passphrase fails. It is ErrPassphrasePolicy.
+type PassphrasePolicyError struct {
+	Violations []*PassphraseViolation
+}
+
+func (perr *PassphrasePolicyError) Error() string {
+	messages := make([]string, 0, len(perr.Violations))
+	for _, violation := range perr.Violations {
+		messages = append(messages, violation.Message)
+	}
+	return fmt.Sprintf("%s, %s", ErrPassphrasePolicy.Error(), strings.Join(messages, ", "))
+}
+
+func (perr *PassphrasePolicyError) Unwrap() error {
+	return ErrPassphrasePolicy
+}
+
+// CheckPassphrase checks the new passphrase of the email against the passphrase policy of the configuration.
+// It returns a PassphrasePolicyError listing every failed rule, not only the first one.
+func CheckPassphrase(email, passphrase string) error {
+	violations := make([]*PassphraseViolation, 0)
+	violate := func(rule, message string) {
+		violations = append(violations, &PassphraseViolation{Rule: rule, Message: message})
+	}
+
+	if minLength := configuration.GetInt("passphrase.min.length"); utf8.RuneCountInString(passphrase) < minLength {
+		violate(PassphraseRuleMinLength, fmt.Sprintf("must be at least %d characters long", minLength))
+	}
+	var lower, upper, digit, symbol bool
+	for _, char := range passphrase {
+		switch {
+		case unicode.IsLower(char):
+			lower = true
+		case unicode.IsUpper(char):
+			upper = true
+		case unicode.IsDigit(char):
+			digit = true
+		case !unicode.IsLetter(char):
+			symbol = true
+		}
+	}
+	if configuration.GetBoolean("passphrase.require.lower") && !lower {
+		violate(PassphraseRuleLower, "must contain a lowercase letter")
+	}
+	if configuration.GetBoolean("passphrase.require.upper") && !upper {
+		violate(PassphraseRuleUpper, "must contain an uppercase letter")
+	}
+	if configuration.GetBoolean("passphrase.require.digit") && !digit {
+		violate(PassphraseRuleDigit, "must contain a digit")
+	}
+	if configuration.GetBoolean("passphrase.require.symbol") && !symbol {
+		violate(PassphraseRuleSymbol, "must contain a symbol or a space")
+	}
+	if configuration.GetBoolean("passphrase.deny.email") && containsEmail(passphrase, email) {
+		violate(PassphraseRuleEmail, "must not contain the email")
+	}
+	if configuration.GetBoolean("passphrase.blocklist") {
+		blocked, err := blocklisted(passphrase)
+		if err != nil {
+			return err
+		}
+		if blocked {
+			violate(PassphraseRuleBlocklist, "is too common, or known from a data breach")
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PassphrasePolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// containsEmail tells whether the passphrase contains the email, or its local part when it is not too short
+// to be found by chance.
+func containsEmail(passphrase, email string) bool {
+	if len(email) == 0 {
+		return false
+	}
+	passphrase, email = strings.ToLower(passphrase), strings.ToLower(email)
+	if strings.Contains(passphrase, email) {
+		return true
+	}
+	local, _, _ := strings.Cut(email, "@")
+	return utf8.RuneCountInString(local) >= 3 && strings.Contains(passphrase, local)
+}
+
+// blocklisted tells whether the passphrase is in the embedded blocklist, or in the passphrase.blocklist.path file.
+func blocklisted(passphrase string) (bool, error) {
+	key := strings.ToLower(strings.TrimSpace(passphrase))
+	embedded, err := loadBlocklist("")
+	if err != nil {
+		return false, err
+	}
+	if embedded[key] {
+		return true, nil
+	}
+	path := configuration.Get("passphrase.blocklist.path")
+	if len(path) == 0 {
+		return false, nil
+	}
+	extra, err := loadBlocklist(path)
+	if err != nil {
+		return false, err
+	}
+	return extra[key], nil
+}
+
+// loadBlocklist reads the blocklist file once, or the embedded one when the path is empty.
+func loadBlocklist(path string) (map[string]bool, error) {
+	blocklistMutex.Lock()
+	defer blocklistMutex.Unlock()
+	if blocklist, ok := blocklists[path]; ok {
+		return blocklist, nil
+	}
+	var reader io.Reader = strings.NewReader(embeddedBlocklist)
+	if len(path) > 0 {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("can not open passphrase blocklist %s. got %w", path, err)
+		}
+		defer file.Close()
+		reader = file
+	}
+	blocklist, err := readBlocklist(reader)
+	if err != nil {
+		return nil, err
+	}
+	blocklists[path] = blocklist
+	return blocklist, nil
+}
+
+// readBlocklist reads one passphrase per line, lower-cased. Empty lines and lines starting with # are skipped.
+func readBlocklist(reader io.Reader) (map[string]bool, error) {
+	blocklist := make(map[string]bool)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		blocklist[strings.ToLower(line)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return blocklist, nil
+}
+
+// checkPassphraseHistory refuses the new passphrase when it is one of the last passphrase.history ones.
+// The hashes are the current passphrase hash, then the previous ones, newest first.
+func checkPassphraseHistory(newPassphrase string, hashes []string) error {
+	limit := configuration.GetInt("passphrase.history")
+	if limit <= 0 {
+		return nil
+	}
+	if len(hashes) > limit {
+		hashes = hashes[:limit]
+	}
+	for _, hash := range hashes {
+		if match, err := security.ComparePasswordAndHash(newPassphrase, hash); err == nil && match {
+			return &PassphrasePolicyError{Violations: []*PassphraseViolation{{
+				Rule:    PassphraseRuleHistory,
+				Message: fmt.Sprintf("must not be one of the last %d passphrases", limit),
+			}}}
+		}
+	}
+	return nil
+}
+
+// nextPassphraseHistory returns the previous passphrase hashes to keep once the current one is replaced, newest first.
+// Together with the new passphrase, they are the last passphrase.history ones.
+func nextPassphraseHistory(currentHash string, history []string) []string {
+	keep := configuration.GetInt("passphrase.history") - 1
+	if keep <= 0 {
+		return nil
+	}
+	next := append([]string{currentHash}, history...)
+	if len(next) > keep {
+		next = next[:keep]
+	}
+	return next
+}
+
+// dummyPassphraseHash is compared against when signing in to an account that does not exist.
+var dummyPassphraseHash = sync.OnceValue(func() string {
+	hash, err := security.CreateHash(NewTokenId(), security.DefaultParams)
+	if err != nil {
+		log.Errorf("can not hash the dummy passphrase. got %s", err.Error())
+	}
+	return hash
+})
+
+// unknownAccount refuses the sign in to an account that does not exist the way a wrong passphrase is refused,
+// hashing the passphrase as well, so neither the answer nor its timing tells which accounts exist.
+func unknownAccount(passphrase string) error {
+	_, _ = security.ComparePasswordAndHash(passphrase, dummyPassphraseHash())
+	return ErrInvalidPassword
+}
+
+// passphraseClock is the time passphrases are changed and aged at, tests move it instead of waiting.
+var passphraseClock = time.Now
+
+// passphraseExpired tells whether the passphrase must be changed before signing in, because an administrator
+// asked for it, or because it was set longer than passphrase.max.age ago. A passphrase set before its time was
+// recorded, with a zero changedAt, only ages once changed.
+func passphraseExpired(mustChange bool, changedAt time.Time) (bool, error) {
+	if mustChange {
+		return true, nil
+	}
+	maxAge := configuration.Get("passphrase.max.age")
+	if len(maxAge) == 0 || changedAt.IsZero() {
+		return false, nil
+	}
+	age, err := jiffy.DurationOf(maxAge)
+	if err != nil {
+		return false, err
+	}
+	return passphraseClock().Sub(changedAt) > age, nil
+}
+
+// CreatePassphraseChangeToken issues the passphrase change token of the user, valid for passphrase.change.age.
+func CreatePassphraseChangeToken(email string) (string, error) {
+	age, err := jiffy.DurationOf(configuration.Get("passphrase.change.age"))
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return SignToken(&security.GoClaim{
+		Issuer:     configuration.Get("token.issuer"),
+		Subscriber: email,
+		TokenType:  PassphraseChangeToken,
+		Audience:   []string{},
+		NotBefore:  now,
+		IssuedAt:   now,
+		ExpireAt:   now.Add(age),
+		Tokenid:    NewTokenId(),
+	}, GetKeyring().Active())
+}
+
+// ChangeExpiredPassphrase sets the new passphrase of the passphrase change token subject, then signs in the way
+// Authenticate does. A passphrase refused by the policy leaves the token valid for another try,
+// it is only used up once the passphrase is changed.
+func ChangeExpiredPassphrase(ctx context.Context, dao DataAccess, changeToken, newPassphrase string) (accessToken, refreshToken, mfaToken string, err error) {
+	claim, err := VerifyToken(changeToken)
+	if err != nil || claim.TokenType != PassphraseChangeToken {
+		return "", "", "", ErrInvalidPassphraseChangeToken
+	}
+	revoked, err := dao.Revocations().IsRevoked(ctx, claim)
+	if err != nil {
+		return "", "", "", err
+	}
+	if revoked {
+		return "", "", "", ErrInvalidPassphraseChangeToken
+	}
+	if _, err := dao.SetUserPassphrase(ctx, claim.Subscriber, newPassphrase); err != nil {
+		return "", "", "", err
+	}
+	if err := dao.Revocations().RevokeToken(ctx, claim.Tokenid, claim.ExpireAt); err != nil {
+		return "", "", "", err
+	}
+	return signInTokens(ctx, dao, claim.Subscriber)
+}
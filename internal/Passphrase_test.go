@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/newm4n/dokku-aaa/configuration"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// violatedRules returns the rules the passphrase of the email fails.
+func violatedRules(t *testing.T, email, passphrase string) []string {
+	err := CheckPassphrase(email, passphrase)
+	if err == nil {
+		return nil
+	}
+	assert.ErrorIs(t, err, ErrPassphrasePolicy)
+	var policyErr *PassphrasePolicyError
+	if !errors.As(err, &policyErr) {
+		t.Fatalf("not a policy error. got %s", err.Error())
+	}
+	rules := make([]string, 0)
+	for _, violation := range policyErr.Violations {
+		assert.NotEmpty(t, violation.Message)
+		rules = append(rules, violation.Rule)
+	}
+	return rules
+}
+
+func TestCheckPassphrase(t *testing.T) {
+	assert.Empty(t, violatedRules(t, "user@mail.com", "a passphrase"))
+	assert.Empty(t, violatedRules(t, "user@mail.com", "kérosène ça"))
+	assert.Equal(t, []string{PassphraseRuleMinLength}, violatedRules(t, "user@mail.com", "short"))
+	assert.Equal(t, []string{PassphraseRuleBlocklist}, violatedRules(t, "user@mail.com", "Password123"))
+	assert.Equal(t, []string{PassphraseRuleBlocklist}, violatedRules(t, "user@mail.com", "QWERTYUIOP"))
+	assert.Equal(t, []string{PassphraseRuleEmail}, violatedRules(t, "john.doe@mail.com", "i am John.Doe"))
+	assert.Equal(t, []string{PassphraseRuleEmail}, violatedRules(t, "jo@mail.com", "mine is jo@mail.com"))
+	// a local part this short is found in too many passphrases by chance.
+	assert.Empty(t, violatedRules(t, "jo@mail.com", "a journey passphrase"))
+	// every failed rule is listed.
+	assert.Equal(t, []string{PassphraseRuleMinLength, PassphraseRuleBlocklist}, violatedRules(t, "user@mail.com", "123456"))
+
+	configuration.SetConfig("passphrase.min.length", "12")
+	configuration.SetConfig("passphrase.require.lower", "true")
+	configuration.SetConfig("passphrase.require.upper", "true")
+	configuration.SetConfig("passphrase.require.digit", "true")
+	configuration.SetConfig("passphrase.require.symbol", "true")
+	configuration.SetConfig("passphrase.deny.email", "false")
+	configuration.SetConfig("passphrase.blocklist", "false")
+	defer func() {
+		for _, key := range []string{"passphrase.min.length", "passphrase.require.lower", "passphrase.require.upper",
+			"passphrase.require.digit", "passphrase.require.symbol", "passphrase.deny.email", "passphrase.blocklist"} {
+			configuration.SetConfig(key, "")
+		}
+	}()
+	assert.Equal(t, []string{PassphraseRuleUpper, PassphraseRuleDigit}, violatedRules(t, "user@mail.com", "a passphrase"))
+	assert.Equal(t, []string{PassphraseRuleMinLength, PassphraseRuleLower, PassphraseRuleSymbol}, violatedRules(t, "user@mail.com", "ABC123"))
+	assert.Empty(t, violatedRules(t, "user@mail.com", "User Passphrase 7"))
+	assert.Empty(t, violatedRules(t, "user@mail.com", "Password1234!"))
+}
+
+func TestCheckPassphrase_BlocklistPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	assert.NoError(t, os.WriteFile(path, []byte("# breached\n\nCorrect Horse Battery Staple\n"), 0600))
+	assert.Empty(t, violatedRules(t, "user@mail.com", "correct horse battery staple"))
+
+	configuration.SetConfig("passphrase.blocklist.path", path)
+	defer configuration.SetConfig("passphrase.blocklist.path", "")
+	assert.Equal(t, []string{PassphraseRuleBlocklist}, violatedRules(t, "user@mail.com", "correct horse battery staple"))
+	assert.Equal(t, []string{PassphraseRuleBlocklist}, violatedRules(t, "user@mail.com", "password123"))
+	assert.Empty(t, violatedRules(t, "user@mail.com", "a passphrase"))
+
+	configuration.SetConfig("passphrase.blocklist.path", filepath.Join(t.TempDir(), "missing.txt"))
+	err := CheckPassphrase("user@mail.com", "a passphrase")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrPassphrasePolicy)
+}
+
+func TestTheHandler_PassphrasePolicy(t *testing.T) {
+	router := newTestRouter()
+	resp := serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/create-user",
+		`{"Email":"user@mail.com","Passphrase":"user","TenantRole":["viewer@ACME"]}`)))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	policyResp := &PassphrasePolicyResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), policyResp))
+	assert.Equal(t, ErrPassphrasePolicy.Error(), policyResp.Error)
+	if assert.Len(t, policyResp.Violations, 2) {
+		assert.Equal(t, PassphraseRuleMinLength, policyResp.Violations[0].Rule)
+		assert.Equal(t, PassphraseRuleEmail, policyResp.Violations[1].Rule)
+	}
+	resp = serve(router, asRoot(newRequest(http.MethodGet, "/user/ACME/user@mail.com", "")))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/create-user",
+		`{"Email":"user@mail.com","Passphrase":"a passphrase","TenantRole":["viewer@ACME"]}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	resp = serve(router, asRoot(newRequest(http.MethodPut, "/user/ACME/user@mail.com",
+		`{"OldPassphrase":"a passphrase","NewPassphrase":"iloveyou"}`)))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	policyResp = &PassphrasePolicyResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), policyResp))
+	if assert.Len(t, policyResp.Violations, 1) {
+		assert.Equal(t, PassphraseRuleBlocklist, policyResp.Violations[0].Rule)
+	}
+}
+
+func TestPassphraseExpired(t *testing.T) {
+	expired, err := passphraseExpired(true, time.Now())
+	assert.NoError(t, err)
+	assert.True(t, expired)
+	expired, err = passphraseExpired(false, time.Now().Add(-365*24*time.Hour))
+	assert.NoError(t, err)
+	assert.False(t, expired)
+
+	configuration.SetConfig("passphrase.max.age", "90 days")
+	defer configuration.SetConfig("passphrase.max.age", "")
+	expired, err = passphraseExpired(false, time.Now().Add(-89*24*time.Hour))
+	assert.NoError(t, err)
+	assert.False(t, expired)
+	expired, err = passphraseExpired(false, time.Now().Add(-91*24*time.Hour))
+	assert.NoError(t, err)
+	assert.True(t, expired)
+	// a passphrase set before its time was recorded does not age.
+	expired, err = passphraseExpired(false, time.Time{})
+	assert.NoError(t, err)
+	assert.False(t, expired)
+}
+
+func TestNextPassphraseHistory(t *testing.T) {
+	assert.Nil(t, nextPassphraseHistory("h3", []string{"h2", "h1"}))
+	configuration.SetConfig("passphrase.history", "3")
+	defer configuration.SetConfig("passphrase.history", "")
+	assert.Equal(t, []string{"h1"}, nextPassphraseHistory("h1", nil))
+	assert.Equal(t, []string{"h3", "h2"}, nextPassphraseHistory("h3", []string{"h2", "h1"}))
+}
+
+func TestTheHandler_ExpiredPassphrase(t *testing.T) {
+	configuration.SetConfig("passphrase.history", "2")
+	defer configuration.SetConfig("passphrase.history", "")
+	router := newTestRouter()
+	resp := serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/create-user",
+		`{"Email":"user@mail.com","Passphrase":"a passphrase","TenantRole":["viewer@ACME"],"MustChangePassphrase":true}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	// only a passphrase change token is issued, it is no access token.
+	resp = serve(router, newRequest(http.MethodPost, "/login", `{"Email":"user@mail.com","Passphrase":"a passphrase"}`))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	authResp := &AuthenticateResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), authResp))
+	assert.Empty(t, authResp.Access)
+	assert.Empty(t, authResp.Refresh)
+	assert.NotEmpty(t, authResp.PassphraseChangeToken)
+	resp = serve(router, bearer(newRequest(http.MethodGet, "/userinfo", ""), authResp.PassphraseChangeToken))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = serve(router, newRequest(http.MethodPost, "/login", `{"Email":"user@mail.com","Passphrase":"wrong passphrase"}`))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	change := func(token, passphrase string) *httptest.ResponseRecorder {
+		return serve(router, newRequest(http.MethodPost, "/login/passphrase",
+			`{"PassphraseChangeToken":"`+token+`","NewPassphrase":"`+passphrase+`"}`))
+	}
+	assert.Equal(t, http.StatusUnauthorized, change("not a token", "new passphrase").Code)
+	// the policy, and the history, still apply, the token can be tried again.
+	assert.Equal(t, http.StatusBadRequest, change(authResp.PassphraseChangeToken, "a passphrase").Code)
+	resp = change(authResp.PassphraseChangeToken, "new passphrase")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	changeResp := &AuthenticateResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), changeResp))
+	assert.NotEmpty(t, changeResp.Access)
+	assert.NotEmpty(t, changeResp.Refresh)
+	// the token is used up.
+	assert.Equal(t, http.StatusUnauthorized, change(authResp.PassphraseChangeToken, "newer passphrase").Code)
+
+	resp = serve(router, newRequest(http.MethodPost, "/login", `{"Email":"user@mail.com","Passphrase":"new passphrase"}`))
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// only root expires a passphrase.
+	resp = serve(router, newRequest(http.MethodPost, "/user/ACME/user@mail.com/expire-passphrase", ""))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/nobody@mail.com/expire-passphrase", "")))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/user@mail.com/expire-passphrase", "")))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	// the tokens issued so far are revoked, they no longer sign the user in.
+	resp = serve(router, bearer(newRequest(http.MethodGet, "/userinfo", ""), changeResp.Access))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = serve(router, newRequest(http.MethodPost, "/refresh", `{"Refresh":"`+changeResp.Refresh+`"}`))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.Equal(t, http.StatusForbidden, approveDevice(router, "BCDF-GHJK", "new passphrase", "approve"))
+	resp = serve(router, newRequest(http.MethodPost, "/login", `{"Email":"user@mail.com","Passphrase":"new passphrase"}`))
+	authResp = &AuthenticateResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), authResp))
+	assert.NotEmpty(t, authResp.PassphraseChangeToken)
+}
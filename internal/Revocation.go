@@ -0,0 +1,340 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/hyperjumptech/jiffy"
+	"github.com/newm4n/dokku-aaa/configuration"
+	"github.com/newm4n/dokku-common/security"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTokenRevoked = fmt.Errorf("token is revoked")
+)
+
+// RevocationStore keeps the revoked tokens, until the tokens would have expired anyway.
+// A token is revoked either by its id (jti), or together with every token issued to its subject up to a point in time.
+type RevocationStore interface {
+	// RevokeToken revokes a single token by its id. The entry is kept until expireAt.
+	RevokeToken(ctx context.Context, tokenId string, expireAt time.Time) error
+	// UseToken marks the token id as used, it is revoked from now on. The entry is kept until expireAt.
+	// It returns false when the token id was already used or revoked, so only one caller may use the token.
+	UseToken(ctx context.Context, tokenId string, expireAt time.Time) (firstUse bool, err error)
+	// RevokeFamily revokes every refresh token of the token family. The entry is kept until expireAt.
+	RevokeFamily(ctx context.Context, family string, expireAt time.Time) error
+	// RevokeSubject revokes every token issued to the subject up to revokedAt. The entry is kept until expireAt.
+	RevokeSubject(ctx context.Context, subject string, revokedAt, expireAt time.Time) error
+	// IsRevoked tells whether the token is revoked, by its id, its token family or by its subject.
+	IsRevoked(ctx context.Context, claim *security.GoClaim) (revoked bool, err error)
+}
+
+// RevokeRefreshToken verifies the refresh token and revokes it until it expires, together with its token family.
+// Tokens issued before they carried a jti can only be revoked together with every other token of their subject.
+func RevokeRefreshToken(ctx context.Context, revocation RevocationStore, refreshToken string) error {
+	claim, err := VerifyRefreshToken(ctx, revocation, refreshToken)
+	if err != nil {
+		return err
+	}
+	if len(claim.Tokenid) == 0 {
+		return revocation.RevokeSubject(ctx, claim.Subscriber, time.Now(), claim.ExpireAt)
+	}
+	if err := revokeTokenFamily(ctx, revocation, TokenFamily(claim)); err != nil {
+		return err
+	}
+	return revocation.RevokeToken(ctx, claim.Tokenid, claim.ExpireAt)
+}
+
+// revokeTokenFamily revokes the token family, long enough for the latest refresh token of the family to expire.
+func revokeTokenFamily(ctx context.Context, revocation RevocationStore, family string) error {
+	if len(family) == 0 {
+		return nil
+	}
+	durRefresh, err := jiffy.DurationOf(configuration.Get("token.age.refresh"))
+	if err != nil {
+		return err
+	}
+	return revocation.RevokeFamily(ctx, family, time.Now().Add(durRefresh))
+}
+
+// RevokeUserTokens revokes every access and refresh token issued to the user so far.
+func RevokeUserTokens(ctx context.Context, revocation RevocationStore, email string) error {
+	durAccess, err := jiffy.DurationOf(configuration.Get("token.age.access"))
+	if err != nil {
+		return err
+	}
+	durRefresh, err := jiffy.DurationOf(configuration.Get("token.age.refresh"))
+	if err != nil {
+		return err
+	}
+	longest := durRefresh
+	if durAccess > longest {
+		longest = durAccess
+	}
+	now := time.Now()
+	return revocation.RevokeSubject(ctx, email, now, now.Add(longest))
+}
+
+// revokedBySubject tells whether the token was issued up to the time its subject was revoked.
+func revokedBySubject(claim *security.GoClaim, revokedAt time.Time) bool {
+	return !claim.IssuedAt.After(revokedAt.Truncate(time.Microsecond))
+}
+
+// MemoryRevocationStore is the in memory RevocationStore, every revocation is lost on restart.
+type MemoryRevocationStore struct {
+	mutex     sync.RWMutex
+	tokens    map[string]time.Time
+	families  map[string]time.Time
+	subjects  map[string]*revokedSubject
+	lastPurge time.Time
+}
+
+type revokedSubject struct {
+	revokedAt time.Time
+	expireAt  time.Time
+}
+
+func NewMemoryRevocationStore() *MemoryRevocationStore {
+	return &MemoryRevocationStore{
+		tokens:    make(map[string]time.Time),
+		families:  make(map[string]time.Time),
+		subjects:  make(map[string]*revokedSubject),
+		lastPurge: time.Now(),
+	}
+}
+
+// purge removes the expired entries, at most once a minute. The caller must hold the mutex.
+func (store *MemoryRevocationStore) purge(now time.Time) {
+	if now.Sub(store.lastPurge) < time.Minute {
+		return
+	}
+	for tokenId, expireAt := range store.tokens {
+		if now.After(expireAt) {
+			delete(store.tokens, tokenId)
+		}
+	}
+	for family, expireAt := range store.families {
+		if now.After(expireAt) {
+			delete(store.families, family)
+		}
+	}
+	for subject, data := range store.subjects {
+		if now.After(data.expireAt) {
+			delete(store.subjects, subject)
+		}
+	}
+	store.lastPurge = now
+}
+
+func (store *MemoryRevocationStore) RevokeToken(ctx context.Context, tokenId string, expireAt time.Time) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if len(tokenId) == 0 {
+		return ErrArgumentEmpty
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.purge(time.Now())
+	store.tokens[tokenId] = expireAt
+	return nil
+}
+
+func (store *MemoryRevocationStore) UseToken(ctx context.Context, tokenId string, expireAt time.Time) (firstUse bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(tokenId) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	now := time.Now()
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.purge(now)
+	if usedExpireAt, exist := store.tokens[tokenId]; exist && !now.After(usedExpireAt) {
+		return false, nil
+	}
+	store.tokens[tokenId] = expireAt
+	return true, nil
+}
+
+func (store *MemoryRevocationStore) RevokeFamily(ctx context.Context, family string, expireAt time.Time) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if len(family) == 0 {
+		return ErrArgumentEmpty
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.purge(time.Now())
+	store.families[family] = expireAt
+	return nil
+}
+
+func (store *MemoryRevocationStore) RevokeSubject(ctx context.Context, subject string, revokedAt, expireAt time.Time) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if len(subject) == 0 {
+		return ErrArgumentEmpty
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.purge(time.Now())
+	store.subjects[normalizeEmail(subject)] = &revokedSubject{
+		revokedAt: revokedAt,
+		expireAt:  expireAt,
+	}
+	return nil
+}
+
+func (store *MemoryRevocationStore) IsRevoked(ctx context.Context, claim *security.GoClaim) (revoked bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if claim == nil {
+		return false, ErrArgumentEmpty
+	}
+	now := time.Now()
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if expireAt, exist := store.tokens[claim.Tokenid]; exist && len(claim.Tokenid) > 0 && !now.After(expireAt) {
+		return true, nil
+	}
+	if expireAt, exist := store.families[TokenFamily(claim)]; exist && !now.After(expireAt) {
+		return true, nil
+	}
+	if data, exist := store.subjects[normalizeEmail(claim.Subscriber)]; exist && !now.After(data.expireAt) {
+		return revokedBySubject(claim, data.revokedAt), nil
+	}
+	return false, nil
+}
+
+// SqlRevocationStore is the RevocationStore kept in the revoked_token, revoked_family and revoked_subject tables
+// of a SqlDAO database.
+type SqlRevocationStore struct {
+	DB *sql.DB
+}
+
+func NewSqlRevocationStore(db *sql.DB) *SqlRevocationStore {
+	return &SqlRevocationStore{DB: db}
+}
+
+// sqlTime converts the time into the form kept in the database. SQLite compares timestamps as text,
+// so every timestamp is stored in UTC with the same precision.
+func sqlTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Second)
+}
+
+func (store *SqlRevocationStore) RevokeToken(ctx context.Context, tokenId string, expireAt time.Time) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if len(tokenId) == 0 {
+		return ErrArgumentEmpty
+	}
+	if _, err := store.DB.ExecContext(ctx, `DELETE FROM revoked_token WHERE expire_at < $1`, sqlTime(time.Now())); err != nil {
+		return err
+	}
+	_, err := store.DB.ExecContext(ctx, `INSERT INTO revoked_token (token_id, expire_at) VALUES ($1, $2)
+ON CONFLICT (token_id) DO UPDATE SET expire_at = excluded.expire_at`, tokenId, sqlTime(expireAt))
+	return err
+}
+
+func (store *SqlRevocationStore) UseToken(ctx context.Context, tokenId string, expireAt time.Time) (firstUse bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(tokenId) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	if _, err := store.DB.ExecContext(ctx, `DELETE FROM revoked_token WHERE expire_at < $1`, sqlTime(time.Now())); err != nil {
+		return false, err
+	}
+	result, err := store.DB.ExecContext(ctx, `INSERT INTO revoked_token (token_id, expire_at) VALUES ($1, $2)
+ON CONFLICT (token_id) DO NOTHING`, tokenId, sqlTime(expireAt))
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+func (store *SqlRevocationStore) RevokeFamily(ctx context.Context, family string, expireAt time.Time) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if len(family) == 0 {
+		return ErrArgumentEmpty
+	}
+	if _, err := store.DB.ExecContext(ctx, `DELETE FROM revoked_family WHERE expire_at < $1`, sqlTime(time.Now())); err != nil {
+		return err
+	}
+	_, err := store.DB.ExecContext(ctx, `INSERT INTO revoked_family (family, expire_at) VALUES ($1, $2)
+ON CONFLICT (family) DO UPDATE SET expire_at = excluded.expire_at`, family, sqlTime(expireAt))
+	return err
+}
+
+func (store *SqlRevocationStore) RevokeSubject(ctx context.Context, subject string, revokedAt, expireAt time.Time) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if len(subject) == 0 {
+		return ErrArgumentEmpty
+	}
+	if _, err := store.DB.ExecContext(ctx, `DELETE FROM revoked_subject WHERE expire_at < $1`, sqlTime(time.Now())); err != nil {
+		return err
+	}
+	// revoked_at is only compared with the iat claim, never in SQL, so it keeps the microseconds of iat.
+	_, err := store.DB.ExecContext(ctx, `INSERT INTO revoked_subject (subject, revoked_at, expire_at) VALUES ($1, $2, $3)
+ON CONFLICT (subject) DO UPDATE SET revoked_at = excluded.revoked_at, expire_at = excluded.expire_at`,
+		strings.ToLower(subject), revokedAt.UTC().Truncate(time.Microsecond), sqlTime(expireAt))
+	return err
+}
+
+func (store *SqlRevocationStore) IsRevoked(ctx context.Context, claim *security.GoClaim) (revoked bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if claim == nil {
+		return false, ErrArgumentEmpty
+	}
+	now := time.Now()
+	if len(claim.Tokenid) > 0 {
+		var expireAt time.Time
+		err := store.DB.QueryRowContext(ctx, `SELECT expire_at FROM revoked_token WHERE token_id = $1`, claim.Tokenid).Scan(&expireAt)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return false, err
+		}
+		if err == nil && !now.After(expireAt) {
+			return true, nil
+		}
+	}
+	if family := TokenFamily(claim); len(family) > 0 {
+		var expireAt time.Time
+		err := store.DB.QueryRowContext(ctx, `SELECT expire_at FROM revoked_family WHERE family = $1`, family).Scan(&expireAt)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return false, err
+		}
+		if err == nil && !now.After(expireAt) {
+			return true, nil
+		}
+	}
+	var revokedAt, expireAt time.Time
+	err = store.DB.QueryRowContext(ctx, `SELECT revoked_at, expire_at FROM revoked_subject WHERE subject = $1`, strings.ToLower(claim.Subscriber)).Scan(&revokedAt, &expireAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !now.After(expireAt) && revokedBySubject(claim, revokedAt), nil
+}
@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"context"
+	"github.com/newm4n/dokku-common/security"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func testRevocationStore(t *testing.T, newStore func(t *testing.T) RevocationStore) {
+	ctx := context.Background()
+	now := time.Now()
+
+	t.Run("RevokeToken", func(t *testing.T) {
+		store := newStore(t)
+		claim := &security.GoClaim{Tokenid: "abc", Subscriber: "user@mail.com", IssuedAt: now.Add(-time.Minute)}
+		revoked, err := store.IsRevoked(ctx, claim)
+		assert.NoError(t, err)
+		assert.False(t, revoked)
+
+		assert.NoError(t, store.RevokeToken(ctx, "abc", now.Add(time.Hour)))
+		assert.NoError(t, store.RevokeToken(ctx, "abc", now.Add(2*time.Hour)))
+		revoked, err = store.IsRevoked(ctx, claim)
+		assert.NoError(t, err)
+		assert.True(t, revoked)
+
+		revoked, err = store.IsRevoked(ctx, &security.GoClaim{Tokenid: "def", Subscriber: "user@mail.com", IssuedAt: now})
+		assert.NoError(t, err)
+		assert.False(t, revoked)
+
+		assert.ErrorIs(t, store.RevokeToken(ctx, "", now.Add(time.Hour)), ErrArgumentEmpty)
+	})
+
+	t.Run("RevokeToken expired", func(t *testing.T) {
+		store := newStore(t)
+		assert.NoError(t, store.RevokeToken(ctx, "abc", now.Add(-time.Hour)))
+		revoked, err := store.IsRevoked(ctx, &security.GoClaim{Tokenid: "abc", IssuedAt: now.Add(-2 * time.Hour)})
+		assert.NoError(t, err)
+		assert.False(t, revoked)
+	})
+
+	t.Run("UseToken", func(t *testing.T) {
+		store := newStore(t)
+		firstUse, err := store.UseToken(ctx, "abc", now.Add(time.Hour))
+		assert.NoError(t, err)
+		assert.True(t, firstUse)
+		firstUse, err = store.UseToken(ctx, "abc", now.Add(time.Hour))
+		assert.NoError(t, err)
+		assert.False(t, firstUse)
+		revoked, err := store.IsRevoked(ctx, &security.GoClaim{Tokenid: "abc", IssuedAt: now})
+		assert.NoError(t, err)
+		assert.True(t, revoked)
+
+		assert.NoError(t, store.RevokeToken(ctx, "def", now.Add(time.Hour)))
+		firstUse, err = store.UseToken(ctx, "def", now.Add(time.Hour))
+		assert.NoError(t, err)
+		assert.False(t, firstUse)
+
+		_, err = store.UseToken(ctx, "", now.Add(time.Hour))
+		assert.ErrorIs(t, err, ErrArgumentEmpty)
+	})
+
+	t.Run("RevokeFamily", func(t *testing.T) {
+		store := newStore(t)
+		assert.NoError(t, store.RevokeFamily(ctx, "fam", now.Add(time.Hour)))
+		revoked, err := store.IsRevoked(ctx, &security.GoClaim{Tokenid: "fam.abc", IssuedAt: now})
+		assert.NoError(t, err)
+		assert.True(t, revoked)
+		revoked, err = store.IsRevoked(ctx, &security.GoClaim{Tokenid: "other.abc", IssuedAt: now})
+		assert.NoError(t, err)
+		assert.False(t, revoked)
+
+		assert.NoError(t, store.RevokeFamily(ctx, "old", now.Add(-time.Hour)))
+		revoked, err = store.IsRevoked(ctx, &security.GoClaim{Tokenid: "old.abc", IssuedAt: now.Add(-2 * time.Hour)})
+		assert.NoError(t, err)
+		assert.False(t, revoked)
+
+		assert.ErrorIs(t, store.RevokeFamily(ctx, "", now.Add(time.Hour)), ErrArgumentEmpty)
+	})
+
+	t.Run("RevokeSubject", func(t *testing.T) {
+		store := newStore(t)
+		revokedAt := now.Truncate(time.Microsecond)
+		assert.NoError(t, store.RevokeSubject(ctx, "User@Mail.com", revokedAt, now.Add(time.Hour)))
+
+		revoked, err := store.IsRevoked(ctx, &security.GoClaim{Tokenid: "abc", Subscriber: "user@mail.com", IssuedAt: revokedAt.Add(-time.Minute)})
+		assert.NoError(t, err)
+		assert.True(t, revoked)
+
+		revoked, err = store.IsRevoked(ctx, &security.GoClaim{Tokenid: "abc", Subscriber: "user@mail.com", IssuedAt: revokedAt})
+		assert.NoError(t, err)
+		assert.True(t, revoked)
+
+		revoked, err = store.IsRevoked(ctx, &security.GoClaim{Tokenid: "abc", Subscriber: "user@mail.com", IssuedAt: revokedAt.Add(time.Millisecond)})
+		assert.NoError(t, err)
+		assert.False(t, revoked)
+
+		revoked, err = store.IsRevoked(ctx, &security.GoClaim{Tokenid: "abc", Subscriber: "other@mail.com", IssuedAt: revokedAt.Add(-time.Minute)})
+		assert.NoError(t, err)
+		assert.False(t, revoked)
+
+		assert.ErrorIs(t, store.RevokeSubject(ctx, "", now, now.Add(time.Hour)), ErrArgumentEmpty)
+	})
+
+	t.Run("RevokeSubject expired", func(t *testing.T) {
+		store := newStore(t)
+		assert.NoError(t, store.RevokeSubject(ctx, "user@mail.com", now.Add(-2*time.Hour), now.Add(-time.Hour)))
+		revoked, err := store.IsRevoked(ctx, &security.GoClaim{Subscriber: "user@mail.com", IssuedAt: now.Add(-3 * time.Hour)})
+		assert.NoError(t, err)
+		assert.False(t, revoked)
+	})
+}
+
+func TestMemoryRevocationStore(t *testing.T) {
+	testRevocationStore(t, func(t *testing.T) RevocationStore {
+		return NewMemoryRevocationStore()
+	})
+}
+
+func TestMemoryRevocationStore_Purge(t *testing.T) {
+	store := NewMemoryRevocationStore()
+	assert.NoError(t, store.RevokeToken(context.Background(), "abc", time.Now().Add(-time.Hour)))
+	assert.NoError(t, store.RevokeToken(context.Background(), "def", time.Now().Add(time.Hour)))
+	store.purge(time.Now().Add(2 * time.Minute))
+	assert.Len(t, store.tokens, 1)
+	assert.Contains(t, store.tokens, "def")
+}
+
+func TestSqlRevocationStore_SQLite(t *testing.T) {
+	testRevocationStore(t, func(t *testing.T) RevocationStore {
+		return newSQLiteDAO(t).Revocations()
+	})
+}
+
+func TestRevokeUserTokens_SameSecond(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range map[string]RevocationStore{"memory": NewMemoryRevocationStore(), "sqlite": newSQLiteDAO(t).Revocations()} {
+		t.Run(name, func(t *testing.T) {
+			before, err := CreateAccessToken("user@mail.com", []string{"viewer@ACME"}, []string{"pwd"})
+			assert.NoError(t, err)
+			assert.NoError(t, RevokeUserTokens(ctx, store, "user@mail.com"))
+			// a sign in right after the revocation, most likely within the same second, stays valid.
+			after, err := CreateAccessToken("user@mail.com", []string{"viewer@ACME"}, []string{"pwd"})
+			assert.NoError(t, err)
+
+			claim, err := VerifyToken(before)
+			assert.NoError(t, err)
+			revoked, err := store.IsRevoked(ctx, claim)
+			assert.NoError(t, err)
+			assert.True(t, revoked)
+
+			claim, err = VerifyToken(after)
+			assert.NoError(t, err)
+			revoked, err = store.IsRevoked(ctx, claim)
+			assert.NoError(t, err)
+			assert.False(t, revoked)
+		})
+	}
+}
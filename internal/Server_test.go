@@ -1,10 +1,27 @@
 package internal
 
 import (
+	"github.com/newm4n/dokku-common/security"
 	"github.com/stretchr/testify/assert"
+	"os"
 	"testing"
+	"time"
 )
 
+func TestMain(m *testing.M) {
+	// tests sign their tokens using ephemeral keys instead of the configured PEM files.
+	privKey, pubKey, err := security.GenerateKeyPair(2048)
+	if err != nil {
+		panic(err)
+	}
+	active, err := NewSigningKey(privKey, pubKey, "RS512")
+	if err != nil {
+		panic(err)
+	}
+	keyring = NewKeyring(active, time.Hour)
+	os.Exit(m.Run())
+}
+
 func TestExist(t *testing.T) {
 	assert.True(t, true)
 }
@@ -0,0 +1,227 @@
+package internal
+
+import (
+	stdcrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/SermoDigital/jose/crypto"
+	"github.com/SermoDigital/jose/jws"
+	"math/big"
+)
+
+var (
+	ErrUnknownAlgorithm  = fmt.Errorf("unknown signing algorithm")
+	ErrAlgorithmMismatch = fmt.Errorf("signing algorithm does not match the key type")
+	ErrUnsupportedKey    = fmt.Errorf("unsupported key type")
+	ErrSignatureInvalid  = fmt.Errorf("signature is invalid")
+	ErrKeyPairMismatch   = fmt.Errorf("public key does not belong to the private key")
+	SigningMethodES256   = &SigningMethodECDSA{Name: "ES256", Hash: stdcrypto.SHA256, Curve: elliptic.P256()}
+	SigningMethodES384   = &SigningMethodECDSA{Name: "ES384", Hash: stdcrypto.SHA384, Curve: elliptic.P384()}
+	SigningMethodES512   = &SigningMethodECDSA{Name: "ES512", Hash: stdcrypto.SHA512, Curve: elliptic.P521()}
+	SigningMethodEd25519 = &SigningMethodEdDSA{}
+	signingMethodsByAlg  = map[string]crypto.SigningMethod{
+		"RS256": crypto.SigningMethodRS256,
+		"RS384": crypto.SigningMethodRS384,
+		"RS512": crypto.SigningMethodRS512,
+		"PS256": crypto.SigningMethodPS256,
+		"PS384": crypto.SigningMethodPS384,
+		"PS512": crypto.SigningMethodPS512,
+		"ES256": SigningMethodES256,
+		"ES384": SigningMethodES384,
+		"ES512": SigningMethodES512,
+		"EdDSA": SigningMethodEd25519,
+	}
+)
+
+func init() {
+	// jose does not know EdDSA, tokens using it can not even be parsed unless it is registered.
+	jws.RegisterSigningMethod(SigningMethodEd25519)
+}
+
+// SigningMethodFor returns the signing method of the JWS algorithm name.
+// Only asymmetric algorithms are known, so a token can never be verified using a shared secret or none.
+func SigningMethodFor(alg string) (crypto.SigningMethod, error) {
+	method, ok := signingMethodsByAlg[alg]
+	if !ok {
+		return nil, fmt.Errorf("%w \"%s\"", ErrUnknownAlgorithm, alg)
+	}
+	return method, nil
+}
+
+// CheckKeyAlgorithm tells whether the public key can be used with the JWS algorithm.
+func CheckKeyAlgorithm(alg string, key stdcrypto.PublicKey) error {
+	method, err := SigningMethodFor(alg)
+	if err != nil {
+		return err
+	}
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		switch method.(type) {
+		case *crypto.SigningMethodRSA, *crypto.SigningMethodRSAPSS:
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if ecMethod, ok := method.(*SigningMethodECDSA); ok && ecMethod.Curve == pub.Curve {
+			return nil
+		}
+	case ed25519.PublicKey:
+		if _, ok := method.(*SigningMethodEdDSA); ok {
+			return nil
+		}
+	default:
+		return ErrUnsupportedKey
+	}
+	return fmt.Errorf("%w, %s can not be used with %T", ErrAlgorithmMismatch, alg, key)
+}
+
+// ParsePrivateKeyPEM reads a PKCS#1 RSA, SEC 1 EC or PKCS#8 (RSA, EC or Ed25519) private key.
+func ParsePrivateKeyPEM(pemBytes []byte) (stdcrypto.Signer, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, ErrMalformedKey
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch key := key.(type) {
+		case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+			return key.(stdcrypto.Signer), nil
+		}
+		return nil, ErrUnsupportedKey
+	}
+	return nil, fmt.Errorf("%w, pem block \"%s\" is not a private key", ErrMalformedKey, block.Type)
+}
+
+// ParsePublicKeyPEM reads a PKIX (RSA, EC or Ed25519) or PKCS#1 RSA public key.
+func ParsePublicKeyPEM(pemBytes []byte) (stdcrypto.PublicKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, ErrMalformedKey
+	}
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+			return key, nil
+		}
+		return nil, ErrUnsupportedKey
+	}
+	return nil, fmt.Errorf("%w, pem block \"%s\" is not a public key", ErrMalformedKey, block.Type)
+}
+
+// SigningMethodECDSA signs using ECDSA, with the signature serialized as the fixed size R || S
+// concatenation required by RFC 7518. jose's own ECDSA methods use ASN.1, which other JWT libraries reject.
+type SigningMethodECDSA struct {
+	Name  string
+	Hash  stdcrypto.Hash
+	Curve elliptic.Curve
+}
+
+func (m *SigningMethodECDSA) Alg() string {
+	return m.Name
+}
+
+func (m *SigningMethodECDSA) Hasher() stdcrypto.Hash {
+	return m.Hash
+}
+
+func (m *SigningMethodECDSA) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + m.Alg() + `"`), nil
+}
+
+func (m *SigningMethodECDSA) sum(raw []byte) []byte {
+	hasher := m.Hash.New()
+	hasher.Write(raw)
+	return hasher.Sum(nil)
+}
+
+func (m *SigningMethodECDSA) size() int {
+	return (m.Curve.Params().BitSize + 7) / 8
+}
+
+func (m *SigningMethodECDSA) Sign(raw []byte, key interface{}) (crypto.Signature, error) {
+	priKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok || priKey.Curve != m.Curve {
+		return nil, crypto.ErrInvalidKey
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, priKey, m.sum(raw))
+	if err != nil {
+		return nil, err
+	}
+	size := m.size()
+	sig := make([]byte, 2*size)
+	r.FillBytes(sig[:size])
+	s.FillBytes(sig[size:])
+	return sig, nil
+}
+
+func (m *SigningMethodECDSA) Verify(raw []byte, sig crypto.Signature, key interface{}) error {
+	pubKey, ok := key.(*ecdsa.PublicKey)
+	if !ok || pubKey.Curve != m.Curve {
+		return crypto.ErrInvalidKey
+	}
+	size := m.size()
+	if len(sig) != 2*size {
+		return ErrSignatureInvalid
+	}
+	r := new(big.Int).SetBytes(sig[:size])
+	s := new(big.Int).SetBytes(sig[size:])
+	if !ecdsa.Verify(pubKey, m.sum(raw), r, s) {
+		return ErrSignatureInvalid
+	}
+	return nil
+}
+
+// SigningMethodEdDSA signs using Ed25519 (RFC 8037).
+type SigningMethodEdDSA struct{}
+
+func (m *SigningMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+// Hasher returns SHA-512, the hash Ed25519 uses internally. jose refuses to register a method without hash.
+func (m *SigningMethodEdDSA) Hasher() stdcrypto.Hash {
+	return stdcrypto.SHA512
+}
+
+func (m *SigningMethodEdDSA) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + m.Alg() + `"`), nil
+}
+
+func (m *SigningMethodEdDSA) Sign(raw []byte, key interface{}) (crypto.Signature, error) {
+	priKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, crypto.ErrInvalidKey
+	}
+	return ed25519.Sign(priKey, raw), nil
+}
+
+func (m *SigningMethodEdDSA) Verify(raw []byte, sig crypto.Signature, key interface{}) error {
+	pubKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return crypto.ErrInvalidKey
+	}
+	if !ed25519.Verify(pubKey, raw, sig) {
+		return ErrSignatureInvalid
+	}
+	return nil
+}
@@ -0,0 +1,1040 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	_ "github.com/lib/pq"
+	security "github.com/newm4n/dokku-common/security"
+	log "github.com/sirupsen/logrus"
+	_ "modernc.org/sqlite"
+	"strings"
+	"time"
+)
+
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+)
+
+// sqlQuerier is satisfied by both *sql.DB and *sql.Tx, so queries can be shared inside and outside transaction.
+type sqlQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// SqlDAO is the DataAccess implementation on top of database/sql, for SQLite and PostgreSQL.
+// Emails are compared case-insensitively, the same way MemoryDAO does.
+type SqlDAO struct {
+	DB         *sql.DB
+	Revocation *SqlRevocationStore
+	Client     *SqlClientStore
+	Code       *SqlAuthorizationCodeStore
+	Device     *SqlDeviceCodeStore
+	Factor     *SqlMFAStore
+	Passkey    *SqlWebAuthnCredentialStore
+	Attempt    *SqlLoginAttemptStore
+}
+
+// NewSqlDAO opens the database using the driver (DriverSQLite or DriverPostgres) and applies the schema migrations.
+func NewSqlDAO(ctx context.Context, driverName, dataSourceName string) (*SqlDAO, error) {
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if driverName == DriverSQLite {
+		// SQLite allows a single writer, and each connection to ":memory:" would open a different database.
+		db.SetMaxOpenConns(1)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := Migrate(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SqlDAO{DB: db, Revocation: NewSqlRevocationStore(db), Client: NewSqlClientStore(db), Code: NewSqlAuthorizationCodeStore(db),
+		Device: NewSqlDeviceCodeStore(db), Factor: NewSqlMFAStore(db), Passkey: NewSqlWebAuthnCredentialStore(db), Attempt: NewSqlLoginAttemptStore(db)}, nil
+}
+
+// Close the underlying database.
+func (sdao *SqlDAO) Close() error {
+	return sdao.DB.Close()
+}
+
+func validContext(ctx context.Context) error {
+	if ctx == nil {
+		return ErrArgumentEmpty
+	}
+	return ctx.Err()
+}
+
+// likePrefix creates the LIKE pattern, escaped by '\', for a case-insensitive prefix search.
+func likePrefix(search string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return replacer.Replace(strings.ToLower(search)) + "%"
+}
+
+func (sdao *SqlDAO) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := sdao.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			log.Errorf("failed to rollback transaction. got %s", rbErr.Error())
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+func queryStrings(ctx context.Context, q sqlQuerier, query string, args ...interface{}) ([]string, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]string, 0)
+	for rows.Next() {
+		var str string
+		if err := rows.Scan(&str); err != nil {
+			return nil, err
+		}
+		ret = append(ret, str)
+	}
+	return ret, rows.Err()
+}
+
+func queryExist(ctx context.Context, q sqlQuerier, query string, args ...interface{}) (bool, error) {
+	var count int
+	if err := q.QueryRowContext(ctx, query, args...).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func queryTenants(ctx context.Context, q sqlQuerier, query string, args ...interface{}) ([]*Tenant, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]*Tenant, 0)
+	for rows.Next() {
+		tenant := &Tenant{}
+		if err := rows.Scan(&tenant.Name, &tenant.DisplayName, &tenant.CreatedAt, &tenant.Status); err != nil {
+			return nil, err
+		}
+		ret = append(ret, tenant)
+	}
+	return ret, rows.Err()
+}
+
+func (sdao *SqlDAO) CreateUserAccount(ctx context.Context, email, passphrase string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 || len(passphrase) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	if ClientSubject(email) {
+		return false, ErrArgumentInvalid
+	}
+	if err := CheckPassphrase(email, passphrase); err != nil {
+		return false, err
+	}
+	exist, err := sdao.UserExist(ctx, email)
+	if err != nil {
+		return false, err
+	}
+	if exist {
+		log.Errorf("can not create user. user with %s email aready exist in user_account", email)
+		return false, ErrFound
+	}
+	passHash, err := security.CreateHash(passphrase, security.DefaultParams)
+	if err != nil {
+		return false, ErrInvalidPassword
+	}
+	_, err = sdao.DB.ExecContext(ctx, `INSERT INTO user_account (email, passphrase, full_name, status, passphrase_changed_at) VALUES ($1, $2, '', $3, $4)`,
+		email, passHash, string(UserStatusActive), sqlTime(passphraseClock()))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (sdao *SqlDAO) UpdateUserPassphrase(ctx context.Context, email, oldPassphrase, newPassphrase string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 || len(oldPassphrase) == 0 || len(newPassphrase) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	if err := CheckPassphrase(email, newPassphrase); err != nil {
+		return false, err
+	}
+	var passHash string
+	err = sdao.DB.QueryRowContext(ctx, `SELECT passphrase FROM user_account WHERE LOWER(email) = LOWER($1)`, email).Scan(&passHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	compare, err := security.ComparePasswordAndHash(oldPassphrase, passHash)
+	if err != nil {
+		return false, err
+	}
+	if !compare {
+		return false, nil
+	}
+	return sdao.replacePassphrase(ctx, email, passHash, newPassphrase)
+}
+
+func (sdao *SqlDAO) SetUserPassphrase(ctx context.Context, email, newPassphrase string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 || len(newPassphrase) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	if err := CheckPassphrase(email, newPassphrase); err != nil {
+		return false, err
+	}
+	var passHash string
+	err = sdao.DB.QueryRowContext(ctx, `SELECT passphrase FROM user_account WHERE LOWER(email) = LOWER($1)`, email).Scan(&passHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, ErrNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+	return sdao.replacePassphrase(ctx, email, passHash, newPassphrase)
+}
+
+// replacePassphrase sets the new passphrase of the account, unless it is one of the last ones.
+// It returns false when the passphrase was changed, or the account deleted, in the meantime.
+func (sdao *SqlDAO) replacePassphrase(ctx context.Context, email, oldHash, newPassphrase string) (success bool, err error) {
+	history, err := queryStrings(ctx, sdao.DB, `SELECT passphrase FROM passphrase_history WHERE email = $1 ORDER BY seq`, strings.ToLower(email))
+	if err != nil {
+		return false, err
+	}
+	if err := checkPassphraseHistory(newPassphrase, append([]string{oldHash}, history...)); err != nil {
+		return false, err
+	}
+	newHash, err := security.CreateHash(newPassphrase, security.DefaultParams)
+	if err != nil {
+		return false, err
+	}
+	err = sdao.inTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, `UPDATE user_account SET passphrase = $1, must_change_passphrase = $2, passphrase_changed_at = $3
+WHERE LOWER(email) = LOWER($4) AND passphrase = $5`, newHash, false, sqlTime(passphraseClock()), email, oldHash)
+		if err != nil {
+			return err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		success = affected > 0
+		if !success {
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM passphrase_history WHERE email = $1`, strings.ToLower(email)); err != nil {
+			return err
+		}
+		for seq, hash := range nextPassphraseHistory(oldHash, history) {
+			if _, err := tx.ExecContext(ctx, `INSERT INTO passphrase_history (email, seq, passphrase) VALUES ($1, $2, $3)`,
+				strings.ToLower(email), seq, hash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return success, nil
+}
+
+func (sdao *SqlDAO) ExpireUserPassphrase(ctx context.Context, email string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	result, err := sdao.DB.ExecContext(ctx, `UPDATE user_account SET must_change_passphrase = $1 WHERE LOWER(email) = LOWER($2)`, true, email)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if affected == 0 {
+		return false, ErrNotFound
+	}
+	return true, nil
+}
+
+func (sdao *SqlDAO) DeleteUserAccount(ctx context.Context, email string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	if _, err := sdao.DB.ExecContext(ctx, `DELETE FROM passphrase_history WHERE email = $1`, strings.ToLower(email)); err != nil {
+		return false, err
+	}
+	result, err := sdao.DB.ExecContext(ctx, `DELETE FROM user_account WHERE LOWER(email) = LOWER($1)`, email)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+func (sdao *SqlDAO) UserExist(ctx context.Context, email string) (exist bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	return queryExist(ctx, sdao.DB, `SELECT COUNT(*) FROM user_account WHERE LOWER(email) = LOWER($1)`, email)
+}
+
+func (sdao *SqlDAO) SearchUser(ctx context.Context, search string) (emails []string, err error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(search) == 0 {
+		return make([]string, 0), ErrArgumentEmpty
+	}
+	return queryStrings(ctx, sdao.DB, `SELECT email FROM user_account WHERE LOWER(email) LIKE $1 ESCAPE '\' ORDER BY email`, likePrefix(search))
+}
+
+func (sdao *SqlDAO) GetUserProfile(ctx context.Context, email string) (profile *UserProfile, err error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(email) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	profile = &UserProfile{}
+	err = sdao.DB.QueryRowContext(ctx, `SELECT email, full_name, status FROM user_account WHERE LOWER(email) = LOWER($1)`, email).Scan(&profile.Email, &profile.FullName, &profile.Status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+func (sdao *SqlDAO) UpdateUserProfile(ctx context.Context, email, fullName string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	result, err := sdao.DB.ExecContext(ctx, `UPDATE user_account SET full_name = $1 WHERE LOWER(email) = LOWER($2)`, fullName, email)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if affected == 0 {
+		return false, ErrNotFound
+	}
+	return true, nil
+}
+
+func (sdao *SqlDAO) UpdateUserStatus(ctx context.Context, email string, status UserStatus) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 || len(status) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	result, err := sdao.DB.ExecContext(ctx, `UPDATE user_account SET status = $1 WHERE LOWER(email) = LOWER($2)`, string(status), email)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if affected == 0 {
+		return false, ErrNotFound
+	}
+	return true, nil
+}
+
+func (sdao *SqlDAO) CreateTenant(ctx context.Context, tenant, displayName string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(tenant) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	if !ValidTenantName(tenant) {
+		return false, ErrInvalidTenantName
+	}
+	exist, err := queryExist(ctx, sdao.DB, `SELECT COUNT(*) FROM tenant WHERE name = $1`, tenant)
+	if err != nil {
+		return false, err
+	}
+	if exist {
+		return false, ErrFound
+	}
+	if len(displayName) == 0 {
+		displayName = tenant
+	}
+	_, err = sdao.DB.ExecContext(ctx, `INSERT INTO tenant (name, display_name, created_at, status) VALUES ($1, $2, $3, $4)`,
+		tenant, displayName, time.Now().UTC(), string(TenantStatusActive))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (sdao *SqlDAO) UpdateTenant(ctx context.Context, oldTenant, newTenant, displayName string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(oldTenant) == 0 || len(newTenant) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	if newTenant != ReservedTenant && !ValidTenantName(newTenant) {
+		return false, ErrInvalidTenantName
+	}
+	err = sdao.inTx(ctx, func(tx *sql.Tx) error {
+		exist, err := queryExist(ctx, tx, `SELECT COUNT(*) FROM tenant WHERE name = $1`, oldTenant)
+		if err != nil {
+			return err
+		}
+		if !exist {
+			return ErrNotFound
+		}
+		if oldTenant != newTenant {
+			if oldTenant == ReservedTenant || newTenant == ReservedTenant {
+				return ErrTenantReserved
+			}
+			exist, err := queryExist(ctx, tx, `SELECT COUNT(*) FROM tenant WHERE name = $1`, newTenant)
+			if err != nil {
+				return err
+			}
+			if exist {
+				return ErrFound
+			}
+			// rename the record first, so moving the memberships will not create a new one.
+			if _, err := tx.ExecContext(ctx, `UPDATE tenant SET name = $1 WHERE name = $2`, newTenant, oldTenant); err != nil {
+				return err
+			}
+			members, err := queryStrings(ctx, tx, `SELECT email FROM user_tenant WHERE tenant = $1 ORDER BY email`, oldTenant)
+			if err != nil {
+				return err
+			}
+			for _, email := range members {
+				if err := updateUserTenant(ctx, tx, email, oldTenant, newTenant); err != nil {
+					return err
+				}
+			}
+		}
+		if len(displayName) > 0 {
+			if _, err := tx.ExecContext(ctx, `UPDATE tenant SET display_name = $1 WHERE name = $2`, displayName, newTenant); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (sdao *SqlDAO) DeleteTenant(ctx context.Context, tenant string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(tenant) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	if tenant == ReservedTenant {
+		return false, ErrTenantReserved
+	}
+	err = sdao.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM user_tenant_role WHERE tenant = $1`, tenant); err != nil {
+			return err
+		}
+		members, err := tx.ExecContext(ctx, `DELETE FROM user_tenant WHERE tenant = $1`, tenant)
+		if err != nil {
+			return err
+		}
+		records, err := tx.ExecContext(ctx, `DELETE FROM tenant WHERE name = $1`, tenant)
+		if err != nil {
+			return err
+		}
+		memberCount, err := members.RowsAffected()
+		if err != nil {
+			return err
+		}
+		recordCount, err := records.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if memberCount == 0 && recordCount == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (sdao *SqlDAO) DeleteAllTenant(ctx context.Context) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	err = sdao.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM user_tenant_role WHERE tenant <> $1`, ReservedTenant); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM user_tenant WHERE tenant <> $1`, ReservedTenant); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `DELETE FROM tenant WHERE name <> $1`, ReservedTenant)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (sdao *SqlDAO) GetTenant(ctx context.Context, tenant string) (data *Tenant, err error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(tenant) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	tenants, err := queryTenants(ctx, sdao.DB, `SELECT name, display_name, created_at, status FROM tenant WHERE name = $1`, tenant)
+	if err != nil {
+		return nil, err
+	}
+	if len(tenants) == 0 {
+		return nil, ErrNotFound
+	}
+	return tenants[0], nil
+}
+
+func (sdao *SqlDAO) ListTenant(ctx context.Context) (tenants []*Tenant, err error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	return queryTenants(ctx, sdao.DB, `SELECT name, display_name, created_at, status FROM tenant ORDER BY name`)
+}
+
+func (sdao *SqlDAO) SearchTenant(ctx context.Context, search string) (tenants []*Tenant, err error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(search) == 0 {
+		return make([]*Tenant, 0), ErrArgumentEmpty
+	}
+	return queryTenants(ctx, sdao.DB, `SELECT name, display_name, created_at, status FROM tenant WHERE LOWER(name) LIKE $1 ESCAPE '\' ORDER BY name`, likePrefix(search))
+}
+
+func (sdao *SqlDAO) ListTenantUser(ctx context.Context, tenant string) (emails []string, err error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(tenant) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	return queryStrings(ctx, sdao.DB, `SELECT email FROM user_tenant WHERE tenant = $1 ORDER BY email`, tenant)
+}
+
+// ensureTenant creates the tenant record for a tenant that is referred by a membership.
+func ensureTenant(ctx context.Context, q sqlQuerier, tenant string) error {
+	exist, err := queryExist(ctx, q, `SELECT COUNT(*) FROM tenant WHERE name = $1`, tenant)
+	if err != nil || exist {
+		return err
+	}
+	_, err = q.ExecContext(ctx, `INSERT INTO tenant (name, display_name, created_at, status) VALUES ($1, $2, $3, $4)`,
+		tenant, tenant, time.Now().UTC(), string(TenantStatusActive))
+	return err
+}
+
+func userTenantExist(ctx context.Context, q sqlQuerier, email, tenant string) (bool, error) {
+	return queryExist(ctx, q, `SELECT COUNT(*) FROM user_tenant WHERE LOWER(email) = LOWER($1) AND tenant = $2`, email, tenant)
+}
+
+func (sdao *SqlDAO) CreateUserTenant(ctx context.Context, email, tenant string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 || len(tenant) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	if tenant != ReservedTenant && !ValidTenantName(tenant) {
+		return false, ErrInvalidTenantName
+	}
+	err = sdao.inTx(ctx, func(tx *sql.Tx) error {
+		exist, err := userTenantExist(ctx, tx, email, tenant)
+		if err != nil {
+			return err
+		}
+		if exist {
+			return ErrFound
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO user_tenant (email, tenant) VALUES ($1, $2)`, email, tenant); err != nil {
+			return err
+		}
+		return ensureTenant(ctx, tx, tenant)
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// updateUserTenant moves the membership, and its roles, from the old tenant into the new one.
+// When the user is already a member of the new tenant, the roles are merged.
+func updateUserTenant(ctx context.Context, q sqlQuerier, email, oldTenant, newTenant string) error {
+	var storedEmail string
+	err := q.QueryRowContext(ctx, `SELECT email FROM user_tenant WHERE LOWER(email) = LOWER($1) AND tenant = $2`, email, oldTenant).Scan(&storedEmail)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if oldTenant == newTenant {
+		return nil
+	}
+	exist, err := userTenantExist(ctx, q, email, newTenant)
+	if err != nil {
+		return err
+	}
+	if !exist {
+		if _, err := q.ExecContext(ctx, `INSERT INTO user_tenant (email, tenant) VALUES ($1, $2)`, storedEmail, newTenant); err != nil {
+			return err
+		}
+		if err := ensureTenant(ctx, q, newTenant); err != nil {
+			return err
+		}
+	}
+	roles, err := queryStrings(ctx, q, `SELECT role FROM user_tenant_role WHERE LOWER(email) = LOWER($1) AND tenant = $2`, email, oldTenant)
+	if err != nil {
+		return err
+	}
+	for _, role := range roles {
+		exist, err := queryExist(ctx, q, `SELECT COUNT(*) FROM user_tenant_role WHERE LOWER(email) = LOWER($1) AND tenant = $2 AND role = $3`, email, newTenant, role)
+		if err != nil {
+			return err
+		}
+		if exist {
+			continue
+		}
+		if _, err := q.ExecContext(ctx, `INSERT INTO user_tenant_role (email, tenant, role) VALUES ($1, $2, $3)`, storedEmail, newTenant, role); err != nil {
+			return err
+		}
+	}
+	return deleteUserTenant(ctx, q, email, oldTenant)
+}
+
+func deleteUserTenant(ctx context.Context, q sqlQuerier, email, tenant string) error {
+	if _, err := q.ExecContext(ctx, `DELETE FROM user_tenant_role WHERE LOWER(email) = LOWER($1) AND tenant = $2`, email, tenant); err != nil {
+		return err
+	}
+	_, err := q.ExecContext(ctx, `DELETE FROM user_tenant WHERE LOWER(email) = LOWER($1) AND tenant = $2`, email, tenant)
+	return err
+}
+
+func (sdao *SqlDAO) UpdateUserTenant(ctx context.Context, email, oldTenant, newTenant string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 || len(oldTenant) == 0 || len(newTenant) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	if !ValidTenantName(newTenant) {
+		return false, ErrInvalidTenantName
+	}
+	err = sdao.inTx(ctx, func(tx *sql.Tx) error {
+		return updateUserTenant(ctx, tx, email, oldTenant, newTenant)
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (sdao *SqlDAO) DeleteUserTenant(ctx context.Context, email, tenant string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 || len(tenant) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	err = sdao.inTx(ctx, func(tx *sql.Tx) error {
+		return deleteUserTenant(ctx, tx, email, tenant)
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (sdao *SqlDAO) DeleteUserAllTenant(ctx context.Context, email string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	err = sdao.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM user_tenant_role WHERE LOWER(email) = LOWER($1)`, email); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `DELETE FROM user_tenant WHERE LOWER(email) = LOWER($1)`, email)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (sdao *SqlDAO) UserTenantExist(ctx context.Context, email, tenant string) (exist bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 || len(tenant) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	return userTenantExist(ctx, sdao.DB, email, tenant)
+}
+
+func (sdao *SqlDAO) SearchUserTenant(ctx context.Context, email, search string) (tenants []string, err error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(search) == 0 {
+		return make([]string, 0), ErrArgumentEmpty
+	}
+	return queryStrings(ctx, sdao.DB, `SELECT tenant FROM user_tenant WHERE LOWER(email) = LOWER($1) AND LOWER(tenant) LIKE $2 ESCAPE '\' ORDER BY tenant`, email, likePrefix(search))
+}
+
+func (sdao *SqlDAO) CreateUserTenantRole(ctx context.Context, email, tenant, role string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 || len(tenant) == 0 || len(role) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	if tenant != ReservedTenant && !ValidTenantName(tenant) {
+		return false, ErrInvalidTenantName
+	}
+	if !ValidRoleName(role) {
+		return false, ErrInvalidRoleName
+	}
+	err = sdao.inTx(ctx, func(tx *sql.Tx) error {
+		exist, err := userTenantExist(ctx, tx, email, tenant)
+		if err != nil {
+			return err
+		}
+		if !exist {
+			if _, err := tx.ExecContext(ctx, `INSERT INTO user_tenant (email, tenant) VALUES ($1, $2)`, email, tenant); err != nil {
+				return err
+			}
+			if err := ensureTenant(ctx, tx, tenant); err != nil {
+				return err
+			}
+		}
+		exist, err = queryExist(ctx, tx, `SELECT COUNT(*) FROM user_tenant_role WHERE LOWER(email) = LOWER($1) AND tenant = $2 AND role = $3`, email, tenant, role)
+		if err != nil {
+			return err
+		}
+		if exist {
+			return ErrFound
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO user_tenant_role (email, tenant, role) VALUES ($1, $2, $3)`, email, tenant, role)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (sdao *SqlDAO) DeleteUserTenantRole(ctx context.Context, email, tenant, role string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 || len(tenant) == 0 || len(role) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	result, err := sdao.DB.ExecContext(ctx, `DELETE FROM user_tenant_role WHERE LOWER(email) = LOWER($1) AND tenant = $2 AND role = $3`, email, tenant, role)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if affected == 0 {
+		return false, ErrNotFound
+	}
+	return true, nil
+}
+
+func (sdao *SqlDAO) DeleteUserTenantAllRoles(ctx context.Context, email, tenant string) (success bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 || len(tenant) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	exist, err := userTenantExist(ctx, sdao.DB, email, tenant)
+	if err != nil {
+		return false, err
+	}
+	if !exist {
+		return false, ErrNotFound
+	}
+	if _, err := sdao.DB.ExecContext(ctx, `DELETE FROM user_tenant_role WHERE LOWER(email) = LOWER($1) AND tenant = $2`, email, tenant); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (sdao *SqlDAO) UserTenantRoleExist(ctx context.Context, email, tenant, role string) (exist bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	if len(email) == 0 || len(tenant) == 0 || len(role) == 0 {
+		return false, ErrArgumentEmpty
+	}
+	exist, err = userTenantExist(ctx, sdao.DB, email, tenant)
+	if err != nil {
+		return false, err
+	}
+	if !exist {
+		return false, ErrNotFound
+	}
+	return queryExist(ctx, sdao.DB, `SELECT COUNT(*) FROM user_tenant_role WHERE LOWER(email) = LOWER($1) AND tenant = $2 AND role = $3`, email, tenant, role)
+}
+
+func (sdao *SqlDAO) SearchUserRoleTenant(ctx context.Context, email, tenant, search string) (roles []string, err error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(email) == 0 || len(tenant) == 0 || len(search) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	exist, err := userTenantExist(ctx, sdao.DB, email, tenant)
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		return nil, ErrNotFound
+	}
+	return queryStrings(ctx, sdao.DB, `SELECT role FROM user_tenant_role WHERE LOWER(email) = LOWER($1) AND tenant = $2 AND LOWER(role) LIKE $3 ESCAPE '\' ORDER BY role`, email, tenant, likePrefix(search))
+}
+
+func (sdao *SqlDAO) ListUserTenantRole(ctx context.Context, email, tenant string) (roles []string, err error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(email) == 0 || len(tenant) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	exist, err := userTenantExist(ctx, sdao.DB, email, tenant)
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		return nil, ErrNotFound
+	}
+	return queryStrings(ctx, sdao.DB, `SELECT role FROM user_tenant_role WHERE LOWER(email) = LOWER($1) AND tenant = $2 ORDER BY role`, email, tenant)
+}
+
+func (sdao *SqlDAO) ListUserTenantRoles(ctx context.Context, email string) (tenantRoles []*TenantRoles, err error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(email) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	return userTenantRoles(ctx, sdao.DB, email)
+}
+
+// userTenantRoles lists the roles of the user in every tenant, ordered by tenant.
+func userTenantRoles(ctx context.Context, q sqlQuerier, email string) ([]*TenantRoles, error) {
+	tenants, err := queryStrings(ctx, q, `SELECT tenant FROM user_tenant WHERE LOWER(email) = LOWER($1) ORDER BY tenant`, email)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*TenantRoles, 0, len(tenants))
+	for _, tenant := range tenants {
+		roles, err := queryStrings(ctx, q, `SELECT role FROM user_tenant_role WHERE LOWER(email) = LOWER($1) AND tenant = $2 ORDER BY role`, email, tenant)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, &TenantRoles{
+			Tenant: tenant,
+			Roles:  roles,
+		})
+	}
+	return ret, nil
+}
+
+// userAudience lists the tenant roles of the user in the 'role1,role2@tenant' pattern used as token audience.
+func userAudience(ctx context.Context, q sqlQuerier, email string) ([]string, error) {
+	tenantRoles, err := userTenantRoles(ctx, q, email)
+	if err != nil {
+		return nil, err
+	}
+	return tenantRolesAudience(tenantRoles), nil
+}
+
+func (sdao *SqlDAO) Authenticate(ctx context.Context, email, passphrase string) (accessToken, refreshToken, mfaToken string, err error) {
+	if err := sdao.VerifyPassphrase(ctx, email, passphrase); err != nil {
+		return "", "", "", err
+	}
+	return signInTokens(ctx, sdao, email)
+}
+
+func (sdao *SqlDAO) VerifyPassphrase(ctx context.Context, email, passphrase string) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	var passHash string
+	var status UserStatus
+	var mustChange bool
+	var changedAt sql.NullTime
+	err := sdao.DB.QueryRowContext(ctx, `SELECT passphrase, status, must_change_passphrase, passphrase_changed_at FROM user_account WHERE LOWER(email) = LOWER($1)`, email).
+		Scan(&passHash, &status, &mustChange, &changedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return unknownAccount(passphrase)
+	}
+	if err != nil {
+		return err
+	}
+	match, err := security.ComparePasswordAndHash(passphrase, passHash)
+	if err != nil || !match {
+		return ErrInvalidPassword
+	}
+	if status == UserStatusDisabled {
+		return ErrAccountDisabled
+	}
+	expired, err := passphraseExpired(mustChange, changedAt.Time)
+	if err != nil {
+		return err
+	}
+	if expired {
+		return ErrPassphraseExpired
+	}
+	return nil
+}
+
+func (sdao *SqlDAO) IssueTokens(ctx context.Context, email string, amr []string) (accessToken, refreshToken string, err error) {
+	if err := validContext(ctx); err != nil {
+		return "", "", err
+	}
+	auds, err := sdao.signInAudience(ctx, email)
+	if err != nil {
+		return "", "", err
+	}
+	return CreateTokenPair(email, auds, amr)
+}
+
+// signInAudience returns the token audience of the subject, as long as it can sign in.
+func (sdao *SqlDAO) signInAudience(ctx context.Context, email string) ([]string, error) {
+	var status UserStatus
+	var mustChange bool
+	var changedAt sql.NullTime
+	err := sdao.DB.QueryRowContext(ctx, `SELECT status, must_change_passphrase, passphrase_changed_at FROM user_account WHERE LOWER(email) = LOWER($1)`, email).
+		Scan(&status, &mustChange, &changedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAccountDeleted
+	}
+	if err != nil {
+		return nil, err
+	}
+	if status == UserStatusDisabled {
+		return nil, ErrAccountDisabled
+	}
+	expired, err := passphraseExpired(mustChange, changedAt.Time)
+	if err != nil {
+		return nil, err
+	}
+	if expired {
+		return nil, ErrPassphraseExpired
+	}
+	return userAudience(ctx, sdao.DB, email)
+}
+
+func (sdao *SqlDAO) Refresh(ctx context.Context, refreshToken string) (accessToken, nextRefreshToken string, err error) {
+	if err := validContext(ctx); err != nil {
+		return "", "", err
+	}
+	if len(refreshToken) == 0 {
+		return "", "", ErrArgumentEmpty
+	}
+	claim, err := VerifyRefreshToken(ctx, sdao.Revocation, refreshToken)
+	if err != nil {
+		return "", "", err
+	}
+	auds, err := sdao.signInAudience(ctx, claim.Subscriber)
+	if err != nil {
+		return "", "", err
+	}
+	return RefreshTokens(ctx, sdao.Revocation, claim, auds, TokenAmr(refreshToken))
+}
+
+func (sdao *SqlDAO) Revocations() RevocationStore {
+	return sdao.Revocation
+}
+
+func (sdao *SqlDAO) Clients() ClientStore {
+	return sdao.Client
+}
+
+func (sdao *SqlDAO) AuthorizationCodes() AuthorizationCodeStore {
+	return sdao.Code
+}
+
+func (sdao *SqlDAO) DeviceCodes() DeviceCodeStore {
+	return sdao.Device
+}
+
+func (sdao *SqlDAO) MFA() MFAStore {
+	return sdao.Factor
+}
+
+func (sdao *SqlDAO) WebAuthnCredentials() WebAuthnCredentialStore {
+	return sdao.Passkey
+}
+
+func (sdao *SqlDAO) LoginAttempts() LoginAttemptStore {
+	return sdao.Attempt
+}
@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func newSQLiteDAO(t *testing.T) DataAccess {
+	dao, err := NewSqlDAO(context.Background(), DriverSQLite, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = dao.Close()
+	})
+	return dao
+}
+
+func TestSqlDAO_SQLiteBehaviour(t *testing.T) {
+	testDataAccessBehaviour(t, newSQLiteDAO)
+}
+
+// TestSqlDAO_PostgresBehaviour only runs when SERVICE_TEST_POSTGRES_DSN points to a disposable database.
+func TestSqlDAO_PostgresBehaviour(t *testing.T) {
+	dsn := os.Getenv("SERVICE_TEST_POSTGRES_DSN")
+	if len(dsn) == 0 {
+		t.Skip("SERVICE_TEST_POSTGRES_DSN is not set")
+	}
+	testDataAccessBehaviour(t, func(t *testing.T) DataAccess {
+		dao, err := NewSqlDAO(context.Background(), DriverPostgres, dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, table := range []string{"user_tenant_role", "user_tenant", "tenant", "user_account"} {
+			if _, err := dao.DB.Exec("DELETE FROM " + table); err != nil {
+				t.Fatal(err)
+			}
+		}
+		t.Cleanup(func() {
+			_ = dao.Close()
+		})
+		return dao
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	migrations, err := LoadMigrations()
+	assert.NoError(t, err)
+	assert.True(t, len(migrations) > 0)
+	assert.Equal(t, 1, migrations[0].Version)
+
+	dao, err := NewSqlDAO(context.Background(), DriverSQLite, ":memory:")
+	assert.NoError(t, err)
+	defer dao.Close()
+
+	// migrating an up to date schema is a no-op
+	assert.NoError(t, Migrate(context.Background(), dao.DB))
+
+	var count int
+	assert.NoError(t, dao.DB.QueryRow("SELECT COUNT(*) FROM schema_migration").Scan(&count))
+	assert.Equal(t, len(migrations), count)
+}
@@ -0,0 +1,333 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/SermoDigital/jose/crypto"
+	"github.com/SermoDigital/jose/jws"
+	"github.com/hyperjumptech/jiffy"
+	"github.com/newm4n/dokku-aaa/configuration"
+	"github.com/newm4n/dokku-common/security"
+	"math"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformedToken = fmt.Errorf("malformed jwt token")
+)
+
+// ParseToken verifies the token signature and validity time, and returns its claim.
+// It is used instead of security.NewGoClaimFromToken, which can not read the numeric claims as they are
+// decoded by the JSON parser.
+func ParseToken(tokenString string, verifyKey interface{}, signM crypto.SigningMethod) (*security.GoClaim, error) {
+	jwt, err := jws.ParseJWT([]byte(tokenString))
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	if err := jwt.Validate(verifyKey, signM); err != nil {
+		return nil, err
+	}
+	claims := jws.Claims(jwt.Claims())
+	gc := &security.GoClaim{}
+	gc.Issuer, _ = claims.Issuer()
+	gc.Subscriber, _ = claims.Subject()
+	gc.Audience, _ = claims.Audience()
+	if gc.Audience == nil {
+		gc.Audience = make([]string, 0)
+	}
+	if typ, ok := claims.Get("typ").(string); ok {
+		gc.TokenType = security.TokenType(typ)
+	}
+	gc.NotBefore, _ = claims.NotBefore()
+	gc.IssuedAt = issuedAt(claims)
+	gc.ExpireAt, _ = claims.Expiration()
+	gc.Tokenid, _ = claims.JWTID()
+	return gc, nil
+}
+
+// issuedAt reads the iat claim, including its fraction of a second.
+func issuedAt(claims jws.Claims) time.Time {
+	if iat, ok := claims.Get("iat").(float64); ok {
+		return time.UnixMicro(int64(math.Round(iat * 1e6)))
+	}
+	iat, _ := claims.IssuedAt()
+	return iat
+}
+
+// Actor is the RFC 8693 act claim, the party acting on behalf of the token subject.
+// A token exchanged again nests the previous actor.
+type Actor struct {
+	Subject string `json:"sub"`
+	Actor   *Actor `json:"act,omitempty"`
+}
+
+// TokenActor returns the act claim of the token, or nil when the token carries none.
+// It does not verify the token, the caller must have verified it already.
+func TokenActor(tokenString string) *Actor {
+	jwt, err := jws.ParseJWT([]byte(tokenString))
+	if err != nil {
+		return nil
+	}
+	raw, ok := jwt.Claims().Get("act").(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	return actorFromClaim(raw)
+}
+
+// TokenAmr returns the amr claim of the token, the RFC 8176 methods the subject authenticated with,
+// or nil when the token carries none. Like TokenActor, it does not verify the token.
+func TokenAmr(tokenString string) []string {
+	jwt, err := jws.ParseJWT([]byte(tokenString))
+	if err != nil {
+		return nil
+	}
+	raw, ok := jwt.Claims().Get("amr").([]interface{})
+	if !ok {
+		return nil
+	}
+	amr := make([]string, 0, len(raw))
+	for _, method := range raw {
+		if str, ok := method.(string); ok {
+			amr = append(amr, str)
+		}
+	}
+	return amr
+}
+
+func actorFromClaim(raw map[string]interface{}) *Actor {
+	subject, _ := raw["sub"].(string)
+	if len(subject) == 0 {
+		return nil
+	}
+	actor := &Actor{Subject: subject}
+	if nested, ok := raw["act"].(map[string]interface{}); ok {
+		actor.Actor = actorFromClaim(nested)
+	}
+	return actor
+}
+
+// NewTokenId creates a random token id, used as the jti claim.
+func NewTokenId() string {
+	return randomHex(16)
+}
+
+// newRefreshTokenId creates the jti of a refresh token, prefixed by the token family it belongs to.
+// Every refresh token rotated out of the same login shares the family.
+func newRefreshTokenId(family string) string {
+	return family + "." + randomHex(12)
+}
+
+// TokenFamily returns the token family of the refresh token, or empty for tokens without family.
+func TokenFamily(claim *security.GoClaim) string {
+	family, _, found := strings.Cut(claim.Tokenid, ".")
+	if !found {
+		return ""
+	}
+	return family
+}
+
+func randomHex(size int) string {
+	buff := make([]byte, size)
+	if _, err := rand.Read(buff); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buff)
+}
+
+// SignToken serializes the claim into a signed jwt token. Unlike GoClaim.ToToken, it carries the jti claim,
+// and the kid header naming the signing key.
+func SignToken(gc *security.GoClaim, signing *SigningKey) (string, error) {
+	return signClaims(tokenClaims(gc), signing)
+}
+
+// SignActorToken is SignToken, the token also carrying the act claim naming the party acting on behalf of the subject.
+func SignActorToken(gc *security.GoClaim, actor *Actor, signing *SigningKey) (string, error) {
+	claims := tokenClaims(gc)
+	if actor != nil {
+		claims.Set("act", actor)
+	}
+	return signClaims(claims, signing)
+}
+
+// SignAmrToken is SignToken, the token also carrying the amr claim listing how the subject authenticated.
+func SignAmrToken(gc *security.GoClaim, amr []string, signing *SigningKey) (string, error) {
+	claims := tokenClaims(gc)
+	if len(amr) > 0 {
+		claims.Set("amr", amr)
+	}
+	return signClaims(claims, signing)
+}
+
+func tokenClaims(gc *security.GoClaim) jws.Claims {
+	claims := jws.Claims{}
+	if len(gc.Issuer) > 0 {
+		claims.SetIssuer(gc.Issuer)
+	}
+	if len(gc.Subscriber) > 0 {
+		claims.SetSubject(gc.Subscriber)
+		claims.SetAudience(gc.Audience...)
+	}
+	if len(gc.Tokenid) > 0 {
+		claims.SetJWTID(gc.Tokenid)
+	}
+	if !gc.IssuedAt.IsZero() {
+		// the iat claim keeps the microseconds, so a token issued right after its subject is revoked stays valid.
+		claims.Set("iat", float64(gc.IssuedAt.UnixMicro())/1e6)
+	}
+	if !gc.NotBefore.IsZero() {
+		claims.SetNotBefore(gc.NotBefore)
+	}
+	if !gc.ExpireAt.IsZero() {
+		claims.SetExpiration(gc.ExpireAt)
+	}
+	if len(gc.TokenType) > 0 {
+		claims.Set("typ", gc.TokenType)
+	}
+	return claims
+}
+
+func signClaims(claims jws.Claims, signing *SigningKey) (string, error) {
+	token := jws.NewJWT(claims, signing.Method)
+	token.(jws.JWS).Protected().Set("kid", signing.Kid)
+	tokenBytes, err := token.Serialize(signing.Private)
+	if err != nil {
+		return "", err
+	}
+	return string(tokenBytes), nil
+}
+
+// CreateTokenPair issues the access and refresh token of the subject, carrying its tenant roles as audience.
+// It is shared by every DataAccess implementation once the subject is authenticated.
+// The refresh token starts a new token family. Both tokens carry the amr of the sign in.
+func CreateTokenPair(email string, auds, amr []string) (accessToken, refreshToken string, err error) {
+	accessToken, err = CreateAccessToken(email, auds, amr)
+	if err != nil {
+		return "", "", err
+	}
+	refreshToken, err = createRefreshToken(email, auds, NewTokenId(), amr)
+	if err != nil {
+		return "", "", err
+	}
+	return accessToken, refreshToken, nil
+}
+
+func createRefreshToken(email string, auds []string, family string, amr []string) (refreshToken string, err error) {
+	now := time.Now()
+
+	durRefresh, err := jiffy.DurationOf(configuration.Get("token.age.refresh"))
+	if err != nil {
+		return "", err
+	}
+
+	expRefresh := now.Add(durRefresh)
+
+	refeshClaim := &security.GoClaim{
+		Issuer:     configuration.Get("token.issuer"),
+		Subscriber: email,
+		TokenType:  security.RefreshToken,
+		Audience:   auds,
+		NotBefore:  now,
+		IssuedAt:   now,
+		ExpireAt:   expRefresh,
+		Tokenid:    newRefreshTokenId(family),
+	}
+	return SignAmrToken(refeshClaim, amr, GetKeyring().Active())
+}
+
+// RefreshRotation tells whether every refresh returns a new refresh token, invalidating the presented one.
+func RefreshRotation() bool {
+	return configuration.GetBoolean("token.refresh.rotation")
+}
+
+// RefreshTokens issues the tokens for a verified refresh token claim, once the subject is allowed to sign in.
+// The refresh token is only issued when RefreshRotation is on. It belongs to the family of the presented one,
+// which is marked as used. If the presented one was already used, the whole family is revoked.
+// The amr of the presented refresh token, see TokenAmr, is carried over to the issued tokens.
+func RefreshTokens(ctx context.Context, revocation RevocationStore, claim *security.GoClaim, auds, amr []string) (accessToken, refreshToken string, err error) {
+	if RefreshRotation() {
+		family := TokenFamily(claim)
+		firstUse, err := revocation.UseToken(ctx, claim.Tokenid, claim.ExpireAt)
+		if err != nil {
+			return "", "", err
+		}
+		if !firstUse {
+			if err := revokeTokenFamily(ctx, revocation, family); err != nil {
+				return "", "", err
+			}
+			return "", "", ErrTokenRevoked
+		}
+		if len(family) == 0 {
+			family = NewTokenId()
+		}
+		refreshToken, err = createRefreshToken(claim.Subscriber, auds, family, amr)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	accessToken, err = CreateAccessToken(claim.Subscriber, auds, amr)
+	if err != nil {
+		return "", "", err
+	}
+	return accessToken, refreshToken, nil
+}
+
+// VerifyRefreshToken verifies the refresh token, and that it is not revoked, then returns its claim.
+// The caller must make sure the subject still exist before issuing a new access token.
+// When RefreshRotation is on, presenting a revoked refresh token is taken as a theft signal, its whole family is revoked.
+func VerifyRefreshToken(ctx context.Context, revocation RevocationStore, refreshToken string) (*security.GoClaim, error) {
+	claim, err := ParseKeyringToken(refreshToken, GetKeyring())
+	if err != nil {
+		return nil, err
+	}
+	if claim.Issuer != configuration.Get("token.issuer") {
+		return nil, ErrWrongIssuer
+	}
+	if claim.TokenType != security.RefreshToken {
+		return nil, ErrWrongToken
+	}
+	revoked, err := revocation.IsRevoked(ctx, claim)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		if RefreshRotation() {
+			if err := revokeTokenFamily(ctx, revocation, TokenFamily(claim)); err != nil {
+				return nil, err
+			}
+		}
+		return nil, ErrTokenRevoked
+	}
+	return claim, nil
+}
+
+// CreateAccessToken issues the access token of the subject, carrying its tenant roles as audience
+// and the amr of its sign in.
+func CreateAccessToken(email string, auds, amr []string) (accessToken string, err error) {
+	durAccess, err := jiffy.DurationOf(configuration.Get("token.age.access"))
+	if err != nil {
+		return "", err
+	}
+	return SignAmrToken(newAccessClaim(email, auds, durAccess), amr, GetKeyring().Active())
+}
+
+func createAccessToken(subject string, auds []string, age time.Duration) (accessToken string, err error) {
+	return SignToken(newAccessClaim(subject, auds, age), GetKeyring().Active())
+}
+
+func newAccessClaim(subject string, auds []string, age time.Duration) *security.GoClaim {
+	now := time.Now()
+	return &security.GoClaim{
+		Issuer:     configuration.Get("token.issuer"),
+		Subscriber: subject,
+		TokenType:  security.AccessToken,
+		Audience:   auds,
+		NotBefore:  now,
+		IssuedAt:   now,
+		ExpireAt:   now.Add(age),
+		Tokenid:    NewTokenId(),
+	}
+}
@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"crypto/rsa"
+	"github.com/SermoDigital/jose/crypto"
+	"github.com/newm4n/dokku-common/security"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseToken(t *testing.T) {
+	now := time.Now()
+	claim := &security.GoClaim{
+		Issuer:     "issuer",
+		Subscriber: "user@mail.com",
+		TokenType:  security.AccessToken,
+		Audience:   []string{"admin,viewer@ACME"},
+		NotBefore:  now,
+		IssuedAt:   now,
+		ExpireAt:   now.Add(time.Minute),
+	}
+	token, err := claim.ToToken(GetPrivateKey().(*rsa.PrivateKey), crypto.SigningMethodRS512)
+	assert.NoError(t, err)
+
+	parsed, err := ParseToken(token, GetPublicKey(), crypto.SigningMethodRS512)
+	assert.NoError(t, err)
+	assert.Equal(t, "issuer", parsed.Issuer)
+	assert.Equal(t, "user@mail.com", parsed.Subscriber)
+	assert.Equal(t, security.AccessToken, parsed.TokenType)
+	assert.Equal(t, []string{"admin,viewer@ACME"}, parsed.Audience)
+	assert.Equal(t, now.Unix(), parsed.IssuedAt.Unix())
+	assert.Equal(t, now.Add(time.Minute).Unix(), parsed.ExpireAt.Unix())
+
+	_, err = ParseToken("not.a.token", GetPublicKey(), crypto.SigningMethodRS512)
+	assert.Error(t, err)
+
+	otherKey, _, err := security.GenerateKeyPair(2048)
+	assert.NoError(t, err)
+	forged, err := claim.ToToken(otherKey, crypto.SigningMethodRS512)
+	assert.NoError(t, err)
+	_, err = ParseToken(forged, GetPublicKey(), crypto.SigningMethodRS512)
+	assert.Error(t, err)
+
+	claim.ExpireAt = now.Add(-time.Minute)
+	claim.NotBefore = now.Add(-time.Hour)
+	claim.IssuedAt = now.Add(-time.Hour)
+	expired, err := claim.ToToken(GetPrivateKey().(*rsa.PrivateKey), crypto.SigningMethodRS512)
+	assert.NoError(t, err)
+	_, err = ParseToken(expired, GetPublicKey(), crypto.SigningMethodRS512)
+	assert.Error(t, err)
+}
+
+func TestCreateTokenPair_UniqueTokenId(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		access, refresh, err := CreateTokenPair("user@mail.com", []string{"root@*"}, nil)
+		assert.NoError(t, err)
+		for _, token := range []string{access, refresh} {
+			claim, err := ParseToken(token, GetPublicKey(), crypto.SigningMethodRS512)
+			assert.NoError(t, err)
+			assert.NotEmpty(t, claim.Tokenid)
+			assert.False(t, seen[claim.Tokenid])
+			seen[claim.Tokenid] = true
+		}
+	}
+}
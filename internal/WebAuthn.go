@@ -0,0 +1,965 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hyperjumptech/jiffy"
+	"github.com/newm4n/dokku-aaa/configuration"
+	"github.com/newm4n/dokku-common/security"
+	bolt "go.etcd.io/bbolt"
+	"math/big"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// WebAuthnCreateToken and WebAuthnGetToken are the token types of the registration and login ceremony sessions.
+	// Their jti is the challenge the authenticator signs, they are single-use.
+	WebAuthnCreateToken security.TokenType = "application/webauthn-create+jwt"
+	WebAuthnGetToken    security.TokenType = "application/webauthn-get+jwt"
+
+	// AmrHardwareKey is the RFC 8176 amr value of a sign in with a passkey, a proof of possession of a key.
+	AmrHardwareKey = "hwk"
+
+	// coseAlgES256, coseAlgEdDSA and coseAlgRS256 are the COSE algorithms of the supported credential public keys.
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+
+	// authenticator data flags, WebAuthn 6.1.
+	flagUserPresent   = 0x01
+	flagUserVerified  = 0x04
+	flagAttestedData  = 0x40
+	webAuthnChallenge = 32
+	// maxCredentialIdSize is the longest credential id WebAuthn allows.
+	maxCredentialIdSize = 1023
+)
+
+var (
+	ErrInvalidWebAuthn           = fmt.Errorf("invalid webauthn response")
+	ErrInvalidWebAuthnSession    = fmt.Errorf("webauthn session is invalid, expired or already used")
+	ErrWebAuthnCounter           = fmt.Errorf("authenticator signature counter did not increase, the credential may be cloned")
+	ErrRelyingPartyNotConfigured = fmt.Errorf("passkeys need webauthn.rp.id and webauthn.origins, or server.url, to be configured")
+
+	// bucketWebAuthnCredential holds the passkeys, keyed by credential id.
+	bucketWebAuthnCredential = []byte("webauthn_credential")
+	// bucketUserWebAuthnIndex indexes the passkeys of a user, keyed by lower(email)|credential id.
+	bucketUserWebAuthnIndex = []byte("idx_user_webauthn")
+)
+
+// WebAuthnCredential is a passkey registered by a user. The public key is kept as the COSE key the authenticator sent.
+type WebAuthnCredential struct {
+	Id         string // base64url credential id
+	Email      string
+	Name       string
+	PublicKey  []byte
+	SignCount  uint32
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+}
+
+func (credential *WebAuthnCredential) copy() *WebAuthnCredential {
+	ret := *credential
+	ret.PublicKey = append([]byte(nil), credential.PublicKey...)
+	return &ret
+}
+
+// RelyingParty is the server as the authenticators know it. Passkeys are bound to its id, a domain,
+// and only the listed origins may run the ceremonies.
+type RelyingParty struct {
+	Id      string
+	Name    string
+	Origins []string
+}
+
+// RelyingPartyOf returns the configured relying party: webauthn.rp.id, or the host of server.url,
+// and the webauthn.origins, or the origin of server.url. It is never taken from the request headers,
+// a forged Host would let passkeys be registered for another domain, so it fails when neither is set.
+func RelyingPartyOf() (*RelyingParty, error) {
+	rp := &RelyingParty{Id: configuration.Get("webauthn.rp.id"), Name: configuration.Get("token.issuer"), Origins: make([]string, 0)}
+	for _, origin := range strings.Split(configuration.Get("webauthn.origins"), ",") {
+		if origin = strings.TrimSpace(origin); len(origin) > 0 {
+			rp.Origins = append(rp.Origins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	if baseUrl := configuration.Get("server.url"); len(baseUrl) > 0 {
+		if parsed, err := url.Parse(baseUrl); err == nil && len(parsed.Hostname()) > 0 {
+			if len(rp.Id) == 0 {
+				rp.Id = parsed.Hostname()
+			}
+			if len(rp.Origins) == 0 {
+				rp.Origins = append(rp.Origins, parsed.Scheme+"://"+parsed.Host)
+			}
+		}
+	}
+	if len(rp.Id) == 0 || len(rp.Origins) == 0 {
+		return nil, ErrRelyingPartyNotConfigured
+	}
+	return rp, nil
+}
+
+// WebAuthnEntity is the relying party, or the user, an authenticator creates a passkey for.
+type WebAuthnEntity struct {
+	Id          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName,omitempty"`
+}
+
+type WebAuthnCredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type WebAuthnCredentialDescriptor struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+}
+
+type WebAuthnAuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// WebAuthnCreationOptions is the JSON form of the options of navigator.credentials.create(),
+// binary values are base64url encoded as PublicKeyCredential.parseCreationOptionsFromJSON() expects.
+type WebAuthnCreationOptions struct {
+	Rp                     *WebAuthnEntity                 `json:"rp"`
+	User                   *WebAuthnEntity                 `json:"user"`
+	Challenge              string                          `json:"challenge"`
+	PubKeyCredParams       []*WebAuthnCredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                           `json:"timeout"`
+	ExcludeCredentials     []*WebAuthnCredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection *WebAuthnAuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                          `json:"attestation"`
+}
+
+// WebAuthnRequestOptions is the JSON form of the options of navigator.credentials.get().
+// Without allowed credentials, the authenticator offers the passkeys it holds for the relying party.
+type WebAuthnRequestOptions struct {
+	Challenge        string                          `json:"challenge"`
+	Timeout          int64                           `json:"timeout"`
+	RpId             string                          `json:"rpId"`
+	AllowCredentials []*WebAuthnCredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                          `json:"userVerification"`
+}
+
+// WebAuthnCredentialJSON is the JSON form of the PublicKeyCredential the browser returns, as PublicKeyCredential.toJSON().
+type WebAuthnCredentialJSON struct {
+	Id       string                         `json:"id"`
+	RawId    string                         `json:"rawId"`
+	Type     string                         `json:"type"`
+	Response *WebAuthnAuthenticatorResponse `json:"response"`
+}
+
+// WebAuthnAuthenticatorResponse holds the attestation response of a registration, or the assertion response of a login.
+type WebAuthnAuthenticatorResponse struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject,omitempty"`
+	AuthenticatorData string `json:"authenticatorData,omitempty"`
+	Signature         string `json:"signature,omitempty"`
+	UserHandle        string `json:"userHandle,omitempty"`
+}
+
+// collectedClientData is the client data the browser passes to the authenticator, WebAuthn 5.8.1.
+type collectedClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+type authenticatorData struct {
+	rpIdHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialId []byte
+	publicKey    []byte
+}
+
+// webAuthnUserHandle is the user id given to the authenticators, it does not disclose the email.
+func webAuthnUserHandle(email string) []byte {
+	hash := sha256.Sum256([]byte(strings.ToLower(email)))
+	return hash[:]
+}
+
+// decodeBase64Url decodes the base64url values of the WebAuthn JSON, with or without padding.
+func decodeBase64Url(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+// BeginWebAuthnRegistration starts the registration of a passkey of the signed in user. The session is posted back
+// to FinishWebAuthnRegistration along with the credential the browser created using the options.
+func BeginWebAuthnRegistration(ctx context.Context, dao DataAccess, rp *RelyingParty, email string) (options *WebAuthnCreationOptions, session string, err error) {
+	profile, err := dao.GetUserProfile(ctx, email)
+	if err != nil {
+		return nil, "", err
+	}
+	credentials, err := dao.WebAuthnCredentials().ListCredentials(ctx, email)
+	if err != nil {
+		return nil, "", err
+	}
+	challenge, session, timeout, err := newWebAuthnSession(WebAuthnCreateToken, profile.Email)
+	if err != nil {
+		return nil, "", err
+	}
+	displayName := profile.FullName
+	if len(displayName) == 0 {
+		displayName = profile.Email
+	}
+	return &WebAuthnCreationOptions{
+		Rp:        &WebAuthnEntity{Id: rp.Id, Name: rp.Name},
+		User:      &WebAuthnEntity{Id: base64.RawURLEncoding.EncodeToString(webAuthnUserHandle(profile.Email)), Name: profile.Email, DisplayName: displayName},
+		Challenge: challenge,
+		PubKeyCredParams: []*WebAuthnCredentialParameter{
+			{Type: "public-key", Alg: coseAlgES256}, {Type: "public-key", Alg: coseAlgEdDSA}, {Type: "public-key", Alg: coseAlgRS256}},
+		Timeout:                timeout.Milliseconds(),
+		ExcludeCredentials:     credentialDescriptors(credentials),
+		AuthenticatorSelection: &WebAuthnAuthenticatorSelection{ResidentKey: "preferred", UserVerification: "preferred"},
+		Attestation:            "none",
+	}, session, nil
+}
+
+// FinishWebAuthnRegistration verifies the credential created for the registration session, and stores the passkey.
+// Attestation statements are not verified, the server asks for none and does not rely on the authenticator model.
+// It returns ErrFound when the credential is already registered.
+func FinishWebAuthnRegistration(ctx context.Context, dao DataAccess, rp *RelyingParty, email, session, name string, credential *WebAuthnCredentialJSON) (*WebAuthnCredential, error) {
+	claim, err := useWebAuthnSession(ctx, dao.Revocations(), session, WebAuthnCreateToken)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(claim.Subscriber, email) {
+		return nil, ErrInvalidWebAuthnSession
+	}
+	if credential == nil || credential.Response == nil || credential.Type != "public-key" {
+		return nil, fmt.Errorf("%w, a public-key credential is required", ErrInvalidWebAuthn)
+	}
+	if err := verifyClientData(rp, credential.Response.ClientDataJSON, "webauthn.create", claim.Tokenid); err != nil {
+		return nil, err
+	}
+	attestation, err := decodeBase64Url(credential.Response.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("%w, attestationObject is not base64url", ErrInvalidWebAuthn)
+	}
+	item, _, err := decodeCbor(attestation)
+	if err != nil {
+		return nil, fmt.Errorf("%w, %s", ErrInvalidWebAuthn, err.Error())
+	}
+	object, _ := item.(map[interface{}]interface{})
+	rawAuthData, ok := object["authData"].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("%w, attestationObject has no authData", ErrInvalidWebAuthn)
+	}
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyAuthenticatorData(rp, authData); err != nil {
+		return nil, err
+	}
+	if authData.flags&flagAttestedData == 0 {
+		return nil, fmt.Errorf("%w, authData has no attested credential", ErrInvalidWebAuthn)
+	}
+	if _, _, err := parseCoseKey(authData.publicKey); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	passkey := &WebAuthnCredential{
+		Id:        base64.RawURLEncoding.EncodeToString(authData.credentialId),
+		Email:     claim.Subscriber,
+		Name:      strings.TrimSpace(name),
+		PublicKey: authData.publicKey,
+		SignCount: authData.signCount,
+		CreatedAt: now,
+	}
+	if len(passkey.Name) == 0 {
+		passkey.Name = "Passkey " + now.UTC().Format("2006-01-02")
+	}
+	if err := dao.WebAuthnCredentials().SaveCredential(ctx, passkey); err != nil {
+		return nil, err
+	}
+	return passkey, nil
+}
+
+// BeginWebAuthnLogin starts a passkey sign in. With an email, the authenticator is asked for the passkeys of that user,
+// without, it offers the passkeys it holds for the relying party. An unknown email gets the same options as a
+// user without passkey, so the options do not tell which accounts exist.
+func BeginWebAuthnLogin(ctx context.Context, dao DataAccess, rp *RelyingParty, email string) (options *WebAuthnRequestOptions, session string, err error) {
+	credentials := make([]*WebAuthnCredential, 0)
+	if len(email) > 0 {
+		credentials, err = dao.WebAuthnCredentials().ListCredentials(ctx, email)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	challenge, session, timeout, err := newWebAuthnSession(WebAuthnGetToken, email)
+	if err != nil {
+		return nil, "", err
+	}
+	return &WebAuthnRequestOptions{
+		Challenge:        challenge,
+		Timeout:          timeout.Milliseconds(),
+		RpId:             rp.Id,
+		AllowCredentials: credentialDescriptors(credentials),
+		UserVerification: "preferred",
+	}, session, nil
+}
+
+// FinishWebAuthnLogin verifies the assertion of the login session, and issues the tokens of the passkey owner
+// the way Authenticate does. The tokens carry the hwk amr, and mfa too when the authenticator verified the user.
+func FinishWebAuthnLogin(ctx context.Context, dao DataAccess, rp *RelyingParty, session string, credential *WebAuthnCredentialJSON) (accessToken, refreshToken string, err error) {
+	claim, err := useWebAuthnSession(ctx, dao.Revocations(), session, WebAuthnGetToken)
+	if err != nil {
+		return "", "", err
+	}
+	if credential == nil || credential.Response == nil || credential.Type != "public-key" {
+		return "", "", fmt.Errorf("%w, a public-key credential is required", ErrInvalidWebAuthn)
+	}
+	passkey, err := dao.WebAuthnCredentials().GetCredential(ctx, strings.TrimRight(credential.RawId, "="))
+	if errors.Is(err, ErrNotFound) {
+		return "", "", fmt.Errorf("%w, unknown credential", ErrInvalidWebAuthn)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if len(claim.Subscriber) > 0 && !strings.EqualFold(claim.Subscriber, passkey.Email) {
+		return "", "", fmt.Errorf("%w, credential of another user", ErrInvalidWebAuthn)
+	}
+	if len(credential.Response.UserHandle) > 0 {
+		userHandle, err := decodeBase64Url(credential.Response.UserHandle)
+		if err != nil || !bytes.Equal(userHandle, webAuthnUserHandle(passkey.Email)) {
+			return "", "", fmt.Errorf("%w, credential of another user", ErrInvalidWebAuthn)
+		}
+	}
+	if err := verifyClientData(rp, credential.Response.ClientDataJSON, "webauthn.get", claim.Tokenid); err != nil {
+		return "", "", err
+	}
+	rawAuthData, err := decodeBase64Url(credential.Response.AuthenticatorData)
+	if err != nil {
+		return "", "", fmt.Errorf("%w, authenticatorData is not base64url", ErrInvalidWebAuthn)
+	}
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return "", "", err
+	}
+	if err := verifyAuthenticatorData(rp, authData); err != nil {
+		return "", "", err
+	}
+	alg, publicKey, err := parseCoseKey(passkey.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+	clientData, _ := decodeBase64Url(credential.Response.ClientDataJSON)
+	clientDataHash := sha256.Sum256(clientData)
+	signedData := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	signature, err := decodeBase64Url(credential.Response.Signature)
+	if err != nil || !verifyCoseSignature(alg, publicKey, signedData, signature) {
+		return "", "", fmt.Errorf("%w, bad signature", ErrInvalidWebAuthn)
+	}
+	fresh, err := dao.WebAuthnCredentials().UseCredential(ctx, passkey.Id, authData.signCount)
+	if err != nil {
+		return "", "", err
+	}
+	if !fresh {
+		return "", "", ErrWebAuthnCounter
+	}
+	amr := []string{AmrHardwareKey}
+	if authData.flags&flagUserVerified != 0 {
+		amr = append(amr, AmrMFA)
+	}
+	return dao.IssueTokens(ctx, passkey.Email, amr)
+}
+
+func credentialDescriptors(credentials []*WebAuthnCredential) []*WebAuthnCredentialDescriptor {
+	descriptors := make([]*WebAuthnCredentialDescriptor, 0, len(credentials))
+	for _, credential := range credentials {
+		descriptors = append(descriptors, &WebAuthnCredentialDescriptor{Type: "public-key", Id: credential.Id})
+	}
+	return descriptors
+}
+
+// newWebAuthnSession issues the ceremony session token of the type, valid for webauthn.ceremony.age.
+// Its jti is the random challenge, base64url encoded.
+func newWebAuthnSession(tokenType security.TokenType, email string) (challenge, session string, timeout time.Duration, err error) {
+	timeout, err = jiffy.DurationOf(configuration.Get("webauthn.ceremony.age"))
+	if err != nil {
+		return "", "", 0, err
+	}
+	buff := make([]byte, webAuthnChallenge)
+	if _, err := rand.Read(buff); err != nil {
+		return "", "", 0, err
+	}
+	challenge = base64.RawURLEncoding.EncodeToString(buff)
+	now := time.Now()
+	session, err = SignToken(&security.GoClaim{
+		Issuer:     configuration.Get("token.issuer"),
+		Subscriber: email,
+		TokenType:  tokenType,
+		Audience:   []string{},
+		NotBefore:  now,
+		IssuedAt:   now,
+		ExpireAt:   now.Add(timeout),
+		Tokenid:    challenge,
+	}, GetKeyring().Active())
+	if err != nil {
+		return "", "", 0, err
+	}
+	return challenge, session, timeout, nil
+}
+
+// useWebAuthnSession verifies the ceremony session token, and marks it used whatever the ceremony outcome.
+func useWebAuthnSession(ctx context.Context, revocation RevocationStore, session string, tokenType security.TokenType) (*security.GoClaim, error) {
+	claim, err := VerifyToken(session)
+	if err != nil || claim.TokenType != tokenType || len(claim.Tokenid) == 0 {
+		return nil, ErrInvalidWebAuthnSession
+	}
+	firstUse, err := revocation.UseToken(ctx, claim.Tokenid, claim.ExpireAt)
+	if err != nil {
+		return nil, err
+	}
+	if !firstUse {
+		return nil, ErrInvalidWebAuthnSession
+	}
+	return claim, nil
+}
+
+// verifyClientData checks the client data is the one of the ceremony, for the challenge, from an allowed origin.
+func verifyClientData(rp *RelyingParty, encoded, ceremony, challenge string) error {
+	raw, err := decodeBase64Url(encoded)
+	if err != nil {
+		return fmt.Errorf("%w, clientDataJSON is not base64url", ErrInvalidWebAuthn)
+	}
+	clientData := &collectedClientData{}
+	if err := json.Unmarshal(raw, clientData); err != nil {
+		return fmt.Errorf("%w, clientDataJSON is not json", ErrInvalidWebAuthn)
+	}
+	if clientData.Type != ceremony {
+		return fmt.Errorf("%w, client data type must be %s", ErrInvalidWebAuthn, ceremony)
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.TrimRight(clientData.Challenge, "=")), []byte(challenge)) != 1 {
+		return fmt.Errorf("%w, challenge mismatch", ErrInvalidWebAuthn)
+	}
+	if clientData.CrossOrigin {
+		return fmt.Errorf("%w, cross origin ceremonies are not allowed", ErrInvalidWebAuthn)
+	}
+	for _, origin := range rp.Origins {
+		if clientData.Origin == origin {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w, origin %s is not allowed", ErrInvalidWebAuthn, clientData.Origin)
+}
+
+// parseAuthenticatorData parses the authenticator data, WebAuthn 6.1, with its attested credential when there is one.
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, fmt.Errorf("%w, authenticator data too short", ErrInvalidWebAuthn)
+	}
+	authData := &authenticatorData{
+		rpIdHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if authData.flags&flagAttestedData == 0 {
+		return authData, nil
+	}
+	// aaguid, then the credential id length.
+	rest := data[37:]
+	if len(rest) < 18 {
+		return nil, fmt.Errorf("%w, attested credential data too short", ErrInvalidWebAuthn)
+	}
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLength == 0 || idLength > maxCredentialIdSize || len(rest) < idLength {
+		return nil, fmt.Errorf("%w, bad credential id length", ErrInvalidWebAuthn)
+	}
+	authData.credentialId = rest[:idLength]
+	rest = rest[idLength:]
+	_, extensions, err := decodeCbor(rest)
+	if err != nil {
+		return nil, fmt.Errorf("%w, credential public key: %s", ErrInvalidWebAuthn, err.Error())
+	}
+	authData.publicKey = rest[:len(rest)-len(extensions)]
+	return authData, nil
+}
+
+// verifyAuthenticatorData checks the authenticator data is scoped to the relying party and the user was present.
+func verifyAuthenticatorData(rp *RelyingParty, authData *authenticatorData) error {
+	rpIdHash := sha256.Sum256([]byte(rp.Id))
+	if subtle.ConstantTimeCompare(authData.rpIdHash, rpIdHash[:]) != 1 {
+		return fmt.Errorf("%w, credential of another relying party", ErrInvalidWebAuthn)
+	}
+	if authData.flags&flagUserPresent == 0 {
+		return fmt.Errorf("%w, user was not present", ErrInvalidWebAuthn)
+	}
+	return nil
+}
+
+// parseCoseKey parses the COSE key (RFC 9053) of a credential, P-256 keys for ES256, Ed25519 keys for EdDSA
+// and RSA keys of at least 2048 bits for RS256.
+func parseCoseKey(data []byte) (alg int64, key crypto.PublicKey, err error) {
+	item, _, err := decodeCbor(data)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w, credential public key: %s", ErrInvalidWebAuthn, err.Error())
+	}
+	coseKey, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return 0, nil, fmt.Errorf("%w, credential public key is not a COSE key", ErrInvalidWebAuthn)
+	}
+	kty, _ := coseKey[int64(1)].(int64)
+	alg, _ = coseKey[int64(3)].(int64)
+	crv, _ := coseKey[int64(-1)].(int64)
+	switch {
+	case kty == 2 && alg == coseAlgES256 && crv == 1:
+		x, _ := coseKey[int64(-2)].([]byte)
+		y, _ := coseKey[int64(-3)].([]byte)
+		if len(x) != 32 || len(y) != 32 {
+			break
+		}
+		// ecdh refuses the points not on the curve.
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			break
+		}
+		return alg, &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case kty == 1 && alg == coseAlgEdDSA && crv == 6:
+		x, _ := coseKey[int64(-2)].([]byte)
+		if len(x) != ed25519.PublicKeySize {
+			break
+		}
+		return alg, ed25519.PublicKey(x), nil
+	case kty == 3 && alg == coseAlgRS256:
+		n, _ := coseKey[int64(-1)].([]byte)
+		e, _ := coseKey[int64(-2)].([]byte)
+		modulus := new(big.Int).SetBytes(n)
+		exponent := new(big.Int).SetBytes(e)
+		if modulus.BitLen() < 2048 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			break
+		}
+		return alg, &rsa.PublicKey{N: modulus, E: int(exponent.Int64())}, nil
+	}
+	return 0, nil, fmt.Errorf("%w, unsupported credential public key", ErrInvalidWebAuthn)
+}
+
+// verifyCoseSignature verifies the assertion signature made with the key of the COSE algorithm.
+func verifyCoseSignature(alg int64, key crypto.PublicKey, data, signature []byte) bool {
+	switch alg {
+	case coseAlgES256:
+		hash := sha256.Sum256(data)
+		return ecdsa.VerifyASN1(key.(*ecdsa.PublicKey), hash[:], signature)
+	case coseAlgEdDSA:
+		return ed25519.Verify(key.(ed25519.PublicKey), data, signature)
+	case coseAlgRS256:
+		hash := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, hash[:], signature) == nil
+	default:
+		return false
+	}
+}
+
+// WebAuthnCredentialStore keeps the passkeys of the users.
+type WebAuthnCredentialStore interface {
+	// SaveCredential returns ErrFound when the credential id is already registered.
+	SaveCredential(ctx context.Context, credential *WebAuthnCredential) error
+	// GetCredential returns ErrNotFound when the credential id is not registered.
+	GetCredential(ctx context.Context, id string) (*WebAuthnCredential, error)
+	// ListCredentials lists the passkeys of the user, oldest first.
+	ListCredentials(ctx context.Context, email string) ([]*WebAuthnCredential, error)
+	// UseCredential records the signature counter of an assertion and the time of use. It returns false,
+	// recording nothing, when the counter did not increase, unless the authenticator does not count, both being zero.
+	UseCredential(ctx context.Context, id string, signCount uint32) (fresh bool, err error)
+	// DeleteCredential returns ErrNotFound when the user has no such passkey.
+	DeleteCredential(ctx context.Context, email, id string) error
+}
+
+// signCountFresh tells whether the signature counter of an assertion follows the stored one.
+func signCountFresh(stored, signCount uint32) bool {
+	return signCount > stored || (stored == 0 && signCount == 0)
+}
+
+// sortCredentials orders the passkeys the way ListCredentials returns them.
+func sortCredentials(credentials []*WebAuthnCredential) {
+	sort.SliceStable(credentials, func(i, j int) bool {
+		return credentials[i].CreatedAt.Before(credentials[j].CreatedAt)
+	})
+}
+
+// MemoryWebAuthnCredentialStore is the in memory WebAuthnCredentialStore, passkeys are lost on restart.
+type MemoryWebAuthnCredentialStore struct {
+	mutex       sync.Mutex
+	credentials map[string]*WebAuthnCredential
+}
+
+func NewMemoryWebAuthnCredentialStore() *MemoryWebAuthnCredentialStore {
+	return &MemoryWebAuthnCredentialStore{
+		credentials: make(map[string]*WebAuthnCredential),
+	}
+}
+
+func (store *MemoryWebAuthnCredentialStore) SaveCredential(ctx context.Context, credential *WebAuthnCredential) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if credential == nil || len(credential.Id) == 0 || len(credential.Email) == 0 {
+		return ErrArgumentEmpty
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, exist := store.credentials[credential.Id]; exist {
+		return ErrFound
+	}
+	store.credentials[credential.Id] = credential.copy()
+	return nil
+}
+
+func (store *MemoryWebAuthnCredentialStore) GetCredential(ctx context.Context, id string) (*WebAuthnCredential, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(id) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	credential, exist := store.credentials[id]
+	if !exist {
+		return nil, ErrNotFound
+	}
+	return credential.copy(), nil
+}
+
+func (store *MemoryWebAuthnCredentialStore) ListCredentials(ctx context.Context, email string) ([]*WebAuthnCredential, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(email) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	ret := make([]*WebAuthnCredential, 0)
+	for _, credential := range store.credentials {
+		if strings.EqualFold(credential.Email, email) {
+			ret = append(ret, credential.copy())
+		}
+	}
+	sortCredentials(ret)
+	return ret, nil
+}
+
+func (store *MemoryWebAuthnCredentialStore) UseCredential(ctx context.Context, id string, signCount uint32) (fresh bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	credential, exist := store.credentials[id]
+	if !exist {
+		return false, ErrNotFound
+	}
+	if !signCountFresh(credential.SignCount, signCount) {
+		return false, nil
+	}
+	credential.SignCount = signCount
+	credential.LastUsedAt = time.Now()
+	return true, nil
+}
+
+func (store *MemoryWebAuthnCredentialStore) DeleteCredential(ctx context.Context, email, id string) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if len(email) == 0 || len(id) == 0 {
+		return ErrArgumentEmpty
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	credential, exist := store.credentials[id]
+	if !exist || !strings.EqualFold(credential.Email, email) {
+		return ErrNotFound
+	}
+	delete(store.credentials, id)
+	return nil
+}
+
+// SqlWebAuthnCredentialStore is the WebAuthnCredentialStore kept in the webauthn_credential table, for SQLite and PostgreSQL.
+type SqlWebAuthnCredentialStore struct {
+	DB *sql.DB
+}
+
+func NewSqlWebAuthnCredentialStore(db *sql.DB) *SqlWebAuthnCredentialStore {
+	return &SqlWebAuthnCredentialStore{DB: db}
+}
+
+const webAuthnColumns = `id, email, name, public_key, sign_count, created_at, last_used_at`
+
+func (store *SqlWebAuthnCredentialStore) SaveCredential(ctx context.Context, credential *WebAuthnCredential) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if credential == nil || len(credential.Id) == 0 || len(credential.Email) == 0 {
+		return ErrArgumentEmpty
+	}
+	result, err := store.DB.ExecContext(ctx, `INSERT INTO webauthn_credential (`+webAuthnColumns+`)
+VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT DO NOTHING`,
+		credential.Id, strings.ToLower(credential.Email), credential.Name, base64.RawURLEncoding.EncodeToString(credential.PublicKey),
+		int64(credential.SignCount), sqlTime(credential.CreatedAt), sqlTime(credential.LastUsedAt))
+	if err != nil {
+		return err
+	}
+	inserted, err := usedUp(result)
+	if err != nil {
+		return err
+	}
+	if !inserted {
+		return ErrFound
+	}
+	return nil
+}
+
+func (store *SqlWebAuthnCredentialStore) GetCredential(ctx context.Context, id string) (*WebAuthnCredential, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(id) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	credential, err := scanWebAuthnCredential(store.DB.QueryRowContext(ctx, `SELECT `+webAuthnColumns+` FROM webauthn_credential WHERE id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return credential, err
+}
+
+func (store *SqlWebAuthnCredentialStore) ListCredentials(ctx context.Context, email string) ([]*WebAuthnCredential, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(email) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	rows, err := store.DB.QueryContext(ctx, `SELECT `+webAuthnColumns+` FROM webauthn_credential WHERE email = $1
+ORDER BY created_at, id`, strings.ToLower(email))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]*WebAuthnCredential, 0)
+	for rows.Next() {
+		credential, err := scanWebAuthnCredential(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, credential)
+	}
+	return ret, rows.Err()
+}
+
+func (store *SqlWebAuthnCredentialStore) UseCredential(ctx context.Context, id string, signCount uint32) (fresh bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	// the condition decides which of two concurrent assertions of the same counter is fresh.
+	result, err := store.DB.ExecContext(ctx, `UPDATE webauthn_credential SET sign_count = $1, last_used_at = $2
+WHERE id = $3 AND (sign_count < $1 OR (sign_count = 0 AND $1 = 0))`, int64(signCount), sqlTime(time.Now()), id)
+	if err != nil {
+		return false, err
+	}
+	fresh, err = usedUp(result)
+	if err != nil || fresh {
+		return fresh, err
+	}
+	if _, err := store.GetCredential(ctx, id); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+func (store *SqlWebAuthnCredentialStore) DeleteCredential(ctx context.Context, email, id string) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if len(email) == 0 || len(id) == 0 {
+		return ErrArgumentEmpty
+	}
+	result, err := store.DB.ExecContext(ctx, `DELETE FROM webauthn_credential WHERE id = $1 AND email = $2`, id, strings.ToLower(email))
+	if err != nil {
+		return err
+	}
+	return expectAffected(result)
+}
+
+// rowScanner is either a *sql.Row or *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanWebAuthnCredential(row rowScanner) (*WebAuthnCredential, error) {
+	credential := &WebAuthnCredential{}
+	var publicKey string
+	var signCount int64
+	if err := row.Scan(&credential.Id, &credential.Email, &credential.Name, &publicKey, &signCount,
+		&credential.CreatedAt, &credential.LastUsedAt); err != nil {
+		return nil, err
+	}
+	key, err := base64.RawURLEncoding.DecodeString(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	credential.PublicKey = key
+	credential.SignCount = uint32(signCount)
+	if credential.LastUsedAt.Year() <= 1 {
+		credential.LastUsedAt = time.Time{}
+	}
+	return credential, nil
+}
+
+// BoltWebAuthnCredentialStore is the WebAuthnCredentialStore kept in the webauthn_credential bucket of the bolt file.
+type BoltWebAuthnCredentialStore struct {
+	DB *bolt.DB
+}
+
+func NewBoltWebAuthnCredentialStore(db *bolt.DB) *BoltWebAuthnCredentialStore {
+	return &BoltWebAuthnCredentialStore{DB: db}
+}
+
+func getBoltWebAuthnCredential(tx *bolt.Tx, id string) (*WebAuthnCredential, error) {
+	data := tx.Bucket(bucketWebAuthnCredential).Get([]byte(id))
+	if data == nil {
+		return nil, ErrNotFound
+	}
+	credential := &WebAuthnCredential{}
+	if err := json.Unmarshal(data, credential); err != nil {
+		return nil, err
+	}
+	return credential, nil
+}
+
+func putBoltWebAuthnCredential(tx *bolt.Tx, credential *WebAuthnCredential) error {
+	data, err := json.Marshal(credential)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketWebAuthnCredential).Put([]byte(credential.Id), data)
+}
+
+func userWebAuthnKey(email, id string) []byte {
+	return []byte(strings.ToLower(email) + "|" + id)
+}
+
+func (store *BoltWebAuthnCredentialStore) SaveCredential(ctx context.Context, credential *WebAuthnCredential) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if credential == nil || len(credential.Id) == 0 || len(credential.Email) == 0 {
+		return ErrArgumentEmpty
+	}
+	return store.DB.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketWebAuthnCredential).Get([]byte(credential.Id)) != nil {
+			return ErrFound
+		}
+		if err := tx.Bucket(bucketUserWebAuthnIndex).Put(userWebAuthnKey(credential.Email, credential.Id), []byte(credential.Id)); err != nil {
+			return err
+		}
+		return putBoltWebAuthnCredential(tx, credential)
+	})
+}
+
+func (store *BoltWebAuthnCredentialStore) GetCredential(ctx context.Context, id string) (*WebAuthnCredential, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(id) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	var credential *WebAuthnCredential
+	err := store.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		credential, err = getBoltWebAuthnCredential(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return credential, nil
+}
+
+func (store *BoltWebAuthnCredentialStore) ListCredentials(ctx context.Context, email string) ([]*WebAuthnCredential, error) {
+	if err := validContext(ctx); err != nil {
+		return nil, err
+	}
+	if len(email) == 0 {
+		return nil, ErrArgumentEmpty
+	}
+	ret := make([]*WebAuthnCredential, 0)
+	err := store.DB.View(func(tx *bolt.Tx) error {
+		return scanPrefix(tx.Bucket(bucketUserWebAuthnIndex), []byte(strings.ToLower(email)+"|"), func(k, v []byte) error {
+			credential, err := getBoltWebAuthnCredential(tx, string(v))
+			if err != nil {
+				return err
+			}
+			ret = append(ret, credential)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortCredentials(ret)
+	return ret, nil
+}
+
+func (store *BoltWebAuthnCredentialStore) UseCredential(ctx context.Context, id string, signCount uint32) (fresh bool, err error) {
+	if err := validContext(ctx); err != nil {
+		return false, err
+	}
+	err = store.DB.Update(func(tx *bolt.Tx) error {
+		credential, err := getBoltWebAuthnCredential(tx, id)
+		if err != nil {
+			return err
+		}
+		if !signCountFresh(credential.SignCount, signCount) {
+			return nil
+		}
+		credential.SignCount = signCount
+		credential.LastUsedAt = time.Now()
+		fresh = true
+		return putBoltWebAuthnCredential(tx, credential)
+	})
+	return fresh, err
+}
+
+func (store *BoltWebAuthnCredentialStore) DeleteCredential(ctx context.Context, email, id string) error {
+	if err := validContext(ctx); err != nil {
+		return err
+	}
+	if len(email) == 0 || len(id) == 0 {
+		return ErrArgumentEmpty
+	}
+	return store.DB.Update(func(tx *bolt.Tx) error {
+		index := tx.Bucket(bucketUserWebAuthnIndex)
+		if index.Get(userWebAuthnKey(email, id)) == nil {
+			return ErrNotFound
+		}
+		if err := index.Delete(userWebAuthnKey(email, id)); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketWebAuthnCredential).Delete([]byte(id))
+	})
+}
@@ -0,0 +1,417 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/newm4n/dokku-aaa/configuration"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// softAuthenticator is a software WebAuthn authenticator, it holds a single passkey.
+type softAuthenticator struct {
+	rpId         string
+	origin       string
+	alg          int64
+	key          crypto.Signer
+	credentialId []byte
+	userHandle   []byte
+	signCount    uint32
+	// flags are the authenticator data flags of its responses, user present and verified by default.
+	flags byte
+}
+
+func newSoftAuthenticator(t *testing.T, alg int64) *softAuthenticator {
+	authenticator := &softAuthenticator{rpId: "example.com", origin: "http://example.com", alg: alg,
+		credentialId: make([]byte, 16), flags: flagUserPresent | flagUserVerified}
+	_, err := rand.Read(authenticator.credentialId)
+	assert.NoError(t, err)
+	switch alg {
+	case coseAlgES256:
+		authenticator.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case coseAlgEdDSA:
+		_, authenticator.key, err = ed25519.GenerateKey(rand.Reader)
+	case coseAlgRS256:
+		authenticator.key, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	assert.NoError(t, err)
+	return authenticator
+}
+
+func (authenticator *softAuthenticator) coseKey() []byte {
+	switch key := authenticator.key.Public().(type) {
+	case *ecdsa.PublicKey:
+		return encodeCbor(map[interface{}]interface{}{1: 2, 3: coseAlgES256, -1: 1, -2: key.X.FillBytes(make([]byte, 32)), -3: key.Y.FillBytes(make([]byte, 32))})
+	case ed25519.PublicKey:
+		return encodeCbor(map[interface{}]interface{}{1: 1, 3: coseAlgEdDSA, -1: 6, -2: []byte(key)})
+	case *rsa.PublicKey:
+		return encodeCbor(map[interface{}]interface{}{1: 3, 3: coseAlgRS256, -1: key.N.Bytes(), -2: big.NewInt(int64(key.E)).Bytes()})
+	}
+	return nil
+}
+
+func (authenticator *softAuthenticator) clientData(ceremony, challenge string) []byte {
+	data, _ := json.Marshal(&collectedClientData{Type: ceremony, Challenge: challenge, Origin: authenticator.origin})
+	return data
+}
+
+func (authenticator *softAuthenticator) authData(flags byte, attested []byte) []byte {
+	rpIdHash := sha256.Sum256([]byte(authenticator.rpId))
+	data := append(rpIdHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, authenticator.signCount)
+	return append(data, attested...)
+}
+
+// create answers navigator.credentials.create() with the options.
+func (authenticator *softAuthenticator) create(t *testing.T, options *WebAuthnCreationOptions) *WebAuthnCredentialJSON {
+	userHandle, err := base64.RawURLEncoding.DecodeString(options.User.Id)
+	assert.NoError(t, err)
+	authenticator.userHandle = userHandle
+	authenticator.signCount++
+	attested := append(make([]byte, 16), binary.BigEndian.AppendUint16(nil, uint16(len(authenticator.credentialId)))...)
+	attested = append(append(attested, authenticator.credentialId...), authenticator.coseKey()...)
+	attestation := encodeCbor(map[interface{}]interface{}{"fmt": "none", "attStmt": map[interface{}]interface{}{},
+		"authData": authenticator.authData(authenticator.flags|flagAttestedData, attested)})
+	id := base64.RawURLEncoding.EncodeToString(authenticator.credentialId)
+	return &WebAuthnCredentialJSON{Id: id, RawId: id, Type: "public-key", Response: &WebAuthnAuthenticatorResponse{
+		ClientDataJSON:    base64.RawURLEncoding.EncodeToString(authenticator.clientData("webauthn.create", options.Challenge)),
+		AttestationObject: base64.RawURLEncoding.EncodeToString(attestation),
+	}}
+}
+
+// get answers navigator.credentials.get() with the options.
+func (authenticator *softAuthenticator) get(t *testing.T, options *WebAuthnRequestOptions) *WebAuthnCredentialJSON {
+	authenticator.signCount++
+	authData := authenticator.authData(authenticator.flags, nil)
+	clientData := authenticator.clientData("webauthn.get", options.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	signed := append(append([]byte{}, authData...), clientDataHash[:]...)
+	var signature []byte
+	var err error
+	if authenticator.alg == coseAlgEdDSA {
+		signature, err = authenticator.key.Sign(rand.Reader, signed, crypto.Hash(0))
+	} else {
+		hash := sha256.Sum256(signed)
+		signature, err = authenticator.key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	}
+	assert.NoError(t, err)
+	id := base64.RawURLEncoding.EncodeToString(authenticator.credentialId)
+	return &WebAuthnCredentialJSON{Id: id, RawId: id, Type: "public-key", Response: &WebAuthnAuthenticatorResponse{
+		ClientDataJSON:    base64.RawURLEncoding.EncodeToString(clientData),
+		AuthenticatorData: base64.RawURLEncoding.EncodeToString(authData),
+		Signature:         base64.RawURLEncoding.EncodeToString(signature),
+		UserHandle:        base64.RawURLEncoding.EncodeToString(authenticator.userHandle),
+	}}
+}
+
+func testWebAuthnCredentialStore(t *testing.T, newStore func(t *testing.T) WebAuthnCredentialStore) {
+	ctx := context.Background()
+
+	t.Run("CRUD", func(t *testing.T) {
+		store := newStore(t)
+		_, err := store.GetCredential(ctx, "unknown")
+		assert.ErrorIs(t, err, ErrNotFound)
+		now := time.Now().Truncate(time.Second)
+		assert.NoError(t, store.SaveCredential(ctx, &WebAuthnCredential{Id: "second", Email: "user@mail.com", Name: "Phone",
+			PublicKey: []byte{1, 2, 3}, CreatedAt: now.Add(time.Minute)}))
+		assert.NoError(t, store.SaveCredential(ctx, &WebAuthnCredential{Id: "first", Email: "user@mail.com", Name: "Laptop",
+			PublicKey: []byte{4, 5, 6}, SignCount: 5, CreatedAt: now}))
+		assert.NoError(t, store.SaveCredential(ctx, &WebAuthnCredential{Id: "other", Email: "other@mail.com", CreatedAt: now}))
+		assert.ErrorIs(t, store.SaveCredential(ctx, &WebAuthnCredential{Id: "first", Email: "other@mail.com"}), ErrFound)
+
+		got, err := store.GetCredential(ctx, "first")
+		assert.NoError(t, err)
+		assert.Equal(t, "Laptop", got.Name)
+		assert.Equal(t, []byte{4, 5, 6}, got.PublicKey)
+		assert.Equal(t, uint32(5), got.SignCount)
+		assert.True(t, got.LastUsedAt.IsZero())
+
+		list, err := store.ListCredentials(ctx, "USER@mail.com")
+		assert.NoError(t, err)
+		if assert.Len(t, list, 2) {
+			assert.Equal(t, "first", list[0].Id)
+			assert.Equal(t, "second", list[1].Id)
+		}
+
+		// the counter only moves forward, unless the authenticator does not count.
+		fresh, err := store.UseCredential(ctx, "first", 5)
+		assert.NoError(t, err)
+		assert.False(t, fresh)
+		fresh, err = store.UseCredential(ctx, "first", 6)
+		assert.NoError(t, err)
+		assert.True(t, fresh)
+		got, err = store.GetCredential(ctx, "first")
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(6), got.SignCount)
+		assert.False(t, got.LastUsedAt.IsZero())
+		fresh, err = store.UseCredential(ctx, "second", 0)
+		assert.NoError(t, err)
+		assert.True(t, fresh)
+		fresh, err = store.UseCredential(ctx, "second", 0)
+		assert.NoError(t, err)
+		assert.True(t, fresh)
+		_, err = store.UseCredential(ctx, "unknown", 1)
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		// only the owner deletes a passkey.
+		assert.ErrorIs(t, store.DeleteCredential(ctx, "other@mail.com", "first"), ErrNotFound)
+		assert.NoError(t, store.DeleteCredential(ctx, "user@mail.com", "first"))
+		assert.ErrorIs(t, store.DeleteCredential(ctx, "user@mail.com", "first"), ErrNotFound)
+		_, err = store.GetCredential(ctx, "first")
+		assert.ErrorIs(t, err, ErrNotFound)
+		list, err = store.ListCredentials(ctx, "user@mail.com")
+		assert.NoError(t, err)
+		assert.Len(t, list, 1)
+	})
+}
+
+func TestMemoryWebAuthnCredentialStore(t *testing.T) {
+	testWebAuthnCredentialStore(t, func(t *testing.T) WebAuthnCredentialStore {
+		return NewMemoryWebAuthnCredentialStore()
+	})
+}
+
+func TestSqlWebAuthnCredentialStore_SQLite(t *testing.T) {
+	testWebAuthnCredentialStore(t, func(t *testing.T) WebAuthnCredentialStore {
+		return newSQLiteDAO(t).WebAuthnCredentials()
+	})
+}
+
+func TestBoltWebAuthnCredentialStore(t *testing.T) {
+	testWebAuthnCredentialStore(t, func(t *testing.T) WebAuthnCredentialStore {
+		return newBoltDAO(t).WebAuthnCredentials()
+	})
+}
+
+// registerPasskey runs the registration ceremony of the authenticator, it returns the status of the finish.
+func registerPasskey(t *testing.T, router http.Handler, accessToken string, authenticator *softAuthenticator) int {
+	resp := serve(router, bearer(newRequest(http.MethodPost, "/webauthn/register/begin", `{"Passphrase":"a passphrase"}`), accessToken))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	begin := &WebAuthnRegistrationOptionsResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), begin))
+	body, err := json.Marshal(&WebAuthnRegistrationRequest{Session: begin.Session, Name: "Laptop", Credential: authenticator.create(t, begin.PublicKey)})
+	assert.NoError(t, err)
+	return serve(router, bearer(newRequest(http.MethodPost, "/webauthn/register/finish", string(body)), accessToken)).Code
+}
+
+// passkeyLogin runs the login ceremony of the authenticator, it returns the status and the tokens of the finish.
+func passkeyLogin(t *testing.T, router http.Handler, email string, authenticator *softAuthenticator) (int, *AuthenticateResponse) {
+	resp := serve(router, newRequest(http.MethodPost, "/webauthn/login/begin", `{"Email":"`+email+`"}`))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	begin := &WebAuthnLoginOptionsResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), begin))
+	body, err := json.Marshal(&WebAuthnLoginRequest{Session: begin.Session, Credential: authenticator.get(t, begin.PublicKey)})
+	assert.NoError(t, err)
+	resp = serve(router, newRequest(http.MethodPost, "/webauthn/login/finish", string(body)))
+	tokens := &AuthenticateResponse{}
+	if resp.Code == http.StatusOK {
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), tokens))
+	}
+	return resp.Code, tokens
+}
+
+func TestRelyingPartyOf(t *testing.T) {
+	defer func() {
+		configuration.SetConfig("server.url", "")
+		configuration.SetConfig("webauthn.rp.id", "")
+		configuration.SetConfig("webauthn.origins", "")
+	}()
+	_, err := RelyingPartyOf()
+	assert.ErrorIs(t, err, ErrRelyingPartyNotConfigured)
+	configuration.SetConfig("webauthn.rp.id", "domain.com")
+	_, err = RelyingPartyOf()
+	assert.ErrorIs(t, err, ErrRelyingPartyNotConfigured)
+
+	configuration.SetConfig("server.url", "https://aaa.domain.com/login/")
+	rp, err := RelyingPartyOf()
+	assert.NoError(t, err)
+	assert.Equal(t, "domain.com", rp.Id)
+	assert.Equal(t, []string{"https://aaa.domain.com"}, rp.Origins)
+	configuration.SetConfig("webauthn.rp.id", "")
+	configuration.SetConfig("webauthn.origins", "https://app.domain.com/, https://aaa.domain.com")
+	rp, err = RelyingPartyOf()
+	assert.NoError(t, err)
+	assert.Equal(t, "aaa.domain.com", rp.Id)
+	assert.Equal(t, []string{"https://app.domain.com", "https://aaa.domain.com"}, rp.Origins)
+}
+
+func TestTheHandler_WebAuthn(t *testing.T) {
+	router := newTestRouter()
+	// passkeys are refused until the relying party is configured, it is not taken from the Host of the request.
+	resp := serve(router, newRequest(http.MethodPost, "/webauthn/login/begin", ""))
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	assert.Contains(t, resp.Body.String(), ErrRelyingPartyNotConfigured.Error())
+	configuration.SetConfig("server.url", "http://example.com")
+	defer configuration.SetConfig("server.url", "")
+
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/create-user",
+		`{"Email":"user@mail.com","Passphrase":"a passphrase","TenantRole":["viewer@ACME"]}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	access, _, err := CreateTokenPair("user@mail.com", []string{"viewer@ACME"}, []string{AmrPassword})
+	assert.NoError(t, err)
+
+	resp = serve(router, newRequest(http.MethodPost, "/webauthn/register/begin", `{"Passphrase":"a passphrase"}`))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	// the access token alone does not add a passkey, the user enters the passphrase again.
+	resp = serve(router, bearer(newRequest(http.MethodPost, "/webauthn/register/begin", `{}`), access))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Contains(t, resp.Body.String(), ErrReauthenticate.Error())
+	resp = serve(router, bearer(newRequest(http.MethodPost, "/webauthn/register/begin", `{"Passphrase":"wrong passphrase"}`), access))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = serve(router, bearer(newRequest(http.MethodPost, "/webauthn/register/begin", `{"Passphrase":"a passphrase"}`), access))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	begin := &WebAuthnRegistrationOptionsResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), begin))
+	assert.Equal(t, "example.com", begin.PublicKey.Rp.Id)
+	assert.Equal(t, "user@mail.com", begin.PublicKey.User.Name)
+	assert.NotContains(t, begin.PublicKey.User.Id, "user")
+	assert.Len(t, begin.PublicKey.Challenge, 43)
+	assert.Empty(t, begin.PublicKey.ExcludeCredentials)
+	assert.Equal(t, "none", begin.PublicKey.Attestation)
+
+	authenticator := newSoftAuthenticator(t, coseAlgES256)
+	credential := authenticator.create(t, begin.PublicKey)
+	body, err := json.Marshal(&WebAuthnRegistrationRequest{Session: begin.Session, Name: "Laptop", Credential: credential})
+	assert.NoError(t, err)
+	resp = serve(router, bearer(newRequest(http.MethodPost, "/webauthn/register/finish", string(body)), access))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	created := &WebAuthnCredentialResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), created))
+	assert.Equal(t, credential.Id, created.Id)
+	assert.Equal(t, "Laptop", created.Name)
+
+	// sessions are single use, and a passkey is registered once.
+	resp = serve(router, bearer(newRequest(http.MethodPost, "/webauthn/register/finish", string(body)), access))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Equal(t, http.StatusConflict, registerPasskey(t, router, access, authenticator))
+
+	// the ceremony is bound to the origin and the relying party.
+	phished := newSoftAuthenticator(t, coseAlgES256)
+	phished.origin = "https://examp1e.com"
+	assert.Equal(t, http.StatusBadRequest, registerPasskey(t, router, access, phished))
+	phished = newSoftAuthenticator(t, coseAlgES256)
+	phished.rpId = "examp1e.com"
+	assert.Equal(t, http.StatusBadRequest, registerPasskey(t, router, access, phished))
+	absent := newSoftAuthenticator(t, coseAlgES256)
+	absent.flags = 0
+	assert.Equal(t, http.StatusBadRequest, registerPasskey(t, router, access, absent))
+
+	// the passkey signs in, the same way the passphrase does.
+	status, tokens := passkeyLogin(t, router, "user@mail.com", authenticator)
+	assert.Equal(t, http.StatusOK, status)
+	claim, err := VerifyToken(tokens.Access)
+	assert.NoError(t, err)
+	assert.Equal(t, "user@mail.com", claim.Subscriber)
+	assert.Equal(t, []string{"viewer@ACME"}, claim.Audience)
+	assert.Equal(t, []string{AmrHardwareKey, AmrMFA}, TokenAmr(tokens.Access))
+	resp = serve(router, newRequest(http.MethodPost, "/refresh", `{"Refresh":"`+tokens.Refresh+`"}`))
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// a discoverable passkey signs in without the email, a passkey without user verification is a single factor.
+	authenticator.flags = flagUserPresent
+	status, tokens = passkeyLogin(t, router, "", authenticator)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{AmrHardwareKey}, TokenAmr(tokens.Access))
+	authenticator.flags = flagUserPresent | flagUserVerified
+
+	// the allowed credentials are those of the user.
+	resp = serve(router, newRequest(http.MethodPost, "/webauthn/login/begin", `{"Email":"user@mail.com"}`))
+	loginBegin := &WebAuthnLoginOptionsResponse{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), loginBegin))
+	assert.Equal(t, "example.com", loginBegin.PublicKey.RpId)
+	if assert.Len(t, loginBegin.PublicKey.AllowCredentials, 1) {
+		assert.Equal(t, credential.Id, loginBegin.PublicKey.AllowCredentials[0].Id)
+	}
+	assertion := authenticator.get(t, loginBegin.PublicKey)
+	body, err = json.Marshal(&WebAuthnLoginRequest{Session: loginBegin.Session, Credential: assertion})
+	assert.NoError(t, err)
+	resp = serve(router, newRequest(http.MethodPost, "/webauthn/login/finish", string(body)))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	resp = serve(router, newRequest(http.MethodPost, "/webauthn/login/finish", string(body)))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// another user can not use the passkey, a cloned passkey is refused, so is a bad signature.
+	resp = serve(router, asRoot(newRequest(http.MethodPost, "/user/ACME/create-user",
+		`{"Email":"other@mail.com","Passphrase":"a passphrase","TenantRole":["viewer@ACME"]}`)))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	status, _ = passkeyLogin(t, router, "other@mail.com", authenticator)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	cloned := *authenticator
+	cloned.signCount = 1
+	status, _ = passkeyLogin(t, router, "user@mail.com", &cloned)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	impostor := newSoftAuthenticator(t, coseAlgES256)
+	impostor.credentialId = authenticator.credentialId
+	impostor.userHandle = authenticator.userHandle
+	impostor.signCount = 100
+	status, _ = passkeyLogin(t, router, "user@mail.com", impostor)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// disabled accounts do not sign in with a passkey either.
+	resp = serve(router, asRoot(newRequest(http.MethodPut, "/user/ACME/user@mail.com/status", `{"Status":"disabled"}`)))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	status, _ = passkeyLogin(t, router, "user@mail.com", authenticator)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	resp = serve(router, asRoot(newRequest(http.MethodPut, "/user/ACME/user@mail.com/status", `{"Status":"active"}`)))
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// the user lists and removes the passkeys.
+	resp = serve(router, bearer(newRequest(http.MethodGet, "/webauthn/credentials", ""), access))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	list := make([]*WebAuthnCredentialResponse, 0)
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &list))
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, credential.Id, list[0].Id)
+		assert.False(t, list[0].LastUsedAt.IsZero())
+	}
+	assert.NotContains(t, resp.Body.String(), "PublicKey")
+	resp = serve(router, bearer(newRequest(http.MethodDelete, "/webauthn/credentials/"+credential.Id, ""), access))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	resp = serve(router, bearer(newRequest(http.MethodDelete, "/webauthn/credentials/"+credential.Id, ""), access))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	status, _ = passkeyLogin(t, router, "user@mail.com", authenticator)
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
+
+func TestWebAuthn_Algorithms(t *testing.T) {
+	ctx := context.Background()
+	dao := NewMemoryDAO()
+	_, err := dao.CreateUserAccount(ctx, "user@mail.com", "a passphrase")
+	assert.NoError(t, err)
+	rp := &RelyingParty{Id: "example.com", Name: "AAA", Origins: []string{"http://example.com"}}
+	for _, alg := range []int64{coseAlgES256, coseAlgEdDSA, coseAlgRS256} {
+		authenticator := newSoftAuthenticator(t, alg)
+		options, session, err := BeginWebAuthnRegistration(ctx, dao, rp, "user@mail.com")
+		assert.NoError(t, err)
+		_, err = FinishWebAuthnRegistration(ctx, dao, rp, "user@mail.com", session, "", authenticator.create(t, options))
+		assert.NoError(t, err, alg)
+
+		requestOptions, session, err := BeginWebAuthnLogin(ctx, dao, rp, "")
+		assert.NoError(t, err)
+		access, _, err := FinishWebAuthnLogin(ctx, dao, rp, session, authenticator.get(t, requestOptions))
+		assert.NoError(t, err, alg)
+		assert.NotEmpty(t, access)
+	}
+
+	// weak RSA keys are refused.
+	weak, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	_, _, err = parseCoseKey(encodeCbor(map[interface{}]interface{}{1: 3, 3: coseAlgRS256, -1: weak.N.Bytes(), -2: []byte{1, 0, 1}}))
+	assert.ErrorIs(t, err, ErrInvalidWebAuthn)
+	// and so are points off the curve.
+	_, _, err = parseCoseKey(encodeCbor(map[interface{}]interface{}{1: 2, 3: coseAlgES256, -1: 1, -2: bytes.Repeat([]byte{1}, 32), -3: bytes.Repeat([]byte{2}, 32)}))
+	assert.ErrorIs(t, err, ErrInvalidWebAuthn)
+}
@@ -0,0 +1,31 @@
+-- Scripts in this directory are applied on both SQLite and PostgreSQL,
+-- so they must stick to the SQL understood by both.
+
+CREATE TABLE user_account (
+    email      VARCHAR(255) NOT NULL,
+    passphrase VARCHAR(255) NOT NULL,
+    full_name  VARCHAR(255) NOT NULL DEFAULT ''
+);
+CREATE UNIQUE INDEX user_account_email_idx ON user_account (LOWER(email));
+
+CREATE TABLE tenant (
+    name         VARCHAR(255) NOT NULL PRIMARY KEY,
+    display_name VARCHAR(255) NOT NULL,
+    created_at   TIMESTAMP    NOT NULL,
+    status       VARCHAR(32)  NOT NULL
+);
+
+CREATE TABLE user_tenant (
+    email  VARCHAR(255) NOT NULL,
+    tenant VARCHAR(255) NOT NULL
+);
+CREATE UNIQUE INDEX user_tenant_email_tenant_idx ON user_tenant (LOWER(email), tenant);
+CREATE INDEX user_tenant_tenant_idx ON user_tenant (tenant);
+
+CREATE TABLE user_tenant_role (
+    email  VARCHAR(255) NOT NULL,
+    tenant VARCHAR(255) NOT NULL,
+    role   VARCHAR(255) NOT NULL
+);
+CREATE UNIQUE INDEX user_tenant_role_idx ON user_tenant_role (LOWER(email), tenant, role);
+CREATE INDEX user_tenant_role_tenant_idx ON user_tenant_role (tenant);
@@ -0,0 +1,3 @@
+-- Disabled accounts can neither sign in nor refresh their tokens.
+
+ALTER TABLE user_account ADD COLUMN status VARCHAR(32) NOT NULL DEFAULT 'active';
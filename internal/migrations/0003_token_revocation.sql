@@ -0,0 +1,14 @@
+-- Revoked tokens are kept until the token would have expired anyway.
+
+CREATE TABLE revoked_token (
+    token_id  VARCHAR(64) NOT NULL PRIMARY KEY,
+    expire_at TIMESTAMP   NOT NULL
+);
+CREATE INDEX revoked_token_expire_idx ON revoked_token (expire_at);
+
+-- every token of the subject, the lower-cased email, issued up to revoked_at is revoked.
+CREATE TABLE revoked_subject (
+    subject    VARCHAR(255) NOT NULL PRIMARY KEY,
+    revoked_at TIMESTAMP    NOT NULL,
+    expire_at  TIMESTAMP    NOT NULL
+);
@@ -0,0 +1,6 @@
+-- A revoked family revokes every refresh token rotated out of the same login.
+
+CREATE TABLE revoked_family (
+    family    VARCHAR(64) NOT NULL PRIMARY KEY,
+    expire_at TIMESTAMP   NOT NULL
+);
@@ -0,0 +1,11 @@
+-- OAuth clients, the machine identities using the client_credentials grant.
+-- tenant_roles holds the json array of 'role1,role2@tenant' entries granted to the client.
+
+CREATE TABLE oauth_client (
+    client_id    VARCHAR(64)  NOT NULL PRIMARY KEY,
+    name         VARCHAR(255) NOT NULL DEFAULT '',
+    secret_hash  VARCHAR(255) NOT NULL,
+    tenant_roles TEXT         NOT NULL,
+    token_age    VARCHAR(64)  NOT NULL DEFAULT '',
+    created_at   TIMESTAMP    NOT NULL
+);
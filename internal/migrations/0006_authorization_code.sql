@@ -0,0 +1,16 @@
+-- Redirect URIs registered for the authorization code flow, as json array. Public clients have no secret,
+-- they can only use the authorization code flow with PKCE.
+
+ALTER TABLE oauth_client ADD COLUMN redirect_uris TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE oauth_client ADD COLUMN public BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Single-use authorization codes, deleted when exchanged at the token endpoint.
+
+CREATE TABLE authorization_code (
+    code           VARCHAR(64)   NOT NULL PRIMARY KEY,
+    client_id      VARCHAR(64)   NOT NULL,
+    redirect_uri   VARCHAR(2048) NOT NULL,
+    subject        VARCHAR(255)  NOT NULL,
+    code_challenge VARCHAR(128)  NOT NULL,
+    expire_at      TIMESTAMP     NOT NULL
+);
@@ -0,0 +1,12 @@
+-- Pending device authorizations of the device grant (RFC 8628), deleted once the device got its tokens.
+
+CREATE TABLE device_authorization (
+    device_code      VARCHAR(64)  NOT NULL PRIMARY KEY,
+    user_code        VARCHAR(16)  NOT NULL UNIQUE,
+    client_id        VARCHAR(64)  NOT NULL,
+    status           VARCHAR(16)  NOT NULL,
+    subject          VARCHAR(255) NOT NULL DEFAULT '',
+    interval_seconds INTEGER      NOT NULL,
+    last_poll_at     TIMESTAMP    NOT NULL,
+    expire_at        TIMESTAMP    NOT NULL
+);
@@ -0,0 +1,21 @@
+-- TOTP second factor of the users, keyed by lower-cased email. A code is never accepted twice,
+-- last_step is the time step of the last accepted one.
+
+CREATE TABLE user_totp (
+    email      VARCHAR(255) NOT NULL PRIMARY KEY,
+    secret     VARCHAR(64)  NOT NULL,
+    confirmed  BOOLEAN      NOT NULL DEFAULT FALSE,
+    last_step  BIGINT       NOT NULL DEFAULT 0,
+    created_at TIMESTAMP    NOT NULL
+);
+
+-- SHA-256 of the unused recovery codes, each one is deleted once used.
+CREATE TABLE user_recovery_code (
+    email     VARCHAR(255) NOT NULL,
+    code_hash VARCHAR(64)  NOT NULL,
+    PRIMARY KEY (email, code_hash)
+);
+
+-- Space separated RFC 8176 amr values of the sign in, carried over to the tokens.
+ALTER TABLE authorization_code ADD COLUMN amr VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE device_authorization ADD COLUMN amr VARCHAR(64) NOT NULL DEFAULT '';
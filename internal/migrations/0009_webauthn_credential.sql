@@ -0,0 +1,13 @@
+-- Passkeys of the users. The id is the base64url credential id, at most 1023 bytes once decoded,
+-- the public key the base64url COSE key. email is lower-cased.
+
+CREATE TABLE webauthn_credential (
+    id           VARCHAR(1366) NOT NULL PRIMARY KEY,
+    email        VARCHAR(255)  NOT NULL,
+    name         VARCHAR(255)  NOT NULL,
+    public_key   TEXT          NOT NULL,
+    sign_count   BIGINT        NOT NULL DEFAULT 0,
+    created_at   TIMESTAMP     NOT NULL,
+    last_used_at TIMESTAMP     NOT NULL
+);
+CREATE INDEX webauthn_credential_email_idx ON webauthn_credential (email);
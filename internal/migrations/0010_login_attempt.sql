@@ -0,0 +1,9 @@
+-- Failed sign in attempts, keyed by account:<lower-cased email> or address:<client ip>.
+-- A row is forgotten once its last failure is older than login.attempt.window.
+
+CREATE TABLE login_attempt (
+    attempt_key     VARCHAR(320) NOT NULL PRIMARY KEY,
+    failures        INTEGER      NOT NULL,
+    last_failure_at TIMESTAMP    NOT NULL
+);
+CREATE INDEX login_attempt_last_failure_idx ON login_attempt (last_failure_at);
@@ -0,0 +1,13 @@
+-- An administrator can force the passphrase to be changed at the next sign in. A passphrase set before
+-- passphrase_changed_at was recorded only ages with passphrase.max.age once changed.
+
+ALTER TABLE user_account ADD COLUMN must_change_passphrase BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE user_account ADD COLUMN passphrase_changed_at TIMESTAMP NULL;
+
+-- Hashes of the previous passphrases, keyed by lower-cased email. seq 0 is the newest one.
+CREATE TABLE passphrase_history (
+    email      VARCHAR(255) NOT NULL,
+    seq        INTEGER      NOT NULL,
+    passphrase VARCHAR(255) NOT NULL,
+    PRIMARY KEY (email, seq)
+);